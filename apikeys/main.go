@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/liviu274/Distributed-systems/auth"
+)
+
+// apikeys registers a client in the key file used by the exercise server
+// (-auth-keys) and by the clients (-keys), creating the file if needed.
+// The file holds secrets and is not checked in: run apikeys once per
+// client to create it.
+func main() {
+	file := flag.String("file", "client-server app/data/clients.json", "key registry file")
+	keyID := flag.String("id", "", "key ID to register (defaults to the client name)")
+	client := flag.String("client", "", "client name the key authenticates as")
+	flag.Parse()
+
+	if *client == "" {
+		fmt.Fprintln(os.Stderr, "usage: apikeys -client NAME [-id KEYID] [-file PATH]")
+		os.Exit(2)
+	}
+	if *keyID == "" {
+		*keyID = *client
+	}
+
+	reg, err := auth.LoadRegistry(*file)
+	if errors.Is(err, os.ErrNotExist) {
+		reg, err = &auth.Registry{}, nil
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load %s: %v\n", *file, err)
+		os.Exit(1)
+	}
+	k, err := reg.Register(*keyID, *client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate key: %v\n", err)
+		os.Exit(1)
+	}
+	if err := reg.Save(*file); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save %s: %v\n", *file, err)
+		os.Exit(1)
+	}
+	fmt.Printf("registered key %s for client %s in %s\n", k.KeyID, k.Client, *file)
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuth(t *testing.T) (*Authenticator, Key) {
+	t.Helper()
+	reg := &Registry{}
+	k, err := reg.Register("k1", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAuthenticator(reg, 5*time.Minute), k
+}
+
+func signed(k Key, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/ex2", strings.NewReader(body))
+	Sign(req, k, []byte(body))
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	a, k := newTestAuth(t)
+	other := Key{KeyID: "k1", Client: "Alice", Secret: "wrong"}
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		body    string
+		wantErr string
+	}{
+		{"valid", func() *http.Request { return signed(k, "[1]") }, "[1]", ""},
+		{"tampered body", func() *http.Request { return signed(k, "[1]") }, "[2]", "signature mismatch"},
+		{"wrong secret", func() *http.Request { return signed(other, "[1]") }, "[1]", "signature mismatch"},
+		{"unknown key", func() *http.Request { return signed(Key{KeyID: "nobody"}, "") }, "", "unknown key"},
+		{"unsigned", func() *http.Request { return httptest.NewRequest(http.MethodPost, "/ex2", nil) }, "", "missing"},
+		{"stale", func() *http.Request {
+			req := signed(k, "")
+			req.Header.Set(HeaderTimestamp, "1000")
+			return req
+		}, "", "stale"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.Verify(tt.req(), []byte(tt.body))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				if got.Client != "Alice" {
+					t.Fatalf("client %q, want Alice", got.Client)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Verify error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	a, k := newTestAuth(t)
+	req := signed(k, "[1]")
+	if _, err := a.Verify(req, []byte("[1]")); err != nil {
+		t.Fatalf("first: %v", err)
+	}
+	if _, err := a.Verify(req, []byte("[1]")); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("replay error %v, want replayed", err)
+	}
+	if _, err := a.Verify(signed(k, "[1]"), []byte("[1]")); err != nil {
+		t.Fatalf("fresh nonce: %v", err)
+	}
+}
+
+func TestNoncesPruned(t *testing.T) {
+	a, k := newTestAuth(t)
+	start := time.Now()
+	a.now = func() time.Time { return start }
+	a.Verify(signed(k, ""), nil)
+	a.now = func() time.Time { return start.Add(11 * time.Minute) }
+	a.useNonce("k1", "x", start.Add(20*time.Minute))
+	if n := len(a.nonces); n != 1 {
+		t.Fatalf("%d nonces kept, want 1", n)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	a, k := newTestAuth(t)
+	var gotName, gotBody string
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotName = r.Header.Get("X-Client-Name")
+		var buf bytes.Buffer
+		buf.ReadFrom(r.Body)
+		gotBody = buf.String()
+	}))
+
+	req := signed(k, "[1,2]")
+	req.Header.Set("X-Client-Name", "Mallory")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || gotName != "Alice" || gotBody != "[1,2]" {
+		t.Fatalf("code %d name %q body %q", rec.Code, gotName, gotBody)
+	}
+
+	big := strings.Repeat("x", MaxBodyBytes+1)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, signed(k, big))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body: code %d, want 413", rec.Code)
+	}
+}
+
+func TestLoadRegistry(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.json")
+	if _, err := LoadRegistry(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing file: %v, want ErrNotExist", err)
+	}
+	reg := &Registry{}
+	k, _ := reg.Register("k1", "Alice")
+	if err := reg.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := loaded.Lookup("k1"); !ok || got != k {
+		t.Fatalf("Lookup = %+v, %v", got, ok)
+	}
+}
@@ -0,0 +1,76 @@
+package causal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// ClientClock is the clock of one run of a command-line client. Its
+// process name is the client name with a per-run suffix (see RunName).
+type ClientClock struct {
+	*Clock
+	Out io.Writer // where events are printed (default os.Stdout)
+
+	name  string
+	trace *os.File
+}
+
+// OpenClientClock returns the clock of a run of client name, appending
+// its events to the trace at path unless path is empty.
+func OpenClientClock(name, path string) (*ClientClock, error) {
+	c := &ClientClock{Out: os.Stdout, name: name}
+	var trace io.Writer
+	if path != "" {
+		f, err := OpenTrace(path)
+		if err != nil {
+			return nil, err
+		}
+		c.trace, trace = f, f
+	}
+	c.Clock = NewClock(RunName(name), trace)
+	return c, nil
+}
+
+// Close closes the trace.
+func (c *ClientClock) Close() error {
+	if c.trace == nil {
+		return nil
+	}
+	return c.trace.Close()
+}
+
+// Request stamps h, the headers of a POST to endpoint, and prints the send event.
+func (c *ClientClock) Request(h http.Header, endpoint string) Event {
+	e := c.Send(h, fmt.Sprintf("Client %s made a POST request to %s", c.name, endpoint))
+	fmt.Fprintf(c.Out, "Client: %s\n", e)
+	return e
+}
+
+// Response records receiving the response with headers h.
+func (c *ClientClock) Response(h http.Header) Event {
+	return c.Receive(h, fmt.Sprintf("Client %s receives response from server", c.name))
+}
+
+// PrintResponse prints the server's messages from body, with their clocks
+// when the server sent its events, followed by received.
+func (c *ClientClock) PrintResponse(body []byte, received Event) {
+	var parsed struct {
+		Messages []string `json:"messages"`
+		Events   []Event  `json:"events"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		if len(parsed.Events) > 0 {
+			for _, e := range parsed.Events {
+				fmt.Fprintf(c.Out, "Server: %s\n", e)
+			}
+		} else {
+			for _, m := range parsed.Messages {
+				fmt.Fprintf(c.Out, "Server: %v\n", m)
+			}
+		}
+	}
+	fmt.Fprintf(c.Out, "Client: %s\n", received)
+}
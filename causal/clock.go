@@ -0,0 +1,282 @@
+// Package causal timestamps the messages exchanged between clients,
+// servers and peers with Lamport and vector clocks. Every process keeps a
+// Clock; sending a message ticks it and stamps the HTTP headers, receiving
+// one merges the sender's stamp. Each event can be appended to a JSONL
+// trace, from which Graph reconstructs the happens-before relation of a run.
+package causal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers carrying a sender's clock and the ID of its send event.
+const (
+	LamportHeader = "X-Lamport"
+	VectorHeader  = "X-Vector-Clock"
+	EventHeader   = "X-Event-Id"
+)
+
+// Event kinds.
+const (
+	Local   = "local"
+	Send    = "send"
+	Receive = "receive"
+)
+
+// Vector maps a process to the number of events it has had.
+type Vector map[string]uint64
+
+// Copy returns an independent copy of v.
+func (v Vector) Copy() Vector {
+	out := make(Vector, len(v))
+	for p, n := range v {
+		out[p] = n
+	}
+	return out
+}
+
+// Leq reports whether every entry of v is at most the one in o.
+func (v Vector) Leq(o Vector) bool {
+	for p, n := range v {
+		if n > o[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// HappenedBefore reports whether the event stamped v happened before the
+// one stamped o.
+func (v Vector) HappenedBefore(o Vector) bool {
+	return v.Leq(o) && !o.Leq(v)
+}
+
+// String encodes v as "alice:2,server:5", sorted by process. Process names
+// may themselves contain colons (e.g. URLs); the count follows the last one.
+// Commas and percent signs in names are percent-encoded.
+func (v Vector) String() string {
+	procs := make([]string, 0, len(v))
+	for p := range v {
+		procs = append(procs, p)
+	}
+	sort.Strings(procs)
+	parts := make([]string, len(procs))
+	for i, p := range procs {
+		parts[i] = nameEscaper.Replace(p) + ":" + strconv.FormatUint(v[p], 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+var nameEscaper = strings.NewReplacer("%", "%25", ",", "%2C")
+
+// ParseVector decodes the format written by String.
+func ParseVector(s string) (Vector, error) {
+	v := Vector{}
+	if strings.TrimSpace(s) == "" {
+		return v, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		i := strings.LastIndex(part, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid vector clock entry %q", part)
+		}
+		n, err := strconv.ParseUint(part[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector clock entry %q", part)
+		}
+		name, err := url.PathUnescape(strings.TrimSpace(part[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector clock entry %q", part)
+		}
+		v[name] = n
+	}
+	return v, nil
+}
+
+// Event is one step of a process, with its clocks after the step.
+type Event struct {
+	ID      string    `json:"id"` // process#n, where n is the process's own vector entry
+	Process string    `json:"process"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Lamport uint64    `json:"lamport"`
+	Vector  Vector    `json:"vector"`
+	Cause   string    `json:"cause,omitempty"` // for a receive, the ID of the matching send
+	Time    time.Time `json:"time"`
+}
+
+// String formats the event for logs, e.g. "[L=3 V=alice:1,server:2] message".
+func (e Event) String() string {
+	return fmt.Sprintf("[L=%d V=%s] %s", e.Lamport, e.Vector, e.Message)
+}
+
+// Clock is the logical clock of one process. It is safe for concurrent use.
+type Clock struct {
+	process string
+
+	mu      sync.Mutex
+	lamport uint64
+	vector  Vector
+	trace   io.Writer
+}
+
+// NewClock returns a clock for process. When trace is not nil every event
+// is appended to it as a JSON line.
+func NewClock(process string, trace io.Writer) *Clock {
+	return &Clock{process: process, vector: Vector{}, trace: trace}
+}
+
+// RunName returns name with a random suffix, e.g. "Alice-3f9a2c", naming
+// one run of a process so runs that share a trace never reuse event IDs.
+func RunName(name string) string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return name + "-" + hex.EncodeToString(suffix)
+}
+
+// OpenTrace opens path for appending events. Several processes on one
+// host may share a trace file; each event is written in a single call.
+func OpenTrace(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// Process returns the name the clock stamps events with.
+func (c *Clock) Process() string {
+	return c.process
+}
+
+// tick advances the clock for a new event, merging a received stamp if
+// any. Caller holds c.mu.
+func (c *Clock) tick(kind, message string, lamport uint64, vector Vector, cause string) Event {
+	if lamport > c.lamport {
+		c.lamport = lamport
+	}
+	c.lamport++
+	for p, n := range vector {
+		if n > c.vector[p] {
+			c.vector[p] = n
+		}
+	}
+	c.vector[c.process]++
+
+	e := Event{
+		ID:      c.process + "#" + strconv.FormatUint(c.vector[c.process], 10),
+		Process: c.process,
+		Kind:    kind,
+		Message: message,
+		Lamport: c.lamport,
+		Vector:  c.vector.Copy(),
+		Cause:   cause,
+		Time:    time.Now().UTC(),
+	}
+	if c.trace != nil {
+		if line, err := json.Marshal(e); err == nil {
+			c.trace.Write(append(line, '\n'))
+		}
+	}
+	return e
+}
+
+// Local records an internal event.
+func (c *Clock) Local(message string) Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tick(Local, message, 0, nil, "")
+}
+
+// Send records sending a message and stamps h, the headers of the request
+// or response that carries it.
+func (c *Clock) Send(h http.Header, message string) Event {
+	c.mu.Lock()
+	e := c.tick(Send, message, 0, nil, "")
+	c.mu.Unlock()
+	h.Set(LamportHeader, strconv.FormatUint(e.Lamport, 10))
+	h.Set(VectorHeader, e.Vector.String())
+	h.Set(EventHeader, e.ID)
+	return e
+}
+
+// Receive records receiving a message whose headers are h, merging the
+// sender's stamp. Messages from senders without a clock only tick it.
+func (c *Clock) Receive(h http.Header, message string) Event {
+	lamport, _ := strconv.ParseUint(h.Get(LamportHeader), 10, 64)
+	vector, err := ParseVector(h.Get(VectorHeader))
+	if err != nil {
+		vector = nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tick(Receive, message, lamport, vector, h.Get(EventHeader))
+}
+
+// Transport returns an http.RoundTripper that records every request sent
+// through base (http.DefaultTransport if nil) and every response received.
+func (c *Clock) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{clock: c, base: base}
+}
+
+type transport struct {
+	clock *Clock
+	base  http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	target := req.URL.Host + req.URL.Path
+	t.clock.Send(req.Header, fmt.Sprintf("%s sends %s %s", t.clock.process, req.Method, target))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.clock.Receive(resp.Header, fmt.Sprintf("%s receives %s from %s", t.clock.process, resp.Status, target))
+	return resp, nil
+}
+
+// Handler returns a handler that records receiving every request to h and
+// stamps its response, the server side of peers whose client uses
+// Transport.
+func (c *Clock) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Host + r.URL.Path
+		c.Receive(r.Header, fmt.Sprintf("%s receives %s %s", c.process, r.Method, target))
+		h.ServeHTTP(&stampingWriter{ResponseWriter: w, clock: c, target: target}, r)
+	})
+}
+
+// stampingWriter stamps the response headers just before they are written.
+type stampingWriter struct {
+	http.ResponseWriter
+	clock   *Clock
+	target  string
+	stamped bool
+}
+
+func (w *stampingWriter) WriteHeader(code int) {
+	if !w.stamped {
+		w.stamped = true
+		w.clock.Send(w.Header(), fmt.Sprintf("%s answers %d for %s", w.clock.process, code, w.target))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *stampingWriter) Write(b []byte) (int, error) {
+	if !w.stamped {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,78 @@
+package causal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVectorRoundTrip(t *testing.T) {
+	tests := []Vector{
+		{},
+		{"alice": 2, "server": 5},
+		{"http://localhost:8080": 3},
+		{"Smith, John": 1, "a,b:c": 4},
+		{"100%": 7, "x%2Cy": 1},
+	}
+	for _, v := range tests {
+		got, err := ParseVector(v.String())
+		if err != nil || !reflect.DeepEqual(got, v) {
+			t.Errorf("ParseVector(%q) = %v, %v; want %v", v.String(), got, err, v)
+		}
+	}
+	for _, bad := range []string{"alice", "alice:x", ":3", "a%zz:1"} {
+		if _, err := ParseVector(bad); err == nil {
+			t.Errorf("ParseVector(%q) accepted", bad)
+		}
+	}
+}
+
+func TestClocksAcrossMessages(t *testing.T) {
+	client, server := NewClock("Smith, John", nil), NewClock("server", nil)
+	h := http.Header{}
+	sent := client.Send(h, "request")
+	recv := server.Receive(h, "request")
+	if recv.Cause != sent.ID || recv.Lamport != sent.Lamport+1 || !sent.Vector.HappenedBefore(recv.Vector) {
+		t.Fatalf("send %+v does not precede receive %+v", sent, recv)
+	}
+}
+
+func TestClientClocksAreUnique(t *testing.T) {
+	a, _ := OpenClientClock("Alice", "")
+	b, _ := OpenClientClock("Alice", "")
+	if a.Process() == b.Process() {
+		t.Fatalf("two runs of Alice share process %s", a.Process())
+	}
+}
+
+func TestHandlerStampsPeerMessages(t *testing.T) {
+	client, server := NewClock(RunName("n1"), nil), NewClock(RunName("n2"), nil)
+	srv := httptest.NewServer(server.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	defer srv.Close()
+
+	resp, err := (&http.Client{Transport: client.Transport(nil)}).Get(srv.URL + "/raft/vote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Client send, server receive and send, client receive.
+	if resp.Header.Get(EventHeader) != server.Process()+"#2" {
+		t.Errorf("response stamped by %q, want the server's second event", resp.Header.Get(EventHeader))
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	want := Vector{client.Process(): 2, server.Process(): 2}
+	if !reflect.DeepEqual(client.vector, want) || client.lamport != 4 {
+		t.Errorf("client clock L=%d V=%v, want L=4 V=%v", client.lamport, client.vector, want)
+	}
+}
+
+func TestRunNamesAreUnique(t *testing.T) {
+	if a, b := RunName("node"), RunName("node"); a == b || !strings.HasPrefix(a, "node-") {
+		t.Fatalf("run names %s and %s", a, b)
+	}
+}
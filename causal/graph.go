@@ -0,0 +1,185 @@
+package causal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ReadTrace reads the JSON lines written by a Clock.
+func ReadTrace(r io.Reader) ([]Event, error) {
+	var events []Event
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		events = append(events, e)
+	}
+	return events, sc.Err()
+}
+
+// Edge kinds of the happens-before graph.
+const (
+	ProgramEdge = "program" // consecutive events of one process
+	MessageEdge = "message" // a send and its receive
+)
+
+// Edge is a direct happens-before relation between two events.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// Graph is the happens-before graph of a run: its transitive closure
+// orders exactly the events whose vector clocks are ordered.
+type Graph struct {
+	Events    []Event // sorted by Lamport time, a linear extension of the graph
+	Edges     []Edge
+	Processes []string
+	// Problems lists inconsistencies found while building, such as
+	// duplicate event IDs or receives whose send is missing from the trace.
+	Problems []string
+}
+
+// BuildGraph reconstructs the graph of events gathered from any number of
+// process traces.
+func BuildGraph(events []Event) *Graph {
+	g := &Graph{}
+	byID := make(map[string]Event)
+	byProcess := make(map[string][]Event)
+	for _, e := range events {
+		if _, dup := byID[e.ID]; dup {
+			g.Problems = append(g.Problems, fmt.Sprintf("duplicate event %s (was a process name reused?)", e.ID))
+			continue
+		}
+		byID[e.ID] = e
+		byProcess[e.Process] = append(byProcess[e.Process], e)
+		g.Events = append(g.Events, e)
+	}
+
+	for p, evs := range byProcess {
+		g.Processes = append(g.Processes, p)
+		sort.Slice(evs, func(i, j int) bool { return evs[i].Vector[p] < evs[j].Vector[p] })
+		for i := 1; i < len(evs); i++ {
+			g.Edges = append(g.Edges, Edge{From: evs[i-1].ID, To: evs[i].ID, Kind: ProgramEdge})
+		}
+	}
+	sort.Strings(g.Processes)
+
+	for _, e := range g.Events {
+		if e.Kind != Receive || e.Cause == "" {
+			continue
+		}
+		send, ok := byID[e.Cause]
+		if !ok {
+			g.Problems = append(g.Problems, fmt.Sprintf("%s receives %s, which is not in the trace", e.ID, e.Cause))
+			continue
+		}
+		if !send.Vector.HappenedBefore(e.Vector) || send.Lamport >= e.Lamport {
+			g.Problems = append(g.Problems, fmt.Sprintf("clocks of %s do not follow its send %s", e.ID, send.ID))
+		}
+		g.Edges = append(g.Edges, Edge{From: send.ID, To: e.ID, Kind: MessageEdge})
+	}
+
+	sort.SliceStable(g.Events, func(i, j int) bool {
+		a, b := g.Events[i], g.Events[j]
+		if a.Lamport != b.Lamport {
+			return a.Lamport < b.Lamport
+		}
+		return a.ID < b.ID
+	})
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	return g
+}
+
+// Concurrent counts the pairs of events neither of which happened before
+// the other.
+func (g *Graph) Concurrent() int {
+	n := 0
+	for i := range g.Events {
+		for j := i + 1; j < len(g.Events); j++ {
+			a, b := g.Events[i].Vector, g.Events[j].Vector
+			if !a.HappenedBefore(b) && !b.HappenedBefore(a) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// WriteText prints the events in Lamport order, each with the events it
+// directly follows.
+func (g *Graph) WriteText(w io.Writer) error {
+	preds := make(map[string][]string)
+	messages := 0
+	for _, e := range g.Edges {
+		label := e.From
+		if e.Kind == MessageEdge {
+			label += " (message)"
+			messages++
+		}
+		preds[e.To] = append(preds[e.To], label)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "processes: %s\n", strings.Join(g.Processes, ", "))
+	fmt.Fprintf(bw, "events: %d, messages: %d, concurrent pairs: %d\n\n", len(g.Events), messages, g.Concurrent())
+	for _, e := range g.Events {
+		fmt.Fprintf(bw, "L=%-4d %-28s %-8s %s\n", e.Lamport, e.ID, e.Kind, e.Message)
+		fmt.Fprintf(bw, "       V={%s}\n", e.Vector)
+		if p := preds[e.ID]; len(p) > 0 {
+			fmt.Fprintf(bw, "       after %s\n", strings.Join(p, ", "))
+		}
+	}
+	if len(g.Problems) > 0 {
+		fmt.Fprintf(bw, "\nproblems:\n")
+		for _, p := range g.Problems {
+			fmt.Fprintf(bw, "  %s\n", p)
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteDOT prints the graph in Graphviz DOT, one cluster per process.
+// Program order is drawn solid and messages dashed.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph happensbefore {")
+	fmt.Fprintln(bw, "  rankdir=LR;")
+	fmt.Fprintln(bw, "  node [shape=box, fontsize=10];")
+	for i, p := range g.Processes {
+		fmt.Fprintf(bw, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(bw, "    label=%q;\n", p)
+		for _, e := range g.Events {
+			if e.Process == p {
+				label := fmt.Sprintf("%s\nL=%d V={%s}", e.Message, e.Lamport, e.Vector)
+				fmt.Fprintf(bw, "    %q [label=%q];\n", e.ID, label)
+			}
+		}
+		fmt.Fprintln(bw, "  }")
+	}
+	for _, e := range g.Edges {
+		if e.Kind == MessageEdge {
+			fmt.Fprintf(bw, "  %q -> %q [style=dashed, color=blue];\n", e.From, e.To)
+		} else {
+			fmt.Fprintf(bw, "  %q -> %q;\n", e.From, e.To)
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/tlsutil"
+)
+
+// certgen creates a local CA, a server certificate and one client
+// certificate per name, for running the exercise server with TLS/mTLS:
+//
+//	go run ./certgen -clients Alice,Dan
+//
+// An existing CA in the output directory is reused so that new client
+// certificates can be added later.
+func main() {
+	outDir := flag.String("out", "client-server app/certs", "output directory")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma-separated server host names and IPs")
+	clients := flag.String("clients", "Alice,Dan,Matei,Ina,Elena", "comma-separated client names (certificate common names)")
+	validFor := flag.Duration("valid", 365*24*time.Hour, "certificate validity")
+	flag.Parse()
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create %s: %v\n", *outDir, err)
+		os.Exit(1)
+	}
+	path := func(name string) string { return filepath.Join(*outDir, name) }
+
+	ca, err := tlsutil.LoadAuthority(path("ca.pem"), path("ca-key.pem"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "failed to load CA from %s: %v\n", *outDir, err)
+		os.Exit(1)
+	}
+	if err != nil {
+		ca, err = tlsutil.NewAuthority("Distributed-systems local CA", *validFor)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create CA: %v\n", err)
+			os.Exit(1)
+		}
+		if err := tlsutil.WriteFiles(ca.Cert, ca.Key, path("ca.pem"), path("ca-key.pem")); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write CA: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("created CA %s\n", path("ca.pem"))
+	} else {
+		fmt.Printf("reusing CA %s\n", path("ca.pem"))
+	}
+
+	cert, key, err := ca.Issue("localhost", strings.Split(*hosts, ","), false, *validFor)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to issue server certificate: %v\n", err)
+		os.Exit(1)
+	}
+	if err := tlsutil.WriteFiles(cert, key, path("server.pem"), path("server-key.pem")); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write server certificate: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("created server certificate %s\n", path("server.pem"))
+
+	for _, name := range strings.Split(*clients, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		cert, key, err := ca.Issue(name, nil, true, *validFor)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to issue certificate for %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		if err := tlsutil.WriteFiles(cert, key, path(name+".pem"), path(name+"-key.pem")); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write certificate for %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("created client certificate %s\n", path(name+".pem"))
+	}
+}
@@ -0,0 +1,263 @@
+// Package chaos injects faults into HTTP responses so client retry logic
+// can be exercised against an unreliable server: added latency, 500 and
+// 503 errors, dropped connections, truncated bodies and slow body writes.
+// Faults are described by rules scoped by path and client name, can be
+// changed at runtime through AdminHandler, and are drawn from a seeded
+// generator so a sequence of requests meets the same faults on every run.
+package chaos
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/httpbuf"
+)
+
+// Rule describes the faults applied to matching requests. Rates are
+// probabilities between 0 and 1, drawn independently for each request.
+type Rule struct {
+	Path   string `json:"path,omitempty"`   // e.g. "/ex2"; empty matches every path
+	Client string `json:"client,omitempty"` // X-Client-Name; empty matches every client
+
+	LatencyMS int `json:"latency_ms,omitempty"` // added before the request is handled
+	JitterMS  int `json:"jitter_ms,omitempty"`  // up to this much more latency
+
+	ErrorRate       float64 `json:"error_rate,omitempty"`       // answer 500 without handling
+	UnavailableRate float64 `json:"unavailable_rate,omitempty"` // answer 503 without handling
+	DropRate        float64 `json:"drop_rate,omitempty"`        // close the connection without answering
+	TruncateRate    float64 `json:"truncate_rate,omitempty"`    // send half the body, then close
+
+	SlowRate   float64 `json:"slow_rate,omitempty"`      // send the body in chunks with pauses
+	ChunkBytes int     `json:"chunk_bytes,omitempty"`    // chunk size of slow writes (default 16)
+	ChunkPause int     `json:"chunk_pause_ms,omitempty"` // pause between chunks (default 100)
+}
+
+func (rule Rule) matches(r *http.Request) bool {
+	if rule.Path != "" && rule.Path != r.URL.Path {
+		return false
+	}
+	if rule.Client != "" && rule.Client != r.Header.Get("X-Client-Name") {
+		return false
+	}
+	return true
+}
+
+// Config is the injector's runtime configuration. The first matching rule
+// applies to a request.
+type Config struct {
+	Seed  int64  `json:"seed"`
+	Rules []Rule `json:"rules"`
+}
+
+// Stats counts the faults injected so far.
+type Stats struct {
+	Requests    int `json:"requests"`
+	Delayed     int `json:"delayed"`
+	Errors      int `json:"errors"`
+	Unavailable int `json:"unavailable"`
+	Dropped     int `json:"dropped"`
+	Truncated   int `json:"truncated"`
+	Slowed      int `json:"slowed"`
+}
+
+// Injector is the fault-injection middleware.
+type Injector struct {
+	mu    sync.Mutex
+	cfg   Config
+	rng   *rand.Rand
+	stats Stats
+}
+
+// New returns an injector with no rules, seeded with seed.
+func New(seed int64) *Injector {
+	inj := &Injector{}
+	inj.Set(Config{Seed: seed})
+	return inj
+}
+
+// Set replaces the configuration and reseeds the generator, so applying
+// the same configuration again replays the same faults.
+func (inj *Injector) Set(cfg Config) {
+	if cfg.Rules == nil {
+		cfg.Rules = []Rule{}
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.cfg = cfg
+	inj.rng = rand.New(rand.NewSource(cfg.Seed))
+	inj.stats = Stats{}
+}
+
+// plan is the fate drawn for one request.
+type plan struct {
+	delay      time.Duration
+	status     int // 500 or 503 instead of handling, 0 to handle
+	drop       bool
+	truncate   bool
+	slow       bool
+	chunkBytes int
+	chunkPause time.Duration
+}
+
+// draw picks the faults for r. Every rate is drawn for every matching
+// request, so changing one rate does not shift the faults the others produce.
+func (inj *Injector) draw(r *http.Request) (plan, bool) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	var rule *Rule
+	for i := range inj.cfg.Rules {
+		if inj.cfg.Rules[i].matches(r) {
+			rule = &inj.cfg.Rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return plan{}, false
+	}
+	inj.stats.Requests++
+
+	var p plan
+	p.delay = time.Duration(rule.LatencyMS) * time.Millisecond
+	jitter := inj.rng.Float64()
+	if rule.JitterMS > 0 {
+		p.delay += time.Duration(jitter * float64(time.Duration(rule.JitterMS)*time.Millisecond))
+	}
+	drop, errRoll, unavailable := inj.rng.Float64(), inj.rng.Float64(), inj.rng.Float64()
+	truncate, slow := inj.rng.Float64(), inj.rng.Float64()
+
+	switch {
+	case drop < rule.DropRate:
+		p.drop = true
+		inj.stats.Dropped++
+	case errRoll < rule.ErrorRate:
+		p.status = http.StatusInternalServerError
+		inj.stats.Errors++
+	case unavailable < rule.UnavailableRate:
+		p.status = http.StatusServiceUnavailable
+		inj.stats.Unavailable++
+	case truncate < rule.TruncateRate:
+		p.truncate = true
+		inj.stats.Truncated++
+	case slow < rule.SlowRate:
+		p.slow = true
+		inj.stats.Slowed++
+		p.chunkBytes = rule.ChunkBytes
+		if p.chunkBytes <= 0 {
+			p.chunkBytes = 16
+		}
+		p.chunkPause = time.Duration(rule.ChunkPause) * time.Millisecond
+		if p.chunkPause <= 0 {
+			p.chunkPause = 100 * time.Millisecond
+		}
+	}
+	if p.delay > 0 {
+		inj.stats.Delayed++
+	}
+	return p, true
+}
+
+// Wrap applies the configured faults to next.
+func (inj *Injector) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := inj.draw(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if p.delay > 0 {
+			select {
+			case <-time.After(p.delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if p.drop {
+			// The server closes the connection without writing anything.
+			panic(http.ErrAbortHandler)
+		}
+		if p.status != 0 {
+			w.Header().Set("X-Chaos", "injected")
+			http.Error(w, "chaos: injected "+http.StatusText(p.status), p.status)
+			return
+		}
+		if !p.truncate && !p.slow {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		out := httpbuf.Serve(next, r)
+		for k, v := range out.Header() {
+			w.Header()[k] = v
+		}
+		body := out.Body.Bytes()
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(out.Code)
+		flusher, _ := w.(http.Flusher)
+
+		if p.truncate {
+			w.Write(body[:len(body)/2])
+			if flusher != nil {
+				flusher.Flush()
+			}
+			// The client sees the connection close before Content-Length bytes.
+			panic(http.ErrAbortHandler)
+		}
+		for len(body) > 0 {
+			n := min(p.chunkBytes, len(body))
+			if _, err := w.Write(body[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			body = body[n:]
+			if len(body) == 0 {
+				break
+			}
+			select {
+			case <-time.After(p.chunkPause):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// AdminHandler shows the configuration and fault counters (GET), replaces
+// the configuration with the JSON body (PUT), or removes every rule
+// (DELETE), e.g.
+//
+//	curl -X PUT localhost:8080/admin/chaos -d '{"seed":7,"rules":[{"path":"/ex2","unavailable_rate":0.3}]}'
+func (inj *Injector) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var cfg Config
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		inj.Set(cfg)
+	case http.MethodDelete:
+		inj.mu.Lock()
+		seed := inj.cfg.Seed
+		inj.mu.Unlock()
+		inj.Set(Config{Seed: seed})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	inj.mu.Lock()
+	resp := map[string]interface{}{"config": inj.cfg, "stats": inj.stats}
+	inj.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
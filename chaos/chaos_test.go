@@ -0,0 +1,195 @@
+package chaos
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const body = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func server(t *testing.T, inj *Injector) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(inj.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// post sends one request to path as client and describes the outcome: the
+// status and body, or "error" when the connection failed. It posts because
+// the transport silently retries a GET whose connection was dropped.
+func post(srv *httptest.Server, path, client string) string {
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader("{}"))
+	if client != "" {
+		req.Header.Set("X-Client-Name", client)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		return "error"
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "truncated"
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.Status
+	}
+	return string(data)
+}
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		want  string
+		stats Stats
+	}{
+		{"no fault", Rule{}, body, Stats{Requests: 1}},
+		{"error", Rule{ErrorRate: 1}, "500 Internal Server Error", Stats{Requests: 1, Errors: 1}},
+		{"unavailable", Rule{UnavailableRate: 1}, "503 Service Unavailable", Stats{Requests: 1, Unavailable: 1}},
+		{"drop", Rule{DropRate: 1}, "error", Stats{Requests: 1, Dropped: 1}},
+		{"truncate", Rule{TruncateRate: 1}, "truncated", Stats{Requests: 1, Truncated: 1}},
+		{"slow", Rule{SlowRate: 1, ChunkBytes: 10, ChunkPause: 1}, body, Stats{Requests: 1, Slowed: 1}},
+		{"latency", Rule{LatencyMS: 1}, body, Stats{Requests: 1, Delayed: 1}},
+		{"drop wins over error", Rule{DropRate: 1, ErrorRate: 1}, "error", Stats{Requests: 1, Dropped: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inj := New(1)
+			inj.Set(Config{Seed: 1, Rules: []Rule{tt.rule}})
+			srv := server(t, inj)
+			if got := post(srv, "/ex2", ""); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			inj.mu.Lock()
+			stats := inj.stats
+			inj.mu.Unlock()
+			if stats != tt.stats {
+				t.Errorf("stats %+v, want %+v", stats, tt.stats)
+			}
+		})
+	}
+}
+
+func TestSlowWritesPause(t *testing.T) {
+	inj := New(1)
+	inj.Set(Config{Rules: []Rule{{SlowRate: 1, ChunkBytes: 10, ChunkPause: 20}}})
+	srv := server(t, inj)
+	start := time.Now()
+	if got := post(srv, "/", ""); got != body {
+		t.Fatalf("got %q", got)
+	}
+	// 36 bytes in chunks of 10: three pauses.
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("slow body took %v, want at least 60ms", elapsed)
+	}
+}
+
+func TestRuleMatching(t *testing.T) {
+	rules := []Rule{
+		{Path: "/ex2", Client: "Alice", ErrorRate: 1},
+		{Path: "/ex2", UnavailableRate: 1},
+		{Client: "Dan", DropRate: 1},
+	}
+	tests := []struct {
+		path, client string
+		want         string
+	}{
+		{"/ex2", "Alice", "500 Internal Server Error"},
+		{"/ex2", "Bob", "503 Service Unavailable"},
+		{"/ex2", "Dan", "503 Service Unavailable"}, // the first matching rule applies
+		{"/ex5", "Dan", "error"},
+		{"/ex5", "Alice", body},
+	}
+	inj := New(1)
+	inj.Set(Config{Rules: rules})
+	srv := server(t, inj)
+	for _, tt := range tests {
+		if got := post(srv, tt.path, tt.client); got != tt.want {
+			t.Errorf("%s as %s: got %q, want %q", tt.path, tt.client, got, tt.want)
+		}
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.stats.Requests != 4 {
+		t.Errorf("%d requests matched, want 4", inj.stats.Requests)
+	}
+}
+
+// outcomes returns which of n requests get each injected status.
+func outcomes(inj *Injector, n int) []int {
+	var codes []int
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/ex2", nil)
+		p, _ := inj.draw(req)
+		codes = append(codes, p.status)
+	}
+	return codes
+}
+
+func TestSeedReplays(t *testing.T) {
+	cfg := Config{Seed: 7, Rules: []Rule{{ErrorRate: 0.3, UnavailableRate: 0.3}}}
+	inj := New(0)
+	inj.Set(cfg)
+	first := outcomes(inj, 50)
+	inj.Set(cfg)
+	if again := outcomes(inj, 50); !reflect.DeepEqual(again, first) {
+		t.Fatalf("same seed gave %v, then %v", first, again)
+	}
+	cfg.Seed = 8
+	inj.Set(cfg)
+	if other := outcomes(inj, 50); reflect.DeepEqual(other, first) {
+		t.Fatal("different seeds gave the same faults")
+	}
+}
+
+func TestRatesAreIndependent(t *testing.T) {
+	errorsOnly := Config{Seed: 3, Rules: []Rule{{ErrorRate: 0.3}}}
+	withSlow := Config{Seed: 3, Rules: []Rule{{ErrorRate: 0.3, SlowRate: 0.5, LatencyMS: 1, JitterMS: 5}}}
+	a, b := New(0), New(0)
+	a.Set(errorsOnly)
+	b.Set(withSlow)
+	if x, y := outcomes(a, 50), outcomes(b, 50); !reflect.DeepEqual(x, y) {
+		t.Fatalf("adding a slow rate moved the errors:\n%v\n%v", x, y)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	inj := New(5)
+	steps := []struct {
+		method, body string
+		wantCode     int
+		wantRules    int
+		wantSeed     int64
+	}{
+		{http.MethodGet, "", http.StatusOK, 0, 5},
+		{http.MethodPut, `{"seed":9,"rules":[{"path":"/ex2","error_rate":0.5}]}`, http.StatusOK, 1, 9},
+		{http.MethodPut, `{"rules":`, http.StatusBadRequest, 1, 9},
+		{http.MethodDelete, "", http.StatusOK, 0, 9},
+		{http.MethodPost, "", http.StatusMethodNotAllowed, 0, 9},
+	}
+	for _, st := range steps {
+		rec := httptest.NewRecorder()
+		inj.AdminHandler(rec, httptest.NewRequest(st.method, "/admin/chaos", strings.NewReader(st.body)))
+		if rec.Code != st.wantCode {
+			t.Fatalf("%s: status %d, want %d", st.method, rec.Code, st.wantCode)
+		}
+		if rec.Code == http.StatusOK {
+			var resp struct{ Config Config }
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Config.Rules) != st.wantRules || resp.Config.Seed != st.wantSeed {
+				t.Fatalf("%s: config %+v", st.method, resp.Config)
+			}
+		}
+	}
+}
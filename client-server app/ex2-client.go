@@ -8,6 +8,10 @@ import (
 	"io"
 	"net/http"
 	"os"
+
+	"github.com/liviu274/Distributed-systems/auth"
+	"github.com/liviu274/Distributed-systems/causal"
+	"github.com/liviu274/Distributed-systems/tlsutil"
 )
 
 func main() {
@@ -15,8 +19,23 @@ func main() {
 	clientName := flag.String("name", "Alice", "client name to send in header")
 	const inputFile string = "data/ex2-input.txt"
 	maxElements := flag.Int("max", 0, "maximum number of elements to send (0 = send all)")
+	keyID := flag.String("key", "", "API key ID used to sign the request (empty = unsigned)")
+	keysFile := flag.String("keys", "data/clients.json", "key registry file holding the secret for -key")
+	priority := flag.String("priority", "", "scheduling class sent in X-Priority: high, normal or low")
+	tlsCA := flag.String("tls-ca", "", "CA certificate to trust; switches to HTTPS")
+	tlsCert := flag.String("tls-cert", "", "client certificate for mutual TLS")
+	tlsKey := flag.String("tls-key", "", "client private key for mutual TLS")
+	tracePath := flag.String("trace", "", "append clock events to this JSONL file (see hbgraph)")
 	flag.Parse()
 
+	// Logical clock stamping the messages exchanged with the server
+	clock, err := causal.OpenClientClock(*clientName, *tracePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open trace: %v\n", err)
+		os.Exit(1)
+	}
+	defer clock.Close()
+
 	content, err := os.ReadFile(inputFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", inputFile, err)
@@ -48,8 +67,21 @@ func main() {
 	fmt.Printf("Client %s Connected.\n", *clientName)
 	fmt.Printf("Client %s made a POST request to /ex2 with data %s\n", *clientName, string(data))
 
+	// Use HTTPS (and optionally a client certificate) when a CA is given
+	scheme := "http"
+	httpClient := &http.Client{}
+	if *tlsCA != "" {
+		cfg, err := tlsutil.ClientConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to configure TLS: %v\n", err)
+			os.Exit(1)
+		}
+		scheme = "https"
+		httpClient.Transport = &http.Transport{TLSClientConfig: cfg}
+	}
+
 	// Build request so we can add headers with client metadata
-	req, err := http.NewRequest("POST", "http://localhost:8080/ex2", bytes.NewReader(data))
+	req, err := http.NewRequest("POST", scheme+"://localhost:8080/ex2", bytes.NewReader(data))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to build request: %v\n", err)
 		os.Exit(1)
@@ -57,28 +89,38 @@ func main() {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Client-Name", *clientName)
 	req.Header.Set("X-Request-Type", "POST")
+	if *priority != "" {
+		req.Header.Set("X-Priority", *priority)
+	}
+	clock.Request(req.Header, "/ex2")
+
+	// Sign the request when an API key is configured
+	if *keyID != "" {
+		reg, err := auth.LoadRegistry(*keysFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load keys: %v\n", err)
+			os.Exit(1)
+		}
+		k, ok := reg.Lookup(*keyID)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "key %s not found in %s\n", *keyID, *keysFile)
+			os.Exit(1)
+		}
+		auth.Sign(req, k, data)
+	}
 
-	httpClient := &http.Client{}
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "request error: %v\n", err)
 		os.Exit(1)
 	}
 	defer resp.Body.Close()
+	received := clock.Response(resp.Header)
 
 	body, _ := io.ReadAll(resp.Body)
 	fmt.Printf("status: %s\n", resp.Status)
 	fmt.Printf("body: %s\n", string(body))
 
-	// Try to parse messages from server response
-	var parsed map[string]interface{}
-	if err := json.Unmarshal(body, &parsed); err == nil {
-		if msgs, ok := parsed["messages"].([]interface{}); ok {
-			for _, m := range msgs {
-				fmt.Printf("Server: %v\n", m)
-			}
-		}
-	}
-
-	fmt.Printf("Client %s receives response from server\n", *clientName)
+	// Print messages from server response, with their clocks if present
+	clock.PrintResponse(body, received)
 }
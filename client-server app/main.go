@@ -1,14 +1,37 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/liviu274/Distributed-systems/auth"
+	"github.com/liviu274/Distributed-systems/causal"
+	"github.com/liviu274/Distributed-systems/chaos"
+	"github.com/liviu274/Distributed-systems/cluster"
+	"github.com/liviu274/Distributed-systems/gossip"
+	"github.com/liviu274/Distributed-systems/joblog"
+	"github.com/liviu274/Distributed-systems/lease"
+	"github.com/liviu274/Distributed-systems/raft"
+	"github.com/liviu274/Distributed-systems/ratelimit"
+	"github.com/liviu274/Distributed-systems/sched"
+	"github.com/liviu274/Distributed-systems/tlsutil"
+	"github.com/liviu274/Distributed-systems/twopc"
 )
 
 type resultBool struct {
@@ -26,6 +49,33 @@ type resultString struct {
 	val string
 }
 
+// scheduler runs per-item work when a scheduling policy is configured;
+// when nil every item gets its own goroutine.
+var scheduler *sched.Scheduler
+
+// clock timestamps the messages this server exchanges with clients and
+// other nodes; main replaces it once the node ID is known.
+var clock = causal.NewClock("server", nil)
+
+// inFlight counts items that are queued or being processed; workers
+// report it to the coordinator with each heartbeat.
+var inFlight atomic.Int64
+
+// runItem starts the processing of one item on behalf of the request's
+// client, honouring the X-Priority header when a scheduler is in use.
+func runItem(r *http.Request, fn func()) {
+	inFlight.Add(1)
+	task := func() {
+		defer inFlight.Add(-1)
+		fn()
+	}
+	if scheduler == nil {
+		go task()
+		return
+	}
+	scheduler.Submit(ratelimit.ClientName(r), sched.ParsePriority(r.Header.Get("X-Priority")), task)
+}
+
 func helloHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Hello, this is a simple handler!")
 }
@@ -125,7 +175,9 @@ func ex2ArrayHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Messages exchanged (will be included in the response)
 	messages := []string{}
-	messages = append(messages, fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr)))
+	received := fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr))
+	messages = append(messages, received)
+	events := []causal.Event{clock.Receive(r.Header, received)}
 
 	// Process each item concurrently using goroutines.
 	ch := make(chan resultBool, len(arr))
@@ -133,7 +185,7 @@ func ex2ArrayHandler(w http.ResponseWriter, r *http.Request) {
 	wg.Add(len(arr))
 
 	for i, s := range arr {
-		go ex2ProcessString(s, i, &wg, ch)
+		runItem(r, func() { ex2ProcessString(s, i, &wg, ch) })
 	}
 
 	// Wait for all workers to finish then close the channel and collect results.
@@ -153,11 +205,13 @@ func ex2ArrayHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	messages = append(messages, fmt.Sprintf("Server sends response to client %s", clientName))
+	sent := fmt.Sprintf("Server sends response to client %s", clientName)
+	messages = append(messages, sent)
+	events = append(events, clock.Send(w.Header(), sent))
 
 	// Write back the response (including messages)
 	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": trueCount, "messages": messages}
+	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": trueCount, "messages": messages, "events": events}
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 		return
@@ -216,7 +270,9 @@ func ex5ArrayHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Messages exchanged (will be included in the response)
 	messages := []string{}
-	messages = append(messages, fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr)))
+	received := fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr))
+	messages = append(messages, received)
+	events := []causal.Event{clock.Receive(r.Header, received)}
 
 	// Process each item concurrently using goroutines.
 	ch := make(chan resultInt, len(arr))
@@ -224,7 +280,7 @@ func ex5ArrayHandler(w http.ResponseWriter, r *http.Request) {
 	wg.Add(len(arr))
 
 	for i, s := range arr {
-		go ex5ProcessString(s, i, &wg, ch)
+		runItem(r, func() { ex5ProcessString(s, i, &wg, ch) })
 	}
 
 	// Wait for all workers to finish then close the channel and collect results.
@@ -243,11 +299,13 @@ func ex5ArrayHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	messages = append(messages, fmt.Sprintf("Server sends response to client %s", clientName))
+	sent := fmt.Sprintf("Server sends response to client %s", clientName)
+	messages = append(messages, sent)
+	events = append(events, clock.Send(w.Header(), sent))
 
 	// Write back the response (including messages)
 	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": result, "messages": messages}
+	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": result, "messages": messages, "events": events}
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 		return
@@ -302,7 +360,9 @@ func ex7ArrayHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Messages exchanged (will be included in the response)
 	messages := []string{}
-	messages = append(messages, fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr)))
+	received := fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr))
+	messages = append(messages, received)
+	events := []causal.Event{clock.Receive(r.Header, received)}
 
 	// Process each item concurrently using goroutines.
 	ch := make(chan resultString, len(arr))
@@ -310,7 +370,7 @@ func ex7ArrayHandler(w http.ResponseWriter, r *http.Request) {
 	wg.Add(len(arr))
 
 	for i, s := range arr {
-		go ex7ProcessString(s, i, &wg, ch)
+		runItem(r, func() { ex7ProcessString(s, i, &wg, ch) })
 	}
 
 	// Wait for all workers to finish then close the channel and collect results.
@@ -322,11 +382,13 @@ func ex7ArrayHandler(w http.ResponseWriter, r *http.Request) {
 		processed[res.idx] = res.val
 	}
 
-	messages = append(messages, fmt.Sprintf("Server sends response to client %s", clientName))
+	sent := fmt.Sprintf("Server sends response to client %s", clientName)
+	messages = append(messages, sent)
+	events = append(events, clock.Send(w.Header(), sent))
 
 	// Write back the response (including messages)
 	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": "No result value given by the exercise", "messages": messages}
+	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": "No result value given by the exercise", "messages": messages, "events": events}
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 		return
@@ -384,7 +446,9 @@ func ex9ArrayHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Messages exchanged (will be included in the response)
 	messages := []string{}
-	messages = append(messages, fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr)))
+	received := fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr))
+	messages = append(messages, received)
+	events := []causal.Event{clock.Receive(r.Header, received)}
 
 	// Process each item concurrently using goroutines.
 	ch := make(chan resultBool, len(arr))
@@ -392,7 +456,7 @@ func ex9ArrayHandler(w http.ResponseWriter, r *http.Request) {
 	wg.Add(len(arr))
 
 	for i, s := range arr {
-		go ex9ProcessString(s, i, &wg, ch)
+		runItem(r, func() { ex9ProcessString(s, i, &wg, ch) })
 	}
 
 	// Wait for all workers to finish then close the channel and collect results.
@@ -412,11 +476,13 @@ func ex9ArrayHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	messages = append(messages, fmt.Sprintf("Server sends response to client %s", clientName))
+	sent := fmt.Sprintf("Server sends response to client %s", clientName)
+	messages = append(messages, sent)
+	events = append(events, clock.Send(w.Header(), sent))
 
 	// Write back the response (including messages)
 	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": trueCount, "messages": messages}
+	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": trueCount, "messages": messages, "events": events}
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 		return
@@ -478,7 +544,9 @@ func ex14ArrayHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Messages exchanged (will be included in the response)
 	messages := []string{}
-	messages = append(messages, fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr)))
+	received := fmt.Sprintf("Server received request from client %s (type=%s) with %d items", clientName, reqType, len(arr))
+	messages = append(messages, received)
+	events := []causal.Event{clock.Receive(r.Header, received)}
 
 	// Process each item concurrently using goroutines.
 	ch := make(chan resultBool, len(arr))
@@ -486,7 +554,7 @@ func ex14ArrayHandler(w http.ResponseWriter, r *http.Request) {
 	wg.Add(len(arr))
 
 	for i, s := range arr {
-		go ex14ProcessString(s, i, &wg, ch)
+		runItem(r, func() { ex14ProcessString(s, i, &wg, ch) })
 	}
 
 	// Wait for all workers to finish then close the channel and collect results.
@@ -506,29 +574,615 @@ func ex14ArrayHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	messages = append(messages, fmt.Sprintf("Server sends response to client %s", clientName))
+	sent := fmt.Sprintf("Server sends response to client %s", clientName)
+	messages = append(messages, sent)
+	events = append(events, clock.Send(w.Header(), sent))
 
 	// Write back the response (including messages)
 	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": res, "messages": messages}
+	resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": res, "messages": messages, "events": events}
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 		return
 	}
 }
 
+// exerciseResult recomputes the RESULT field of an exercise from the
+// merged per-item values, mirroring the exercise handlers above.
+func exerciseResult(exercise string, arr []string, processed []json.RawMessage) (interface{}, error) {
+	switch exercise {
+	case "ex2", "ex9":
+		trueCount := 0
+		for _, raw := range processed {
+			var v bool
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return nil, err
+			}
+			if v {
+				trueCount++
+			}
+		}
+		return trueCount, nil
+	case "ex5":
+		var result []int
+		for _, raw := range processed {
+			var v int
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return nil, err
+			}
+			if v != -1 {
+				result = append(result, v)
+			}
+		}
+		return result, nil
+	case "ex7":
+		return "No result value given by the exercise", nil
+	case "ex14":
+		var res []string
+		for i, raw := range processed {
+			var v bool
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return nil, err
+			}
+			if v {
+				res = append(res, arr[i])
+			}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unknown exercise %q", exercise)
+}
+
+// coordinatorHandler serves an exercise in coordinator mode: the array is
+// sharded across the workers and the results merged back in order, within
+// timeout.
+func coordinatorHandler(coord *cluster.Coordinator, exercise string, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		var arr []string
+		if err := json.Unmarshal(body, &arr); err != nil {
+			http.Error(w, "invalid json: expected array of strings", http.StatusBadRequest)
+			return
+		}
+
+		clientName := ratelimit.ClientName(r)
+		reqType := r.Header.Get("X-Request-Type")
+		if reqType == "" {
+			reqType = r.Method
+		}
+
+		messages := []string{}
+		received := fmt.Sprintf("Coordinator received request from client %s (type=%s) with %d items", clientName, reqType, len(arr))
+		messages = append(messages, received)
+		events := []causal.Event{clock.Receive(r.Header, received)}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		processed, shards, err := coord.Process(ctx, exercise, arr, r.Header)
+		if err != nil {
+			http.Error(w, "coordinator: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		for _, sh := range shards {
+			messages = append(messages, fmt.Sprintf("Coordinator sent %s to worker %s (attempts=%d)", sh.Describe(), sh.Worker, sh.Attempts))
+		}
+
+		result, err := exerciseResult(exercise, arr, processed)
+		if err != nil {
+			http.Error(w, "coordinator: invalid worker result: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		sent := fmt.Sprintf("Coordinator sends response to client %s", clientName)
+		messages = append(messages, sent)
+		events = append(events, clock.Send(w.Header(), sent))
+
+		w.Header().Set("Content-Type", "application/json")
+		resp := map[string]interface{}{"original": arr, "processed": processed, "count": len(arr), "RESULT": result, "messages": messages, "events": events}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// routedHandler processes shards forwarded by another node locally and
+// spreads every other request across the cluster.
+func routedHandler(local, spread http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(cluster.ForwardedHeader) != "" {
+			local(w, r)
+			return
+		}
+		spread(w, r)
+	}
+}
+
+// shardOrClient serves shard requests forwarded by a coordinator with shard
+// and all others with client. Shards skip the rate limiter: their request
+// was counted when the coordinator received it. Only a node that takes
+// shards (worker is set) serves them, and only when they are signed with
+// the cluster key; they keep the client name the coordinator forwarded,
+// not the key's. Any other request claiming to be a shard loses the claim
+// and goes through the client chain.
+func shardOrClient(authenticator *auth.Authenticator, clusterKey string, worker bool, shard, client http.Handler) http.Handler {
+	asClient := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(cluster.ForwardedHeader)
+		client.ServeHTTP(w, r)
+	})
+	if authenticator == nil {
+		return asClient
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get("X-Client-Name")
+		authenticator.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !worker || clusterKey == "" || r.Header.Get(cluster.ForwardedHeader) == "" || r.Header.Get(auth.HeaderKeyID) != clusterKey {
+				asClient(w, r)
+				return
+			}
+			r.Header.Set("X-Client-Name", name)
+			shard.ServeHTTP(w, r)
+		})).ServeHTTP(w, r)
+	})
+}
+
+// clusterOnly wraps handlers that only other cluster nodes may call. With
+// authentication on, their requests must be signed with the cluster key;
+// without it they are taken at their word, like forwarded shards.
+func clusterOnly(authenticator *auth.Authenticator, clusterKey string) func(http.HandlerFunc) http.Handler {
+	return func(h http.HandlerFunc) http.Handler {
+		if authenticator == nil {
+			return h
+		}
+		return authenticator.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if clusterKey == "" || r.Header.Get(auth.HeaderKeyID) != clusterKey {
+				http.Error(w, "cluster requests must be signed with the cluster key", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+		}))
+	}
+}
+
+// withoutToken drops the fencing token of a client request: only the
+// shards of a coordinator may carry one.
+func withoutToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(lease.TokenHeader)
+		next(w, r)
+	}
+}
+
+// adminOnly guards the /admin endpoints. With authentication on, their
+// requests must be signed with the cluster key, like cluster requests;
+// without it they are served only to the local machine.
+func adminOnly(authenticator *auth.Authenticator, clusterKey string) func(http.HandlerFunc) http.Handler {
+	if authenticator != nil {
+		return clusterOnly(authenticator, clusterKey)
+	}
+	return func(h http.HandlerFunc) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+				http.Error(w, "admin endpoints are served only to localhost without -auth-keys", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+		})
+	}
+}
+
+// leaderOnly serves an exercise only while this instance holds the
+// coordinator lease; standby coordinators answer 503. The fencing token
+// the request was admitted under goes with it in its context, so every
+// shard it leads to carries that token even if the lease changes hands.
+func leaderOnly(elector *lease.Elector, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, token := elector.Leader()
+		if !ok {
+			if holder := elector.Holder(); holder != "" {
+				w.Header().Set("X-Lease-Holder", holder)
+			}
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "not the active coordinator", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r.WithContext(lease.WithToken(r.Context(), token)))
+	}
+}
+
 func main() {
+	clientRate := flag.Float64("client-rate", 0, "requests per second allowed per X-Client-Name (0 = unlimited)")
+	clientBurst := flag.Int("client-burst", 5, "token bucket size per X-Client-Name")
+	ipRate := flag.Float64("ip-rate", 0, "requests per second allowed per remote IP (0 = unlimited)")
+	ipBurst := flag.Int("ip-burst", 10, "token bucket size per remote IP")
+	chaosSeed := flag.Int64("chaos-seed", 1, "seed for the fault injection configured at /admin/chaos")
+	authKeys := flag.String("auth-keys", "", "key registry file; when set, exercise requests must be HMAC-signed")
+	authSkew := flag.Duration("auth-skew", 5*time.Minute, "maximum allowed clock skew for signed requests")
+	clusterKey := flag.String("cluster-key", "", "key ID in -auth-keys that cluster nodes sign forwarded shards, heartbeats, Raft and 2PC messages with; workers and peers take shards only when signed with it")
+	tlsCert := flag.String("tls-cert", "", "server certificate (PEM); enables HTTPS together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "server private key (PEM)")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA for client certificates; enables mutual TLS")
+	schedPolicy := flag.String("sched", "", "per-item scheduling policy: fifo or drr (empty = one goroutine per item)")
+	schedWorkers := flag.Int("sched-workers", 4, "number of scheduler workers")
+	schedWeights := flag.String("sched-weights", "", "DRR weights per client, e.g. Alice=2,Dan=1")
+	addr := flag.String("addr", ":8080", "listen address")
+	mode := flag.String("mode", "standalone", "server role: standalone, worker, coordinator or peer")
+	workers := flag.String("workers", "", "coordinator mode: comma-separated worker URLs, e.g. http://localhost:8081,http://localhost:8082")
+	shardSize := flag.Int("shard-size", 4, "coordinator/peer mode: maximum items per shard")
+	coordTimeout := flag.Duration("coord-timeout", 10*time.Second, "coordinator/peer mode: time allowed for a sharded request, retries included")
+	routing := flag.String("routing", "shard", "coordinator/peer mode: shard (contiguous shards) or hash (consistent hashing per item)")
+	vnodes := flag.Int("vnodes", 64, "hash routing: virtual nodes per server on the ring")
+	cacheSize := flag.Int("cache-size", 10000, "worker/peer mode: exercise results cached for forwarded shards (0 = no cache)")
+	suspectAfter := flag.Duration("suspect-after", 3*time.Second, "coordinator mode: mark a worker suspect after this long without a heartbeat")
+	deadAfter := flag.Duration("dead-after", 10*time.Second, "coordinator mode: mark a worker dead after this long without a heartbeat")
+	leaseStore := flag.String("lease-store", "", "lease store for coordinator leader election, file:DIR or a lease KV URL (empty = always active); workers given one reject forwarded shards without a fencing token")
+	leaseName := flag.String("lease-name", "coordinator", "coordinator mode: name of the lease to compete for")
+	leaseTTL := flag.Duration("lease-ttl", 3*time.Second, "coordinator mode: how long a lease lasts without renewal")
+	coordinatorURL := flag.String("coordinator", "", "worker mode: coordinator URL to register with, e.g. http://localhost:8080")
+	advertise := flag.String("advertise", "", "worker/peer mode: URL other nodes use to reach this server (default http://localhost<addr>)")
+	nodeID := flag.String("id", "", "node ID used for cluster membership, the coordinator lease and message clocks, which add a per-run suffix (default the advertised URL)")
+	tracePath := flag.String("trace", "", "append Lamport/vector clock events of every message to this JSONL file (see hbgraph)")
+	heartbeat := flag.Duration("heartbeat", time.Second, "worker mode: heartbeat interval")
+	gossipAddr := flag.String("gossip-addr", ":7946", "peer mode: UDP address for the gossip protocol")
+	seeds := flag.String("seeds", "", "peer mode: comma-separated gossip addresses of nodes to join through")
+	raftID := flag.String("raft-id", "", "Raft node ID; enables the replicated job log (requires -raft-peers)")
+	raftPeers := flag.String("raft-peers", "", "Raft cluster as id=url pairs, e.g. n1=http://localhost:8080,n2=http://localhost:8081,n3=http://localhost:8082")
+	raftDir := flag.String("raft-dir", ".", "directory for the Raft log and snapshot files")
+	raftSnapshot := flag.Uint64("raft-snapshot", 100, "log entries applied between Raft snapshots")
+	txDir := flag.String("2pc-dir", "", "directory for two-phase commit logs; enables /2pc/submit and the participant endpoints")
+	txParticipants := flag.String("2pc-participants", "", "comma-separated URLs of the servers /2pc/submit may name as participants (default this server)")
+	txCrash := flag.String("2pc-crash-after", "", "exit after a 2PC coordinator phase (prepare or decision), to demonstrate recovery")
+	flag.Parse()
+
+	limiter := ratelimit.New(ratelimit.Config{
+		ClientRate:  *clientRate,
+		ClientBurst: *clientBurst,
+		IPRate:      *ipRate,
+		IPBurst:     *ipBurst,
+	})
+
+	var authenticator *auth.Authenticator
+	var shardKey *auth.Key // signs the shards this node forwards
+	if *authKeys != "" {
+		reg, err := auth.LoadRegistry(*authKeys)
+		if err != nil {
+			log.Fatalf("failed to load %s: %v", *authKeys, err)
+		}
+		authenticator = auth.NewAuthenticator(reg, *authSkew)
+		if *clusterKey != "" {
+			k, ok := reg.Lookup(*clusterKey)
+			if !ok {
+				log.Fatalf("cluster key %s not found in %s", *clusterKey, *authKeys)
+			}
+			shardKey = &k
+		}
+	}
+
+	// The /admin endpoints change how every client is served.
+	admin := adminOnly(authenticator, *clusterKey)
+
+	if *schedPolicy != "" {
+		policy, err := sched.ParsePolicy(*schedPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		weights, err := sched.ParseWeights(*schedWeights)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scheduler = sched.New(*schedWorkers, policy, weights)
+		http.Handle("/admin/scheduler", admin(scheduler.AdminHandler))
+	}
+
+	// exercise wraps an exercise handler with the request middleware chain.
+	// Identity (API key, then client certificate, which takes precedence)
+	// is established first so the rate limiter sees the verified client name.
+	// Shards forwarded by a coordinator take a shorter chain on the nodes
+	// that take shards, see shardOrClient.
+	// The fence rejects shards from a coordinator whose lease has been taken
+	// over; when coordinators are elected by lease, shards without a
+	// fencing token are rejected too. Only authenticated shards reach it:
+	// a token sent by a client could fence out the real coordinator, so
+	// client requests lose theirs.
+	fence := &lease.Fence{}
+	if *leaseStore != "" {
+		fence.Required = func(r *http.Request) bool { return r.Header.Get(cluster.ForwardedHeader) != "" }
+	}
+	// Faults for testing client retries; none until rules are set at /admin/chaos.
+	injector := chaos.New(*chaosSeed)
+	takesShards := *mode == "worker" || *mode == "peer"
+	exercise := func(h http.HandlerFunc) http.Handler {
+		client := tlsutil.PeerIdentity(injector.Wrap(limiter.Wrap(withoutToken(h))))
+		shard := injector.Wrap(fence.Wrap(h))
+		return shardOrClient(authenticator, *clusterKey, takesShards, shard, client)
+	}
+
+	exercises := map[string]http.HandlerFunc{
+		"ex2":  ex2ArrayHandler,
+		"ex5":  ex5ArrayHandler,
+		"ex7":  ex7ArrayHandler,
+		"ex9":  ex9ArrayHandler,
+		"ex14": ex14ArrayHandler,
+	}
+
+	// Workers cache the per-item results of the shards they are sent; hash
+	// routing sends repeated items to the same worker to make use of it.
+	if *cacheSize > 0 {
+		cache := cluster.NewResultCache(*cacheSize)
+		for name, h := range exercises {
+			exercises[name] = cache.Wrap(name, h).ServeHTTP
+		}
+		http.Handle("/admin/cache", admin(cache.Handler))
+	}
+
+	if *routing != "shard" && *routing != "hash" {
+		log.Fatalf("unknown routing %q", *routing)
+	}
+	// newCoordinator builds the coordinator used by coordinator and peer modes.
+	newCoordinator := func(workers []string) *cluster.Coordinator {
+		coord := cluster.NewCoordinator(workers, *shardSize)
+		coord.Client.Transport = clock.Transport(nil)
+		if shardKey != nil {
+			coord.Sign = func(req *http.Request, body []byte) { auth.Sign(req, *shardKey, body) }
+		}
+		if *routing == "hash" {
+			coord.EnableRing(*vnodes)
+			http.HandleFunc("/cluster/ring", coord.RingHandler)
+		}
+		return coord
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// shutdown is closed once background cluster work has finished after an
+	// interrupt, so the server can be closed.
+	shutdown := make(chan struct{})
+
+	self := *advertise
+	if self == "" {
+		self = "http://localhost" + *addr
+	}
+	id := *nodeID
+	if id == "" {
+		id = self
+	}
+
+	var trace io.Writer
+	if *tracePath != "" {
+		f, err := causal.OpenTrace(*tracePath)
+		if err != nil {
+			log.Fatalf("failed to open trace: %v", err)
+		}
+		defer f.Close()
+		trace = f
+	}
+	// Restarts append to the same trace, so every run is its own process.
+	clock = causal.NewClock(causal.RunName(id), trace)
+	// peerOnly guards the endpoints other nodes call and records their
+	// messages, whose senders stamp them with clock.Transport.
+	peerOnly := func(h http.HandlerFunc) http.Handler {
+		return clusterOnly(authenticator, *clusterKey)(clock.Handler(h).ServeHTTP)
+	}
+
+	switch *mode {
+	case "standalone":
+		close(shutdown)
+	case "worker":
+		if *coordinatorURL == "" {
+			close(shutdown)
+			break
+		}
+		hb := &cluster.Heartbeater{
+			Coordinator: *coordinatorURL,
+			Self:        cluster.Heartbeat{ID: id, URL: self},
+			Interval:    *heartbeat,
+			InFlight:    func() int { return int(inFlight.Load()) },
+			Client:      &http.Client{Timeout: 2 * time.Second, Transport: clock.Transport(nil)},
+		}
+		if shardKey != nil {
+			hb.Sign = func(req *http.Request, body []byte) { auth.Sign(req, *shardKey, body) }
+		}
+		go func() {
+			hb.Run(ctx)
+			close(shutdown)
+		}()
+	case "coordinator":
+		static := strings.Split(*workers, ",")
+		coord := newCoordinator(static)
+		members := cluster.NewMembership(*suspectAfter, *deadAfter)
+		members.OnChange = func(alive []string) {
+			coord.SetWorkers(append(append([]string(nil), static...), alive...))
+		}
+		members.Register(http.DefaultServeMux, peerOnly)
+		go members.Run(*suspectAfter/3, ctx.Done())
+		for name := range exercises {
+			exercises[name] = coordinatorHandler(coord, name, *coordTimeout)
+		}
+		if *leaseStore == "" {
+			close(shutdown)
+			break
+		}
+		kv, err := lease.OpenKV(*leaseStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		elector := lease.NewElector(kv, *leaseName, id, *leaseTTL)
+		coord.Stamp = func(ctx context.Context, header http.Header) error {
+			token, ok := lease.TokenFrom(ctx)
+			if !ok {
+				return errors.New("no fencing token: request was not admitted as lease holder")
+			}
+			header.Set(lease.TokenHeader, strconv.FormatUint(token, 10))
+			return nil
+		}
+		for name, h := range exercises {
+			exercises[name] = leaderOnly(elector, h)
+		}
+		go func() {
+			elector.Run(ctx)
+			close(shutdown)
+		}()
+	case "peer":
+		// A peer forwards shards to itself too; unless they can be told
+		// from client requests it would spread them again forever.
+		if shardKey == nil {
+			log.Fatal("peer mode needs -auth-keys and -cluster-key to sign the shards peers forward")
+		}
+		coord := newCoordinator([]string{self})
+		node, err := gossip.Start(gossip.Config{
+			ID:       id,
+			BindAddr: *gossipAddr,
+			Meta:     self,
+			Seeds:    strings.Split(*seeds, ","),
+			Stamp:    func(h http.Header, what string) { clock.Send(h, clock.Process()+" sends "+what) },
+			Observe:  func(h http.Header, what string) { clock.Receive(h, clock.Process()+" receives "+what) },
+			OnChange: func(alive []gossip.Member) {
+				urls := make([]string, 0, len(alive))
+				for _, m := range alive {
+					urls = append(urls, m.Meta)
+				}
+				coord.SetWorkers(urls)
+			},
+		})
+		if err != nil {
+			log.Fatalf("failed to start gossip: %v", err)
+		}
+		http.HandleFunc("/cluster/gossip", node.Handler)
+		for name, local := range exercises {
+			exercises[name] = routedHandler(local, coordinatorHandler(coord, name, *coordTimeout))
+		}
+		go func() {
+			<-ctx.Done()
+			node.Leave()
+			close(shutdown)
+		}()
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+
+	if *raftID != "" {
+		peers, err := raft.ParsePeers(*raftPeers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := peers[*raftID]; !ok {
+			log.Fatalf("-raft-peers must include -raft-id %s", *raftID)
+		}
+		ids := make([]string, 0, len(peers))
+		for peerID := range peers {
+			ids = append(ids, peerID)
+		}
+
+		jobs := joblog.NewLog()
+		recorder := joblog.NewRecorder(jobs, peers)
+		recorder.Client.Transport = clock.Transport(nil)
+		transport := raft.NewHTTPTransport(peers)
+		transport.Client.Transport = clock.Transport(nil)
+		if shardKey != nil {
+			transport.Sign = func(req *http.Request, body []byte) { auth.Sign(req, *shardKey, body) }
+		}
+		node, err := raft.New(raft.Config{
+			ID:                *raftID,
+			Peers:             ids,
+			Transport:         transport,
+			Storage:           raft.NewFileStorage(filepath.Join(*raftDir, "raft-"+*raftID+".log")),
+			StateMachine:      jobs,
+			SnapshotThreshold: *raftSnapshot,
+			OnLeader:          func(uint64) { recorder.Recover() },
+		})
+		if err != nil {
+			log.Fatalf("failed to start raft: %v", err)
+		}
+		recorder.Node = node
+		node.Start()
+		raft.Register(http.DefaultServeMux, node, peerOnly)
+		http.HandleFunc("/raft/jobs", recorder.JobsHandler)
+		for name, h := range exercises {
+			exercises[name] = recorder.Wrap(name, h).ServeHTTP
+		}
+	}
+
+	if *txDir != "" {
+		if err := os.MkdirAll(*txDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+		handlers := make(map[string]http.Handler, len(exercises))
+		for name, h := range exercises {
+			handlers[name] = h
+		}
+		participant, err := twopc.NewParticipant(*txDir, handlers)
+		if err != nil {
+			log.Fatalf("failed to open 2pc participant log: %v", err)
+		}
+		participant.Client.Transport = clock.Transport(nil)
+		participant.Register(http.DefaultServeMux, peerOnly)
+		go participant.Run(ctx)
+
+		txCoord, err := twopc.NewCoordinator(*txDir, self)
+		if err != nil {
+			log.Fatalf("failed to open 2pc coordinator log: %v", err)
+		}
+		txCoord.CrashAfter = *txCrash
+		txCoord.Client.Transport = clock.Transport(nil)
+		txCoord.Participants = []string{self}
+		if *txParticipants != "" {
+			txCoord.Participants = strings.Split(*txParticipants, ",")
+		}
+		if shardKey != nil {
+			txCoord.Sign = func(req *http.Request, body []byte) { auth.Sign(req, *shardKey, body) }
+		}
+		txCoord.Register(http.DefaultServeMux, exercise)
+		go txCoord.Run(ctx)
+	}
+
 	http.HandleFunc("/", helloHandler)
-	http.HandleFunc("/ex2", ex2ArrayHandler)
-	http.HandleFunc("/ex5", ex5ArrayHandler)
-	http.HandleFunc("/ex7", ex7ArrayHandler)
-	http.HandleFunc("/ex9", ex9ArrayHandler)
-	http.HandleFunc("/ex14", ex14ArrayHandler)
+	for name, h := range exercises {
+		http.Handle("/"+name, exercise(h))
+	}
+	http.Handle("/admin/ratelimit", admin(limiter.AdminHandler))
+	http.Handle("/admin/chaos", admin(injector.AdminHandler))
 
 	srv := &http.Server{
-		Addr:         ":8080",
+		Addr:         *addr,
 		Handler:      nil, // default mux
 		ReadTimeout:  2 * time.Second,
 		WriteTimeout: 4 * time.Second}
-	log.Fatal(srv.ListenAndServe())
+	if *mode == "coordinator" || *mode == "peer" {
+		// Leave time to answer once sharding has given up.
+		srv.WriteTimeout = *coordTimeout + 2*time.Second
+	}
+
+	go func() {
+		<-ctx.Done()
+		<-shutdown
+		srv.Close()
+	}()
+
+	var err error
+	if *tlsCert != "" || *tlsKey != "" {
+		cfg, cfgErr := tlsutil.ServerConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if cfgErr != nil {
+			log.Fatalf("failed to configure TLS: %v", cfgErr)
+		}
+		srv.TLSConfig = cfg
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 }
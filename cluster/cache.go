@@ -0,0 +1,179 @@
+package cluster
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/liviu274/Distributed-systems/httpbuf"
+)
+
+// CacheHitsHeader reports on a shard response how many items were served
+// from the worker's result cache.
+const CacheHitsHeader = "X-Cache-Hits"
+
+// ResultCache remembers the processed value of (exercise, item) pairs on a
+// worker, evicting the least recently used beyond its size. Exercise
+// results depend only on the item, and hash routing sends an item to the
+// same worker every time, so repeated items are not processed again.
+type ResultCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // front is most recent
+	hits    int
+	misses  int
+}
+
+type cacheEntry struct {
+	key   string
+	value json.RawMessage
+}
+
+// NewResultCache returns a cache holding up to size items.
+func NewResultCache(size int) *ResultCache {
+	return &ResultCache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+func cacheKey(exercise, item string) string { return exercise + "\x00" + item }
+
+// get returns the cached value of item.
+func (c *ResultCache) get(exercise, item string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKey(exercise, item)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true
+}
+
+// put caches the value of item.
+func (c *ResultCache) put(exercise, item string, value json.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(exercise, item)
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry).value = value
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: value})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Wrap serves shard requests for exercise from the cache where it can:
+// only the items not cached are passed to next, and the values it
+// returns are cached. The response holds the original items, the merged
+// processed values and the count; the other fields of next's response
+// describe only the items it processed. Requests that are not forwarded
+// shards go straight to next.
+func (c *ResultCache) Wrap(exercise string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ForwardedHeader) == "" || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		var items []string
+		if err != nil || json.Unmarshal(body, &items) != nil {
+			// Let the exercise handler report the bad request.
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		processed := make([]json.RawMessage, len(items))
+		var missing []int
+		for i, item := range items {
+			if v, ok := c.get(exercise, item); ok {
+				processed[i] = v
+			} else {
+				missing = append(missing, i)
+			}
+		}
+
+		resp := map[string]json.RawMessage{}
+		if len(missing) > 0 {
+			batch := make([]string, len(missing))
+			for j, i := range missing {
+				batch[j] = items[i]
+			}
+			data, _ := json.Marshal(batch)
+			sub := r.Clone(r.Context())
+			sub.Body = io.NopCloser(bytes.NewReader(data))
+			sub.ContentLength = int64(len(data))
+			out := httpbuf.Serve(next, sub)
+			for k, v := range out.Header() {
+				w.Header()[k] = v
+			}
+			var values []json.RawMessage
+			if out.Code != http.StatusOK || json.Unmarshal(out.Body.Bytes(), &resp) != nil ||
+				json.Unmarshal(resp["processed"], &values) != nil || len(values) != len(batch) {
+				// Pass failures through untouched.
+				w.WriteHeader(out.Code)
+				w.Write(out.Body.Bytes())
+				return
+			}
+			for j, i := range missing {
+				processed[i] = values[j]
+				c.put(exercise, items[i], values[j])
+			}
+		}
+
+		resp["original"], _ = json.Marshal(items)
+		resp["processed"], _ = json.Marshal(processed)
+		resp["count"], _ = json.Marshal(len(items))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(CacheHitsHeader, strconv.Itoa(len(items)-len(missing)))
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// CacheStats is the state of a ResultCache.
+type CacheStats struct {
+	Items  int `json:"items"`
+	Size   int `json:"size"`
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+}
+
+// Stats returns the number of cached items and the hits and misses so far.
+func (c *ResultCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Items: c.lru.Len(), Size: c.size, Hits: c.hits, Misses: c.misses}
+}
+
+// Handler serves Stats as JSON on GET and empties the cache on DELETE.
+func (c *ResultCache) Handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		c.mu.Lock()
+		c.entries = make(map[string]*list.Element)
+		c.lru.Init()
+		c.hits, c.misses = 0, 0
+		c.mu.Unlock()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.Stats()); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// upper is an exercise handler returning every item in upper case.
+func upper(calls *atomic.Int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var items []string
+		json.NewDecoder(r.Body).Decode(&items)
+		calls.Add(int64(len(items)))
+		out := make([]string, len(items))
+		for i, s := range items {
+			out[i] = strings.ToUpper(s)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"processed": out, "RESULT": len(items)})
+	})
+}
+
+func shard(t *testing.T, h http.Handler, items ...string) (processed []string, hits string) {
+	t.Helper()
+	data, _ := json.Marshal(items)
+	req := httptest.NewRequest(http.MethodPost, "/ex", strings.NewReader(string(data)))
+	req.Header.Set(ForwardedHeader, "1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Processed []string `json:"processed"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Processed, rec.Header().Get(CacheHitsHeader)
+}
+
+func TestResultCacheWrap(t *testing.T) {
+	var calls atomic.Int64
+	cache := NewResultCache(3)
+	h := cache.Wrap("ex", upper(&calls))
+
+	steps := []struct {
+		items     []string
+		want      string
+		hits      string
+		processed int64 // items the handler saw
+	}{
+		{[]string{"a", "b"}, "A B", "0", 2},
+		{[]string{"b", "c", "a"}, "B C A", "2", 1},
+		{[]string{"d"}, "D", "0", 1}, // evicts b, the least recently used
+		{[]string{"a", "b"}, "A B", "1", 1},
+	}
+	for i, st := range steps {
+		before := calls.Load()
+		got, hits := shard(t, h, st.items...)
+		if strings.Join(got, " ") != st.want || hits != st.hits || calls.Load()-before != st.processed {
+			t.Errorf("step %d: got %v hits %s processed %d; want %s hits %s processed %d",
+				i, got, hits, calls.Load()-before, st.want, st.hits, st.processed)
+		}
+	}
+}
+
+func TestResultCachePassesClientRequests(t *testing.T) {
+	var calls atomic.Int64
+	cache := NewResultCache(10)
+	h := cache.Wrap("ex", upper(&calls))
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/ex", strings.NewReader(`["a"]`))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body, _ := io.ReadAll(rec.Body)
+		if !strings.Contains(string(body), `"RESULT":1`) {
+			t.Fatalf("client response changed: %s", body)
+		}
+	}
+	if calls.Load() != 2 || cache.Stats().Items != 0 {
+		t.Fatalf("client requests were cached: calls %d, stats %+v", calls.Load(), cache.Stats())
+	}
+}
+
+func TestProcessRingRetriesOnNeighbour(t *testing.T) {
+	var calls atomic.Int64
+	good := httptest.NewServer(upper(&calls))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	c := NewCoordinator([]string{good.URL, bad.URL}, 4)
+	c.EnableRing(16)
+	items := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	processed, shards, err := c.Process(t.Context(), "ex", items, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, raw := range processed {
+		var v string
+		json.Unmarshal(raw, &v)
+		if v != strings.ToUpper(items[i]) {
+			t.Fatalf("item %d = %q", i, v)
+		}
+	}
+	for _, sh := range shards {
+		if sh.Worker != good.URL {
+			t.Fatalf("shard %s reported on failed worker %s", sh.Describe(), sh.Worker)
+		}
+		// Items first sent to the failed worker are on their second attempt.
+		for _, i := range sh.Items {
+			owner := c.ring.GetN("ex\x00"+items[i], 2)[0]
+			want := 1
+			if owner == bad.URL {
+				want = 2
+			}
+			if sh.Attempts != want {
+				t.Fatalf("item %d in shard with attempts %d, want %d", i, sh.Attempts, want)
+			}
+		}
+	}
+}
+
+func TestStampFailureSendsNothing(t *testing.T) {
+	var calls atomic.Int64
+	w := httptest.NewServer(upper(&calls))
+	defer w.Close()
+
+	c := NewCoordinator([]string{w.URL}, 2)
+	c.Stamp = func(ctx context.Context, header http.Header) error { return errors.New("no token") }
+	if _, _, err := c.Process(t.Context(), "ex", []string{"a", "b", "c"}, http.Header{}); err == nil {
+		t.Fatal("Process succeeded without a stamp")
+	}
+	if calls.Load() != 0 {
+		t.Fatalf("worker processed %d items", calls.Load())
+	}
+}
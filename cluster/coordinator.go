@@ -0,0 +1,376 @@
+// Package cluster spreads the items of an exercise request over several
+// exercise server instances. A coordinator splits the incoming array into
+// shards, forwards each shard to a worker (the same server binary running
+// in worker mode) and merges the per-item results back in order.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/hashring"
+)
+
+// ForwardedHeader marks shard requests sent by a coordinator, so a node
+// that is both coordinator and worker processes them locally instead of
+// sharding them again.
+const ForwardedHeader = "X-Cluster-Forwarded"
+
+// forwardedHeaders are copied from the client request onto shard requests.
+var forwardedHeaders = []string{"X-Client-Name", "X-Request-Type", "X-Priority"}
+
+// Coordinator forwards shards of exercise requests to workers.
+type Coordinator struct {
+	// ShardSize is the maximum number of items per shard.
+	ShardSize int
+	// Client sends shard requests.
+	Client *http.Client
+	// AttemptTimeout bounds each attempt at a shard (3s by default). When
+	// the request context has a deadline, an attempt gets at most an equal
+	// share of the time left among the attempts still possible, so a hung
+	// worker leaves time to retry on the others.
+	AttemptTimeout time.Duration
+	// Stamp, if set, adds headers to every shard request of a Process
+	// call, such as the fencing token the request was admitted under. It
+	// gets the context passed to Process; if it fails, no shard is sent.
+	Stamp func(ctx context.Context, header http.Header) error
+	// Sign, if set, authenticates every shard request with its body, such
+	// as with auth.Sign and the cluster key.
+	Sign func(req *http.Request, body []byte)
+
+	mu        sync.RWMutex
+	workers   []string
+	next      atomic.Uint64
+	ring      *hashring.Ring
+	lastStats hashring.Stats
+}
+
+// NewCoordinator returns a coordinator for the given worker base URLs
+// (e.g. http://localhost:8081).
+func NewCoordinator(workers []string, shardSize int) *Coordinator {
+	if shardSize < 1 {
+		shardSize = 1
+	}
+	c := &Coordinator{
+		ShardSize:      shardSize,
+		Client:         &http.Client{},
+		AttemptTimeout: 3 * time.Second,
+	}
+	c.SetWorkers(workers)
+	return c
+}
+
+// SetWorkers replaces the worker list. Empty and repeated URLs are dropped.
+func (c *Coordinator) SetWorkers(workers []string) {
+	list := make([]string, 0, len(workers))
+	seen := make(map[string]bool)
+	for _, w := range workers {
+		if w = strings.TrimRight(strings.TrimSpace(w), "/"); w != "" && !seen[w] {
+			seen[w] = true
+			list = append(list, w)
+		}
+	}
+	c.mu.Lock()
+	c.workers = list
+	if c.ring != nil {
+		c.lastStats = c.ring.Set(list)
+	}
+	c.mu.Unlock()
+}
+
+// EnableRing switches the coordinator from contiguous shards to
+// consistent-hash routing: each item goes to the worker owning
+// hash(exercise, item) on a ring with vnodes points per worker, so repeated
+// items always land on the same worker.
+func (c *Coordinator) EnableRing(vnodes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ring = hashring.New(vnodes)
+	c.lastStats = c.ring.Set(c.workers)
+}
+
+// RingHandler serves the ring's nodes, ownership shares and the statistics
+// of the last rebalance as JSON.
+func (c *Coordinator) RingHandler(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	ring, stats := c.ring, c.lastStats
+	c.mu.RUnlock()
+	if ring == nil {
+		http.Error(w, "consistent-hash routing is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"nodes": ring.Nodes(), "ownership": ring.Ownership(), "last_rebalance": stats}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// Workers returns the current worker list.
+func (c *Coordinator) Workers() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.workers...)
+}
+
+// Shard is a group of items sent to one worker: either the contiguous
+// range [Start, End) of the original array or, with consistent-hash
+// routing, the item indices in Items.
+type Shard struct {
+	Start, End int
+	Items      []int
+	Worker     string // worker that processed the shard
+	Attempts   int
+	Cached     int // items the worker served from its result cache
+}
+
+// Describe returns a short human-readable description of the shard's items.
+func (s Shard) Describe() string {
+	desc := fmt.Sprintf("items %d-%d", s.Start, s.End-1)
+	if s.Items != nil {
+		desc = fmt.Sprintf("%d items %v", len(s.Items), s.Items)
+	}
+	if s.Cached > 0 {
+		desc += fmt.Sprintf(", %d cached", s.Cached)
+	}
+	return desc
+}
+
+// shardResponse is the subset of an exercise response the coordinator needs.
+type shardResponse struct {
+	Processed []json.RawMessage `json:"processed"`
+}
+
+// Process runs exercise (e.g. "ex2") over items on the workers and returns
+// the per-item processed values in the original order, together with the
+// shards as they were finally assigned. A shard whose worker fails is
+// retried on the next worker until every worker has been tried.
+func (c *Coordinator) Process(ctx context.Context, exercise string, items []string, header http.Header) ([]json.RawMessage, []Shard, error) {
+	workers := c.Workers()
+	if len(workers) == 0 {
+		return nil, nil, errors.New("no workers available")
+	}
+	header, err := c.shardHeader(ctx, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.RLock()
+	ring := c.ring
+	c.mu.RUnlock()
+	if ring != nil {
+		return c.processRing(ctx, ring, exercise, items, header)
+	}
+
+	var shards []Shard
+	for start := 0; start < len(items); start += c.ShardSize {
+		end := start + c.ShardSize
+		if end > len(items) {
+			end = len(items)
+		}
+		shards = append(shards, Shard{Start: start, End: end})
+	}
+
+	processed := make([]json.RawMessage, len(items))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	wg.Add(len(shards))
+	for i := range shards {
+		go func(sh *Shard, errp *error) {
+			defer wg.Done()
+			first := int(c.next.Add(1))
+			for attempt := 0; attempt < len(workers); attempt++ {
+				worker := workers[(first+attempt)%len(workers)]
+				sh.Worker = worker
+				sh.Attempts = attempt + 1
+				actx, cancel := c.attemptContext(ctx, len(workers)-attempt)
+				out, cached, err := c.send(actx, worker, exercise, items[sh.Start:sh.End], header)
+				cancel()
+				if err == nil {
+					sh.Cached = cached
+					copy(processed[sh.Start:sh.End], out)
+					*errp = nil
+					return
+				}
+				*errp = err
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}(&shards[i], &errs[i])
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, shards, fmt.Errorf("shard %d (items %d-%d): %w", i, shards[i].Start, shards[i].End-1, err)
+		}
+	}
+	return processed, shards, nil
+}
+
+// processRing routes every item to the owner of hash(exercise, item), whose
+// result cache is then likely to hold it. Items whose owner fails move to
+// the next distinct node on the ring, so a failed worker's share is spread
+// over its ring neighbours. Items are grouped by worker and attempt, so
+// every shard reports the attempt its items are at.
+func (c *Coordinator) processRing(ctx context.Context, ring *hashring.Ring, exercise string, items []string, header http.Header) ([]json.RawMessage, []Shard, error) {
+	nodes := len(ring.Nodes())
+	owners := make([][]string, len(items))
+	attempt := make([]int, len(items))
+	pending := make([]int, len(items))
+	for i, item := range items {
+		owners[i] = ring.GetN(exercise+"\x00"+item, nodes)
+		pending[i] = i
+	}
+
+	processed := make([]json.RawMessage, len(items))
+	var shards []Shard
+	type group struct {
+		worker  string
+		attempt int
+	}
+	for len(pending) > 0 {
+		groups := map[group][]int{}
+		var order []group
+		for _, i := range pending {
+			if attempt[i] >= len(owners[i]) {
+				return nil, shards, fmt.Errorf("item %d: all %d workers failed", i, len(owners[i]))
+			}
+			g := group{owners[i][attempt[i]], attempt[i]}
+			if _, ok := groups[g]; !ok {
+				order = append(order, g)
+			}
+			groups[g] = append(groups[g], i)
+		}
+
+		round := make([]Shard, len(order))
+		errs := make([]error, len(order))
+		var wg sync.WaitGroup
+		wg.Add(len(order))
+		for k, g := range order {
+			idx := groups[g]
+			round[k] = Shard{Items: idx, Worker: g.worker, Attempts: g.attempt + 1}
+			go func(sh *Shard, errp *error) {
+				defer wg.Done()
+				batch := make([]string, len(sh.Items))
+				for j, i := range sh.Items {
+					batch[j] = items[i]
+				}
+				actx, cancel := c.attemptContext(ctx, nodes-sh.Attempts+1)
+				defer cancel()
+				out, cached, err := c.send(actx, sh.Worker, exercise, batch, header)
+				if err != nil {
+					*errp = err
+					return
+				}
+				sh.Cached = cached
+				for j, i := range sh.Items {
+					processed[i] = out[j]
+				}
+			}(&round[k], &errs[k])
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return nil, shards, ctx.Err()
+		}
+
+		pending = pending[:0]
+		for k, sh := range round {
+			if errs[k] == nil {
+				shards = append(shards, sh)
+				continue
+			}
+			for _, i := range sh.Items {
+				attempt[i]++
+				pending = append(pending, i)
+			}
+		}
+	}
+	return processed, shards, nil
+}
+
+// shardHeader returns the headers every shard request of a Process call
+// carries: the forwarded client headers and those added by Stamp.
+func (c *Coordinator) shardHeader(ctx context.Context, client http.Header) (http.Header, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set(ForwardedHeader, "1")
+	for _, h := range forwardedHeaders {
+		if v := client.Get(h); v != "" {
+			header.Set(h, v)
+		}
+	}
+	if c.Stamp != nil {
+		if err := c.Stamp(ctx, header); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+// attemptContext returns the context of one attempt at a shard, when left
+// attempts are still possible including this one.
+func (c *Coordinator) attemptContext(ctx context.Context, left int) (context.Context, context.CancelFunc) {
+	timeout := c.AttemptTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if share := time.Until(deadline) / time.Duration(max(left, 1)); timeout <= 0 || share < timeout {
+			timeout = share
+		}
+	}
+	if timeout <= 0 && c.AttemptTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// send posts one shard to worker with the headers from shardHeader and
+// returns its processed values and how many came from the worker's cache.
+func (c *Coordinator) send(ctx context.Context, worker, exercise string, items []string, header http.Header) ([]json.RawMessage, int, error) {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, worker+"/"+exercise, bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header = header.Clone()
+	if c.Sign != nil {
+		c.Sign(req, data)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("worker %s: %s", worker, resp.Status)
+	}
+
+	var parsed shardResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, 0, fmt.Errorf("worker %s: invalid response: %w", worker, err)
+	}
+	if len(parsed.Processed) != len(items) {
+		return nil, 0, fmt.Errorf("worker %s: got %d results for %d items", worker, len(parsed.Processed), len(items))
+	}
+	cached, _ := strconv.Atoi(resp.Header.Get(CacheHitsHeader))
+	return parsed.Processed, cached, nil
+}
@@ -0,0 +1,104 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recording records the items of every shard a worker receives.
+type recording struct {
+	mu     sync.Mutex
+	shards map[string]bool // request bodies
+}
+
+func (rec *recording) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		rec.shards[string(body)] = true
+		rec.mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestProcessRetriesFailedShards(t *testing.T) {
+	tests := []struct {
+		name   string
+		broken http.Handler
+		down   bool
+	}{
+		{"error", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "boom", http.StatusInternalServerError)
+		}), false},
+		{"timeout", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done() // hangs until the coordinator gives up
+		}), false},
+		{"down", nil, true},
+	}
+	items := []string{"a", "b", "c", "d", "e", "f", "g"}
+	want := `["A","B","C","D","E","F","G"]`
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int64
+			good := &recording{shards: map[string]bool{}}
+			bad := &recording{shards: map[string]bool{}}
+
+			w1 := httptest.NewServer(good.wrap(upper(&calls)))
+			defer w1.Close()
+			var w2 *httptest.Server
+			if tt.down {
+				w2 = httptest.NewServer(http.NotFoundHandler())
+				w2.Close()
+			} else {
+				w2 = httptest.NewServer(bad.wrap(tt.broken))
+				defer w2.Close()
+			}
+
+			c := NewCoordinator([]string{w1.URL, w2.URL}, 2)
+			c.AttemptTimeout = 200 * time.Millisecond
+			processed, shards, err := c.Process(context.Background(), "ex", items, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := json.Marshal(processed); string(got) != want {
+				t.Errorf("processed %s, want %s", got, want)
+			}
+
+			retried := 0
+			for i, sh := range shards {
+				if sh.Start != 2*i || sh.End != min(2*i+2, len(items)) {
+					t.Errorf("shard %d covers items %d-%d", i, sh.Start, sh.End-1)
+				}
+				if sh.Worker != w1.URL {
+					t.Errorf("shard %s reported done by %s", sh.Describe(), sh.Worker)
+				}
+				if sh.Attempts == 2 {
+					retried++
+					data, _ := json.Marshal(items[sh.Start:sh.End])
+					if !tt.down && !bad.shards[string(data)] {
+						t.Errorf("retried shard %s was never sent to the broken worker", data)
+					}
+					if !good.shards[string(data)] {
+						t.Errorf("retried shard %s did not reach the healthy worker whole", data)
+					}
+				}
+			}
+			// Shards are handed out round-robin, so the broken worker got some.
+			if retried == 0 {
+				t.Error("no shard was retried")
+			}
+			if calls.Load() != int64(len(items)) {
+				t.Errorf("healthy worker processed %d items, want %d", calls.Load(), len(items))
+			}
+		})
+	}
+}
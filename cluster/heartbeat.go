@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"time"
+)
+
+// Heartbeater registers a worker with a coordinator and keeps it alive by
+// sending periodic heartbeats with load information.
+type Heartbeater struct {
+	Coordinator string        // coordinator base URL
+	Self        Heartbeat     // ID and URL this worker advertises
+	Interval    time.Duration // time between heartbeats
+	// InFlight reports the number of items currently being processed.
+	InFlight func() int
+	Client   *http.Client
+	// Sign, if set, authenticates every request to the coordinator with
+	// its body, such as with auth.Sign and the cluster key.
+	Sign func(req *http.Request, body []byte)
+
+	cpu cpuSampler
+}
+
+// Run registers and then sends heartbeats until ctx is done, at which
+// point it tells the coordinator the worker is leaving. Failed heartbeats
+// are logged and retried on the next tick, so a worker started before its
+// coordinator joins as soon as the coordinator is up.
+func (h *Heartbeater) Run(ctx context.Context) {
+	if h.Client == nil {
+		h.Client = &http.Client{Timeout: 2 * time.Second}
+	}
+	base := strings.TrimRight(h.Coordinator, "/")
+
+	if err := h.send(ctx, base+"/cluster/register"); err != nil {
+		log.Printf("register with %s failed: %v", base, err)
+	}
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.send(ctx, base+"/cluster/heartbeat"); err != nil {
+				log.Printf("heartbeat to %s failed: %v", base, err)
+			}
+		case <-ctx.Done():
+			h.leave(base)
+			return
+		}
+	}
+}
+
+func (h *Heartbeater) send(ctx context.Context, endpoint string) error {
+	hb := h.Self
+	if h.InFlight != nil {
+		hb.InFlight = h.InFlight()
+	}
+	hb.CPU = h.cpu.sample()
+
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Sign != nil {
+		h.Sign(req, data)
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (h *Heartbeater) leave(base string) {
+	req, err := http.NewRequest(http.MethodDelete, base+"/cluster/members?id="+url.QueryEscape(h.Self.ID), nil)
+	if err != nil {
+		return
+	}
+	if h.Sign != nil {
+		h.Sign(req, nil)
+	}
+	if resp, err := h.Client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// cpuSampler estimates process CPU usage from the runtime's CPU time
+// metrics, as a fraction of GOMAXPROCS between consecutive samples.
+type cpuSampler struct {
+	lastCPU  float64
+	lastWall time.Time
+}
+
+func (c *cpuSampler) sample() float64 {
+	s := []metrics.Sample{{Name: "/cpu/classes/user:cpu-seconds"}}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	cpu := s[0].Value.Float64()
+	now := time.Now()
+
+	var usage float64
+	if !c.lastWall.IsZero() {
+		wall := now.Sub(c.lastWall).Seconds() * float64(runtime.GOMAXPROCS(0))
+		if wall > 0 {
+			usage = (cpu - c.lastCPU) / wall
+		}
+	}
+	c.lastCPU, c.lastWall = cpu, now
+	return usage
+}
@@ -0,0 +1,245 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is the failure detector's opinion of a member.
+type State string
+
+const (
+	Alive   State = "alive"
+	Suspect State = "suspect"
+	Dead    State = "dead"
+)
+
+// Load is the load information a worker reports with each heartbeat.
+type Load struct {
+	InFlight int     `json:"in_flight"`
+	CPU      float64 `json:"cpu"` // fraction of available CPU used since the previous heartbeat
+}
+
+// Heartbeat is the body of register and heartbeat requests.
+type Heartbeat struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	Load
+}
+
+// Member is one row of the membership table.
+type Member struct {
+	ID            string    `json:"id"`
+	URL           string    `json:"url"`
+	State         State     `json:"state"`
+	Load          Load      `json:"load"`
+	Joined        time.Time `json:"joined"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Heartbeats    int       `json:"heartbeats"`
+}
+
+// Membership is the coordinator's table of registered workers with a
+// timeout-based failure detector: a member that has not sent a heartbeat
+// for SuspectAfter becomes suspect, and after DeadAfter it is dead. A dead
+// member that sends a heartbeat again rejoins as alive.
+type Membership struct {
+	SuspectAfter time.Duration
+	DeadAfter    time.Duration
+	// OnChange, if set, is called with the URLs of the alive members
+	// whenever that set changes. It is called without the table locked,
+	// one call at a time and never with a set older than the last one.
+	OnChange func(alive []string)
+
+	mu      sync.Mutex
+	members map[string]*Member
+	version uint64 // changes of the alive set
+	now     func() time.Time
+
+	notifyMu sync.Mutex
+	notified uint64 // version last passed to OnChange
+}
+
+// NewMembership returns an empty membership table.
+func NewMembership(suspectAfter, deadAfter time.Duration) *Membership {
+	return &Membership{
+		SuspectAfter: suspectAfter,
+		DeadAfter:    deadAfter,
+		members:      make(map[string]*Member),
+		now:          time.Now,
+	}
+}
+
+// aliveURLs returns the sorted URLs of alive members. Caller must hold m.mu.
+func (m *Membership) aliveURLs() []string {
+	urls := []string{}
+	for _, mem := range m.members {
+		if mem.State == Alive {
+			urls = append(urls, mem.URL)
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// update applies fn under the lock and calls OnChange if the alive set
+// changed. When concurrent updates race to OnChange, a set that arrives
+// after a newer one is dropped.
+func (m *Membership) update(fn func()) {
+	m.mu.Lock()
+	before := strings.Join(m.aliveURLs(), ",")
+	fn()
+	after := m.aliveURLs()
+	changed := before != strings.Join(after, ",")
+	if changed {
+		m.version++
+	}
+	version := m.version
+	m.mu.Unlock()
+
+	if !changed || m.OnChange == nil {
+		return
+	}
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	if version > m.notified {
+		m.notified = version
+		m.OnChange(after)
+	}
+}
+
+// Heartbeat records a heartbeat (or registration) from a worker.
+func (m *Membership) Heartbeat(hb Heartbeat) {
+	m.update(func() {
+		now := m.now()
+		mem, ok := m.members[hb.ID]
+		if !ok {
+			mem = &Member{ID: hb.ID, Joined: now}
+			m.members[hb.ID] = mem
+		}
+		mem.URL = strings.TrimRight(hb.URL, "/")
+		mem.State = Alive
+		mem.Load = hb.Load
+		mem.LastHeartbeat = now
+		mem.Heartbeats++
+	})
+}
+
+// Leave removes a member that is shutting down cleanly.
+func (m *Membership) Leave(id string) {
+	m.update(func() {
+		delete(m.members, id)
+	})
+}
+
+// Check runs the failure detector once.
+func (m *Membership) Check() {
+	m.update(func() {
+		now := m.now()
+		for _, mem := range m.members {
+			silent := now.Sub(mem.LastHeartbeat)
+			switch {
+			case silent >= m.DeadAfter:
+				mem.State = Dead
+			case silent >= m.SuspectAfter:
+				mem.State = Suspect
+			}
+		}
+	})
+}
+
+// Run calls Check every interval until stop is closed.
+func (m *Membership) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.Check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Members returns a copy of the table sorted by ID.
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Member, 0, len(m.members))
+	for _, mem := range m.members {
+		out = append(out, *mem)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Alive returns the URLs of alive members.
+func (m *Membership) Alive() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.aliveURLs()
+}
+
+// Register installs the membership endpoints on mux:
+//
+//	POST   /cluster/register   register a worker (Heartbeat body)
+//	POST   /cluster/heartbeat  periodic heartbeat with load (Heartbeat body)
+//	DELETE /cluster/members?id=ID  graceful leave
+//	GET    /cluster/members    membership table
+//
+// Every endpoint but the table is wrapped by wrap, which should only let
+// workers through (see Heartbeater.Sign).
+func (m *Membership) Register(mux *http.ServeMux, wrap func(http.HandlerFunc) http.Handler) {
+	mux.Handle("/cluster/register", wrap(m.heartbeatHandler))
+	mux.Handle("/cluster/heartbeat", wrap(m.heartbeatHandler))
+	leave := wrap(m.membersHandler)
+	mux.HandleFunc("/cluster/members", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			m.membersHandler(w, r)
+			return
+		}
+		leave.ServeHTTP(w, r)
+	})
+}
+
+func (m *Membership) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var hb Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+		http.Error(w, "invalid json: expected heartbeat", http.StatusBadRequest)
+		return
+	}
+	if hb.ID == "" || hb.URL == "" {
+		http.Error(w, "heartbeat needs id and url", http.StatusBadRequest)
+		return
+	}
+	m.Heartbeat(hb)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *Membership) membersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		m.Leave(r.URL.Query().Get("id"))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"members": m.Members(), "alive": m.Alive()}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,149 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFailureDetector(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := NewMembership(3*time.Second, 10*time.Second)
+	m.now = func() time.Time { return now }
+	m.Heartbeat(Heartbeat{ID: "w1", URL: "http://w1/"})
+	m.Heartbeat(Heartbeat{ID: "w2", URL: "http://w2"})
+
+	steps := []struct {
+		at    time.Duration
+		beat  string // worker sending a heartbeat at this step
+		want  map[string]State
+		alive []string
+	}{
+		{2 * time.Second, "w2", map[string]State{"w1": Alive, "w2": Alive}, []string{"http://w1", "http://w2"}},
+		{4 * time.Second, "w2", map[string]State{"w1": Suspect, "w2": Alive}, []string{"http://w2"}},
+		{11 * time.Second, "w2", map[string]State{"w1": Dead, "w2": Alive}, []string{"http://w2"}},
+		{12 * time.Second, "w1", map[string]State{"w1": Alive, "w2": Alive}, []string{"http://w1", "http://w2"}},
+	}
+	for _, st := range steps {
+		now = time.Unix(0, 0).Add(st.at)
+		m.Heartbeat(Heartbeat{ID: st.beat, URL: "http://" + st.beat})
+		m.Check()
+		for _, mem := range m.Members() {
+			if mem.State != st.want[mem.ID] {
+				t.Errorf("at %v: %s is %s, want %s", st.at, mem.ID, mem.State, st.want[mem.ID])
+			}
+		}
+		if got := m.Alive(); !reflect.DeepEqual(got, st.alive) {
+			t.Errorf("at %v: alive %v, want %v", st.at, got, st.alive)
+		}
+	}
+}
+
+func TestOnChangeNeverGoesBack(t *testing.T) {
+	m := NewMembership(time.Minute, time.Hour)
+	var mu sync.Mutex
+	var last []string
+	m.OnChange = func(alive []string) {
+		mu.Lock()
+		last = alive
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("w%02d", i)
+			m.Heartbeat(Heartbeat{ID: id, URL: "http://" + id})
+			if i%2 == 0 {
+				m.Leave(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if want := m.Alive(); !reflect.DeepEqual(last, want) {
+		t.Fatalf("last OnChange %v, table %v", last, want)
+	}
+}
+
+func TestSetWorkersDeduplicates(t *testing.T) {
+	c := NewCoordinator([]string{"http://a/", " http://b", "", "http://a", "http://b/"}, 2)
+	if got, want := c.Workers(), []string{"http://a", "http://b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("workers %v, want %v", got, want)
+	}
+}
+
+func TestRegisterWrapsChanges(t *testing.T) {
+	m := NewMembership(time.Minute, time.Minute)
+	mux := http.NewServeMux()
+	m.Register(mux, func(h http.HandlerFunc) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Signed") == "" {
+				http.Error(w, "unsigned", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// A rogue worker cannot join.
+	resp, err := http.Post(srv.URL+"/cluster/register", "application/json", strings.NewReader(`{"id":"rogue","url":"http://rogue"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || len(m.Members()) != 0 {
+		t.Fatalf("unsigned register: %s, members %v", resp.Status, m.Members())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hb := &Heartbeater{
+		Coordinator: srv.URL,
+		Self:        Heartbeat{ID: "w1", URL: "http://w1"},
+		Interval:    time.Hour,
+		Sign:        func(req *http.Request, body []byte) { req.Header.Set("X-Signed", "1") },
+	}
+	done := make(chan struct{})
+	go func() {
+		hb.Run(ctx)
+		close(done)
+	}()
+	waitFor(t, func() bool { return len(m.Alive()) == 1 })
+
+	// The table is open to anyone.
+	resp, err = http.Get(srv.URL + "/cluster/members")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("members table: %s", resp.Status)
+	}
+
+	// Leaving is signed too.
+	cancel()
+	<-done
+	if alive := m.Alive(); len(alive) != 0 {
+		t.Errorf("alive after leaving: %v", alive)
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
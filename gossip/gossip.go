@@ -0,0 +1,672 @@
+// Package gossip maintains cluster membership between server instances with
+// a SWIM-style protocol over UDP. Every protocol period a node pings one
+// member; when no ack arrives it asks a few other members to ping the
+// target on its behalf (ping-req), and only if those fail too the target is
+// suspected. Suspected members that do not refute the suspicion within a
+// timeout are declared dead. Membership changes are disseminated by
+// piggybacking them on ping and ack messages.
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is the status of a member as seen by the local node.
+type State string
+
+const (
+	Alive   State = "alive"
+	Suspect State = "suspect"
+	Dead    State = "dead"
+)
+
+// Member is a node of the cluster.
+type Member struct {
+	ID          string    `json:"id"`
+	Addr        string    `json:"addr"` // UDP gossip address
+	Meta        string    `json:"meta"` // application data, e.g. the node's HTTP URL
+	State       State     `json:"state"`
+	Incarnation uint64    `json:"incarnation"`
+	Since       time.Time `json:"since"` // when the local node saw the last state change
+}
+
+// update is a membership change carried on messages.
+type update struct {
+	ID          string `json:"id"`
+	Addr        string `json:"addr"`
+	Meta        string `json:"meta,omitempty"`
+	State       State  `json:"state"`
+	Incarnation uint64 `json:"inc"`
+}
+
+const (
+	msgPing    = "ping"
+	msgPingReq = "ping-req"
+	msgAck     = "ack"
+)
+
+// message is the UDP datagram exchanged between nodes.
+type message struct {
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq"`
+	Target  string      `json:"target,omitempty"` // ping-req: address to probe
+	Updates []update    `json:"updates,omitempty"`
+	Header  http.Header `json:"header,omitempty"` // set by Config.Stamp
+}
+
+// Config configures a Node. Zero durations get defaults.
+type Config struct {
+	ID       string
+	BindAddr string // UDP address to listen on, e.g. ":7946"
+	// AdvertiseAddr is the address other nodes use to reach this one;
+	// defaults to BindAddr with an empty host replaced by 127.0.0.1.
+	AdvertiseAddr string
+	Meta          string
+	Seeds         []string // gossip addresses of nodes to join through
+
+	ProbeInterval    time.Duration // protocol period (default 1s)
+	ProbeTimeout     time.Duration // wait for a direct ack (default 300ms)
+	SuspicionTimeout time.Duration // suspect -> dead (default 5s)
+	IndirectChecks   int           // members asked to ping-req (default 3)
+	RetransmitMult   int           // an update is piggybacked RetransmitMult*log2(n+1) times (default 3)
+	MaxUpdates       int           // updates piggybacked per message (default 8)
+
+	// Conn, if set, is used instead of listening on BindAddr.
+	Conn net.PacketConn
+	// Rand, if set, makes member selection deterministic.
+	Rand *rand.Rand
+	// OnChange is called with the alive members (including this node)
+	// whenever that set changes. It is called without the member table
+	// locked, one call at a time and never with a set older than the last.
+	OnChange func(alive []Member)
+	// Stamp, if set, fills in the headers every message carries, and
+	// Observe is called with those of every message received, such as
+	// to time them with causal.Clock Send and Receive.
+	Stamp   func(h http.Header, what string)
+	Observe func(h http.Header, what string)
+	Logger  *log.Logger
+}
+
+type broadcast struct {
+	u         update
+	remaining int
+}
+
+// Node is a running gossip participant.
+type Node struct {
+	cfg  Config
+	conn net.PacketConn
+
+	mu         sync.Mutex
+	self       Member
+	members    map[string]*Member // excluding self
+	queue      []*broadcast
+	seq        uint64
+	acks       map[uint64]chan struct{}
+	probeOrder []string
+	probeIdx   int
+	rnd        *rand.Rand
+	version    uint64 // changes of the alive set
+
+	notifyMu sync.Mutex
+	notified uint64 // version last passed to OnChange
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Start creates a node, joins through the seeds and starts the protocol.
+func Start(cfg Config) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("gossip: node needs an ID")
+	}
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = 300 * time.Millisecond
+	}
+	if cfg.SuspicionTimeout <= 0 {
+		cfg.SuspicionTimeout = 5 * time.Second
+	}
+	if cfg.IndirectChecks <= 0 {
+		cfg.IndirectChecks = 3
+	}
+	if cfg.RetransmitMult <= 0 {
+		cfg.RetransmitMult = 3
+	}
+	if cfg.MaxUpdates <= 0 {
+		cfg.MaxUpdates = 8
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	if cfg.Rand == nil {
+		cfg.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	conn := cfg.Conn
+	if conn == nil {
+		var err error
+		conn, err = net.ListenPacket("udp", cfg.BindAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AdvertiseAddr == "" {
+		cfg.AdvertiseAddr = advertiseFor(conn.LocalAddr().String())
+	}
+
+	n := &Node{
+		cfg:  cfg,
+		conn: conn,
+		self: Member{
+			ID:   cfg.ID,
+			Addr: cfg.AdvertiseAddr,
+			Meta: cfg.Meta,
+			// Starting from the clock lets a restarted node override the
+			// dead state peers still hold for its previous incarnation.
+			Incarnation: uint64(time.Now().Unix()),
+			State:       Alive,
+			Since:       time.Now(),
+		},
+		members: make(map[string]*Member),
+		acks:    make(map[uint64]chan struct{}),
+		rnd:     cfg.Rand,
+		stop:    make(chan struct{}),
+	}
+
+	n.wg.Add(2)
+	go n.readLoop()
+	go n.probeLoop()
+	n.join()
+	return n, nil
+}
+
+// advertiseFor fills in a loopback host for addresses bound to all interfaces.
+func advertiseFor(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// join pings every seed; their acks carry this node's alive update back
+// into the cluster and their own state to us.
+func (n *Node) join() {
+	for _, seed := range n.cfg.Seeds {
+		seed = strings.TrimSpace(seed)
+		if seed == "" || seed == n.self.Addr {
+			continue
+		}
+		n.mu.Lock()
+		n.seq++
+		seq := n.seq
+		n.mu.Unlock()
+		n.send(seed, message{Type: msgPing, Seq: seq})
+	}
+}
+
+// Leave announces that this node is leaving and stops it.
+func (n *Node) Leave() {
+	n.mu.Lock()
+	n.self.State = Dead
+	leaving := n.selfUpdate()
+	targets := n.aliveAddrs()
+	n.mu.Unlock()
+
+	for _, addr := range targets {
+		n.sendRaw(addr, message{Type: msgPing, Updates: []update{leaving}})
+	}
+	n.Close()
+}
+
+// Close stops the node without announcing anything.
+func (n *Node) Close() {
+	select {
+	case <-n.stop:
+		return
+	default:
+	}
+	close(n.stop)
+	n.conn.Close()
+	n.wg.Wait()
+}
+
+// Self returns this node's own entry.
+func (n *Node) Self() Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.self
+}
+
+// Members returns every known member including this node, sorted by ID.
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	out := []Member{n.self}
+	for _, m := range n.members {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Alive returns the alive members including this node, sorted by ID.
+func (n *Node) Alive() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.alive()
+}
+
+// alive lists alive members. Caller must hold n.mu.
+func (n *Node) alive() []Member {
+	out := []Member{n.self}
+	for _, m := range n.members {
+		if m.State == Alive {
+			out = append(out, *m)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func aliveKey(members []Member) string {
+	var b strings.Builder
+	for _, m := range members {
+		b.WriteString(m.ID + "|" + m.Meta + ",")
+	}
+	return b.String()
+}
+
+// mutate runs fn under the lock and reports alive-set changes to OnChange,
+// dropping a set that loses the race to OnChange against a newer one.
+func (n *Node) mutate(fn func()) {
+	n.mu.Lock()
+	before := aliveKey(n.alive())
+	fn()
+	after := n.alive()
+	changed := before != aliveKey(after)
+	if changed {
+		n.version++
+	}
+	version := n.version
+	n.mu.Unlock()
+
+	if !changed || n.cfg.OnChange == nil {
+		return
+	}
+	n.notifyMu.Lock()
+	defer n.notifyMu.Unlock()
+	if version > n.notified {
+		n.notified = version
+		n.cfg.OnChange(after)
+	}
+}
+
+// aliveAddrs returns the addresses of non-dead members. Caller must hold n.mu.
+func (n *Node) aliveAddrs() []string {
+	var addrs []string
+	for _, m := range n.members {
+		if m.State != Dead {
+			addrs = append(addrs, m.Addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (n *Node) selfUpdate() update {
+	return update{ID: n.self.ID, Addr: n.self.Addr, Meta: n.self.Meta, State: n.self.State, Incarnation: n.self.Incarnation}
+}
+
+// enqueue schedules u for dissemination, replacing any older update about
+// the same member. Caller must hold n.mu.
+func (n *Node) enqueue(u update) {
+	retransmits := n.cfg.RetransmitMult * int(math.Ceil(math.Log2(float64(len(n.members)+2))))
+	for _, b := range n.queue {
+		if b.u.ID == u.ID {
+			b.u = u
+			b.remaining = retransmits
+			return
+		}
+	}
+	n.queue = append(n.queue, &broadcast{u: u, remaining: retransmits})
+}
+
+// piggyback returns this node's own state plus up to MaxUpdates queued
+// updates, consuming one retransmission of each. Caller must hold n.mu.
+func (n *Node) piggyback() []update {
+	updates := []update{n.selfUpdate()}
+	kept := n.queue[:0]
+	for _, b := range n.queue {
+		if len(updates) <= n.cfg.MaxUpdates && b.u.ID != n.self.ID {
+			updates = append(updates, b.u)
+			b.remaining--
+		}
+		if b.remaining > 0 && b.u.ID != n.self.ID {
+			kept = append(kept, b)
+		}
+	}
+	n.queue = kept
+	return updates
+}
+
+// merge applies an update received from the network. Caller must hold n.mu.
+func (n *Node) merge(u update) {
+	if u.ID == n.self.ID {
+		// Refute suspicion (or a stale death notice) about ourselves.
+		if n.self.State == Alive && u.State != Alive && u.Incarnation >= n.self.Incarnation {
+			n.self.Incarnation = u.Incarnation + 1
+			n.enqueue(n.selfUpdate())
+		}
+		return
+	}
+
+	m, ok := n.members[u.ID]
+	if !ok {
+		n.members[u.ID] = &Member{ID: u.ID, Addr: u.Addr, Meta: u.Meta, State: u.State, Incarnation: u.Incarnation, Since: time.Now()}
+		n.enqueue(u)
+		if u.State == Alive {
+			n.cfg.Logger.Printf("gossip: %s joined (%s)", u.ID, u.Addr)
+		}
+		return
+	}
+
+	var accept bool
+	switch u.State {
+	case Alive:
+		accept = u.Incarnation > m.Incarnation
+	case Suspect:
+		accept = (m.State == Alive && u.Incarnation >= m.Incarnation) ||
+			(m.State == Suspect && u.Incarnation > m.Incarnation)
+	case Dead:
+		accept = m.State != Dead && u.Incarnation >= m.Incarnation
+	}
+	if !accept {
+		return
+	}
+	if m.State != u.State {
+		n.cfg.Logger.Printf("gossip: %s is %s (incarnation %d)", u.ID, u.State, u.Incarnation)
+		m.Since = time.Now()
+	}
+	m.Addr, m.State, m.Incarnation = u.Addr, u.State, u.Incarnation
+	if u.Meta != "" {
+		m.Meta = u.Meta
+	}
+	n.enqueue(u)
+}
+
+func (n *Node) send(addr string, msg message) {
+	n.mu.Lock()
+	msg.Updates = n.piggyback()
+	n.mu.Unlock()
+	n.sendRaw(addr, msg)
+}
+
+func (n *Node) sendRaw(addr string, msg message) {
+	if n.cfg.Stamp != nil {
+		msg.Header = http.Header{}
+		n.cfg.Stamp(msg.Header, "gossip "+msg.Type+" to "+addr)
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		n.cfg.Logger.Printf("gossip: bad address %s: %v", addr, err)
+		return
+	}
+	var to net.Addr = udpAddr
+	if _, isUDP := n.conn.(*net.UDPConn); !isUDP {
+		// Non-UDP transports (such as a simulated network) address peers by string.
+		to = stringAddr(addr)
+	}
+	n.conn.WriteTo(data, to)
+}
+
+// stringAddr is a net.Addr for transports that accept plain addresses.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "udp" }
+func (a stringAddr) String() string  { return string(a) }
+
+func (n *Node) readLoop() {
+	defer n.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		size, from, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-n.stop:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(buf[:size], &msg); err != nil {
+			continue
+		}
+		n.handle(msg, from.String())
+	}
+}
+
+func (n *Node) handle(msg message, from string) {
+	if n.cfg.Observe != nil {
+		if msg.Header == nil {
+			msg.Header = http.Header{}
+		}
+		n.cfg.Observe(msg.Header, "gossip "+msg.Type+" from "+from)
+	}
+	n.mutate(func() {
+		for _, u := range msg.Updates {
+			n.merge(u)
+		}
+	})
+
+	// Reply to the advertised address of the sender, which is always the
+	// first update, so nodes behind a wildcard bind are reachable.
+	replyTo := from
+	if len(msg.Updates) > 0 && msg.Updates[0].Addr != "" {
+		replyTo = msg.Updates[0].Addr
+	}
+
+	switch msg.Type {
+	case msgPing:
+		if msg.Seq != 0 {
+			n.send(replyTo, message{Type: msgAck, Seq: msg.Seq})
+		}
+	case msgPingReq:
+		go n.relayProbe(msg.Seq, msg.Target, replyTo)
+	case msgAck:
+		n.mu.Lock()
+		ch, ok := n.acks[msg.Seq]
+		n.mu.Unlock()
+		if ok {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// relayProbe pings target on behalf of requester and forwards the ack.
+func (n *Node) relayProbe(reqSeq uint64, target, requester string) {
+	seq, ch := n.expectAck()
+	defer n.forgetAck(seq)
+	n.send(target, message{Type: msgPing, Seq: seq})
+	select {
+	case <-ch:
+		n.send(requester, message{Type: msgAck, Seq: reqSeq})
+	case <-time.After(n.cfg.ProbeTimeout):
+	case <-n.stop:
+	}
+}
+
+func (n *Node) expectAck() (uint64, chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	ch := make(chan struct{}, 1)
+	n.acks[n.seq] = ch
+	return n.seq, ch
+}
+
+func (n *Node) forgetAck(seq uint64) {
+	n.mu.Lock()
+	delete(n.acks, seq)
+	n.mu.Unlock()
+}
+
+func (n *Node) probeLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.probe()
+			n.expireSuspects()
+			n.mu.Lock()
+			lonely := len(n.aliveAddrs()) == 0
+			n.mu.Unlock()
+			if lonely {
+				n.join()
+			}
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// nextTarget picks the next member to probe, walking a shuffled list of
+// members round-robin. Caller must hold n.mu.
+func (n *Node) nextTarget() (*Member, bool) {
+	for attempts := 0; attempts < 2; attempts++ {
+		for n.probeIdx < len(n.probeOrder) {
+			m, ok := n.members[n.probeOrder[n.probeIdx]]
+			n.probeIdx++
+			if ok && m.State != Dead {
+				return m, true
+			}
+		}
+		n.probeOrder = n.probeOrder[:0]
+		for id, m := range n.members {
+			if m.State != Dead {
+				n.probeOrder = append(n.probeOrder, id)
+			}
+		}
+		sort.Strings(n.probeOrder)
+		n.rnd.Shuffle(len(n.probeOrder), func(i, j int) {
+			n.probeOrder[i], n.probeOrder[j] = n.probeOrder[j], n.probeOrder[i]
+		})
+		n.probeIdx = 0
+	}
+	return nil, false
+}
+
+// probe runs one protocol period: a direct ping, then indirect pings
+// through IndirectChecks other members, then suspicion.
+func (n *Node) probe() {
+	n.mu.Lock()
+	target, ok := n.nextTarget()
+	var targetID, targetAddr string
+	var helpers []string
+	if ok {
+		targetID, targetAddr = target.ID, target.Addr
+		for _, addr := range n.aliveAddrs() {
+			if addr != targetAddr {
+				helpers = append(helpers, addr)
+			}
+		}
+		n.rnd.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+		if len(helpers) > n.cfg.IndirectChecks {
+			helpers = helpers[:n.cfg.IndirectChecks]
+		}
+	}
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	seq, ch := n.expectAck()
+	defer n.forgetAck(seq)
+
+	n.send(targetAddr, message{Type: msgPing, Seq: seq})
+	select {
+	case <-ch:
+		return
+	case <-time.After(n.cfg.ProbeTimeout):
+	case <-n.stop:
+		return
+	}
+
+	for _, h := range helpers {
+		n.send(h, message{Type: msgPingReq, Seq: seq, Target: targetAddr})
+	}
+	remaining := n.cfg.ProbeInterval - n.cfg.ProbeTimeout
+	if remaining < n.cfg.ProbeTimeout {
+		remaining = n.cfg.ProbeTimeout
+	}
+	select {
+	case <-ch:
+		return
+	case <-time.After(remaining):
+	case <-n.stop:
+		return
+	}
+
+	n.mutate(func() {
+		m, ok := n.members[targetID]
+		if !ok || m.State != Alive {
+			return
+		}
+		n.merge(update{ID: m.ID, Addr: m.Addr, Meta: m.Meta, State: Suspect, Incarnation: m.Incarnation})
+	})
+}
+
+// expireSuspects declares dead the members suspected for too long.
+func (n *Node) expireSuspects() {
+	n.mutate(func() {
+		now := time.Now()
+		for _, m := range n.members {
+			if m.State == Suspect && now.Sub(m.Since) >= n.cfg.SuspicionTimeout {
+				n.merge(update{ID: m.ID, Addr: m.Addr, Meta: m.Meta, State: Dead, Incarnation: m.Incarnation})
+			}
+		}
+	})
+}
+
+// Handler serves the membership table as JSON.
+func (n *Node) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"self": n.Self(), "members": n.Members()}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,227 @@
+package gossip
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+var quiet = log.New(io.Discard, "", 0)
+
+// startNode starts a node on a loopback UDP port with fast timers.
+func startNode(t *testing.T, id string, seeds ...string) *Node {
+	t.Helper()
+	n, err := Start(Config{
+		ID:               id,
+		BindAddr:         "127.0.0.1:0",
+		Meta:             "http://" + id,
+		Seeds:            seeds,
+		ProbeInterval:    50 * time.Millisecond,
+		ProbeTimeout:     15 * time.Millisecond,
+		SuspicionTimeout: 200 * time.Millisecond,
+		Rand:             rand.New(rand.NewSource(1)),
+		Logger:           quiet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Close)
+	return n
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stateOf returns the state n holds for id.
+func stateOf(n *Node, id string) State {
+	for _, m := range n.Members() {
+		if m.ID == id {
+			return m.State
+		}
+	}
+	return ""
+}
+
+func aliveIDs(n *Node) string {
+	s := ""
+	for _, m := range n.Alive() {
+		s += m.ID + " "
+	}
+	return s
+}
+
+func TestJoinAndLeave(t *testing.T) {
+	a := startNode(t, "a")
+	b := startNode(t, "b", a.Self().Addr)
+	c := startNode(t, "c", a.Self().Addr)
+
+	for _, n := range []*Node{a, b, c} {
+		n := n
+		waitFor(t, n.Self().ID+" to see everyone", func() bool { return aliveIDs(n) == "a b c " })
+	}
+
+	c.Leave()
+	for _, n := range []*Node{a, b} {
+		n := n
+		waitFor(t, n.Self().ID+" to see c leave", func() bool { return stateOf(n, "c") == Dead })
+	}
+}
+
+func TestCrashSuspectedThenDead(t *testing.T) {
+	a := startNode(t, "a")
+	b := startNode(t, "b", a.Self().Addr)
+	c := startNode(t, "c", a.Self().Addr)
+	waitFor(t, "cluster to form", func() bool { return aliveIDs(a) == "a b c " && aliveIDs(b) == "a b c " })
+
+	// Watch the states a goes through for c.
+	var seen []State
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			s := stateOf(a, "c")
+			if len(seen) == 0 || seen[len(seen)-1] != s {
+				seen = append(seen, s)
+			}
+			if s == Dead {
+				return
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+
+	c.Close() // crash: no leave message
+	for _, n := range []*Node{a, b} {
+		n := n
+		waitFor(t, n.Self().ID+" to declare c dead", func() bool { return stateOf(n, "c") == Dead })
+	}
+	<-done
+	if fmt.Sprint(seen) != "[alive suspect dead]" {
+		t.Fatalf("a saw c go through %v, want alive, suspect, dead", seen)
+	}
+}
+
+// newBare returns a node without a network, for testing merge.
+func newBare(id string) *Node {
+	return &Node{
+		cfg:     Config{ID: id, RetransmitMult: 3, MaxUpdates: 8, Logger: quiet},
+		self:    Member{ID: id, Addr: id, State: Alive, Incarnation: 5},
+		members: make(map[string]*Member),
+		acks:    make(map[uint64]chan struct{}),
+	}
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	n := newBare("self")
+	for _, st := range []State{Suspect, Dead} {
+		inc := n.self.Incarnation
+		n.merge(update{ID: "self", Addr: "self", State: st, Incarnation: inc})
+		if n.self.State != Alive || n.self.Incarnation != inc+1 {
+			t.Fatalf("after %s rumour: %s incarnation %d, want alive %d", st, n.self.State, n.self.Incarnation, inc+1)
+		}
+		if u := n.piggyback()[0]; u.State != Alive || u.Incarnation != inc+1 {
+			t.Fatalf("piggybacked self %+v, want alive at %d", u, inc+1)
+		}
+	}
+
+	// Rumours about an older incarnation are ignored.
+	inc := n.self.Incarnation
+	n.merge(update{ID: "self", State: Suspect, Incarnation: inc - 1})
+	if n.self.Incarnation != inc {
+		t.Fatalf("stale suspicion bumped incarnation to %d", n.self.Incarnation)
+	}
+}
+
+func TestMergeRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		have    State
+		haveInc uint64
+		got     State
+		gotInc  uint64
+		want    State
+		wantInc uint64
+	}{
+		{"alive needs newer incarnation", Suspect, 3, Alive, 3, Suspect, 3},
+		{"alive refutes suspicion", Suspect, 3, Alive, 4, Alive, 4},
+		{"suspect same incarnation", Alive, 3, Suspect, 3, Suspect, 3},
+		{"suspect older incarnation", Alive, 3, Suspect, 2, Alive, 3},
+		{"suspect again needs newer", Suspect, 3, Suspect, 3, Suspect, 3},
+		{"dead overrides alive", Alive, 3, Dead, 3, Dead, 3},
+		{"dead ignores older", Alive, 3, Dead, 2, Alive, 3},
+		{"dead stays dead", Dead, 3, Suspect, 9, Dead, 3},
+		{"rejoin after death", Dead, 3, Alive, 4, Alive, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newBare("self")
+			n.members["x"] = &Member{ID: "x", Addr: "x", State: tt.have, Incarnation: tt.haveInc}
+			n.merge(update{ID: "x", Addr: "x", State: tt.got, Incarnation: tt.gotInc})
+			m := n.members["x"]
+			if m.State != tt.want || m.Incarnation != tt.wantInc {
+				t.Fatalf("got %s@%d, want %s@%d", m.State, m.Incarnation, tt.want, tt.wantInc)
+			}
+		})
+	}
+}
+
+func TestPiggybackRetransmits(t *testing.T) {
+	n := newBare("self")
+	n.merge(update{ID: "x", Addr: "x", State: Alive, Incarnation: 1})
+	sends := 0
+	for len(n.queue) > 0 {
+		n.piggyback()
+		sends++
+	}
+	// RetransmitMult * ceil(log2(members+2)) = 3 * ceil(log2(3)) = 6.
+	if sends != 6 {
+		t.Fatalf("update sent %d times, want 6", sends)
+	}
+}
+
+func TestStampedMessages(t *testing.T) {
+	var mu sync.Mutex
+	heard := map[string]string{} // receiver -> sender named in the last header
+	start := func(id string, seeds ...string) *Node {
+		n, err := Start(Config{
+			ID:            id,
+			BindAddr:      "127.0.0.1:0",
+			Seeds:         seeds,
+			ProbeInterval: 50 * time.Millisecond,
+			Logger:        quiet,
+			Stamp:         func(h http.Header, what string) { h.Set("X-Sender", id) },
+			Observe: func(h http.Header, what string) {
+				mu.Lock()
+				heard[id] = h.Get("X-Sender")
+				mu.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(n.Close)
+		return n
+	}
+	a := start("a")
+	start("b", a.Self().Addr)
+
+	waitFor(t, "both nodes to get stamped messages", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return heard["a"] == "b" && heard["b"] == "a"
+	})
+}
@@ -0,0 +1,283 @@
+// Package hashring implements a consistent-hash ring with virtual nodes.
+// Each node is placed on the ring at several pseudo-random points; a key
+// belongs to the node owning the first point at or after the key's hash.
+// Adding or removing a node only moves the keys on the arcs next to that
+// node's points, and the ring reports how much of the key space moved.
+package hashring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Stats describes a membership change of the ring.
+type Stats struct {
+	Added   []string           `json:"added,omitempty"`
+	Removed []string           `json:"removed,omitempty"`
+	Moved   float64            `json:"moved"`  // fraction of the key space that changed owner
+	Before  map[string]float64 `json:"before"` // ownership share per node before the change
+	After   map[string]float64 `json:"after"`  // ownership share per node after the change
+}
+
+// Ring is a consistent-hash ring. It is safe for concurrent use.
+type Ring struct {
+	mu     sync.RWMutex
+	vnodes int
+	points []uint64          // sorted virtual node positions
+	owners map[uint64]string // position -> node
+	nodes  map[string]bool
+}
+
+// New returns an empty ring placing each node at vnodes points.
+func New(vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	return &Ring{vnodes: vnodes, owners: make(map[uint64]string), nodes: make(map[string]bool)}
+}
+
+// Hash maps a key onto the ring.
+func Hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV alone clusters similar keys; finish with the splitmix64 mixer.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// snapshot is an immutable copy of the ring layout used for statistics.
+type snapshot struct {
+	points []uint64
+	owners map[uint64]string
+}
+
+func (r *Ring) snapshot() snapshot {
+	owners := make(map[uint64]string, len(r.owners))
+	for p, n := range r.owners {
+		owners[p] = n
+	}
+	return snapshot{points: append([]uint64(nil), r.points...), owners: owners}
+}
+
+// owner returns the node owning position h in s.
+func (s snapshot) owner(h uint64) string {
+	if len(s.points) == 0 {
+		return ""
+	}
+	i := sort.Search(len(s.points), func(i int) bool { return s.points[i] >= h })
+	if i == len(s.points) {
+		i = 0
+	}
+	return s.owners[s.points[i]]
+}
+
+// ownership returns each node's share of the key space.
+func (s snapshot) ownership() map[string]float64 {
+	share := map[string]float64{}
+	for i, p := range s.points {
+		var arc uint64
+		if i == 0 {
+			arc = p - s.points[len(s.points)-1] // wraps around zero
+		} else {
+			arc = p - s.points[i-1]
+		}
+		if len(s.points) == 1 {
+			share[s.owners[p]] = 1
+			continue
+		}
+		share[s.owners[p]] += float64(arc) / (1 << 64)
+	}
+	return share
+}
+
+// moved returns the fraction of the key space whose owner differs between a and b.
+func moved(a, b snapshot) float64 {
+	if len(a.points) == 0 || len(b.points) == 0 {
+		if len(a.points) == len(b.points) {
+			return 0
+		}
+		return 1
+	}
+	all := append(append([]uint64(nil), a.points...), b.points...)
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+
+	var total float64
+	for i, p := range all {
+		prev := all[len(all)-1]
+		if i > 0 {
+			prev = all[i-1]
+		}
+		if p == prev && len(all) > 1 {
+			continue
+		}
+		// Every key in (prev, p] has the same owner in each ring.
+		if a.owner(p) != b.owner(p) {
+			total += float64(p-prev) / (1 << 64)
+		}
+	}
+	return total
+}
+
+func (r *Ring) add(node string) {
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.vnodes; i++ {
+		p := Hash(node + "#" + strconv.Itoa(i))
+		if _, taken := r.owners[p]; taken {
+			continue // astronomically unlikely; first owner keeps the point
+		}
+		r.owners[p] = node
+		r.points = append(r.points, p)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *Ring) remove(node string) {
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	kept := r.points[:0]
+	for _, p := range r.points {
+		if r.owners[p] == node {
+			delete(r.owners, p)
+			continue
+		}
+		kept = append(kept, p)
+	}
+	r.points = kept
+}
+
+// change applies fn and returns the rebalancing statistics. Caller must hold r.mu.
+func (r *Ring) change(fn func() (added, removed []string)) Stats {
+	before := r.snapshot()
+	added, removed := fn()
+	after := r.snapshot()
+	return Stats{
+		Added:   added,
+		Removed: removed,
+		Moved:   moved(before, after),
+		Before:  before.ownership(),
+		After:   after.ownership(),
+	}
+}
+
+// Add places node on the ring.
+func (r *Ring) Add(node string) Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.change(func() ([]string, []string) {
+		if r.nodes[node] {
+			return nil, nil
+		}
+		r.add(node)
+		return []string{node}, nil
+	})
+}
+
+// Remove takes node off the ring.
+func (r *Ring) Remove(node string) Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.change(func() ([]string, []string) {
+		if !r.nodes[node] {
+			return nil, nil
+		}
+		r.remove(node)
+		return nil, []string{node}
+	})
+}
+
+// Set makes the ring contain exactly nodes, adding and removing as needed.
+func (r *Ring) Set(nodes []string) Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.change(func() (added, removed []string) {
+		want := map[string]bool{}
+		for _, n := range nodes {
+			want[n] = true
+		}
+		for n := range r.nodes {
+			if !want[n] {
+				removed = append(removed, n)
+			}
+		}
+		for n := range want {
+			if !r.nodes[n] {
+				added = append(added, n)
+			}
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+		for _, n := range removed {
+			r.remove(n)
+		}
+		for _, n := range added {
+			r.add(n)
+		}
+		return added, removed
+	})
+}
+
+// Get returns the node owning key.
+func (r *Ring) Get(key string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return "", false
+	}
+	return snapshot{points: r.points, owners: r.owners}.owner(Hash(key)), true
+}
+
+// GetN returns up to n distinct nodes for key in ring order, starting with
+// its owner. The later nodes are the natural fallbacks when the owner fails.
+func (r *Ring) GetN(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 || n < 1 {
+		return nil
+	}
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	h := Hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	seen := map[string]bool{}
+	out := make([]string, 0, n)
+	for i := 0; i < len(r.points) && len(out) < n; i++ {
+		node := r.owners[r.points[(start+i)%len(r.points)]]
+		if !seen[node] {
+			seen[node] = true
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// Nodes returns the nodes on the ring, sorted.
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]string, 0, len(r.nodes))
+	for n := range r.nodes {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Ownership returns each node's share of the key space.
+func (r *Ring) Ownership() map[string]float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshot().ownership()
+}
@@ -0,0 +1,150 @@
+package hashring
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func ring(vnodes int, nodes ...string) *Ring {
+	r := New(vnodes)
+	r.Set(nodes)
+	return r
+}
+
+func TestGetN(t *testing.T) {
+	r := ring(50, "a", "b", "c")
+	tests := []struct {
+		n, want int
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{3, 3},
+		{5, 3}, // no more than the nodes on the ring
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.n), func(t *testing.T) {
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprint("key", i)
+				got := r.GetN(key, tt.n)
+				if len(got) != tt.want {
+					t.Fatalf("GetN(%q, %d) = %v, want %d nodes", key, tt.n, got, tt.want)
+				}
+				seen := map[string]bool{}
+				for _, n := range got {
+					if seen[n] {
+						t.Fatalf("GetN(%q, %d) = %v repeats %s", key, tt.n, got, n)
+					}
+					seen[n] = true
+				}
+				if owner, _ := r.Get(key); len(got) > 0 && got[0] != owner {
+					t.Fatalf("GetN(%q, %d) = %v does not start with the owner %s", key, tt.n, got, owner)
+				}
+			}
+		})
+	}
+}
+
+func TestGetNWrapsAround(t *testing.T) {
+	r := ring(1, "a", "b", "c")
+	// In ring order from the first point.
+	order := []string{r.owners[r.points[0]], r.owners[r.points[1]], r.owners[r.points[2]]}
+	tests := []struct {
+		name string
+		past uint64 // the key hashes just after this point
+		want []string
+	}{
+		{"after the last point", r.points[2], order},
+		{"after the second point", r.points[1], []string{order[2], order[0], order[1]}},
+		{"before the first point", 0, order},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := keyAfter(t, r, tt.past)
+			if got := r.GetN(key, 3); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetN = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// keyAfter finds a key hashing into the arc that starts at point p.
+func keyAfter(t *testing.T, r *Ring, p uint64) string {
+	t.Helper()
+	next := uint64(math.MaxUint64)
+	for _, q := range r.points {
+		if q > p {
+			next = q
+			break
+		}
+	}
+	for i := 0; i < 1_000_000; i++ {
+		key := fmt.Sprint("k", i)
+		if h := Hash(key); h > p && h < next {
+			return key
+		}
+	}
+	t.Fatalf("no key hashes after %x", p)
+	return ""
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		name           string
+		change         func(*Ring) Stats
+		added, removed []string
+		changed        string // the node every moved key comes from or goes to
+	}{
+		{"add", func(r *Ring) Stats { return r.Add("d") }, []string{"d"}, nil, "d"},
+		{"remove", func(r *Ring) Stats { return r.Remove("b") }, nil, []string{"b"}, "b"},
+		{"set adds", func(r *Ring) Stats { return r.Set([]string{"a", "b", "c", "d"}) }, []string{"d"}, nil, "d"},
+		{"set removes", func(r *Ring) Stats { return r.Set([]string{"a", "c"}) }, nil, []string{"b"}, "b"},
+		{"add existing", func(r *Ring) Stats { return r.Add("a") }, nil, nil, ""},
+		{"remove missing", func(r *Ring) Stats { return r.Remove("z") }, nil, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := ring(100, "a", "b", "c")
+			const keys = 20000
+			before := make([]string, keys)
+			for i := range before {
+				before[i], _ = r.Get(fmt.Sprint("key", i))
+			}
+
+			s := tt.change(r)
+			if !reflect.DeepEqual(s.Added, tt.added) || !reflect.DeepEqual(s.Removed, tt.removed) {
+				t.Errorf("added %v removed %v, want %v %v", s.Added, s.Removed, tt.added, tt.removed)
+			}
+			// What moved is exactly the share the changed node gained or lost.
+			if want := s.After[tt.changed] + s.Before[tt.changed]; math.Abs(s.Moved-want) > 1e-9 {
+				t.Errorf("moved %.4f, want %.4f", s.Moved, want)
+			}
+			for _, share := range []map[string]float64{s.Before, s.After} {
+				total := 0.0
+				for _, f := range share {
+					total += f
+				}
+				if math.Abs(total-1) > 1e-9 {
+					t.Errorf("ownership %v adds up to %f", share, total)
+				}
+			}
+
+			moved := 0
+			for i, old := range before {
+				now, _ := r.Get(fmt.Sprint("key", i))
+				if now == old {
+					continue
+				}
+				moved++
+				if old != tt.changed && now != tt.changed {
+					t.Fatalf("key%d moved from %s to %s", i, old, now)
+				}
+			}
+			if got := float64(moved) / keys; math.Abs(got-s.Moved) > 0.02 {
+				t.Errorf("%.4f of the keys moved, Stats.Moved says %.4f", got, s.Moved)
+			}
+		})
+	}
+}
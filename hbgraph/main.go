@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/liviu274/Distributed-systems/causal"
+)
+
+// hbgraph reconstructs the happens-before graph of a run from the traces
+// written by the exercise server and clients with -trace:
+//
+//	go run ./hbgraph trace.jsonl
+//	go run ./hbgraph -format dot trace.jsonl | dot -Tsvg > run.svg
+func main() {
+	format := flag.String("format", "text", "output format: text or dot")
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"trace.jsonl"}
+	}
+	var events []causal.Event
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		evs, err := causal.ReadTrace(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		events = append(events, evs...)
+	}
+
+	g := causal.BuildGraph(events)
+	var err error
+	switch *format {
+	case "text":
+		err = g.WriteText(os.Stdout)
+	case "dot":
+		err = g.WriteDOT(os.Stdout)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
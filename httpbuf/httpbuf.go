@@ -0,0 +1,46 @@
+// Package httpbuf runs HTTP handlers in-process and keeps their response
+// in memory, for servers that call their own handlers as part of a larger
+// operation.
+package httpbuf
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// Response is an http.ResponseWriter that buffers what is written to it.
+type Response struct {
+	Code int
+	Body bytes.Buffer
+
+	header http.Header
+	wrote  bool
+}
+
+// New returns an empty response with status 200.
+func New() *Response {
+	return &Response{Code: http.StatusOK, header: make(http.Header)}
+}
+
+func (r *Response) Header() http.Header { return r.header }
+
+func (r *Response) Write(p []byte) (int, error) {
+	r.wrote = true
+	return r.Body.Write(p)
+}
+
+// WriteHeader records the status code. As with a real connection, only
+// the first call counts.
+func (r *Response) WriteHeader(code int) {
+	if !r.wrote {
+		r.Code = code
+		r.wrote = true
+	}
+}
+
+// Serve runs h on req and returns the response.
+func Serve(h http.Handler, req *http.Request) *Response {
+	resp := New()
+	h.ServeHTTP(resp, req)
+	return resp
+}
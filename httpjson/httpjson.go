@@ -0,0 +1,32 @@
+// Package httpjson holds the helpers of handlers that speak JSON: reading
+// the body of a POST and writing a response.
+package httpjson
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// DecodePost decodes the JSON body of r into v. It answers 405 to methods
+// other than POST and 400 to invalid JSON, reporting false after either.
+func DecodePost(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Write answers with code and v encoded as JSON.
+func Write(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,331 @@
+// Package joblog keeps a Raft-replicated log of the batches submitted to
+// the exercise server and their results. A batch is recorded as pending
+// before it is processed and completed with its response afterwards, so
+// when the leader crashes mid-batch the next leader finds the pending job
+// and runs it again.
+package joblog
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/httpbuf"
+	"github.com/liviu274/Distributed-systems/raft"
+)
+
+// Job status values.
+const (
+	Pending = "pending"
+	Done    = "done"
+)
+
+// Job is one submitted batch.
+type Job struct {
+	ID        string            `json:"id"`
+	Index     uint64            `json:"index"` // Raft index of the submission
+	Exercise  string            `json:"exercise"`
+	Client    string            `json:"client"`
+	Header    map[string]string `json:"header,omitempty"`
+	Body      json.RawMessage   `json:"body"`
+	Status    string            `json:"status"`
+	Code      int               `json:"code,omitempty"` // HTTP status of the response
+	Response  json.RawMessage   `json:"response,omitempty"`
+	Submitted time.Time         `json:"submitted"`
+	Completed time.Time         `json:"completed,omitempty"`
+}
+
+type command struct {
+	Op  string `json:"op"` // "submit" or "complete"
+	Job Job    `json:"job"`
+}
+
+// Log is the replicated state machine: all jobs by ID.
+type Log struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+// NewLog returns an empty job log.
+func NewLog() *Log {
+	return &Log{jobs: make(map[string]*Job)}
+}
+
+// Apply implements raft.StateMachine.
+func (l *Log) Apply(index uint64, data []byte) interface{} {
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch cmd.Op {
+	case "submit":
+		job := cmd.Job
+		job.Index = index
+		job.Status = Pending
+		l.jobs[job.ID] = &job
+	case "complete":
+		job, ok := l.jobs[cmd.Job.ID]
+		if !ok {
+			return fmt.Errorf("unknown job %s", cmd.Job.ID)
+		}
+		job.Status = Done
+		job.Code = cmd.Job.Code
+		job.Response = cmd.Job.Response
+		job.Completed = cmd.Job.Completed
+	default:
+		return fmt.Errorf("unknown op %q", cmd.Op)
+	}
+	return nil
+}
+
+// Snapshot implements raft.StateMachine.
+func (l *Log) Snapshot() ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return json.Marshal(l.jobs)
+}
+
+// Restore implements raft.StateMachine.
+func (l *Log) Restore(data []byte) error {
+	jobs := make(map[string]*Job)
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.jobs = jobs
+	l.mu.Unlock()
+	return nil
+}
+
+// Jobs returns the jobs with the given status ("" for all), in submission order.
+func (l *Log) Jobs(status string) []Job {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := []Job{}
+	for _, j := range l.jobs {
+		if status == "" || j.Status == status {
+			out = append(out, *j)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Index < out[j].Index })
+	return out
+}
+
+// replayedHeaders are stored with a job so a re-run sees the same client metadata.
+var replayedHeaders = []string{"X-Client-Name", "X-Request-Type", "X-Priority"}
+
+// Recorder wraps exercise handlers so that every batch is replicated
+// through Raft. Only the leader processes batches; other nodes forward
+// them to the leader.
+type Recorder struct {
+	Node    *raft.Node
+	Log     *Log
+	Peers   map[string]string // Raft node ID -> server base URL
+	Timeout time.Duration     // how long to wait for a command to commit
+	Client  *http.Client
+
+	mu       sync.Mutex
+	handlers map[string]http.Handler
+}
+
+// NewRecorder returns a recorder for log; Node must be set before serving.
+func NewRecorder(l *Log, peers map[string]string) *Recorder {
+	return &Recorder{
+		Log:      l,
+		Peers:    peers,
+		Timeout:  3 * time.Second,
+		Client:   &http.Client{Timeout: 5 * time.Second},
+		handlers: make(map[string]http.Handler),
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// completion is the command recording out as the response to job. Error
+// responses are completions too: running the batch again would fail the
+// same way. Bodies that are not JSON, such as those of http.Error, are
+// kept as a JSON string.
+func completion(job string, out *httpbuf.Response) command {
+	body := out.Body.Bytes()
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	return command{Op: "complete", Job: Job{ID: job, Code: out.Code, Response: json.RawMessage(body), Completed: time.Now().UTC()}}
+}
+
+func (rec *Recorder) apply(ctx context.Context, cmd command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, rec.Timeout)
+	defer cancel()
+	res, err := rec.Node.Apply(ctx, data)
+	if err != nil {
+		return err
+	}
+	if err, ok := res.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Wrap returns a handler for exercise (e.g. "ex2") that records each
+// batch in the replicated log around next.
+func (rec *Recorder) Wrap(exercise string, next http.Handler) http.Handler {
+	rec.mu.Lock()
+	rec.handlers[exercise] = next
+	rec.mu.Unlock()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+
+		st := rec.Node.Status()
+		if st.Role != raft.Leader {
+			rec.forward(w, r, st.Leader, body)
+			return
+		}
+
+		if !json.Valid(body) {
+			// Let the handler produce its usual error; nothing to record.
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		job := Job{
+			ID:        newJobID(),
+			Exercise:  exercise,
+			Client:    r.Header.Get("X-Client-Name"),
+			Header:    map[string]string{},
+			Body:      json.RawMessage(body),
+			Submitted: time.Now().UTC(),
+		}
+		for _, h := range replayedHeaders {
+			if v := r.Header.Get(h); v != "" {
+				job.Header[h] = v
+			}
+		}
+		if err := rec.apply(r.Context(), command{Op: "submit", Job: job}); err != nil {
+			http.Error(w, "job log unavailable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		out := httpbuf.Serve(next, r)
+		if err := rec.apply(r.Context(), completion(job.ID, out)); err != nil {
+			http.Error(w, "job log unavailable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		for k, v := range out.Header() {
+			w.Header()[k] = v
+		}
+		w.Header().Set("X-Job-Id", job.ID)
+		w.WriteHeader(out.Code)
+		w.Write(out.Body.Bytes())
+	})
+}
+
+// forward relays a request to the current leader and copies its response.
+func (rec *Recorder) forward(w http.ResponseWriter, r *http.Request, leader string, body []byte) {
+	base, ok := rec.Peers[leader]
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "no raft leader elected yet", http.StatusServiceUnavailable)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, base+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "failed to build request", http.StatusInternalServerError)
+		return
+	}
+	req.Header = r.Header.Clone()
+	resp, err := rec.Client.Do(req)
+	if err != nil {
+		http.Error(w, "leader unreachable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Raft-Leader", leader)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Recover re-runs the jobs left pending by a previous leader. It is meant
+// to be called from raft's OnLeader, which runs once the new leader has
+// applied every job the previous one committed.
+func (rec *Recorder) Recover() {
+	for _, job := range rec.Log.Jobs(Pending) {
+		rec.mu.Lock()
+		h, ok := rec.handlers[job.Exercise]
+		rec.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/"+job.Exercise, bytes.NewReader(job.Body))
+		if err != nil {
+			log.Printf("joblog: re-running job %s failed: %v", job.ID, err)
+			continue
+		}
+		for k, v := range job.Header {
+			req.Header.Set(k, v)
+		}
+		out := httpbuf.Serve(h, req)
+		if out.Code != http.StatusOK {
+			log.Printf("joblog: re-running job %s failed with status %d", job.ID, out.Code)
+		}
+		if err := rec.apply(context.Background(), completion(job.ID, out)); err != nil {
+			if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLostLeadership) {
+				return
+			}
+			log.Printf("joblog: completing job %s failed: %v", job.ID, err)
+			continue
+		}
+		log.Printf("joblog: recovered job %s (%s from %s)", job.ID, job.Exercise, job.Client)
+	}
+}
+
+// JobsHandler lists replicated jobs; ?status=pending or ?status=done filters them.
+func (rec *Recorder) JobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobs := rec.Log.Jobs(r.URL.Query().Get("status"))
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"node": rec.Node.Status(), "jobs": jobs}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
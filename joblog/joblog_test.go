@@ -0,0 +1,184 @@
+package joblog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/raft"
+)
+
+// leader returns a recorder on a single-node Raft cluster that leads.
+func leader(t *testing.T) *Recorder {
+	t.Helper()
+	jobs := NewLog()
+	rec := NewRecorder(jobs, nil)
+	node, err := raft.New(raft.Config{
+		ID:              "solo",
+		Peers:           []string{"solo"},
+		Transport:       raft.NewInmemNetwork().Transport("solo"),
+		StateMachine:    jobs,
+		ElectionTimeout: 20 * time.Millisecond,
+		Logger:          log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Node = node
+	node.Start()
+	t.Cleanup(node.Stop)
+	for deadline := time.Now().Add(2 * time.Second); node.Status().Role != raft.Leader; {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return rec
+}
+
+// echo answers with the number of items posted, or 400 if the body is
+// not an array.
+func echo(w http.ResponseWriter, r *http.Request) {
+	var arr []string
+	if err := json.NewDecoder(r.Body).Decode(&arr); err != nil {
+		http.Error(w, "invalid json: expected array of strings", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"count": len(arr), "client": r.Header.Get("X-Client-Name")})
+}
+
+func post(h http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/ex2", strings.NewReader(body))
+	req.Header.Set("X-Client-Name", "alice")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestRecorderCompletesJobs(t *testing.T) {
+	rec := leader(t)
+	h := rec.Wrap("ex2", http.HandlerFunc(echo))
+	tests := []struct {
+		name, body string
+		code       int
+		response   string
+	}{
+		{"success", `["a","b"]`, http.StatusOK, `{"client":"alice","count":2}`},
+		// Valid JSON the handler refuses is still a finished job.
+		{"error response", `{"not":"an array"}`, http.StatusBadRequest, `"invalid json: expected array of strings\n"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := post(h, tt.body)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			id := w.Header().Get("X-Job-Id")
+			var job *Job
+			for _, j := range rec.Log.Jobs("") {
+				if j.ID == id {
+					job = &j
+				}
+			}
+			if job == nil {
+				t.Fatalf("job %q not in the log", id)
+			}
+			if job.Status != Done || job.Code != tt.code || strings.TrimSpace(string(job.Response)) != tt.response {
+				t.Errorf("job %+v", job)
+			}
+			if job.Client != "alice" || string(job.Body) != tt.body {
+				t.Errorf("submitted as %s: %s", job.Client, job.Body)
+			}
+		})
+	}
+	if pending := rec.Log.Jobs(Pending); len(pending) != 0 {
+		t.Errorf("pending jobs left: %+v", pending)
+	}
+}
+
+func TestRecoverRerunsPendingJobs(t *testing.T) {
+	rec := leader(t)
+	runs := 0
+	rec.Wrap("ex2", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		echo(w, r)
+	}))
+	// Submitted by a leader that crashed before completing them.
+	for _, job := range []Job{
+		{ID: "ok", Exercise: "ex2", Client: "bob", Header: map[string]string{"X-Client-Name": "bob"}, Body: json.RawMessage(`["x"]`)},
+		{ID: "bad", Exercise: "ex2", Body: json.RawMessage(`{}`)},
+		{ID: "unknown", Exercise: "ex99", Body: json.RawMessage(`[]`)},
+	} {
+		if err := rec.apply(context.Background(), command{Op: "submit", Job: job}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec.Recover()
+	if runs != 2 {
+		t.Fatalf("%d jobs run, want 2", runs)
+	}
+	codes := map[string]int{}
+	for _, j := range rec.Log.Jobs(Done) {
+		codes[j.ID] = j.Code
+		if j.ID == "ok" && strings.TrimSpace(string(j.Response)) != `{"client":"bob","count":1}` {
+			t.Errorf("recovered response %s", j.Response)
+		}
+	}
+	if codes["ok"] != http.StatusOK || codes["bad"] != http.StatusBadRequest || len(codes) != 2 {
+		t.Errorf("completed %v", codes)
+	}
+
+	// Nothing is left to run again at the next leader change.
+	rec.Recover()
+	if runs != 2 {
+		t.Errorf("%d runs after a second recovery", runs)
+	}
+}
+
+func TestFollowerForwardsToLeader(t *testing.T) {
+	var got *http.Request
+	var body string
+	leaderSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		got, body = r, string(data)
+		w.Header().Set("X-Job-Id", "from-leader")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	defer leaderSrv.Close()
+
+	jobs := NewLog()
+	node, err := raft.New(raft.Config{ID: "b", Peers: []string{"a", "b"}, Transport: raft.NewInmemNetwork().Transport("b"), StateMachine: jobs, Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := NewRecorder(jobs, map[string]string{"a": leaderSrv.URL})
+	rec.Node = node
+	h := rec.Wrap("ex2", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a follower ran the batch")
+	}))
+
+	// Before a leader is known, clients are told to retry.
+	if w := post(h, `["a"]`); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("without a leader: %d %v", w.Code, w.Header())
+	}
+
+	node.HandleAppendEntries(raft.AppendEntriesArgs{Term: 1, Leader: "a"})
+	w := post(h, `["a"]`)
+	if w.Code != http.StatusAccepted || w.Body.String() != `{"ok":true}` || w.Header().Get("X-Raft-Leader") != "a" || w.Header().Get("X-Job-Id") != "from-leader" {
+		t.Fatalf("forwarded response %d %v %s", w.Code, w.Header(), w.Body)
+	}
+	if got == nil || got.URL.Path != "/ex2" || body != `["a"]` || got.Header.Get("X-Client-Name") != "alice" {
+		t.Errorf("leader received %+v with %q", got, body)
+	}
+	if len(jobs.Jobs("")) != 0 {
+		t.Error("the follower recorded the job itself")
+	}
+}
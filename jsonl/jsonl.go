@@ -0,0 +1,47 @@
+// Package jsonl opens append-only logs of JSON lines, the format the
+// write-ahead logs in this repository share.
+package jsonl
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// Open opens the log at path for appending, creating it if it does not
+// exist, and passes each record already in it to fn, in order. Reading
+// stops at the first line that is incomplete or does not decode, as a
+// crash mid-write leaves the last one; the file is cut there, so the
+// next record starts on a line of its own.
+func Open[T any](path string, fn func(rec T)) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	valid := 0
+	for valid < len(data) {
+		end := bytes.IndexByte(data[valid:], '\n')
+		if end < 0 {
+			break
+		}
+		var rec T
+		if err := json.Unmarshal(data[valid:valid+end], &rec); err != nil {
+			break
+		}
+		fn(rec)
+		valid += end + 1
+	}
+	if valid < len(data) {
+		if err := f.Truncate(int64(valid)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
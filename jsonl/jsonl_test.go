@@ -0,0 +1,51 @@
+package jsonl
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type rec struct {
+	N int `json:"n"`
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name, content string
+		want          []int
+		kept          string
+	}{
+		{"missing file", "", nil, ""},
+		{"complete lines", "{\"n\":1}\n{\"n\":2}\n", []int{1, 2}, "{\"n\":1}\n{\"n\":2}\n"},
+		{"torn last line", "{\"n\":1}\n{\"n\":", []int{1}, "{\"n\":1}\n"},
+		{"line without newline", "{\"n\":1}\n{\"n\":2}", []int{1}, "{\"n\":1}\n"},
+		{"garbage stops reading", "{\"n\":1}\nxx\n{\"n\":3}\n", []int{1}, "{\"n\":1}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log.jsonl")
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []int
+			f, err := Open(path, func(r rec) { got = append(got, r.N) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read %v, want %v", got, tt.want)
+			}
+			// The next record goes on a line of its own.
+			f.WriteString("{\"n\":9}\n")
+			f.Close()
+			data, _ := os.ReadFile(path)
+			if string(data) != tt.kept+"{\"n\":9}\n" {
+				t.Errorf("file %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Client.Get for a key that does not exist or
+// has been deleted.
+var ErrNotFound = errors.New("kvstore: key not found")
+
+// Client talks to any node of the store.
+type Client struct {
+	base string
+	http *http.Client
+}
+
+// NewClient returns a client for the node at base, e.g. http://localhost:9001.
+func NewClient(base string) *Client {
+	return &Client{base: strings.TrimRight(base, "/"), http: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// GetResult is the answer to a read.
+type GetResult struct {
+	Key       string    `json:"key"`
+	Versions  []Version `json:"versions"`
+	Siblings  int       `json:"siblings"`
+	Context   string    `json:"context"`
+	Replicas  []string  `json:"replicas"`
+	Responded int       `json:"responded"`
+}
+
+// PutResult is the answer to a write or delete.
+type PutResult struct {
+	Key         string `json:"key"`
+	Clock       string `json:"clock"`
+	Deleted     bool   `json:"deleted"`
+	Coordinator string `json:"coordinator"`
+	Acks        int    `json:"acks"`
+	W           int    `json:"w"`
+}
+
+// Get reads key. More than one version means concurrent writes the caller
+// should resolve by writing with the returned context.
+func (c *Client) Get(ctx context.Context, key string) (GetResult, error) {
+	var res GetResult
+	status, err := c.do(ctx, http.MethodGet, key, "", nil, &res)
+	if err == nil && status == http.StatusNotFound {
+		err = ErrNotFound
+	}
+	return res, err
+}
+
+// Put stores doc under key. vv is the context of the read the write is
+// based on, or "" to supersede whatever the primary holds.
+func (c *Client) Put(ctx context.Context, key string, doc json.RawMessage, vv string) (PutResult, error) {
+	var res PutResult
+	_, err := c.do(ctx, http.MethodPut, key, vv, doc, &res)
+	return res, err
+}
+
+// Delete removes key; vv works as for Put.
+func (c *Client) Delete(ctx context.Context, key string, vv string) (PutResult, error) {
+	var res PutResult
+	_, err := c.do(ctx, http.MethodDelete, key, vv, nil, &res)
+	return res, err
+}
+
+func (c *Client) do(ctx context.Context, method, key, vv string, body []byte, out interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+"/kv/"+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if vv != "" {
+		req.Header.Set(VersionHeader, vv)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp.StatusCode, json.Unmarshal(data, out)
+}
@@ -0,0 +1,434 @@
+// Package kvstore is a small replicated key-value store for JSON documents.
+// Each key is kept on N nodes picked from a consistent-hash ring; the first
+// reachable one acts as the key's primary, stamps every write with a
+// version vector and replicates it to the backups, and the write succeeds
+// once W replicas have stored it. Reads ask the N replicas and answer after
+// R of them reply, repairing replicas that are behind. Writes accepted by
+// different primaries during a failure are concurrent, and reads return
+// them side by side as siblings until a client writes a resolution.
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/hashring"
+)
+
+// VersionHeader carries the version vector context of reads and writes.
+const VersionHeader = "X-Version-Vector"
+
+// forwardedHeader marks a write forwarded to a key's primary, which then
+// coordinates it instead of forwarding it again.
+const forwardedHeader = "X-KV-Forwarded"
+
+// Config configures a Node.
+type Config struct {
+	ID    string
+	Peers map[string]string // node ID -> base URL, including this node
+	N     int               // replicas per key
+	R     int               // replies needed for a read
+	W     int               // acknowledgements needed for a write
+	Store *Store
+	// Client talks to the other nodes; it defaults to a 2s timeout.
+	Client *http.Client
+}
+
+// Node serves the store's HTTP API and coordinates replication.
+type Node struct {
+	cfg  Config
+	ring *hashring.Ring
+}
+
+// NewNode checks the peers and quorum settings and returns a node.
+func NewNode(cfg Config) (*Node, error) {
+	for id := range cfg.Peers {
+		// Version vectors are written as comma-separated id:count entries.
+		if id == "" || strings.Contains(id, ",") {
+			return nil, fmt.Errorf("kvstore: invalid node ID %q", id)
+		}
+	}
+	if _, ok := cfg.Peers[cfg.ID]; !ok {
+		return nil, fmt.Errorf("kvstore: peers must include %s", cfg.ID)
+	}
+	if cfg.N < 1 || cfg.N > len(cfg.Peers) {
+		return nil, fmt.Errorf("kvstore: N=%d must be between 1 and the %d peers", cfg.N, len(cfg.Peers))
+	}
+	if cfg.R < 1 || cfg.R > cfg.N || cfg.W < 1 || cfg.W > cfg.N {
+		return nil, fmt.Errorf("kvstore: R=%d and W=%d must be between 1 and N=%d", cfg.R, cfg.W, cfg.N)
+	}
+	if cfg.R+cfg.W <= cfg.N {
+		log.Printf("kvstore: R+W <= N, reads may miss the latest write")
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 2 * time.Second}
+	}
+	ring := hashring.New(64)
+	for id := range cfg.Peers {
+		ring.Add(id)
+	}
+	return &Node{cfg: cfg, ring: ring}, nil
+}
+
+// Replicas returns the nodes holding key, primary first.
+func (n *Node) Replicas(key string) []string {
+	return n.ring.GetN(key, n.cfg.N)
+}
+
+// Register adds the client API (/kv/KEY), the replica API used between
+// nodes (/replica/KEY) and /status to mux.
+func (n *Node) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/kv/", n.handleKV)
+	mux.HandleFunc("/replica/", n.handleReplica)
+	mux.HandleFunc("/status", n.handleStatus)
+}
+
+func keyFromPath(r *http.Request, prefix string) (string, bool) {
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+	return key, err == nil && key != ""
+}
+
+func (n *Node) handleKV(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyFromPath(r, "/kv/")
+	if !ok {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		n.serveGet(w, r, key)
+	case http.MethodPut, http.MethodDelete:
+		n.serveWrite(w, r, key)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (n *Node) serveGet(w http.ResponseWriter, r *http.Request, key string) {
+	versions, responded, err := n.read(r.Context(), key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	live := 0
+	for _, v := range versions {
+		if !v.Deleted {
+			live++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(VersionHeader, Context(versions).String())
+	if live == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	resp := map[string]interface{}{
+		"key":       key,
+		"versions":  versions,
+		"siblings":  len(versions),
+		"context":   Context(versions).String(),
+		"replicas":  n.Replicas(key),
+		"responded": responded,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (n *Node) serveWrite(w http.ResponseWriter, r *http.Request, key string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+	deleted := r.Method == http.MethodDelete
+	if !deleted && !json.Valid(body) {
+		http.Error(w, "invalid json document", http.StatusBadRequest)
+		return
+	}
+	var clientCtx VersionVector
+	if h := r.Header.Get(VersionHeader); h != "" {
+		if clientCtx, err = ParseVersionVector(h); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.Header.Get(forwardedHeader) == "" {
+		isReplica := false
+		for _, id := range n.Replicas(key) {
+			if id == n.cfg.ID {
+				isReplica = true
+				break // this node is the first reachable replica
+			}
+			if n.forward(w, r, id, body) {
+				return
+			}
+		}
+		if !isReplica {
+			http.Error(w, "no replica of "+key+" is reachable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	var value json.RawMessage
+	if !deleted {
+		value = body
+	}
+	v, acks, err := n.write(key, clientCtx, value, deleted)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(VersionHeader, v.Clock.String())
+	resp := map[string]interface{}{
+		"key":         key,
+		"clock":       v.Clock.String(),
+		"deleted":     deleted,
+		"coordinator": n.cfg.ID,
+		"acks":        acks,
+		"w":           n.cfg.W,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// forward relays a write to node id and copies its response. It returns
+// false if the node could not be reached, so the next replica can try.
+func (n *Node) forward(w http.ResponseWriter, r *http.Request, id string, body []byte) bool {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, n.cfg.Peers[id]+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(forwardedHeader, n.cfg.ID)
+	resp, err := n.cfg.Client.Do(req)
+	if err != nil {
+		log.Printf("kvstore: primary %s unreachable, trying the next replica: %v", id, err)
+		return false
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
+
+// write stamps a new version of key, stores it and replicates it to the
+// other replicas, returning once W of them (this node included) have it.
+// Without a client context the write supersedes every version this node
+// knows of.
+func (n *Node) write(key string, clientCtx VersionVector, value json.RawMessage, deleted bool) (Version, int, error) {
+	v, err := n.cfg.Store.Update(key, func(cur []Version) Version {
+		local := Context(cur)
+		base := clientCtx
+		if base == nil {
+			base = local
+		}
+		clock := base.Copy()
+		clock[n.cfg.ID] = max(base[n.cfg.ID], local[n.cfg.ID]) + 1
+		return Version{Clock: clock, Value: value, Deleted: deleted, Written: time.Now().UTC()}
+	})
+	if err != nil {
+		return v, 0, fmt.Errorf("failed to store %s: %w", key, err)
+	}
+
+	// The backups keep replicating after the quorum is reached, so they
+	// use their own context rather than the client's request.
+	backups := n.backups(key)
+	results := make(chan error, len(backups))
+	for _, id := range backups {
+		go func(id string) {
+			results <- n.pushReplica(context.Background(), id, key, []Version{v})
+		}(id)
+	}
+	acks := 1
+	for range backups {
+		if acks >= n.cfg.W {
+			return v, acks, nil
+		}
+		if err := <-results; err != nil {
+			log.Printf("kvstore: replicating %s: %v", key, err)
+		} else {
+			acks++
+		}
+	}
+	if acks >= n.cfg.W {
+		return v, acks, nil
+	}
+	return v, acks, fmt.Errorf("write quorum not reached: %d of W=%d replicas stored %s", acks, n.cfg.W, key)
+}
+
+// backups returns the replicas of key other than this node.
+func (n *Node) backups(key string) []string {
+	var out []string
+	for _, id := range n.Replicas(key) {
+		if id != n.cfg.ID {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+type replicaReply struct {
+	id       string
+	versions []Version
+	err      error
+}
+
+// read collects the versions of key from its replicas until R have
+// answered, and repairs the replicas that answered with stale versions.
+func (n *Node) read(ctx context.Context, key string) ([]Version, int, error) {
+	replicas := n.Replicas(key)
+	replies := make(chan replicaReply, len(replicas))
+	for _, id := range replicas {
+		go func(id string) {
+			versions, err := n.fetchReplica(ctx, id, key)
+			replies <- replicaReply{id: id, versions: versions, err: err}
+		}(id)
+	}
+
+	var ok []replicaReply
+	for range replicas {
+		rep := <-replies
+		if rep.err != nil {
+			log.Printf("kvstore: reading %s: %v", key, rep.err)
+			continue
+		}
+		ok = append(ok, rep)
+		if len(ok) >= n.cfg.R {
+			break
+		}
+	}
+	if len(ok) < n.cfg.R {
+		return nil, len(ok), fmt.Errorf("read quorum not reached: %d of R=%d replicas answered for %s", len(ok), n.cfg.R, key)
+	}
+
+	var all []Version
+	for _, rep := range ok {
+		all = append(all, rep.versions...)
+	}
+	merged := Reconcile(all)
+	for _, rep := range ok {
+		if !sameClocks(rep.versions, merged) {
+			go func(id string) {
+				if err := n.pushReplica(context.Background(), id, key, merged); err != nil {
+					log.Printf("kvstore: read repair of %s on %s: %v", key, id, err)
+				}
+			}(rep.id)
+		}
+	}
+	return merged, len(ok), nil
+}
+
+func (n *Node) fetchReplica(ctx context.Context, id, key string) ([]Version, error) {
+	if id == n.cfg.ID {
+		return n.cfg.Store.Get(key), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.cfg.Peers[id]+"/replica/"+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := n.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("replica %s: %s", id, resp.Status)
+	}
+	var versions []Version
+	err = json.NewDecoder(resp.Body).Decode(&versions)
+	return versions, err
+}
+
+func (n *Node) pushReplica(ctx context.Context, id, key string, versions []Version) error {
+	if id == n.cfg.ID {
+		_, err := n.cfg.Store.Put(key, versions...)
+		return err
+	}
+	data, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, n.cfg.Peers[id]+"/replica/"+url.PathEscape(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := n.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("replica %s: %s", id, resp.Status)
+	}
+	return nil
+}
+
+// handleReplica serves the local versions of a key to other nodes and
+// stores the versions they push.
+func (n *Node) handleReplica(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyFromPath(r, "/replica/")
+	if !ok {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(n.cfg.Store.Get(key)); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	case http.MethodPut:
+		var versions []Version
+		if err := json.NewDecoder(r.Body).Decode(&versions); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if _, err := n.cfg.Store.Put(key, versions...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (n *Node) handleStatus(w http.ResponseWriter, r *http.Request) {
+	peers := make([]string, 0, len(n.cfg.Peers))
+	for id := range n.cfg.Peers {
+		peers = append(peers, id)
+	}
+	sort.Strings(peers)
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{
+		"id":    n.cfg.ID,
+		"peers": peers,
+		"n":     n.cfg.N,
+		"r":     n.cfg.R,
+		"w":     n.cfg.W,
+		"keys":  n.cfg.Store.Keys(),
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
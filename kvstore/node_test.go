@@ -0,0 +1,185 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() { log.SetOutput(io.Discard) }
+
+// testCluster is a store cluster of httptest servers, one per node.
+type testCluster struct {
+	nodes   map[string]*Node
+	stores  map[string]*Store
+	servers map[string]*httptest.Server
+	urls    map[string]string
+}
+
+// newCluster starts nodes n1..n<size> with the given quorum settings.
+func newCluster(t *testing.T, size, n, r, w int) *testCluster {
+	t.Helper()
+	c := &testCluster{nodes: map[string]*Node{}, stores: map[string]*Store{}, servers: map[string]*httptest.Server{}, urls: map[string]string{}}
+	muxes := map[string]*http.ServeMux{}
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprint("n", i)
+		muxes[id] = http.NewServeMux()
+		c.servers[id] = httptest.NewServer(muxes[id])
+		t.Cleanup(c.servers[id].Close)
+		c.urls[id] = c.servers[id].URL
+	}
+	for id, mux := range muxes {
+		c.stores[id], _ = OpenStore("")
+		node, err := NewNode(Config{ID: id, Peers: c.urls, N: n, R: r, W: w, Store: c.stores[id]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Register(mux)
+		c.nodes[id] = node
+	}
+	return c
+}
+
+// down stops the server of node id, as if it had crashed.
+func (c *testCluster) down(ids ...string) {
+	for _, id := range ids {
+		c.servers[id].Close()
+	}
+}
+
+// do sends a request for key to node id and returns the status and the
+// decoded JSON response, if any.
+func (c *testCluster) do(t *testing.T, method, id, key, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, c.urls[id]+"/kv/"+key, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func TestQuorum(t *testing.T) {
+	tests := []struct {
+		name       string
+		r, w       int
+		down       int // backups of the key that are down
+		put, get   int // expected status codes
+		acksAtMost int
+	}{
+		{"all up", 2, 2, 0, http.StatusOK, http.StatusOK, 3},
+		{"one backup down", 2, 2, 1, http.StatusOK, http.StatusOK, 2},
+		{"W=3 with a backup down", 1, 3, 1, http.StatusServiceUnavailable, http.StatusOK, 2},
+		{"R=3 with a backup down", 3, 1, 1, http.StatusOK, http.StatusServiceUnavailable, 2},
+		{"both backups down", 2, 2, 2, http.StatusServiceUnavailable, http.StatusServiceUnavailable, 1},
+		{"R=W=1 with both backups down", 1, 1, 2, http.StatusOK, http.StatusOK, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCluster(t, 3, 3, tt.r, tt.w)
+			replicas := c.nodes["n1"].Replicas("k")
+			primary := replicas[0]
+			c.down(replicas[1 : 1+tt.down]...)
+
+			code, out := c.do(t, http.MethodPut, primary, "k", `{"v":1}`)
+			if code != tt.put {
+				t.Fatalf("PUT status %d, want %d: %v", code, tt.put, out)
+			}
+			if acks, _ := out["acks"].(float64); code == http.StatusOK && (int(acks) < tt.w || int(acks) > tt.acksAtMost) {
+				t.Errorf("acks %v, want between W=%d and %d", out["acks"], tt.w, tt.acksAtMost)
+			}
+			code, out = c.do(t, http.MethodGet, primary, "k", "")
+			if code != tt.get {
+				t.Fatalf("GET status %d, want %d: %v", code, tt.get, out)
+			}
+			if code == http.StatusOK && out["responded"].(float64) < float64(tt.r) {
+				t.Errorf("read answered by %v replicas, want at least R=%d", out["responded"], tt.r)
+			}
+		})
+	}
+}
+
+func TestWriteGoesToPrimary(t *testing.T) {
+	tests := []struct {
+		name string
+		down int // replicas of the key that are down, primary first
+		want int // index in the replica list of the expected coordinator, or -1
+	}{
+		{"primary up", 0, 0},
+		{"primary down", 1, 1},
+		{"every replica down", 2, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// With N=2 of 3 nodes, one node does not hold the key.
+			c := newCluster(t, 3, 2, 1, 1)
+			replicas := c.nodes["n1"].Replicas("k")
+			var other string
+			for id := range c.nodes {
+				if id != replicas[0] && id != replicas[1] {
+					other = id
+				}
+			}
+			c.down(replicas[:tt.down]...)
+
+			code, out := c.do(t, http.MethodPut, other, "k", `{"v":1}`)
+			if tt.want < 0 {
+				if code != http.StatusServiceUnavailable {
+					t.Errorf("PUT status %d, want 503: %v", code, out)
+				}
+				return
+			}
+			if code != http.StatusOK || out["coordinator"] != replicas[tt.want] {
+				t.Fatalf("PUT status %d coordinated by %v, want %s", code, out["coordinator"], replicas[tt.want])
+			}
+			if len(c.stores[other].Get("k")) != 0 {
+				t.Errorf("%s stored a key it is not a replica of", other)
+			}
+		})
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	c := newCluster(t, 3, 3, 3, 1)
+	replicas := c.nodes["n1"].Replicas("k")
+	newer := Version{Clock: VersionVector{replicas[0]: 2}, Value: json.RawMessage(`"new"`)}
+	older := Version{Clock: VersionVector{replicas[0]: 1}, Value: json.RawMessage(`"old"`)}
+	c.stores[replicas[0]].Put("k", newer)
+	c.stores[replicas[1]].Put("k", newer)
+	c.stores[replicas[2]].Put("k", older)
+
+	code, out := c.do(t, http.MethodGet, replicas[0], "k", "")
+	if code != http.StatusOK || out["siblings"].(float64) != 1 {
+		t.Fatalf("GET status %d: %v", code, out)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := c.stores[replicas[2]].Get("k")
+		if len(got) == 1 && got[0].Clock.Compare(newer.Clock) == Equal {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stale replica %s still holds %+v", replicas[2], got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewNodeRejectsCommaInID(t *testing.T) {
+	_, err := NewNode(Config{ID: "a,b", Peers: map[string]string{"a,b": "http://x"}, N: 1, R: 1, W: 1})
+	if err == nil {
+		t.Fatal("NewNode accepted an ID that version vectors cannot encode")
+	}
+}
@@ -0,0 +1,169 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Version is one value of a key together with the version vector of the
+// write that produced it. A delete is stored as a tombstone version so it
+// replicates and conflicts like any other write.
+type Version struct {
+	Clock   VersionVector   `json:"clock"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Written time.Time       `json:"written"`
+}
+
+// Reconcile merges versions into the smallest set of concurrent versions:
+// every version another one descends from is dropped. The survivors are
+// the siblings a reader has to resolve.
+func Reconcile(versions []Version) []Version {
+	out := []Version{}
+	for _, v := range versions {
+		keep := true
+		for i := 0; i < len(out); i++ {
+			if out[i].Clock.Descends(v.Clock) {
+				keep = false
+				break
+			}
+			if v.Clock.Descends(out[i].Clock) {
+				out = append(out[:i], out[i+1:]...)
+				i--
+			}
+		}
+		if keep {
+			out = append(out, v)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Written.Before(out[j].Written) })
+	return out
+}
+
+// Context returns the merge of the versions' clocks, which a client sends
+// back with its next write to say which versions the write supersedes.
+func Context(versions []Version) VersionVector {
+	ctx := VersionVector{}
+	for _, v := range versions {
+		ctx = ctx.Merge(v.Clock)
+	}
+	return ctx
+}
+
+// Store is the local replica of a node: the sibling versions of every key
+// it holds, saved as a JSON document on every write.
+type Store struct {
+	path string
+
+	mu   sync.RWMutex
+	keys map[string][]Version
+}
+
+// OpenStore loads the store saved at path, or starts empty if there is none.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path, keys: make(map[string][]Version)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the sibling versions of key.
+func (s *Store) Get(key string) []Version {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Version(nil), s.keys[key]...)
+}
+
+// Put adds versions of key, keeping only those not superseded, and saves
+// the store. It reports whether anything changed.
+func (s *Store) Put(key string, versions ...Version) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.keys[key]
+	after := Reconcile(append(append([]Version(nil), before...), versions...))
+	if sameClocks(before, after) {
+		return false, nil
+	}
+	s.keys[key] = after
+	return true, s.save()
+}
+
+// Update builds a new version of key from its current siblings and stores
+// it as Put does, all under the store lock, so concurrent writers never
+// build on the same siblings. It returns the version built.
+func (s *Store) Update(key string, next func(cur []Version) Version) (Version, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.keys[key]
+	v := next(append([]Version(nil), before...))
+	after := Reconcile(append(append([]Version(nil), before...), v))
+	if sameClocks(before, after) {
+		return v, nil
+	}
+	s.keys[key] = after
+	return v, s.save()
+}
+
+// Keys returns the stored keys, sorted.
+func (s *Store) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.keys))
+	for k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// save writes the store to a temporary file and renames it over the old
+// one, so a crash never leaves a half-written document. Caller holds s.mu.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func sameClocks(a, b []Version) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range b {
+		found := false
+		for _, w := range a {
+			if v.Clock.Compare(w.Clock) == Equal {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
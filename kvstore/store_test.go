@@ -0,0 +1,49 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestUpdateIsAtomic(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Update("k", func(cur []Version) Version {
+				clock := Context(cur).Copy()
+				clock["a"]++
+				return Version{Clock: clock, Value: json.RawMessage(`1`)}
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every write built on the one before it, so none became a sibling
+	// and none was lost.
+	got := s.Get("k")
+	if len(got) != 1 || got[0].Clock["a"] != writers {
+		t.Fatalf("versions %+v, want one at a=%d", got, writers)
+	}
+}
+
+func TestUpdateKeepsConcurrentSiblings(t *testing.T) {
+	s, _ := OpenStore("")
+	s.Put("k", Version{Clock: VersionVector{"a": 1}})
+	// A write from a client that never saw a:1 is concurrent with it.
+	s.Update("k", func(cur []Version) Version { return Version{Clock: VersionVector{"b": 1}} })
+	if got := s.Get("k"); len(got) != 2 {
+		t.Fatalf("versions %+v, want both siblings", got)
+	}
+}
@@ -0,0 +1,122 @@
+package kvstore
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ordering is the causal relation between two version vectors.
+type Ordering int
+
+const (
+	Equal      Ordering = iota
+	Before              // the first vector happened before the second
+	After               // the first vector happened after the second
+	Concurrent          // neither descends from the other: a conflict
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	}
+	return "concurrent"
+}
+
+// VersionVector counts the writes each node has coordinated for a key.
+type VersionVector map[string]uint64
+
+// Copy returns an independent copy of v.
+func (v VersionVector) Copy() VersionVector {
+	out := make(VersionVector, len(v))
+	for id, n := range v {
+		out[id] = n
+	}
+	return out
+}
+
+// Merge returns the element-wise maximum of v and o.
+func (v VersionVector) Merge(o VersionVector) VersionVector {
+	out := v.Copy()
+	for id, n := range o {
+		if n > out[id] {
+			out[id] = n
+		}
+	}
+	return out
+}
+
+// Compare reports how v relates to o.
+func (v VersionVector) Compare(o VersionVector) Ordering {
+	less, greater := false, false
+	for id, n := range v {
+		if n > o[id] {
+			greater = true
+		} else if n < o[id] {
+			less = true
+		}
+	}
+	for id, n := range o {
+		if _, ok := v[id]; !ok && n > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+// Descends reports whether v has seen every write o has.
+func (v VersionVector) Descends(o VersionVector) bool {
+	ord := v.Compare(o)
+	return ord == After || ord == Equal
+}
+
+// String encodes v as "n1:3,n2:1", sorted by node ID; it is the format of
+// the X-Version-Vector header.
+func (v VersionVector) String() string {
+	ids := make([]string, 0, len(v))
+	for id := range v {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = id + ":" + strconv.FormatUint(v[id], 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseVersionVector decodes the format written by String. Node IDs may
+// themselves hold ':', as URLs do, so each count follows the last one.
+func ParseVersionVector(s string) (VersionVector, error) {
+	v := VersionVector{}
+	if strings.TrimSpace(s) == "" {
+		return v, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		entry := strings.TrimSpace(part)
+		i := strings.LastIndexByte(entry, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid version vector entry %q", part)
+		}
+		n, err := strconv.ParseUint(entry[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version vector entry %q", part)
+		}
+		v[entry[:i]] = n
+	}
+	return v, nil
+}
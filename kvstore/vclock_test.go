@@ -0,0 +1,72 @@
+package kvstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b VersionVector
+		want Ordering
+	}{
+		{"both empty", VersionVector{}, VersionVector{}, Equal},
+		{"same", VersionVector{"a": 1, "b": 2}, VersionVector{"a": 1, "b": 2}, Equal},
+		{"zero entry", VersionVector{"a": 1, "b": 0}, VersionVector{"a": 1}, Equal},
+		{"behind", VersionVector{"a": 1}, VersionVector{"a": 2}, Before},
+		{"missing node", VersionVector{"a": 1}, VersionVector{"a": 1, "b": 1}, Before},
+		{"ahead", VersionVector{"a": 2, "b": 1}, VersionVector{"a": 1}, After},
+		{"concurrent", VersionVector{"a": 2}, VersionVector{"a": 1, "b": 1}, Concurrent},
+		{"disjoint", VersionVector{"a": 1}, VersionVector{"b": 1}, Concurrent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Compare(tt.b); got != tt.want {
+				t.Errorf("%v.Compare(%v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			// The relation reads the other way round from b.
+			back := map[Ordering]Ordering{Equal: Equal, Before: After, After: Before, Concurrent: Concurrent}[tt.want]
+			if got := tt.b.Compare(tt.a); got != back {
+				t.Errorf("%v.Compare(%v) = %v, want %v", tt.b, tt.a, got, back)
+			}
+		})
+	}
+}
+
+func TestParseVersionVector(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    VersionVector
+		wantErr bool
+	}{
+		{in: "", want: VersionVector{}},
+		{in: "n1:3,n2:1", want: VersionVector{"n1": 3, "n2": 1}},
+		{in: " n1:3 , n2:1 ", want: VersionVector{"n1": 3, "n2": 1}},
+		{in: "http://localhost:9001:2", want: VersionVector{"http://localhost:9001": 2}},
+		{in: "n1", wantErr: true},
+		{in: ":3", wantErr: true},
+		{in: "n1:", wantErr: true},
+		{in: "n1:-1", wantErr: true},
+		{in: "n1:3,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseVersionVector(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseVersionVector(%q) error %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseVersionVector(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionVectorRoundTrip(t *testing.T) {
+	v := VersionVector{"n1": 3, "http://localhost:9002": 1, "b": 7}
+	got, err := ParseVersionVector(v.String())
+	if err != nil || !reflect.DeepEqual(got, v) {
+		t.Errorf("ParseVersionVector(%q) = %v, %v", v.String(), got, err)
+	}
+}
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/kvstore"
+	"github.com/liviu274/Distributed-systems/raft"
 )
 
 type Person struct {
@@ -12,12 +23,39 @@ type Person struct {
 	Adresses []string
 }
 
+var per1 = Person{"Andrei", 23, []string{
+	"123 Main St, Bucharest",
+	"45 Calea Victoriei, Bucharest",
+	"78 Strada Lipscani, Bucharest",
+}}
+
+const usage = `usage:
+  lab2                                          write per1.json and read it back
+  lab2 serve -id n1 -addr :9001 -peers n1=URL,n2=URL,... [-n 3 -r 2 -w 2] [-data DIR]
+  lab2 get    [-node URL] KEY
+  lab2 put    [-node URL] [-context VV] KEY [JSON]   (JSON defaults to per1)
+  lab2 delete [-node URL] [-context VV] KEY
+`
+
 func main() {
-	var per1 = Person{"Andrei", 23, []string{
-		"123 Main St, Bucharest",
-		"45 Calea Victoriei, Bucharest",
-		"78 Strada Lipscani, Bucharest",
-	}}
+	if len(os.Args) < 2 {
+		persistPerson()
+		return
+	}
+	switch os.Args[1] {
+	case "serve":
+		serve(os.Args[2:])
+	case "get", "put", "delete":
+		runClient(os.Args[1], os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// persistPerson is the original exercise: marshal per1 to per1.json and
+// read it back.
+func persistPerson() {
 	per1B, err := json.Marshal(per1)
 	if err != nil {
 		panic(err)
@@ -37,3 +75,95 @@ func main() {
 	}
 	// fmt.Println(data)
 }
+
+// serve runs one node of the replicated store. Start one process per
+// entry of -peers, e.g. for three local nodes:
+//
+//	lab2 serve -id n1 -addr :9001 -peers n1=http://localhost:9001,n2=http://localhost:9002,n3=http://localhost:9003
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	id := fs.String("id", "", "node ID, one of the -peers IDs")
+	addr := fs.String("addr", ":9001", "listen address")
+	peersFlag := fs.String("peers", "", "all nodes as id=url pairs, including this one")
+	n := fs.Int("n", 3, "replicas per key")
+	r := fs.Int("r", 2, "replicas that must answer a read")
+	w := fs.Int("w", 2, "replicas that must acknowledge a write")
+	dir := fs.String("data", "data", "directory for the node's JSON store")
+	fs.Parse(args)
+
+	peers, err := raft.ParsePeers(*peersFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *id == "" {
+		log.Fatal("-id is required")
+	}
+	store, err := kvstore.OpenStore(filepath.Join(*dir, *id+".json"))
+	if err != nil {
+		log.Fatalf("failed to open store: %v", err)
+	}
+	node, err := kvstore.NewNode(kvstore.Config{ID: *id, Peers: peers, N: *n, R: *r, W: *w, Store: store})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	node.Register(mux)
+	srv := &http.Server{
+		Addr:         *addr,
+		Handler:      mux,
+		ReadTimeout:  2 * time.Second,
+		WriteTimeout: 4 * time.Second}
+	log.Printf("node %s serving on %s (N=%d R=%d W=%d)", *id, *addr, *n, *r, *w)
+	log.Fatal(srv.ListenAndServe())
+}
+
+func runClient(cmd string, args []string) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	node := fs.String("node", "http://localhost:9001", "any node of the store")
+	vv := fs.String("context", "", "version vector of the read this write is based on, e.g. n1:2,n2:1")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	key := fs.Arg(0)
+
+	client := kvstore.NewClient(*node)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var res interface{}
+	var err error
+	switch cmd {
+	case "get":
+		var got kvstore.GetResult
+		got, err = client.Get(ctx, key)
+		if errors.Is(err, kvstore.ErrNotFound) {
+			fmt.Printf("%s not found (context %s)\n", key, got.Context)
+			os.Exit(1)
+		}
+		if len(got.Versions) > 1 {
+			fmt.Fprintf(os.Stderr, "%s has %d conflicting versions; put a resolution with -context %s\n", key, len(got.Versions), got.Context)
+		}
+		res = got
+	case "put":
+		doc := []byte(strings.Join(fs.Args()[1:], " "))
+		if len(doc) == 0 {
+			if doc, err = json.Marshal(per1); err != nil {
+				log.Fatal(err)
+			}
+		}
+		res, err = client.Put(ctx, key, doc, *vv)
+	case "delete":
+		res, err = client.Delete(ctx, key, *vv)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,265 @@
+package lease
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KV is the store leases live in: a map of versioned values with an
+// atomic compare-and-swap. Version 0 means the key does not exist.
+type KV interface {
+	Get(ctx context.Context, key string) (value []byte, version uint64, err error)
+	// CompareAndSwap stores value if the key's current version is version.
+	CompareAndSwap(ctx context.Context, key string, version uint64, value []byte) (bool, error)
+}
+
+// OpenKV selects a store from a flag value: "file:DIR" for a directory on
+// the local host, or an http(s) URL of a lease KV service.
+func OpenKV(spec string) (KV, error) {
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		return NewFileKV(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return NewHTTPKV(spec), nil
+	}
+	return nil, fmt.Errorf("unknown lease store %q: expected file:DIR or an http URL", spec)
+}
+
+type versioned struct {
+	Value   []byte `json:"value"`
+	Version uint64 `json:"version"`
+}
+
+// MemoryKV is an in-process KV.
+type MemoryKV struct {
+	mu   sync.Mutex
+	data map[string]versioned
+}
+
+// NewMemoryKV returns an empty in-memory KV.
+func NewMemoryKV() *MemoryKV {
+	return &MemoryKV{data: make(map[string]versioned)}
+}
+
+func (m *MemoryKV) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v := m.data[key]
+	return v.Value, v.Version, nil
+}
+
+func (m *MemoryKV) CompareAndSwap(ctx context.Context, key string, version uint64, value []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data[key].Version != version {
+		return false, nil
+	}
+	m.data[key] = versioned{Value: value, Version: version + 1}
+	return true, nil
+}
+
+// FileKV keeps each key in its own file in a directory shared by the
+// processes of one host. A lock file created with O_EXCL guards each
+// compare-and-swap, which works the same on every platform.
+type FileKV struct {
+	dir       string
+	staleLock time.Duration
+}
+
+// NewFileKV returns a KV stored in dir, creating it if needed.
+func NewFileKV(dir string) (*FileKV, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileKV{dir: dir, staleLock: 5 * time.Second}, nil
+}
+
+func (f *FileKV) path(key string) string {
+	return filepath.Join(f.dir, url.PathEscape(key)+".json")
+}
+
+func (f *FileKV) read(key string) (versioned, error) {
+	var v versioned
+	data, err := os.ReadFile(f.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return v, err
+	}
+	err = json.Unmarshal(data, &v)
+	return v, err
+}
+
+func (f *FileKV) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	v, err := f.read(key)
+	return v.Value, v.Version, err
+}
+
+// lock takes the per-key lock file, breaking locks left behind by a
+// process that crashed inside the critical section.
+func (f *FileKV) lock(ctx context.Context, key string) (func(), error) {
+	lockPath := f.path(key) + ".lock"
+	for {
+		fh, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fh.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > f.staleLock {
+			os.Remove(lockPath)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func (f *FileKV) CompareAndSwap(ctx context.Context, key string, version uint64, value []byte) (bool, error) {
+	unlock, err := f.lock(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	cur, err := f.read(key)
+	if err != nil {
+		return false, err
+	}
+	if cur.Version != version {
+		return false, nil
+	}
+	data, err := json.Marshal(versioned{Value: value, Version: version + 1})
+	if err != nil {
+		return false, err
+	}
+	tmp := f.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, f.path(key))
+}
+
+// HTTPKV is the client of a KV served by Handler.
+type HTTPKV struct {
+	base   string
+	client *http.Client
+}
+
+// NewHTTPKV returns a client for the KV service at base.
+func NewHTTPKV(base string) *HTTPKV {
+	return &HTTPKV{base: strings.TrimRight(base, "/"), client: &http.Client{Timeout: 2 * time.Second}}
+}
+
+func (h *HTTPKV) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.base+"/kv/"+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("lease kv: %s", resp.Status)
+	}
+	var v versioned
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	return v.Value, v.Version, err
+}
+
+func (h *HTTPKV) CompareAndSwap(ctx context.Context, key string, version uint64, value []byte) (bool, error) {
+	u := h.base + "/kv/" + url.PathEscape(key) + "?version=" + strconv.FormatUint(version, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(value))
+	if err != nil {
+		return false, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+	return false, fmt.Errorf("lease kv: %s", resp.Status)
+}
+
+// Handler serves kv over HTTP:
+//
+//	GET /kv/KEY                 -> {"value": ..., "version": N} or 404
+//	PUT /kv/KEY?version=N body  -> 200 if swapped, 409 if the version moved on
+func Handler(kv KV) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/kv/"))
+		if err != nil || key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			value, version, err := kv.Get(r.Context(), key)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if version == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(versioned{Value: value, Version: version}); err != nil {
+				http.Error(w, "failed to encode response", http.StatusInternalServerError)
+				return
+			}
+		case http.MethodPut:
+			version, err := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid version", http.StatusBadRequest)
+				return
+			}
+			value, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
+			ok, err := kv.CompareAndSwap(r.Context(), key, version, value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "version conflict", http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+// Package lease elects a single leader among processes through a
+// time-limited lease kept in a shared KV store. Every new grant of the
+// lease carries a larger fencing token; the leader attaches it to the
+// requests it sends, and receivers reject tokens older than the newest
+// they have seen, so a stale leader that still believes it holds the lease
+// cannot act on anyone.
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TokenHeader carries the fencing token on requests sent by a leader.
+const TokenHeader = "X-Fencing-Token"
+
+// Record is the lease as stored in the KV.
+type Record struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+	Token   uint64    `json:"token"`
+}
+
+// Elector competes for the lease Name on behalf of ID.
+type Elector struct {
+	KV   KV
+	Name string
+	ID   string
+	TTL  time.Duration
+	// OnChange is called whenever this process gains or loses the lease.
+	OnChange func(leader bool, token uint64)
+
+	mu      sync.Mutex
+	leader  bool
+	token   uint64
+	validTo time.Time
+	holder  string
+}
+
+// NewElector returns an elector for the lease name.
+func NewElector(kv KV, name, id string, ttl time.Duration) *Elector {
+	return &Elector{KV: kv, Name: name, ID: id, TTL: ttl}
+}
+
+// Leader reports whether this process holds the lease and its fencing
+// token. Leadership ends locally as soon as the lease may have expired,
+// even if the store could not be reached to confirm it.
+func (e *Elector) Leader() (bool, uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leader && time.Now().After(e.validTo) {
+		return false, 0
+	}
+	return e.leader, e.token
+}
+
+// Holder returns the last known lease holder.
+func (e *Elector) Holder() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.holder
+}
+
+// tryAcquire grants or renews the lease if it is free, expired or ours.
+func (e *Elector) tryAcquire(ctx context.Context) (bool, uint64, error) {
+	value, version, err := e.KV.Get(ctx, e.Name)
+	if err != nil {
+		return false, 0, err
+	}
+	var cur Record
+	if version > 0 {
+		if err := json.Unmarshal(value, &cur); err != nil {
+			return false, 0, err
+		}
+	}
+
+	now := time.Now()
+	e.mu.Lock()
+	e.holder = cur.Holder
+	e.mu.Unlock()
+	if cur.Holder != "" && cur.Holder != e.ID && now.Before(cur.Expires) {
+		return false, 0, nil
+	}
+
+	next := Record{Holder: e.ID, Expires: now.Add(e.TTL), Token: cur.Token}
+	if cur.Holder != e.ID || !now.Before(cur.Expires) {
+		next.Token++ // a new grant, not a renewal
+	}
+	data, err := json.Marshal(next)
+	if err != nil {
+		return false, 0, err
+	}
+	ok, err := e.KV.CompareAndSwap(ctx, e.Name, version, data)
+	if err != nil || !ok {
+		return false, 0, err
+	}
+	e.mu.Lock()
+	e.holder = e.ID
+	e.validTo = now.Add(e.TTL)
+	e.mu.Unlock()
+	return true, next.Token, nil
+}
+
+// release gives the lease up early so another process can take over
+// without waiting for it to expire.
+func (e *Elector) release(ctx context.Context) {
+	value, version, err := e.KV.Get(ctx, e.Name)
+	if err != nil || version == 0 {
+		return
+	}
+	var cur Record
+	if json.Unmarshal(value, &cur) != nil || cur.Holder != e.ID {
+		return
+	}
+	cur.Expires = time.Now()
+	if data, err := json.Marshal(cur); err == nil {
+		e.KV.CompareAndSwap(ctx, e.Name, version, data)
+	}
+}
+
+func (e *Elector) set(leader bool, token uint64) {
+	e.mu.Lock()
+	changed := e.leader != leader || e.token != token
+	e.leader, e.token = leader, token
+	e.mu.Unlock()
+	if changed {
+		if leader {
+			log.Printf("lease %s: %s is leader (token %d)", e.Name, e.ID, token)
+		} else {
+			log.Printf("lease %s: %s is not leader", e.Name, e.ID)
+		}
+		if e.OnChange != nil {
+			e.OnChange(leader, token)
+		}
+	}
+}
+
+// Run competes for the lease, renewing it every TTL/3 while held, until
+// ctx is done; it then releases the lease if held.
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.TTL / 3)
+	defer ticker.Stop()
+	for {
+		attempt, cancel := context.WithTimeout(ctx, e.TTL/3)
+		ok, token, err := e.tryAcquire(attempt)
+		cancel()
+		if err != nil {
+			log.Printf("lease %s: store error: %v", e.Name, err)
+		}
+		if err == nil {
+			e.set(ok, token)
+		} else if held, _ := e.Leader(); !held {
+			e.set(false, 0)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if held, _ := e.Leader(); held {
+				rel, cancel := context.WithTimeout(context.Background(), time.Second)
+				e.release(rel)
+				cancel()
+			}
+			e.set(false, 0)
+			return
+		}
+	}
+}
+
+type tokenKey struct{}
+
+// WithToken returns a copy of ctx carrying the fencing token a request was
+// admitted under, for the requests the leader sends on its behalf.
+func WithToken(ctx context.Context, token uint64) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// TokenFrom returns the fencing token carried by ctx.
+func TokenFrom(ctx context.Context) (uint64, bool) {
+	token, ok := ctx.Value(tokenKey{}).(uint64)
+	return token, ok && token > 0
+}
+
+// Fence rejects requests carrying a fencing token older than the newest
+// one seen, so only the current leader's requests are served. Requests
+// without a token pass through unless Required says they need one. Wrap
+// only requests authenticated as coming from a leader: any token that
+// reaches the fence raises the one the leader must match.
+type Fence struct {
+	// Required, if set, reports whether r must carry a token, such as the
+	// shards forwarded by coordinators elected through a lease.
+	Required func(r *http.Request) bool
+
+	mu      sync.Mutex
+	highest uint64
+}
+
+// Wrap applies the fence to next.
+func (f *Fence) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.Header.Get(TokenHeader)
+		if raw == "" {
+			if f.Required != nil && f.Required(r) {
+				http.Error(w, "missing fencing token", http.StatusConflict)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid fencing token", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		if token < f.highest {
+			highest := f.highest
+			f.mu.Unlock()
+			http.Error(w, "stale fencing token "+raw+" (current "+strconv.FormatUint(highest, 10)+")", http.StatusConflict)
+			return
+		}
+		f.highest = token
+		f.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
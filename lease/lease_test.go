@@ -0,0 +1,51 @@
+package lease
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFence(t *testing.T) {
+	f := &Fence{Required: func(r *http.Request) bool { return r.Header.Get("X-Forwarded") != "" }}
+	h := f.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	steps := []struct {
+		token     string
+		forwarded bool
+		want      int
+	}{
+		{"", false, http.StatusOK},
+		{"", true, http.StatusConflict},
+		{"3", true, http.StatusOK},
+		{"2", true, http.StatusConflict},
+		{"3", true, http.StatusOK},
+		{"4", false, http.StatusOK},
+		{"3", true, http.StatusConflict},
+		{"x", true, http.StatusBadRequest},
+	}
+	for i, st := range steps {
+		req := httptest.NewRequest(http.MethodPost, "/ex2", nil)
+		if st.token != "" {
+			req.Header.Set(TokenHeader, st.token)
+		}
+		if st.forwarded {
+			req.Header.Set("X-Forwarded", "1")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != st.want {
+			t.Errorf("step %d (token %q, forwarded %v): status %d, want %d", i, st.token, st.forwarded, rec.Code, st.want)
+		}
+	}
+}
+
+func TestTokenContext(t *testing.T) {
+	if _, ok := TokenFrom(context.Background()); ok {
+		t.Fatal("token found in an empty context")
+	}
+	if token, ok := TokenFrom(WithToken(context.Background(), 7)); !ok || token != 7 {
+		t.Fatalf("TokenFrom = %d, %v", token, ok)
+	}
+}
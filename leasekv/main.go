@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/lease"
+)
+
+// leasekv serves the compare-and-swap key-value store used for lease-based
+// leader election when the competing processes do not share a directory:
+//
+//	go run ./leasekv -addr :7070
+//	server -mode coordinator -lease-store http://localhost:7070 ...
+func main() {
+	addr := flag.String("addr", ":7070", "listen address")
+	dir := flag.String("dir", "", "keep keys in this directory instead of in memory")
+	flag.Parse()
+
+	var kv lease.KV = lease.NewMemoryKV()
+	if *dir != "" {
+		fileKV, err := lease.NewFileKV(*dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		kv = fileKV
+	}
+
+	http.Handle("/kv/", lease.Handler(kv))
+	srv := &http.Server{
+		Addr:         *addr,
+		ReadTimeout:  2 * time.Second,
+		WriteTimeout: 4 * time.Second}
+	log.Fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// LinkGraph is the graph of a crawl: a node per URL, crawled or only
+// linked to, and an edge per distinct link.
+type LinkGraph struct {
+	URLs  []string // sorted; node i is URLs[i]
+	Out   [][]int
+	In    [][]int
+	Pages map[string]*Page // the crawled nodes
+
+	index map[string]int
+}
+
+// NewLinkGraph builds the graph of pages.
+func NewLinkGraph(pages []Page) *LinkGraph {
+	g := &LinkGraph{Pages: make(map[string]*Page), index: make(map[string]int)}
+	set := make(map[string]bool)
+	for i := range pages {
+		g.Pages[pages[i].URL] = &pages[i]
+		set[pages[i].URL] = true
+		for _, l := range pages[i].Links {
+			set[l] = true
+		}
+	}
+	for u := range set {
+		g.URLs = append(g.URLs, u)
+	}
+	sort.Strings(g.URLs)
+	for i, u := range g.URLs {
+		g.index[u] = i
+	}
+	g.Out = make([][]int, len(g.URLs))
+	g.In = make([][]int, len(g.URLs))
+	for _, p := range pages {
+		from := g.index[p.URL]
+		seen := make(map[int]bool)
+		for _, l := range p.Links {
+			to := g.index[l]
+			if !seen[to] {
+				seen[to] = true
+				g.Out[from] = append(g.Out[from], to)
+				g.In[to] = append(g.In[to], from)
+			}
+		}
+	}
+	return g
+}
+
+// Node returns the node of url.
+func (g *LinkGraph) Node(url string) (int, bool) {
+	i, ok := g.index[url]
+	return i, ok
+}
+
+// PageRank computes the PageRank of every node by power iteration, until
+// the ranks move less than 1e-9 or after iterations rounds. The rank of
+// nodes without out-links is spread over all nodes. Ranks sum to 1.
+func (g *LinkGraph) PageRank(damping float64, iterations int) []float64 {
+	n := len(g.URLs)
+	if n == 0 {
+		return nil
+	}
+	rank := make([]float64, n)
+	for i := range rank {
+		rank[i] = 1 / float64(n)
+	}
+	next := make([]float64, n)
+	for it := 0; it < iterations; it++ {
+		dangling := 0.0
+		for i := range rank {
+			if len(g.Out[i]) == 0 {
+				dangling += rank[i]
+			}
+		}
+		base := (1-damping)/float64(n) + damping*dangling/float64(n)
+		for i := range next {
+			next[i] = base
+		}
+		for i, outs := range g.Out {
+			share := damping * rank[i] / float64(len(outs))
+			for _, j := range outs {
+				next[j] += share
+			}
+		}
+		delta := 0.0
+		for i := range rank {
+			delta += math.Abs(next[i] - rank[i])
+		}
+		rank, next = next, rank
+		if delta < 1e-9 {
+			break
+		}
+	}
+	return rank
+}
+
+// Components returns the strongly connected components, largest first,
+// using Tarjan's algorithm.
+func (g *LinkGraph) Components() [][]int {
+	n := len(g.URLs)
+	index := make([]int, n)
+	low := make([]int, n)
+	onStack := make([]bool, n)
+	for i := range index {
+		index[i] = -1
+	}
+	var stack []int
+	var comps [][]int
+	counter := 0
+
+	var connect func(v int)
+	connect = func(v int) {
+		index[v], low[v] = counter, counter
+		counter++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range g.Out[v] {
+			if index[w] < 0 {
+				connect(w)
+				low[v] = min(low[v], low[w])
+			} else if onStack[w] {
+				low[v] = min(low[v], index[w])
+			}
+		}
+		if low[v] == index[v] {
+			var comp []int
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				comp = append(comp, w)
+				if w == v {
+					break
+				}
+			}
+			sort.Ints(comp)
+			comps = append(comps, comp)
+		}
+	}
+	for v := 0; v < n; v++ {
+		if index[v] < 0 {
+			connect(v)
+		}
+	}
+	sort.SliceStable(comps, func(i, j int) bool { return len(comps[i]) > len(comps[j]) })
+	return comps
+}
+
+// ShortestPaths returns the number of links on the shortest path from
+// seed to every node, -1 for those it cannot reach, and the node before
+// each on such a path.
+func (g *LinkGraph) ShortestPaths(seed int) (dist, prev []int) {
+	dist = make([]int, len(g.URLs))
+	prev = make([]int, len(g.URLs))
+	for i := range dist {
+		dist[i], prev[i] = -1, -1
+	}
+	dist[seed] = 0
+	queue := []int{seed}
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		for _, w := range g.Out[v] {
+			if dist[w] < 0 {
+				dist[w], prev[w] = dist[v]+1, v
+				queue = append(queue, w)
+			}
+		}
+	}
+	return dist, prev
+}
+
+// Path returns the URLs on the shortest path to node from prev, as given
+// by ShortestPaths, or nil if it is unreachable.
+func (g *LinkGraph) Path(prev []int, seed, node int) []string {
+	var path []string
+	for v := node; v >= 0; v = prev[v] {
+		path = append(path, g.URLs[v])
+		if v == seed {
+			for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return path
+		}
+	}
+	return nil
+}
+
+// BrokenLink is a crawled URL that failed, with the pages linking to it.
+type BrokenLink struct {
+	URL      string   `json:"url"`
+	Status   int      `json:"status"`
+	Err      string   `json:"error"`
+	LinkedBy []string `json:"linked_by"`
+}
+
+// Broken returns the crawled URLs whose fetch failed.
+func (g *LinkGraph) Broken() []BrokenLink {
+	var broken []BrokenLink
+	for i, u := range g.URLs {
+		p := g.Pages[u]
+		if p == nil || p.Err == "" {
+			continue
+		}
+		b := BrokenLink{URL: u, Status: p.Status, Err: p.Err}
+		for _, from := range g.In[i] {
+			b.LinkedBy = append(b.LinkedBy, g.URLs[from])
+		}
+		broken = append(broken, b)
+	}
+	return broken
+}
+
+// Analysis is what analyze reports about a crawl.
+type Analysis struct {
+	Seed      string `json:"seed"`
+	Nodes     int    `json:"nodes"`
+	Crawled   int    `json:"crawled"`
+	Links     int    `json:"links"`
+	Uncrawled int    `json:"uncrawled"` // linked to but not fetched
+
+	TopPageRank  []Ranked `json:"top_pagerank"`
+	TopInDegree  []Ranked `json:"top_in_degree"`
+	TopOutDegree []Ranked `json:"top_out_degree"`
+
+	Components       int        `json:"components"`
+	LargestComponent int        `json:"largest_component"`
+	Cycles           [][]string `json:"cycles"` // components of more than one node, largest first
+
+	Distances   map[int]int `json:"distances"` // nodes by links from the seed
+	Unreachable int         `json:"unreachable"`
+	CrawlDepths map[int]int `json:"crawl_depths"` // crawled pages by the depth they were found at
+
+	Broken []BrokenLink `json:"broken"`
+}
+
+// Ranked is a URL with a score.
+type Ranked struct {
+	URL   string  `json:"url"`
+	Score float64 `json:"score"`
+}
+
+// Analyze computes the statistics of the crawl, measuring distances
+// from seed and listing the top entries of each ranking.
+func Analyze(g *LinkGraph, seed string, top int) (*Analysis, error) {
+	s, ok := g.Node(seed)
+	if !ok {
+		return nil, fmt.Errorf("seed %s is not in the crawl", seed)
+	}
+	a := &Analysis{
+		Seed:        seed,
+		Nodes:       len(g.URLs),
+		Crawled:     len(g.Pages),
+		Distances:   make(map[int]int),
+		CrawlDepths: make(map[int]int),
+		Broken:      g.Broken(),
+	}
+	a.Uncrawled = a.Nodes - a.Crawled
+	in := make([]float64, len(g.URLs))
+	out := make([]float64, len(g.URLs))
+	for i := range g.URLs {
+		a.Links += len(g.Out[i])
+		in[i], out[i] = float64(len(g.In[i])), float64(len(g.Out[i]))
+	}
+	a.TopPageRank = g.top(g.PageRank(0.85, 100), top)
+	a.TopInDegree = g.top(in, top)
+	a.TopOutDegree = g.top(out, top)
+
+	comps := g.Components()
+	a.Components = len(comps)
+	if len(comps) > 0 {
+		a.LargestComponent = len(comps[0])
+	}
+	for _, c := range comps {
+		if len(c) < 2 {
+			break
+		}
+		cycle := make([]string, len(c))
+		for i, v := range c {
+			cycle[i] = g.URLs[v]
+		}
+		a.Cycles = append(a.Cycles, cycle)
+	}
+
+	dist, _ := g.ShortestPaths(s)
+	for _, d := range dist {
+		if d < 0 {
+			a.Unreachable++
+		} else {
+			a.Distances[d]++
+		}
+	}
+	for _, p := range g.Pages {
+		a.CrawlDepths[p.Depth]++
+	}
+	return a, nil
+}
+
+// top returns the n nodes with the highest scores, ties by URL.
+func (g *LinkGraph) top(scores []float64, n int) []Ranked {
+	order := make([]int, len(scores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+	if n > 0 && len(order) > n {
+		order = order[:n]
+	}
+	ranked := make([]Ranked, len(order))
+	for i, v := range order {
+		ranked[i] = Ranked{URL: g.URLs[v], Score: scores[v]}
+	}
+	return ranked
+}
+
+// WriteText prints the analysis for people.
+func (a *Analysis) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "seed: %s\n", a.Seed)
+	fmt.Fprintf(bw, "%d URLs: %d crawled, %d only linked to; %d links\n", a.Nodes, a.Crawled, a.Uncrawled, a.Links)
+
+	ranking := func(title string, rs []Ranked, format string) {
+		fmt.Fprintf(bw, "\n%s:\n", title)
+		for _, r := range rs {
+			fmt.Fprintf(bw, "  "+format+"  %s\n", r.Score, r.URL)
+		}
+	}
+	ranking("PageRank", a.TopPageRank, "%.4f")
+	ranking("in-degree", a.TopInDegree, "%4.0f")
+	ranking("out-degree", a.TopOutDegree, "%4.0f")
+
+	fmt.Fprintf(bw, "\nstrongly connected components: %d, largest %d URLs\n", a.Components, a.LargestComponent)
+	for i, c := range a.Cycles {
+		fmt.Fprintf(bw, "  cycle %d: %d URLs, e.g. %s\n", i+1, len(c), c[0])
+	}
+
+	fmt.Fprintf(bw, "\nlinks from the seed:\n")
+	for _, d := range sortedKeys(a.Distances) {
+		fmt.Fprintf(bw, "  %3d: %d URLs\n", d, a.Distances[d])
+	}
+	if a.Unreachable > 0 {
+		fmt.Fprintf(bw, "  unreachable: %d URLs\n", a.Unreachable)
+	}
+	fmt.Fprintf(bw, "\ncrawl depth:\n")
+	for _, d := range sortedKeys(a.CrawlDepths) {
+		fmt.Fprintf(bw, "  %3d: %d pages\n", d, a.CrawlDepths[d])
+	}
+
+	fmt.Fprintf(bw, "\nbroken links: %d\n", len(a.Broken))
+	for _, b := range a.Broken {
+		// The error names the URL already.
+		fmt.Fprintf(bw, "  %s\n", b.Err)
+		for _, from := range b.LinkedBy {
+			fmt.Fprintf(bw, "    linked by %s\n", from)
+		}
+	}
+	return bw.Flush()
+}
+
+func sortedKeys(m map[int]int) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// graph builds a link graph from "from:to,to" lines, one crawled page each.
+func graph(spec ...string) *LinkGraph {
+	var pages []Page
+	for _, line := range spec {
+		from, to, _ := strings.Cut(line, ":")
+		p := Page{URL: from, Status: 200}
+		if to != "" {
+			p.Links = strings.Split(to, ",")
+		}
+		pages = append(pages, p)
+	}
+	return NewLinkGraph(pages)
+}
+
+func names(g *LinkGraph, nodes []int) []string {
+	out := make([]string, len(nodes))
+	for i, v := range nodes {
+		out[i] = g.URLs[v]
+	}
+	return out
+}
+
+func TestNewLinkGraph(t *testing.T) {
+	g := graph("a:b,b,c", "b:a")
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(g.URLs, want) {
+		t.Fatalf("nodes %v, want %v", g.URLs, want)
+	}
+	// Duplicate links count once; c is linked to but not crawled.
+	if !reflect.DeepEqual(g.Out, [][]int{{1, 2}, {0}, nil}) || !reflect.DeepEqual(g.In, [][]int{{1}, {0}, {0}}) {
+		t.Errorf("out %v in %v", g.Out, g.In)
+	}
+	if len(g.Pages) != 2 || g.Pages["c"] != nil {
+		t.Errorf("pages %v", g.Pages)
+	}
+}
+
+func TestPageRank(t *testing.T) {
+	tests := []struct {
+		name  string
+		graph *LinkGraph
+		want  map[string]float64
+	}{
+		{"empty", graph(), nil},
+		{"single page", graph("a:"), map[string]float64{"a": 1}},
+		{"cycle", graph("a:b", "b:c", "c:a"), map[string]float64{"a": 1.0 / 3, "b": 1.0 / 3, "c": 1.0 / 3}},
+		// r_c = 0.15/3, r_b = 0.05 + 0.85 r_a, r_a = 0.05 + 0.85 (r_b + r_c).
+		{"pair with a feeder", graph("a:b", "b:a", "c:a"), map[string]float64{"a": 0.135 / 0.2775, "b": 0.05 + 0.85*0.135/0.2775, "c": 0.05}},
+		// The dangling b spreads its rank over both pages.
+		{"dangling node", graph("a:b", "b:"), map[string]float64{"a": 1 / 2.85, "b": 1.85 / 2.85}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rank := tt.graph.PageRank(0.85, 1000)
+			if len(rank) != len(tt.want) {
+				t.Fatalf("ranks %v", rank)
+			}
+			sum := 0.0
+			for i, r := range rank {
+				sum += r
+				if want := tt.want[tt.graph.URLs[i]]; math.Abs(r-want) > 1e-6 {
+					t.Errorf("rank of %s %.6f, want %.6f", tt.graph.URLs[i], r, want)
+				}
+			}
+			if len(rank) > 0 && math.Abs(sum-1) > 1e-9 {
+				t.Errorf("ranks sum to %v", sum)
+			}
+		})
+	}
+}
+
+func TestComponents(t *testing.T) {
+	tests := []struct {
+		name  string
+		graph *LinkGraph
+		want  [][]string
+	}{
+		{"empty", graph(), nil},
+		{"chain", graph("a:b", "b:c"), [][]string{{"c"}, {"b"}, {"a"}}},
+		{"cycle", graph("a:b", "b:c", "c:a"), [][]string{{"a", "b", "c"}}},
+		{"self link", graph("a:a,b"), [][]string{{"b"}, {"a"}}},
+		{
+			"two cycles joined one way",
+			graph("a:b", "b:a,c", "c:d", "d:e", "e:c", "x:"),
+			[][]string{{"c", "d", "e"}, {"a", "b"}, {"x"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][]string
+			for _, c := range tt.graph.Components() {
+				got = append(got, names(tt.graph, c))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("components %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShortestPaths(t *testing.T) {
+	g := graph("a:b,c", "b:d", "c:d,e", "d:a", "e:", "f:a")
+	seed, _ := g.Node("a")
+	dist, prev := g.ShortestPaths(seed)
+	tests := []struct {
+		node string
+		dist int
+		path []string
+	}{
+		{"a", 0, []string{"a"}},
+		{"b", 1, []string{"a", "b"}},
+		{"c", 1, []string{"a", "c"}},
+		{"d", 2, []string{"a", "b", "d"}}, // b is reached first
+		{"e", 2, []string{"a", "c", "e"}},
+		{"f", -1, nil}, // it links to a, but nothing links to it
+	}
+	for _, tt := range tests {
+		v, ok := g.Node(tt.node)
+		if !ok {
+			t.Fatalf("no node %s", tt.node)
+		}
+		if dist[v] != tt.dist {
+			t.Errorf("distance to %s %d, want %d", tt.node, dist[v], tt.dist)
+		}
+		if path := g.Path(prev, seed, v); !reflect.DeepEqual(path, tt.path) {
+			t.Errorf("path to %s %v, want %v", tt.node, path, tt.path)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	pages := []Page{
+		{URL: "a", Status: 200, Links: []string{"b", "c", "gone"}},
+		{URL: "b", Depth: 1, Parent: "a", Status: 200, Links: []string{"a"}},
+		{URL: "gone", Depth: 1, Parent: "a", Status: 404, Err: "gone: 404 Not Found"},
+	}
+	g := NewLinkGraph(pages)
+	a, err := Analyze(g, "a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Nodes != 4 || a.Crawled != 3 || a.Uncrawled != 1 || a.Links != 4 {
+		t.Errorf("counts %+v", a)
+	}
+	if a.Components != 3 || a.LargestComponent != 2 || !reflect.DeepEqual(a.Cycles, [][]string{{"a", "b"}}) {
+		t.Errorf("components %d, largest %d, cycles %v", a.Components, a.LargestComponent, a.Cycles)
+	}
+	if !reflect.DeepEqual(a.Distances, map[int]int{0: 1, 1: 3}) || a.Unreachable != 0 {
+		t.Errorf("distances %v, unreachable %d", a.Distances, a.Unreachable)
+	}
+	if len(a.TopOutDegree) != 2 || a.TopOutDegree[0] != (Ranked{URL: "a", Score: 3}) {
+		t.Errorf("top out-degree %v", a.TopOutDegree)
+	}
+	want := []BrokenLink{{URL: "gone", Status: 404, Err: "gone: 404 Not Found", LinkedBy: []string{"a"}}}
+	if !reflect.DeepEqual(a.Broken, want) {
+		t.Errorf("broken %+v", a.Broken)
+	}
+	if _, err := Analyze(g, "nowhere", 2); err == nil {
+		t.Error("analysis from a seed outside the crawl")
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Crawler crawls pages through a Fetcher and fetches each URL at most
+// once. All of its state belongs to the crawler itself, so crawls using
+// different Crawlers can run at the same time in one process.
+//
+// The politeness fields are read when a crawl starts; zero values mean no
+// limit.
+type Crawler struct {
+	// UserAgent is matched against robots.txt groups.
+	UserAgent string
+	// Robots makes the crawler fetch each host's robots.txt with Client
+	// and skip the pages it disallows. Its Crawl-delay raises HostDelay.
+	Robots bool
+	Client *http.Client
+	// RobotsRetry is how long a robots.txt that could not be fetched
+	// keeps its host's pages skipped before it is fetched again.
+	RobotsRetry time.Duration
+	// MaxConcurrency caps the fetches in progress across all hosts.
+	MaxConcurrency int
+	// PerHost caps the fetches in progress on one host.
+	PerHost int
+	// HostDelay is the minimum time between the starts of two requests
+	// to the same host.
+	HostDelay time.Duration
+	// MaxPages caps the pages fetched, failed fetches included.
+	MaxPages int
+	// MaxBytes stops the crawl once the pages the fetcher read add up to
+	// this many bytes.
+	MaxBytes int64
+
+	// Frontier holds the URLs waiting and those already seen.
+	Frontier Frontier
+
+	fetcher Fetcher
+	slots   chan struct{} // global concurrency, nil if unlimited
+	stop    context.CancelCauseFunc
+
+	mu      sync.Mutex
+	hosts   map[string]*hostState
+	depth   int // of the current crawl
+	started int // fetches begun, counted against MaxPages
+	summary Summary
+}
+
+// Page is the record of one fetch, successful or not.
+type Page struct {
+	URL    string `json:"url"`
+	Depth  int    `json:"depth"`            // links followed from the seed, which is 0
+	Parent string `json:"parent,omitempty"` // the page the URL was first found on
+	// Status is the HTTP status: 200 for pages fetched, the code of a
+	// StatusError for those refused, 0 if the fetch failed otherwise.
+	Status    int           `json:"status"`
+	Size      int           `json:"size"` // bytes read from the server; Body may be shorter
+	Body      string        `json:"body,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"` // Body is a summary cut short
+	Links     []string      `json:"links,omitempty"`
+	Err       string        `json:"error,omitempty"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// Summary describes a finished crawl.
+type Summary struct {
+	Pages    int           `json:"pages"` // fetched successfully
+	Bytes    int64         `json:"bytes"` // read from the server, see Page.Size
+	Errors   []CrawlError  `json:"errors,omitempty"`
+	Skipped  []Skip        `json:"skipped,omitempty"`
+	Duration time.Duration `json:"duration"`
+	// Stopped is why the crawl ended before running out of links: a
+	// limit, or the context's error. Empty if it ran to completion.
+	Stopped string `json:"stopped,omitempty"`
+}
+
+// CrawlError is a page that could not be fetched.
+type CrawlError struct {
+	URL string `json:"url"`
+	Err string `json:"error"`
+}
+
+// Skip is a page that was found but not fetched.
+type Skip struct {
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+// Reasons the crawl stops early.
+var (
+	errMaxPages = errors.New("max pages reached")
+	errMaxBytes = errors.New("byte budget exhausted")
+)
+
+// hostState is the politeness state of one host.
+type hostState struct {
+	slots chan struct{} // per-host concurrency, nil if unlimited
+
+	robotsMu    sync.Mutex // held while robots.txt is fetched
+	robots      *Robots    // nil until fetched
+	robotsRetry time.Time  // when a failed fetch may be retried, zero after success
+
+	mu    sync.Mutex
+	delay time.Duration
+	next  time.Time // earliest start of the next request
+}
+
+// NewCrawler returns a crawler that fetches pages with fetcher and keeps
+// its frontier in memory.
+func NewCrawler(fetcher Fetcher) *Crawler {
+	return &Crawler{
+		UserAgent:   "parallel_fetch",
+		RobotsRetry: time.Minute,
+		Frontier:    NewMemoryFrontier(),
+		fetcher:     fetcher,
+		hosts:       make(map[string]*hostState),
+	}
+}
+
+// Crawl crawls pages starting with url, to a maximum of depth, and
+// returns a record of each page in the frontier once all are done,
+// ordered by depth and URL. Pages a resumed frontier finished earlier
+// are included and not fetched again.
+//
+// The crawl stops early when ctx is done or a limit is reached; pages
+// being fetched then are abandoned if the fetcher is a ContextFetcher.
+// URLs left in the frontier are reported as skipped.
+func (c *Crawler) Crawl(ctx context.Context, url string, depth int) ([]Page, Summary) {
+	begin := time.Now()
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	c.mu.Lock()
+	c.stop = stop
+	c.depth = depth
+	c.mu.Unlock()
+
+	if depth > 0 {
+		c.push(Item{URL: url})
+	}
+	// Hand out items until the frontier is empty and nothing is being
+	// fetched that could add more.
+	finished := make(chan struct{})
+	running := 0
+	for {
+		if ctx.Err() == nil && !c.limitReached() {
+			item, ok, err := c.Frontier.Pop()
+			if err != nil {
+				stop(err)
+			} else if ok {
+				running++
+				go func() {
+					c.fetch(ctx, item)
+					finished <- struct{}{}
+				}()
+				continue
+			}
+		}
+		if running == 0 {
+			break
+		}
+		<-finished
+		running--
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.Frontier.Pending()
+	if err := context.Cause(ctx); err != nil {
+		c.summary.Stopped = err.Error()
+	} else if len(pending) > 0 && c.MaxPages > 0 && c.started >= c.MaxPages {
+		// Pages being fetched at the limit still finished and queued their links.
+		c.summary.Stopped = errMaxPages.Error()
+	}
+	for _, item := range pending {
+		c.summary.Skipped = append(c.summary.Skipped, Skip{URL: item.URL, Reason: c.summary.Stopped})
+	}
+	c.summary.Duration = time.Since(begin)
+	return sortPages(c.Frontier.Pages()), c.summary
+}
+
+// sortPages orders pages by depth, then URL.
+func sortPages(pages []Page) []Page {
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].Depth != pages[j].Depth {
+			return pages[i].Depth < pages[j].Depth
+		}
+		return pages[i].URL < pages[j].URL
+	})
+	return pages
+}
+
+// push adds item to the frontier, stopping the crawl if that fails.
+func (c *Crawler) push(item Item) {
+	if _, err := c.Frontier.Push(item); err != nil {
+		c.stop(err)
+	}
+}
+
+// done marks item finished in the frontier, stopping the crawl if that fails.
+func (c *Crawler) done(item Item, page *Page) {
+	if err := c.Frontier.Done(item, page); err != nil {
+		c.stop(err)
+	}
+}
+
+// fetch fetches item and queues the links found on it. An item not
+// fetched because the crawl is stopping stays in the frontier.
+func (c *Crawler) fetch(ctx context.Context, item Item) {
+	page, reason := c.get(ctx, item)
+	if page == nil {
+		if reason != "" {
+			c.skip(item.URL, reason)
+			c.done(item, nil)
+		}
+		return
+	}
+	if page.Err != "" {
+		c.failed(item.URL, page.Err)
+		c.done(item, page)
+		return
+	}
+
+	// Links are queued before the page is done, so a crash in between
+	// fetches the page again rather than losing its links.
+	if item.Depth+1 < c.depth {
+		for _, u := range page.Links {
+			c.push(Item{URL: u, Parent: item.URL, Depth: item.Depth + 1})
+		}
+	}
+	c.done(item, page)
+
+	c.mu.Lock()
+	c.summary.Pages++
+	c.summary.Bytes += int64(page.Size)
+	overBudget := c.MaxBytes > 0 && c.summary.Bytes >= c.MaxBytes
+	c.mu.Unlock()
+	if overBudget {
+		c.stop(errMaxBytes)
+	}
+}
+
+// get fetches item under the crawler's politeness rules and returns the
+// record of the fetch, failed or not. It returns no record if the item is
+// not fetched, with the reason if it never will be, or with none if the
+// crawl is stopping and the item should wait in the frontier.
+func (c *Crawler) get(ctx context.Context, item Item) (*Page, string) {
+	page := &Page{URL: item.URL, Depth: item.Depth, Parent: item.Parent}
+	u, err := url.Parse(item.URL)
+	if err != nil {
+		page.Err = err.Error()
+		return page, ""
+	}
+	host := c.host(u)
+	if c.Robots {
+		robots := host.loadRobots(ctx, c, u)
+		if !robots.Allowed(c.UserAgent, u.RequestURI()) {
+			switch {
+			case ctx.Err() != nil:
+				return nil, ""
+			case robots.disallowAll:
+				return nil, "robots.txt unavailable"
+			}
+			return nil, "disallowed by robots.txt"
+		}
+	}
+	if !c.reserve() {
+		return nil, ""
+	}
+
+	release, err := c.acquire(ctx, host)
+	if err != nil {
+		return nil, ""
+	}
+	start := time.Now()
+	body, urls, size, cut, err := fetchSized(ctx, c.fetcher, item.URL)
+	release()
+	page.Duration = time.Since(start)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ""
+		}
+		var se *StatusError
+		if errors.As(err, &se) {
+			page.Status = se.Code
+		}
+		page.Err = err.Error()
+		return page, ""
+	}
+	page.Status, page.Size, page.Body, page.Truncated, page.Links = http.StatusOK, size, body, cut, urls
+	return page, ""
+}
+
+// limitReached reports whether MaxPages fetches have begun.
+func (c *Crawler) limitReached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.MaxPages > 0 && c.started >= c.MaxPages
+}
+
+// reserve counts a fetch against MaxPages, reporting false once the limit
+// has been reached.
+func (c *Crawler) reserve() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.MaxPages > 0 && c.started >= c.MaxPages {
+		return false
+	}
+	c.started++
+	return true
+}
+
+func (c *Crawler) failed(url, err string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.summary.Errors = append(c.summary.Errors, CrawlError{URL: url, Err: err})
+}
+
+func (c *Crawler) skip(url, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.summary.Skipped = append(c.summary.Skipped, Skip{URL: url, Reason: reason})
+}
+
+// host returns the state of u's host, creating it on first use.
+func (c *Crawler) host(u *url.URL) *hostState {
+	key := u.Scheme + "://" + u.Host
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.hosts[key]
+	if !ok {
+		h = &hostState{delay: c.HostDelay}
+		if c.PerHost > 0 {
+			h.slots = make(chan struct{}, c.PerHost)
+		}
+		c.hosts[key] = h
+	}
+	return h
+}
+
+// acquire waits until a request to h may start under every limit and
+// returns the function that ends it, or fails when ctx is done first. The
+// host slot is taken before the global one, so fetches queued on a busy
+// host do not hold global slots.
+func (c *Crawler) acquire(ctx context.Context, h *hostState) (release func(), err error) {
+	c.mu.Lock()
+	if c.MaxConcurrency > 0 && c.slots == nil {
+		c.slots = make(chan struct{}, c.MaxConcurrency)
+	}
+	slots := c.slots
+	c.mu.Unlock()
+
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	releaseHost := func() {
+		if h.slots != nil {
+			<-h.slots
+		}
+	}
+
+	h.mu.Lock()
+	start := time.Now()
+	if start.Before(h.next) {
+		start = h.next
+	}
+	h.next = start.Add(h.delay)
+	h.mu.Unlock()
+	wait := time.NewTimer(time.Until(start))
+	defer wait.Stop()
+	select {
+	case <-wait.C:
+	case <-ctx.Done():
+		releaseHost()
+		return nil, ctx.Err()
+	}
+
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			releaseHost()
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		if slots != nil {
+			<-slots
+		}
+		releaseHost()
+	}, nil
+}
+
+// loadRobots returns the robots.txt rules of u's host, fetching them the
+// first time they are needed. As RFC 9309 asks, a missing file (4xx)
+// allows everything and an unreachable one (5xx or no answer) allows
+// nothing; that failure is kept for RobotsRetry, then fetched again.
+func (h *hostState) loadRobots(ctx context.Context, c *Crawler, u *url.URL) *Robots {
+	h.robotsMu.Lock()
+	defer h.robotsMu.Unlock()
+	if h.robots != nil && (h.robotsRetry.IsZero() || time.Now().Before(h.robotsRetry)) {
+		return h.robots
+	}
+
+	robotsURL := u.Scheme + "://" + u.Host + "/robots.txt"
+	robots, err := c.fetchRobots(ctx, h, robotsURL)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The crawl is stopping; this says nothing about the host.
+			return unavailable
+		}
+		c.failed(robotsURL, err.Error())
+		h.robots, h.robotsRetry = unavailable, time.Now().Add(c.RobotsRetry)
+		return h.robots
+	}
+	h.robots, h.robotsRetry = robots, time.Time{}
+	if d := robots.CrawlDelay(c.UserAgent); d > 0 {
+		h.mu.Lock()
+		h.delay = max(h.delay, d)
+		h.mu.Unlock()
+	}
+	return robots
+}
+
+// fetchRobots fetches robotsURL under h's politeness limits and parses it.
+func (c *Crawler) fetchRobots(ctx context.Context, h *hostState, robotsURL string) (*Robots, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	release, err := c.acquire(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return ParseRobots(resp.Body), nil
+	case resp.StatusCode >= 400 && resp.StatusCode <= 499:
+		return allowAll, nil
+	}
+	return nil, &StatusError{URL: robotsURL, Code: resp.StatusCode, Status: resp.Status}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingFetcher counts the fetches of each URL and keeps each fetch
+// busy for a moment, so concurrent fetches of one URL would overlap.
+type countingFetcher struct {
+	Fetcher
+	delay time.Duration
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newCountingFetcher(f Fetcher) *countingFetcher {
+	return &countingFetcher{Fetcher: f, delay: 5 * time.Millisecond, counts: make(map[string]int)}
+}
+
+func (f *countingFetcher) Fetch(url string) (string, []string, error) {
+	f.mu.Lock()
+	f.counts[url]++
+	f.mu.Unlock()
+	time.Sleep(f.delay)
+	return f.Fetcher.Fetch(url)
+}
+
+func (f *countingFetcher) fetched() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make(map[string]int, len(f.counts))
+	for u, n := range f.counts {
+		out[u] = n
+	}
+	return out
+}
+
+func urls(pages []Page) []string {
+	var out []string
+	for _, p := range pages {
+		out = append(out, p.URL)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// cycle is a site whose pages all link to each other and themselves.
+var cycle = fakeFetcher{
+	"http://a/": &fakeResult{"a", []string{"http://a/", "http://b/", "http://c/"}},
+	"http://b/": &fakeResult{"b", []string{"http://a/", "http://b/", "http://c/", "http://c/"}},
+	"http://c/": &fakeResult{"c", []string{"http://a/", "http://b/", "http://c/"}},
+}
+
+func TestCrawlFetchesEachURLOnce(t *testing.T) {
+	tests := []struct {
+		name    string
+		fetcher fakeFetcher
+		seed    string
+		depth   int
+		want    []string // URLs fetched, each exactly once
+	}{
+		{"depth 0 fetches nothing", fetcher, "https://golang.org/", 0, nil},
+		{"depth 1 fetches the seed", fetcher, "https://golang.org/", 1, []string{"https://golang.org/"}},
+		{"depth 2", fetcher, "https://golang.org/", 2, []string{
+			"https://golang.org/", "https://golang.org/cmd/", "https://golang.org/pkg/",
+		}},
+		{"golang.org", fetcher, "https://golang.org/", 4, []string{
+			"https://golang.org/", "https://golang.org/cmd/", "https://golang.org/pkg/",
+			"https://golang.org/pkg/fmt/", "https://golang.org/pkg/os/",
+		}},
+		{"cycle", cycle, "http://a/", 10, []string{"http://a/", "http://b/", "http://c/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newCountingFetcher(tt.fetcher)
+			pages, summary := NewCrawler(f).Crawl(context.Background(), tt.seed, tt.depth)
+			counts := f.fetched()
+			var fetched []string
+			for u, n := range counts {
+				if n != 1 {
+					t.Errorf("%s fetched %d times", u, n)
+				}
+				fetched = append(fetched, u)
+			}
+			sort.Strings(fetched)
+			if !reflect.DeepEqual(fetched, tt.want) {
+				t.Errorf("fetched %v, want %v", fetched, tt.want)
+			}
+			if got := urls(pages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pages %v, want %v", got, tt.want)
+			}
+			if want := len(tt.want); summary.Pages+len(summary.Errors) != want {
+				t.Errorf("summary counts %d pages and %d errors, want %d fetches", summary.Pages, len(summary.Errors), want)
+			}
+		})
+	}
+}
+
+func TestCrawlRecordsFirstParent(t *testing.T) {
+	pages, _ := NewCrawler(fetcher).Crawl(context.Background(), "https://golang.org/", 4)
+	want := map[string]struct {
+		depth  int
+		parent string
+	}{
+		"https://golang.org/":         {0, ""},
+		"https://golang.org/pkg/":     {1, "https://golang.org/"},
+		"https://golang.org/cmd/":     {1, "https://golang.org/"},
+		"https://golang.org/pkg/fmt/": {2, "https://golang.org/pkg/"},
+		"https://golang.org/pkg/os/":  {2, "https://golang.org/pkg/"},
+	}
+	for _, p := range pages {
+		w := want[p.URL]
+		if p.Depth != w.depth || p.Parent != w.parent {
+			t.Errorf("%s: depth %d parent %q, want %d %q", p.URL, p.Depth, p.Parent, w.depth, w.parent)
+		}
+	}
+}
+
+func TestCrawlersAreIndependent(t *testing.T) {
+	// Two crawls at once, of the same site, each fetch every page.
+	f1, f2 := newCountingFetcher(cycle), newCountingFetcher(cycle)
+	var wg sync.WaitGroup
+	for _, f := range []*countingFetcher{f1, f2} {
+		wg.Add(1)
+		go func(f *countingFetcher) {
+			defer wg.Done()
+			NewCrawler(f).Crawl(context.Background(), "http://a/", 5)
+		}(f)
+	}
+	wg.Wait()
+	for i, f := range []*countingFetcher{f1, f2} {
+		if got := f.fetched(); len(got) != 3 {
+			t.Errorf("crawl %d fetched %v", i, got)
+		}
+	}
+}
+
+func TestCrawlFailedPagesAreNotRetried(t *testing.T) {
+	// Every page links to a URL the fetcher does not know.
+	site := fakeFetcher{
+		"http://a/": &fakeResult{"a", []string{"http://missing/", "http://b/"}},
+		"http://b/": &fakeResult{"b", []string{"http://missing/", "http://a/"}},
+	}
+	f := newCountingFetcher(site)
+	_, summary := NewCrawler(f).Crawl(context.Background(), "http://a/", 5)
+	if n := f.fetched()["http://missing/"]; n != 1 {
+		t.Errorf("missing page fetched %d times", n)
+	}
+	if len(summary.Errors) != 1 || summary.Errors[0].URL != "http://missing/" {
+		t.Errorf("errors %+v", summary.Errors)
+	}
+}
+
+// spread is a site of three hosts, each with four pages, all linked from
+// the seed.
+func spread() fakeFetcher {
+	site := fakeFetcher{}
+	seed := &fakeResult{body: "seed"}
+	site["http://h0/"] = seed
+	for h := 0; h < 3; h++ {
+		for p := 0; p < 4; p++ {
+			u := fmt.Sprintf("http://h%d/p%d", h, p)
+			seed.urls = append(seed.urls, u)
+			site[u] = &fakeResult{body: u}
+		}
+	}
+	return site
+}
+
+// timingFetcher records when each fetch starts and the most fetches in
+// progress at once, overall and per host.
+type timingFetcher struct {
+	Fetcher
+	delay time.Duration
+
+	mu       sync.Mutex
+	active   map[string]int
+	total    int
+	maxTotal int
+	maxPer   int
+	starts   map[string][]time.Time
+}
+
+func newTimingFetcher(f Fetcher, delay time.Duration) *timingFetcher {
+	return &timingFetcher{Fetcher: f, delay: delay, active: make(map[string]int), starts: make(map[string][]time.Time)}
+}
+
+func (f *timingFetcher) Fetch(rawURL string) (string, []string, error) {
+	u, _ := url.Parse(rawURL)
+	f.mu.Lock()
+	f.active[u.Host]++
+	f.total++
+	f.maxTotal = max(f.maxTotal, f.total)
+	f.maxPer = max(f.maxPer, f.active[u.Host])
+	f.starts[u.Host] = append(f.starts[u.Host], time.Now())
+	f.mu.Unlock()
+
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	f.active[u.Host]--
+	f.total--
+	f.mu.Unlock()
+	return f.Fetcher.Fetch(rawURL)
+}
+
+// minGap returns the shortest time between two fetch starts on one host.
+func (f *timingFetcher) minGap() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	gap := time.Duration(-1)
+	for _, starts := range f.starts {
+		sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+		for i := 1; i < len(starts); i++ {
+			if d := starts[i].Sub(starts[i-1]); gap < 0 || d < gap {
+				gap = d
+			}
+		}
+	}
+	return gap
+}
+
+func TestCrawlLimits(t *testing.T) {
+	const fetchTime = 20 * time.Millisecond
+	tests := []struct {
+		name     string
+		setup    func(*Crawler)
+		maxTotal int           // most fetches at once, overall
+		maxPer   int           // and on one host
+		minGap   time.Duration // least time between starts on one host
+	}{
+		{"no limits", func(c *Crawler) {}, 12, 4, 0},
+		{"MaxConcurrency", func(c *Crawler) { c.MaxConcurrency = 2 }, 2, 2, 0},
+		{"PerHost", func(c *Crawler) { c.PerHost = 1 }, 3, 1, fetchTime},
+		{"PerHost and MaxConcurrency", func(c *Crawler) { c.PerHost = 2; c.MaxConcurrency = 3 }, 3, 2, 0},
+		{"HostDelay", func(c *Crawler) { c.HostDelay = 30 * time.Millisecond }, 3, 1, 30 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTimingFetcher(spread(), fetchTime)
+			c := NewCrawler(f)
+			tt.setup(c)
+			_, summary := c.Crawl(context.Background(), "http://h0/", 2)
+			if summary.Pages != 13 {
+				t.Fatalf("%d pages crawled, want 13", summary.Pages)
+			}
+			// The limits must be reached but never passed.
+			if f.maxTotal != tt.maxTotal {
+				t.Errorf("%d fetches at once, want %d", f.maxTotal, tt.maxTotal)
+			}
+			if f.maxPer != tt.maxPer {
+				t.Errorf("%d fetches at once on one host, want %d", f.maxPer, tt.maxPer)
+			}
+			// Timers may fire a little late, which can shorten one gap.
+			if gap := f.minGap(); gap < tt.minGap-5*time.Millisecond {
+				t.Errorf("fetches on one host %v apart, want at least %v", gap, tt.minGap)
+			}
+		})
+	}
+}
+
+// robotsServer serves robots.txt with the given statuses and bodies in
+// turn, repeating the last, and counts the requests for it.
+type robotsServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	answers  []robotsAnswer
+	requests int
+}
+
+type robotsAnswer struct {
+	code int
+	body string
+}
+
+func newRobotsServer(t *testing.T, answers ...robotsAnswer) *robotsServer {
+	s := &robotsServer{answers: answers}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		a := s.answers[min(s.requests, len(s.answers)-1)]
+		s.requests++
+		s.mu.Unlock()
+		w.WriteHeader(a.code)
+		fmt.Fprint(w, a.body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *robotsServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func TestCrawlRobots(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  robotsAnswer
+		skipped map[string]string // path -> reason
+		errors  int
+	}{
+		{"rules", robotsAnswer{200, "User-agent: *\nDisallow: /private\n"},
+			map[string]string{"/private": "disallowed by robots.txt"}, 0},
+		{"missing", robotsAnswer{404, ""}, map[string]string{}, 0},
+		{"unavailable", robotsAnswer{503, ""},
+			map[string]string{"/": "robots.txt unavailable"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newRobotsServer(t, tt.answer)
+			site := fakeFetcher{
+				srv.URL + "/":        &fakeResult{"home", []string{srv.URL + "/private", srv.URL + "/public"}},
+				srv.URL + "/private": &fakeResult{"private", nil},
+				srv.URL + "/public":  &fakeResult{"public", nil},
+			}
+			c := NewCrawler(site)
+			c.Robots, c.Client = true, srv.Client()
+			_, summary := c.Crawl(context.Background(), srv.URL+"/", 3)
+			skipped := map[string]string{}
+			for _, s := range summary.Skipped {
+				skipped[strings.TrimPrefix(s.URL, srv.URL)] = s.Reason
+			}
+			if !reflect.DeepEqual(skipped, tt.skipped) {
+				t.Errorf("skipped %v, want %v", skipped, tt.skipped)
+			}
+			if len(summary.Errors) != tt.errors {
+				t.Errorf("errors %+v", summary.Errors)
+			}
+			if n := srv.count(); n != 1 {
+				t.Errorf("robots.txt fetched %d times", n)
+			}
+		})
+	}
+}
+
+func TestRobotsFailureIsRetried(t *testing.T) {
+	srv := newRobotsServer(t, robotsAnswer{503, ""}, robotsAnswer{200, "User-agent: *\nDisallow: /private\n"})
+	c := NewCrawler(fetcher)
+	c.Client, c.RobotsRetry = srv.Client(), 50*time.Millisecond
+	u, _ := url.Parse(srv.URL + "/page")
+	h := c.host(u)
+	ctx := context.Background()
+
+	if r := h.loadRobots(ctx, c, u); r != unavailable {
+		t.Fatalf("got %+v after a 503, want unavailable", r)
+	}
+	if r := h.loadRobots(ctx, c, u); r != unavailable || srv.count() != 1 {
+		t.Fatalf("failure not cached: %+v after %d requests", r, srv.count())
+	}
+	time.Sleep(60 * time.Millisecond)
+	r := h.loadRobots(ctx, c, u)
+	if srv.count() != 2 || !r.Allowed(c.UserAgent, "/page") || r.Allowed(c.UserAgent, "/private") {
+		t.Fatalf("got %+v after %d requests, want the rules", r, srv.count())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if h.loadRobots(ctx, c, u); srv.count() != 2 {
+		t.Fatalf("rules fetched again after success: %d requests", srv.count())
+	}
+	if len(c.summary.Errors) != 1 {
+		t.Errorf("errors %+v, want the one failure", c.summary.Errors)
+	}
+}
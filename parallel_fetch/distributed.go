@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/httpjson"
+)
+
+// A distributed crawl has one coordinator, which owns the frontier, and
+// any number of worker processes. A worker leases a URL, fetches it with
+// its own Fetcher and politeness rules, and reports the page back; the
+// coordinator queues the links found. A lease not reported before it
+// expires, because its worker died or hangs, goes to the next worker
+// that asks.
+//
+//	POST /lease   {"worker": id}                     -> leaseResponse
+//	POST /report  Report                             -> 200, or 409 if the lease expired
+//	GET  /status                                     -> coordinator state
+
+// Lease is a URL handed to one worker until Expires.
+type Lease struct {
+	ID      string    `json:"id"`
+	Worker  string    `json:"worker"`
+	Item    Item      `json:"item"`
+	Expires time.Time `json:"expires"`
+}
+
+type leaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+type leaseResponse struct {
+	Lease *Lease `json:"lease,omitempty"` // nil if nothing is waiting right now
+	Done  bool   `json:"done,omitempty"`  // the crawl is over, the worker can exit
+}
+
+// Report is a worker's answer for a lease: the page fetched, or the
+// reason it was skipped, or neither if the worker gave the lease back.
+type Report struct {
+	Worker  string `json:"worker"`
+	Lease   string `json:"lease"`
+	Page    *Page  `json:"page,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// Coordinator hands out the URLs of a crawl to workers.
+type Coordinator struct {
+	Seed     string
+	Depth    int
+	LeaseTTL time.Duration
+
+	frontier Frontier
+	begin    time.Time
+	finished chan struct{} // closed when every URL is done
+
+	mu      sync.Mutex
+	nextID  int
+	leases  map[string]*Lease
+	retry   []Item               // URLs whose lease expired, handed out first
+	workers map[string]time.Time // last request of each worker
+	told    map[string]bool      // workers told the crawl is over
+	summary Summary
+}
+
+// NewCoordinator returns a coordinator crawling from seed to depth, with
+// its state in frontier, which may hold a crawl to resume.
+func NewCoordinator(frontier Frontier, seed string, depth int) (*Coordinator, error) {
+	if depth > 0 {
+		if _, err := frontier.Push(Item{URL: seed}); err != nil {
+			return nil, err
+		}
+	}
+	return &Coordinator{
+		Seed:     seed,
+		Depth:    depth,
+		LeaseTTL: 30 * time.Second,
+		frontier: frontier,
+		begin:    time.Now(),
+		finished: make(chan struct{}),
+		leases:   make(map[string]*Lease),
+		workers:  make(map[string]time.Time),
+		told:     make(map[string]bool),
+	}, nil
+}
+
+// Lease gives worker the next URL to fetch, if one is waiting.
+func (c *Coordinator) Lease(worker string) (leaseResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.workers[worker] = now
+	c.expireLocked(now)
+
+	var item Item
+	if len(c.retry) > 0 {
+		item, c.retry = c.retry[0], c.retry[1:]
+	} else {
+		var ok bool
+		var err error
+		item, ok, err = c.frontier.Pop()
+		if err != nil {
+			return leaseResponse{}, err
+		}
+		if !ok {
+			if c.doneLocked() {
+				c.told[worker] = true
+				return leaseResponse{Done: true}, nil
+			}
+			return leaseResponse{}, nil
+		}
+	}
+	c.nextID++
+	l := &Lease{ID: strconv.Itoa(c.nextID), Worker: worker, Item: item, Expires: now.Add(c.LeaseTTL)}
+	c.leases[l.ID] = l
+	return leaseResponse{Lease: l}, nil
+}
+
+// expireLocked takes back the leases that ran out. Caller holds c.mu.
+func (c *Coordinator) expireLocked(now time.Time) {
+	for id, l := range c.leases {
+		if now.After(l.Expires) {
+			log.Printf("lease %s of %s expired on worker %s; reassigning", id, l.Item.URL, l.Worker)
+			delete(c.leases, id)
+			c.retry = append(c.retry, l.Item)
+		}
+	}
+}
+
+// doneLocked reports whether the crawl is over, closing finished the
+// first time it is. Caller holds c.mu.
+func (c *Coordinator) doneLocked() bool {
+	if len(c.leases) > 0 || len(c.retry) > 0 || len(c.frontier.Pending()) > 0 {
+		return false
+	}
+	select {
+	case <-c.finished:
+	default:
+		c.summary.Duration = time.Since(c.begin)
+		close(c.finished)
+	}
+	return true
+}
+
+// errStaleLease is returned for reports on leases that expired.
+var errStaleLease = fmt.Errorf("lease expired or unknown")
+
+// Report records a worker's result and queues the links it found.
+func (c *Coordinator) Report(r Report) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workers[r.Worker] = time.Now()
+	l, ok := c.leases[r.Lease]
+	if !ok || l.Worker != r.Worker {
+		return errStaleLease
+	}
+	delete(c.leases, r.Lease)
+	item := l.Item
+
+	switch {
+	case r.Page == nil && r.Skipped == "":
+		c.retry = append(c.retry, item)
+		return nil
+	case r.Page == nil:
+		c.summary.Skipped = append(c.summary.Skipped, Skip{URL: item.URL, Reason: r.Skipped})
+		return c.frontier.Done(item, nil)
+	case r.Page.Err != "":
+		c.summary.Errors = append(c.summary.Errors, CrawlError{URL: item.URL, Err: r.Page.Err})
+		return c.frontier.Done(item, r.Page)
+	}
+	// The worker's record keeps the coordinator's view of where the URL was found.
+	r.Page.URL, r.Page.Depth, r.Page.Parent = item.URL, item.Depth, item.Parent
+	if item.Depth+1 < c.Depth {
+		for _, u := range r.Page.Links {
+			if _, err := c.frontier.Push(Item{URL: u, Parent: item.URL, Depth: item.Depth + 1}); err != nil {
+				// Hand the URL out again so its links are queued later;
+				// those pushed already are not queued twice.
+				c.retry = append(c.retry, item)
+				return err
+			}
+		}
+	}
+	c.summary.Pages++
+	c.summary.Bytes += int64(r.Page.Size)
+	return c.frontier.Done(item, r.Page)
+}
+
+// Finished is closed once every URL of the crawl is done.
+func (c *Coordinator) Finished() <-chan struct{} { return c.finished }
+
+// Result returns the pages crawled, ordered by depth and URL, and the
+// summary of the crawl. URLs not done yet are listed as skipped.
+func (c *Coordinator) Result() ([]Page, Summary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	summary := c.summary
+	if summary.Duration == 0 {
+		summary.Duration = time.Since(c.begin)
+	}
+	pending := c.frontier.Pending()
+	if len(pending) > 0 {
+		summary.Stopped = "interrupted"
+	}
+	for _, item := range pending {
+		summary.Skipped = append(summary.Skipped, Skip{URL: item.URL, Reason: summary.Stopped})
+	}
+	return sortPages(c.frontier.Pages()), summary
+}
+
+// AllTold reports whether every worker seen has been told the crawl is over.
+func (c *Coordinator) AllTold() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for w := range c.workers {
+		if !c.told[w] {
+			return false
+		}
+	}
+	return true
+}
+
+// Register adds the coordinator endpoints to mux.
+func (c *Coordinator) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/lease", func(w http.ResponseWriter, r *http.Request) {
+		var req leaseRequest
+		if !httpjson.DecodePost(w, r, &req) {
+			return
+		}
+		resp, err := c.Lease(req.Worker)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, resp)
+	})
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		var rep Report
+		if !httpjson.DecodePost(w, r, &rep) {
+			return
+		}
+		if err := c.Report(rep); err == errStaleLease {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.mu.Lock()
+		leases := make([]*Lease, 0, len(c.leases))
+		for _, l := range c.leases {
+			leases = append(leases, l)
+		}
+		status := map[string]interface{}{
+			"seed":    c.Seed,
+			"depth":   c.Depth,
+			"waiting": len(c.frontier.Pending()) - len(c.leases),
+			"leases":  leases,
+			"pages":   c.summary.Pages,
+			"errors":  len(c.summary.Errors),
+			"workers": c.workers,
+		}
+		c.mu.Unlock()
+		httpjson.Write(w, http.StatusOK, status)
+	})
+}
+
+// Worker fetches pages leased from a coordinator.
+type Worker struct {
+	ID          string
+	Coordinator string // base URL
+	Client      *http.Client
+	// Crawler fetches the pages; only its fetcher and politeness rules are used.
+	Crawler *Crawler
+	// Poll is how long to wait when no URL is waiting or the coordinator
+	// cannot be reached.
+	Poll time.Duration
+}
+
+// Status asks the coordinator for its state, to learn the seed URL.
+func (wk *Worker) Status(ctx context.Context) (seed string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wk.Coordinator+"/status", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := wk.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Seed string `json:"seed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return "", err
+	}
+	return status.Seed, nil
+}
+
+// Run fetches leased pages with n goroutines until the coordinator says
+// the crawl is over or ctx is done, and returns the pages reported.
+func (wk *Worker) Run(ctx context.Context, n int) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reported := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				var resp leaseResponse
+				if err := wk.post(ctx, "/lease", leaseRequest{Worker: wk.ID}, &resp); err != nil {
+					if ctx.Err() == nil {
+						log.Printf("lease: %v", err)
+					}
+					wk.sleep(ctx)
+					continue
+				}
+				if resp.Done {
+					return
+				}
+				if resp.Lease == nil {
+					wk.sleep(ctx)
+					continue
+				}
+
+				page, reason := wk.Crawler.get(ctx, resp.Lease.Item)
+				if page == nil && reason == "" {
+					// Stopping: the lease expires and another worker takes it.
+					return
+				}
+				rep := Report{Worker: wk.ID, Lease: resp.Lease.ID, Page: page, Skipped: reason}
+				if err := wk.post(ctx, "/report", rep, &struct{}{}); err != nil {
+					log.Printf("report %s: %v", resp.Lease.Item.URL, err)
+					continue
+				}
+				mu.Lock()
+				reported++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return reported
+}
+
+func (wk *Worker) sleep(ctx context.Context) {
+	select {
+	case <-time.After(wk.Poll):
+	case <-ctx.Done():
+	}
+}
+
+func (wk *Worker) post(ctx context.Context, path string, in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wk.Coordinator+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wk.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyFrontier fails the next fails pushes.
+type flakyFrontier struct {
+	*MemoryFrontier
+	fails int
+}
+
+func (f *flakyFrontier) Push(item Item) (bool, error) {
+	if f.fails > 0 {
+		f.fails--
+		return false, errors.New("disk full")
+	}
+	return f.MemoryFrontier.Push(item)
+}
+
+func lease(t *testing.T, c *Coordinator, worker string) *Lease {
+	t.Helper()
+	resp, err := c.Lease(worker)
+	if err != nil || resp.Lease == nil {
+		t.Fatalf("no lease for %s: %+v %v", worker, resp, err)
+	}
+	return resp.Lease
+}
+
+func TestReportRequeuesOnPushFailure(t *testing.T) {
+	frontier := &flakyFrontier{MemoryFrontier: NewMemoryFrontier()}
+	c, err := NewCoordinator(frontier, "http://a/", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := &Page{Status: 200, Links: []string{"http://a/1", "http://a/2"}}
+
+	l := lease(t, c, "w1")
+	frontier.fails = 1
+	if err := c.Report(Report{Worker: "w1", Lease: l.ID, Page: page}); err == nil {
+		t.Fatal("report succeeded though queuing its links failed")
+	}
+	// The seed goes out again rather than being lost with its links.
+	again := lease(t, c, "w2")
+	if again.Item.URL != "http://a/" {
+		t.Fatalf("leased %s, want the seed again", again.Item.URL)
+	}
+	if err := c.Report(Report{Worker: "w2", Lease: again.ID, Page: page}); err != nil {
+		t.Fatal(err)
+	}
+	var leased []string
+	for i := 0; i < 2; i++ {
+		leased = append(leased, lease(t, c, "w2").Item.URL)
+	}
+	if leased[0] != "http://a/1" || leased[1] != "http://a/2" {
+		t.Errorf("leased %v after the retry", leased)
+	}
+	if _, summary := c.Result(); summary.Pages != 1 {
+		t.Errorf("%d pages counted, want 1", summary.Pages)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	c, err := NewCoordinator(NewMemoryFrontier(), "http://a/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.LeaseTTL = 10 * time.Millisecond
+	l := lease(t, c, "slow")
+	if resp, _ := c.Lease("other"); resp.Lease != nil || resp.Done {
+		t.Fatalf("second lease %+v while the first is held", resp)
+	}
+	time.Sleep(20 * time.Millisecond)
+	taken := lease(t, c, "other")
+	if taken.Item != l.Item {
+		t.Fatalf("reassigned %+v, want %+v", taken.Item, l.Item)
+	}
+	if err := c.Report(Report{Worker: "slow", Lease: l.ID, Page: &Page{Status: 200}}); err != errStaleLease {
+		t.Fatalf("late report: %v, want errStaleLease", err)
+	}
+	if err := c.Report(Report{Worker: "other", Lease: taken.ID, Page: &Page{Status: 200}}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := c.Lease("other"); !resp.Done {
+		t.Fatalf("crawl not done: %+v", resp)
+	}
+	select {
+	case <-c.Finished():
+	default:
+		t.Fatal("Finished not closed")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exporters maps the names accepted by -format to the writers of a crawl.
+var exporters = map[string]func(io.Writer, []Page) error{
+	"text":  WriteText,
+	"jsonl": WriteJSONL,
+	"csv":   WriteCSV,
+	"dot":   WriteDOT,
+}
+
+// WriteText prints a "found:" line per page fetched, as the crawler
+// always has.
+func WriteText(w io.Writer, pages []Page) error {
+	bw := bufio.NewWriter(w)
+	for _, p := range pages {
+		if p.Err == "" {
+			fmt.Fprintf(bw, "found: %s %q\n", p.URL, p.Body)
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteJSONL writes one JSON object per page.
+func WriteJSONL(w io.Writer, pages []Page) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, p := range pages {
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteCSV writes a header and one row per page. Links are joined with
+// spaces, which URLs cannot contain; bodies are left out.
+func WriteCSV(w io.Writer, pages []Page) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"url", "depth", "parent", "status", "size", "links", "error", "duration_ms"})
+	for _, p := range pages {
+		cw.Write([]string{
+			p.URL,
+			strconv.Itoa(p.Depth),
+			p.Parent,
+			strconv.Itoa(p.Status),
+			strconv.Itoa(p.Size),
+			strings.Join(p.Links, " "),
+			p.Err,
+			strconv.FormatFloat(float64(p.Duration.Microseconds())/1000, 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteDOT prints the link graph in Graphviz DOT. Pages fetched are
+// boxes, failed ones red; links to pages that were not fetched point to
+// grey ellipses.
+func WriteDOT(w io.Writer, pages []Page) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph crawl {")
+	fmt.Fprintln(bw, "  rankdir=LR;")
+	fmt.Fprintln(bw, "  node [shape=box, fontsize=10];")
+	crawled := make(map[string]bool)
+	for _, p := range pages {
+		crawled[p.URL] = true
+		if p.Err != "" {
+			fmt.Fprintf(bw, "  %q [color=red, tooltip=%q];\n", p.URL, p.Err)
+		} else {
+			fmt.Fprintf(bw, "  %q;\n", p.URL)
+		}
+	}
+	unvisited := make(map[string]bool)
+	for _, p := range pages {
+		for _, l := range p.Links {
+			if !crawled[l] && !unvisited[l] {
+				unvisited[l] = true
+				fmt.Fprintf(bw, "  %q [shape=ellipse, color=grey, fontcolor=grey];\n", l)
+			}
+			fmt.Fprintf(bw, "  %q -> %q;\n", p.URL, l)
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// ReadPages reads a crawl written by WriteJSONL or WriteCSV, telling them
+// apart by the first byte. Bodies are only in JSON Lines exports.
+func ReadPages(r io.Reader) ([]Page, error) {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if first[0] == '{' {
+		return readJSONL(br)
+	}
+	return readCSV(br)
+}
+
+func readJSONL(r io.Reader) ([]Page, error) {
+	var pages []Page
+	dec := json.NewDecoder(r)
+	for {
+		var p Page
+		if err := dec.Decode(&p); err == io.EOF {
+			return pages, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("page %d: %v", len(pages)+1, err)
+		}
+		pages = append(pages, p)
+	}
+}
+
+func readCSV(r io.Reader) ([]Page, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || len(rows[0]) != 8 || rows[0][0] != "url" {
+		return nil, fmt.Errorf("not a crawl export: expected JSON Lines or CSV with a url,depth,... header")
+	}
+	pages := make([]Page, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		p := Page{URL: row[0], Parent: row[2], Err: row[6]}
+		if links := strings.Fields(row[5]); len(links) > 0 {
+			p.Links = links
+		}
+		var errs [4]error
+		p.Depth, errs[0] = strconv.Atoi(row[1])
+		p.Status, errs[1] = strconv.Atoi(row[3])
+		p.Size, errs[2] = strconv.Atoi(row[4])
+		ms, err := strconv.ParseFloat(row[7], 64)
+		errs[3] = err
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %v", i+2, err)
+			}
+		}
+		p.Duration = time.Duration(ms * float64(time.Millisecond))
+		pages = append(pages, p)
+	}
+	return pages, nil
+}
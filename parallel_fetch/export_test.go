@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crawl is a small export: a seed with a comma and quotes in its body, a
+// page found on it, and a failed one.
+var crawl = []Page{
+	{
+		URL: "http://a/", Status: 200, Size: 2048, Body: `Title, "quoted"` + "\nline two",
+		Links: []string{"http://a/b", "http://a/missing", "http://other/"}, Duration: 1500 * time.Microsecond,
+	},
+	{URL: "http://a/b", Depth: 1, Parent: "http://a/", Status: 200, Size: 10, Body: "B", Links: []string{"http://a/"}, Duration: 2 * time.Millisecond},
+	{URL: "http://a/missing", Depth: 1, Parent: "http://a/", Status: 404, Err: "http://a/missing: 404 Not Found", Duration: 250 * time.Microsecond},
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteText(&buf, crawl); err != nil {
+		t.Fatal(err)
+	}
+	want := `found: http://a/ "Title, \"quoted\"\nline two"` + "\n" + `found: http://a/b "B"` + "\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, crawl); err != nil {
+		t.Fatal(err)
+	}
+	want := `url,depth,parent,status,size,links,error,duration_ms
+http://a/,0,,200,2048,http://a/b http://a/missing http://other/,,1.500
+http://a/b,1,http://a/,200,10,http://a/,,2.000
+http://a/missing,1,http://a/,404,0,,http://a/missing: 404 Not Found,0.250
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteDOT(&buf, crawl); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph crawl {
+  rankdir=LR;
+  node [shape=box, fontsize=10];
+  "http://a/";
+  "http://a/b";
+  "http://a/missing" [color=red, tooltip="http://a/missing: 404 Not Found"];
+  "http://a/" -> "http://a/b";
+  "http://a/" -> "http://a/missing";
+  "http://other/" [shape=ellipse, color=grey, fontcolor=grey];
+  "http://a/" -> "http://other/";
+  "http://a/b" -> "http://a/";
+}
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestReadPagesRoundTrip(t *testing.T) {
+	// CSV leaves bodies out and keeps durations to the microsecond.
+	noBodies := make([]Page, len(crawl))
+	for i, p := range crawl {
+		p.Body = ""
+		noBodies[i] = p
+	}
+	tests := []struct {
+		name  string
+		write func(*bytes.Buffer) error
+		want  []Page
+	}{
+		{"jsonl", func(b *bytes.Buffer) error { return WriteJSONL(b, crawl) }, crawl},
+		{"csv", func(b *bytes.Buffer) error { return WriteCSV(b, crawl) }, noBodies},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadPages(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read back\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPagesErrors(t *testing.T) {
+	tests := []struct {
+		name, input string
+		pages       int
+		err         string // substring; empty if no error
+	}{
+		{"empty", "", 0, ""},
+		{"jsonl", `{"url":"http://a/"}` + "\n" + `{"url":"http://b/"}`, 2, ""},
+		{"bad json", `{"url":"http://a/"}` + "\n{oops", 0, "page 2"},
+		{"csv header only", "url,depth,parent,status,size,links,error,duration_ms\n", 0, ""},
+		{"not an export", "name,age\nx,1\n", 0, "not a crawl export"},
+		{"bad number", "url,depth,parent,status,size,links,error,duration_ms\nhttp://a/,zero,,200,1,,,1\n", 0, "row 2"},
+		{"ragged csv", "url,depth,parent,status,size,links,error,duration_ms\nhttp://a/,0\n", 0, "wrong number of fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages, err := ReadPages(strings.NewReader(tt.input))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("error %v, want one mentioning %q", err, tt.err)
+			}
+			if len(pages) != tt.pages {
+				t.Errorf("%d pages, want %d", len(pages), tt.pages)
+			}
+		})
+	}
+}
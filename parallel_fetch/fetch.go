@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HTTPFetcher is a Fetcher that downloads pages over HTTP. The body it
+// returns is a summary of the page: its title followed by its visible
+// text. Links are resolved against the page URL and filtered by scheme
+// and host.
+type HTTPFetcher struct {
+	Client    *http.Client
+	UserAgent string
+	// Hosts restricts the links returned to these hosts ("example.com" or
+	// "127.0.0.1:8080"); empty allows every host.
+	Hosts []string
+	// Schemes allowed in links; empty means http and https.
+	Schemes []string
+	// MaxBytes caps how much of a page is read (0 = no limit).
+	MaxBytes int64
+	// SummaryLen caps the length of the returned body in runes (0 = no limit).
+	SummaryLen int
+}
+
+// NewHTTPFetcher returns a fetcher that follows links only to hosts, with
+// a 10 second client timeout, a 1 MiB page limit and 500-rune summaries.
+func NewHTTPFetcher(hosts ...string) *HTTPFetcher {
+	return &HTTPFetcher{
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		UserAgent:  "parallel_fetch/1.0",
+		Hosts:      hosts,
+		MaxBytes:   1 << 20,
+		SummaryLen: 500,
+	}
+}
+
+// StatusError is the error of a fetch answered with a status other than 2xx.
+type StatusError struct {
+	URL    string
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string { return e.URL + ": " + e.Status }
+
+// Fetch downloads rawURL. Answers other than 2xx are errors; pages that
+// are not HTML have no links.
+func (f *HTTPFetcher) Fetch(rawURL string) (string, []string, error) {
+	return f.FetchContext(context.Background(), rawURL)
+}
+
+// FetchContext is Fetch, abandoning the request when ctx is done.
+func (f *HTTPFetcher) FetchContext(ctx context.Context, rawURL string) (string, []string, error) {
+	body, urls, _, _, err := f.FetchSized(ctx, rawURL)
+	return body, urls, err
+}
+
+// FetchSized is FetchContext, also returning how many bytes of the page
+// were read, the whole body or MaxBytes of it, and whether the summary
+// was cut to SummaryLen.
+func (f *HTTPFetcher) FetchSized(ctx context.Context, rawURL string) (string, []string, int, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", nil, 0, false, err
+	}
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, 0, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", nil, 0, false, &StatusError{URL: rawURL, Code: resp.StatusCode, Status: resp.Status}
+	}
+	var r io.Reader = resp.Body
+	if f.MaxBytes > 0 {
+		r = io.LimitReader(r, f.MaxBytes)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, len(data), false, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "" && mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		if strings.HasPrefix(mediaType, "text/") {
+			body, cut := f.summary("", collapse(string(data)))
+			return body, nil, len(data), cut, nil
+		}
+		return "", nil, len(data), false, nil
+	}
+
+	doc := parseHTML(data)
+	// Relative links are relative to where redirects ended, or to <base>.
+	base := resp.Request.URL
+	if doc.base != "" {
+		if b, err := base.Parse(doc.base); err == nil {
+			base = b
+		}
+	}
+	body, cut := f.summary(doc.title, doc.text)
+	return body, f.resolve(base, doc.links), len(data), cut, nil
+}
+
+// resolve turns hrefs into absolute URLs without fragments, keeping each
+// allowed URL once.
+func (f *HTTPFetcher) resolve(base *url.URL, hrefs []string) []string {
+	seen := make(map[string]bool)
+	var urls []string
+	for _, href := range hrefs {
+		u, err := base.Parse(strings.TrimSpace(href))
+		if err != nil || !f.allowed(u) {
+			continue
+		}
+		u.Fragment, u.RawFragment = "", ""
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		s := u.String()
+		if !seen[s] {
+			seen[s] = true
+			urls = append(urls, s)
+		}
+	}
+	return urls
+}
+
+func (f *HTTPFetcher) allowed(u *url.URL) bool {
+	schemes := f.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	ok := false
+	for _, s := range schemes {
+		if strings.EqualFold(u.Scheme, s) {
+			ok = true
+		}
+	}
+	if !ok || u.Host == "" {
+		return false
+	}
+	if len(f.Hosts) == 0 {
+		return true
+	}
+	for _, h := range f.Hosts {
+		if strings.EqualFold(u.Host, h) || strings.EqualFold(u.Hostname(), h) {
+			return true
+		}
+	}
+	return false
+}
+
+// summary joins title and text, cut to SummaryLen runes, and reports
+// whether it was cut.
+func (f *HTTPFetcher) summary(title, text string) (string, bool) {
+	s := text
+	if title != "" {
+		s = strings.TrimSpace(title + "\n" + strings.TrimSpace(strings.TrimPrefix(text, title)))
+	}
+	if f.SummaryLen > 0 {
+		if r := []rune(s); len(r) > f.SummaryLen {
+			return string(r[:f.SummaryLen]) + "...", true
+		}
+	}
+	return s, false
+}
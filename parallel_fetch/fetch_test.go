@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// site serves a small fixture site and returns its URL.
+func site(t *testing.T) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	page := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, body)
+		}
+	}
+	mux.HandleFunc("/", page(`<title>Home</title><p>Welcome</p>
+		<a href="/a">a</a> <a href="b">b</a> <a href="/a#part">a again</a>
+		<a href="http://elsewhere.example/x">off host</a> <a href="mailto:x@y">mail</a>`))
+	mux.HandleFunc("/dir/page", page(`<a href="sub">sub</a> <a href="../up">up</a>`))
+	mux.HandleFunc("/based", page(`<base href="/other/"><a href="x">x</a>`))
+	mux.HandleFunc("/big", page("<title>Big</title>"+strings.Repeat("word ", 1000)+`<a href="/late">late</a>`))
+	mux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "plain   text <a href=\"/no\">")
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte{0x89, 'P', 'N', 'G'})
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	})
+	mux.Handle("/moved", http.RedirectHandler("/dir/page", http.StatusMovedPermanently))
+	mux.HandleFunc("/ua", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.UserAgent())
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestHTTPFetcher(t *testing.T) {
+	base := site(t)
+	host := strings.TrimPrefix(base, "http://")
+	tests := []struct {
+		name     string
+		path     string
+		setup    func(*HTTPFetcher)
+		body     string
+		links    []string // relative to base
+		status   int      // of the StatusError, 0 if none
+		allHosts bool
+	}{
+		{
+			name:  "links are resolved, deduplicated and kept on the host",
+			path:  "/",
+			body:  "Home\nWelcome a b a again off host mail",
+			links: []string{"/a", "/b"},
+		},
+		{
+			name:     "off-host links when every host is allowed",
+			path:     "/",
+			body:     "Home\nWelcome a b a again off host mail",
+			links:    []string{"/a", "/b", "http://elsewhere.example/x"},
+			allHosts: true,
+		},
+		{name: "relative to the page", path: "/dir/page", body: "sub up", links: []string{"/dir/sub", "/up"}},
+		{name: "relative to base", path: "/based", body: "x", links: []string{"/other/x"}},
+		{name: "redirects resolve against the final URL", path: "/moved", body: "sub up", links: []string{"/dir/sub", "/up"}},
+		{name: "plain text has no links", path: "/text", body: `plain text <a href="/no">`},
+		{name: "binary content is dropped", path: "/image"},
+		{name: "not found", path: "/missing", status: http.StatusNotFound},
+		{name: "server error", path: "/broken", status: http.StatusInternalServerError},
+		{
+			name:  "summary is cut",
+			path:  "/big",
+			setup: func(f *HTTPFetcher) { f.SummaryLen = 14 },
+			body:  "Big\nword word ...",
+			links: []string{"/late"},
+		},
+		{
+			name:  "MaxBytes stops reading",
+			path:  "/big",
+			setup: func(f *HTTPFetcher) { f.MaxBytes = 100 },
+			body:  "Big\n" + strings.TrimSpace(strings.Repeat("word ", 16)) + " wo",
+		},
+		{name: "user agent", path: "/ua", body: "test-agent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewHTTPFetcher(host)
+			f.UserAgent = "test-agent"
+			if tt.allHosts {
+				f.Hosts = nil
+			}
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			body, links, err := f.Fetch(base + tt.path)
+			if tt.status != 0 {
+				var se *StatusError
+				if !errors.As(err, &se) || se.Code != tt.status {
+					t.Fatalf("err %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body != tt.body {
+				t.Errorf("body %q, want %q", body, tt.body)
+			}
+			var want []string
+			for _, l := range tt.links {
+				if strings.HasPrefix(l, "/") {
+					l = base + l
+				}
+				want = append(want, l)
+			}
+			if !reflect.DeepEqual(links, want) {
+				t.Errorf("links %v, want %v", links, want)
+			}
+		})
+	}
+}
+
+func TestHTTPFetcherSchemes(t *testing.T) {
+	f := NewHTTPFetcher()
+	f.Schemes = []string{"ftp"}
+	base, _ := http.NewRequest(http.MethodGet, "http://h/", nil)
+	got := f.resolve(base.URL, []string{"ftp://h/file", "http://h/page", "//h/same-scheme"})
+	if want := []string{"ftp://h/file"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("links %v, want %v", got, want)
+	}
+}
+
+func TestHTTPFetcherSize(t *testing.T) {
+	base := site(t)
+	bigLen := len("<title>Big</title>" + strings.Repeat("word ", 1000) + `<a href="/late">late</a>`)
+	tests := []struct {
+		name     string
+		path     string
+		maxBytes int64
+		want     int
+	}{
+		{"the page, not its summary", "/big", 0, bigLen},
+		{"cut by MaxBytes", "/big", 100, 100},
+		{"text", "/text", 0, len(`plain   text <a href="/no">`)},
+		{"binary content counts", "/image", 0, 4},
+		{"errors read nothing", "/missing", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewHTTPFetcher()
+			f.MaxBytes = tt.maxBytes
+			body, _, size, _, _ := f.FetchSized(context.Background(), base+tt.path)
+			if size != tt.want {
+				t.Errorf("size %d, want %d", size, tt.want)
+			}
+			if len(body) > size {
+				t.Errorf("body of %d bytes is longer than the %d read", len(body), size)
+			}
+		})
+	}
+}
+
+func TestCrawlCountsBytesRead(t *testing.T) {
+	base := site(t)
+	f := NewHTTPFetcher()
+	f.SummaryLen = 10
+	c := NewCrawler(f)
+	pages, summary := c.Crawl(context.Background(), base+"/big", 1)
+	if len(pages) != 1 || pages[0].Size <= 5000 || len(pages[0].Body) > 20 || !pages[0].Truncated {
+		t.Fatalf("pages %+v", pages)
+	}
+	if summary.Bytes != int64(pages[0].Size) {
+		t.Errorf("summary counts %d bytes, page %d", summary.Bytes, pages[0].Size)
+	}
+
+	// The budget is spent on what was read, not on the short summaries.
+	c = NewCrawler(f)
+	c.MaxBytes = 5000
+	_, summary = c.Crawl(context.Background(), base+"/big", 1)
+	if summary.Stopped != errMaxBytes.Error() {
+		t.Errorf("crawl of %d bytes not stopped by a budget of 5000: %+v", summary.Bytes, summary)
+	}
+}
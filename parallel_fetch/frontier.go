@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/liviu274/Distributed-systems/jsonl"
+)
+
+// Item is a URL waiting in the frontier.
+type Item struct {
+	URL    string `json:"url"`
+	Parent string `json:"parent,omitempty"`
+	Depth  int    `json:"depth"`
+}
+
+// Frontier is the state of a crawl: the URLs waiting to be fetched, in
+// the order they were found, and every URL ever pushed, so each is
+// fetched once. Items popped but not yet done are in flight.
+type Frontier interface {
+	// Push queues item unless its URL was pushed before.
+	Push(item Item) (added bool, err error)
+	// Pop takes the next waiting item; ok is false if none is waiting.
+	Pop() (item Item, ok bool, err error)
+	// Done marks a popped item finished, with the record of its fetch, or
+	// nil if it was not fetched and never will be.
+	Done(item Item, page *Page) error
+	// Pending lists the items waiting, in flight ones included.
+	Pending() []Item
+	// Pages returns the records of every item done so far.
+	Pages() []Page
+	Close() error
+}
+
+// MemoryFrontier is a Frontier that lives only as long as the process.
+type MemoryFrontier struct {
+	mu       sync.Mutex
+	seen     map[string]Item // every item pushed, by URL
+	queue    []Item
+	inFlight map[string]Item
+	pages    []Page
+}
+
+// NewMemoryFrontier returns an empty frontier.
+func NewMemoryFrontier() *MemoryFrontier {
+	return &MemoryFrontier{seen: make(map[string]Item), inFlight: make(map[string]Item)}
+}
+
+func (f *MemoryFrontier) Push(item Item) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.seen[item.URL]; ok {
+		return false, nil
+	}
+	f.seen[item.URL] = item
+	f.queue = append(f.queue, item)
+	return true, nil
+}
+
+func (f *MemoryFrontier) Pop() (Item, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.queue) == 0 {
+		return Item{}, false, nil
+	}
+	item := f.queue[0]
+	f.queue = f.queue[1:]
+	f.inFlight[item.URL] = item
+	return item, true, nil
+}
+
+func (f *MemoryFrontier) Done(item Item, page *Page) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done(item, page)
+	return nil
+}
+
+// done records item as finished. Caller holds f.mu.
+func (f *MemoryFrontier) done(item Item, page *Page) {
+	f.seen[item.URL] = item
+	delete(f.inFlight, item.URL)
+	if page != nil {
+		f.pages = append(f.pages, *page)
+	}
+}
+
+func (f *MemoryFrontier) Pending() []Item {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items := make([]Item, 0, len(f.inFlight)+len(f.queue))
+	for _, item := range f.inFlight {
+		items = append(items, item)
+	}
+	return append(items, f.queue...)
+}
+
+func (f *MemoryFrontier) Pages() []Page {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Page(nil), f.pages...)
+}
+
+func (f *MemoryFrontier) Close() error { return nil }
+
+// frontierRecord is one line of a DiskFrontier log.
+type frontierRecord struct {
+	Op   string `json:"op"` // "push" or "done"
+	Item Item   `json:"item"`
+	Page *Page  `json:"page,omitempty"`
+}
+
+// DiskFrontier is a Frontier kept in an append-only log, so a crawl can
+// stop at any point and resume where it was. Pops are not logged: items
+// that were in flight when the process died are simply waiting again.
+// Every CompactEvery finished items the log is rewritten to hold only
+// one record per URL.
+type DiskFrontier struct {
+	CompactEvery int
+
+	mem  *MemoryFrontier
+	path string
+
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	finished int // done records since the last compaction
+}
+
+// OpenDiskFrontier opens the frontier logged at path, creating it if it
+// does not exist. A torn last line left by a crash mid-write is dropped.
+func OpenDiskFrontier(path string) (*DiskFrontier, error) {
+	mem := NewMemoryFrontier()
+	done := make(map[string]bool)
+	f, err := jsonl.Open(path, func(rec frontierRecord) {
+		switch rec.Op {
+		case "push":
+			mem.Push(rec.Item)
+		case "done":
+			done[rec.Item.URL] = true
+			mem.done(rec.Item, rec.Page)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Drop what was done from the queue rebuilt from push records.
+	queue := mem.queue[:0]
+	for _, item := range mem.queue {
+		if !done[item.URL] {
+			queue = append(queue, item)
+		}
+	}
+	mem.queue = queue
+
+	return &DiskFrontier{
+		CompactEvery: 500,
+		mem:          mem,
+		path:         path,
+		f:            f,
+		w:            bufio.NewWriter(f),
+	}, nil
+}
+
+func (d *DiskFrontier) Push(item Item) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	added, _ := d.mem.Push(item)
+	if !added {
+		return false, nil
+	}
+	return true, d.append(frontierRecord{Op: "push", Item: item})
+}
+
+func (d *DiskFrontier) Pop() (Item, bool, error) {
+	return d.mem.Pop()
+}
+
+func (d *DiskFrontier) Done(item Item, page *Page) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mem.Done(item, page)
+	if err := d.append(frontierRecord{Op: "done", Item: item, Page: page}); err != nil {
+		return err
+	}
+	d.finished++
+	if d.CompactEvery > 0 && d.finished >= d.CompactEvery {
+		return d.compact()
+	}
+	return nil
+}
+
+func (d *DiskFrontier) Pending() []Item { return d.mem.Pending() }
+
+func (d *DiskFrontier) Pages() []Page { return d.mem.Pages() }
+
+// append writes rec to the log. Caller holds d.mu. Records are flushed
+// to the file at once, but not synced: losing the last ones to a power
+// failure only means fetching a few pages again.
+func (d *DiskFrontier) append(rec frontierRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := d.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// compact replaces the log with one holding a done record per finished
+// URL and a push record per waiting one. Caller holds d.mu.
+func (d *DiskFrontier) compact() error {
+	d.mem.mu.Lock()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	pages := make(map[string]*Page, len(d.mem.pages))
+	for i := range d.mem.pages {
+		pages[d.mem.pages[i].URL] = &d.mem.pages[i]
+	}
+	waiting := make(map[string]bool)
+	for _, item := range d.mem.inFlight {
+		waiting[item.URL] = true
+		enc.Encode(frontierRecord{Op: "push", Item: item})
+	}
+	for _, item := range d.mem.queue {
+		waiting[item.URL] = true
+		enc.Encode(frontierRecord{Op: "push", Item: item})
+	}
+	for url, item := range d.mem.seen {
+		if !waiting[url] {
+			enc.Encode(frontierRecord{Op: "done", Item: item, Page: pages[url]})
+		}
+	}
+	d.mem.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), d.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	d.f.Close()
+	d.f, d.w, d.finished = f, bufio.NewWriter(f), 0
+	return nil
+}
+
+// Close compacts the log and closes it.
+func (d *DiskFrontier) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.compact(); err != nil {
+		d.f.Close()
+		return err
+	}
+	return d.f.Close()
+}
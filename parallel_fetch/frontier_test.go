@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func item(url string) Item { return Item{URL: url, Parent: "http://seed/", Depth: 1} }
+
+func openFrontierT(t *testing.T, path string) *DiskFrontier {
+	t.Helper()
+	d, err := OpenDiskFrontier(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func pendingURLs(f Frontier) []string {
+	var out []string
+	for _, it := range f.Pending() {
+		out = append(out, it.URL)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// fill pushes a, b, c and d, finishes a (fetched) and b (skipped), and
+// leaves c in flight.
+func fill(t *testing.T, f Frontier) {
+	t.Helper()
+	for _, u := range []string{"a", "b", "c", "d"} {
+		if added, err := f.Push(item(u)); !added || err != nil {
+			t.Fatalf("push %s: %v %v", u, added, err)
+		}
+	}
+	for _, page := range []*Page{{URL: "a", Status: 200, Body: "A"}, nil, nil} {
+		it, ok, err := f.Pop()
+		if !ok || err != nil {
+			t.Fatalf("pop: %v %v", ok, err)
+		}
+		if it.URL == "c" {
+			break
+		}
+		if err := f.Done(it, page); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// check verifies the state fill leaves, as seen after a restart: c is
+// waiting again.
+func check(t *testing.T, f Frontier) {
+	t.Helper()
+	if got, want := pendingURLs(f), []string{"c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pending %v, want %v", got, want)
+	}
+	if pages := f.Pages(); len(pages) != 1 || pages[0].URL != "a" || pages[0].Body != "A" {
+		t.Errorf("pages %+v", pages)
+	}
+	for _, u := range []string{"a", "b", "c", "d"} {
+		if added, _ := f.Push(item(u)); added {
+			t.Errorf("%s pushed again", u)
+		}
+	}
+	if it, ok, _ := f.Pop(); !ok || it != item("c") {
+		t.Errorf("popped %+v %v, want c first", it, ok)
+	}
+}
+
+func TestDiskFrontierResume(t *testing.T) {
+	tests := []struct {
+		name  string
+		close bool
+	}{
+		{"after Close", true},
+		{"after a crash", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "frontier.jsonl")
+			d := openFrontierT(t, path)
+			d.CompactEvery = 0
+			fill(t, d)
+			if tt.close {
+				if err := d.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d = openFrontierT(t, path)
+			defer d.Close()
+			check(t, d)
+		})
+	}
+}
+
+func TestDiskFrontierTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frontier.jsonl")
+	d := openFrontierT(t, path)
+	d.CompactEvery = 0
+	fill(t, d)
+
+	// A crash in the middle of writing the record finishing c.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"done","item":{"url":"c","dep`)
+	f.Close()
+
+	d = openFrontierT(t, path)
+	check(t, d)
+	// The torn line is gone, so the next record starts on its own line.
+	if _, err := d.Push(item("e")); err != nil {
+		t.Fatal(err)
+	}
+	d = openFrontierT(t, path)
+	defer d.Close()
+	if got, want := pendingURLs(d), []string{"c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pending %v, want %v", got, want)
+	}
+}
+
+func TestDiskFrontierCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frontier.jsonl")
+	d := openFrontierT(t, path)
+	d.CompactEvery = 2
+	fill(t, d)
+	// Finishing a and b compacted the log to one record per URL.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n != 4 {
+		t.Errorf("compacted log has %d records, want 4:\n%s", n, data)
+	}
+	d = openFrontierT(t, path)
+	defer d.Close()
+	check(t, d)
+}
+
+func TestCrawlResumesFromDiskFrontier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frontier.jsonl")
+	f := newCountingFetcher(fetcher)
+
+	d := openFrontierT(t, path)
+	c := NewCrawler(f)
+	c.Frontier, c.MaxPages, c.MaxConcurrency = d, 2, 1
+	_, summary := c.Crawl(context.Background(), "https://golang.org/", 4)
+	if summary.Stopped != errMaxPages.Error() {
+		t.Fatalf("first crawl not stopped by the page limit: %+v", summary)
+	}
+	d.Close()
+
+	d = openFrontierT(t, path)
+	defer d.Close()
+	c = NewCrawler(f)
+	c.Frontier = d
+	pages, summary := c.Crawl(context.Background(), "https://golang.org/", 4)
+	if summary.Stopped != "" || len(pages) != 5 {
+		t.Fatalf("resumed crawl: %d pages, %+v", len(pages), summary)
+	}
+	for u, n := range f.fetched() {
+		if n != 1 {
+			t.Errorf("%s fetched %d times over both crawls", u, n)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"strings"
+)
+
+// document is what the fetcher keeps of an HTML page.
+type document struct {
+	title string
+	text  string   // visible text, whitespace collapsed
+	base  string   // href of <base>, if any
+	links []string // href of every <a>, as written in the page
+}
+
+// parseHTML scans an HTML page for its title, text and links. It is a
+// small tokenizer rather than a full parser: it understands tags,
+// attributes (quoted or not), comments, and the raw text of <script> and
+// <style>, which is all link extraction needs, and it never fails on
+// malformed markup.
+func parseHTML(page []byte) document {
+	var doc document
+	var text, title strings.Builder
+	inTitle := false
+	for len(page) > 0 {
+		lt := bytes.IndexByte(page, '<')
+		if lt < 0 {
+			lt = len(page)
+		}
+		if lt > 0 {
+			chunk := html.UnescapeString(string(page[:lt]))
+			text.WriteString(chunk)
+			if inTitle {
+				title.WriteString(chunk)
+			}
+			page = page[lt:]
+			continue
+		}
+
+		switch {
+		case bytes.HasPrefix(page, []byte("<!--")):
+			page = skipPast(page[4:], "-->")
+			continue
+		case len(page) > 1 && (page[1] == '!' || page[1] == '?'):
+			page = skipPast(page[2:], ">")
+			continue
+		}
+		name, attrs, closing, rest, ok := readTag(page)
+		if !ok {
+			// A '<' that does not start a tag is text.
+			text.WriteByte('<')
+			if inTitle {
+				title.WriteByte('<')
+			}
+			page = page[1:]
+			continue
+		}
+		page = rest
+
+		switch name {
+		case "title":
+			inTitle = !closing
+		case "a":
+			if href, ok := attrs["href"]; ok && !closing {
+				doc.links = append(doc.links, href)
+			}
+		case "base":
+			if href, ok := attrs["href"]; ok && doc.base == "" {
+				doc.base = href
+			}
+		case "script", "style":
+			if !closing {
+				// Raw text: nothing inside is markup until the end tag.
+				page = skipPastFold(page, "</"+name)
+				page = skipPast(page, ">")
+			}
+		}
+		if isBlock(name) {
+			text.WriteByte(' ')
+		}
+	}
+	doc.title = collapse(title.String())
+	doc.text = collapse(text.String())
+	return doc
+}
+
+// readTag reads the tag at the start of page, which begins with '<'.
+// Attribute names are lower-cased and values unescaped.
+func readTag(page []byte) (name string, attrs map[string]string, closing bool, rest []byte, ok bool) {
+	i := 1
+	if i < len(page) && page[i] == '/' {
+		closing = true
+		i++
+	}
+	start := i
+	for i < len(page) && isNameByte(page[i]) {
+		i++
+	}
+	if i == start || !isLetter(page[start]) {
+		return "", nil, false, page, false
+	}
+	name = strings.ToLower(string(page[start:i]))
+	attrs = make(map[string]string)
+
+	for {
+		for i < len(page) && (isSpace(page[i]) || page[i] == '/') {
+			i++
+		}
+		if i >= len(page) {
+			return name, attrs, closing, nil, true
+		}
+		if page[i] == '>' {
+			return name, attrs, closing, page[i+1:], true
+		}
+		start := i
+		for i < len(page) && !isSpace(page[i]) && page[i] != '=' && page[i] != '>' && page[i] != '/' {
+			i++
+		}
+		key := strings.ToLower(string(page[start:i]))
+		for i < len(page) && isSpace(page[i]) {
+			i++
+		}
+		if i >= len(page) || page[i] != '=' {
+			attrs[key] = ""
+			continue
+		}
+		i++
+		for i < len(page) && isSpace(page[i]) {
+			i++
+		}
+		var val []byte
+		if i < len(page) && (page[i] == '"' || page[i] == '\'') {
+			q := page[i]
+			end := bytes.IndexByte(page[i+1:], q)
+			if end < 0 {
+				return name, attrs, closing, nil, true
+			}
+			val = page[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			start := i
+			for i < len(page) && !isSpace(page[i]) && page[i] != '>' {
+				i++
+			}
+			val = page[start:i]
+		}
+		if _, dup := attrs[key]; !dup {
+			attrs[key] = html.UnescapeString(string(val))
+		}
+	}
+}
+
+// skipPast returns what follows the first sep in b, or nothing.
+func skipPast(b []byte, sep string) []byte {
+	i := bytes.Index(b, []byte(sep))
+	if i < 0 {
+		return nil
+	}
+	return b[i+len(sep):]
+}
+
+// skipPastFold is skipPast ignoring ASCII case, and keeps the separator.
+// It compares in place: lower-casing a copy would move offsets wherever
+// the page is not valid UTF-8.
+func skipPastFold(b []byte, sep string) []byte {
+	for i := 0; i+len(sep) <= len(b); i++ {
+		if bytes.EqualFold(b[i:i+len(sep)], []byte(sep)) {
+			return b[i:]
+		}
+	}
+	return nil
+}
+
+func isBlock(tag string) bool {
+	switch tag {
+	case "p", "div", "br", "li", "tr", "td", "th", "h1", "h2", "h3", "h4", "h5", "h6",
+		"title", "section", "article", "header", "footer", "nav", "pre", "table", "ul", "ol":
+		return true
+	}
+	return false
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+func isNameByte(c byte) bool { return isLetter(c) || c >= '0' && c <= '9' || c == '-' }
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+
+// collapse trims s and replaces every run of whitespace with one space.
+func collapse(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
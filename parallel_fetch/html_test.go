@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want document
+	}{
+		{
+			name: "title and text",
+			page: "<html><head><title> Hello  &amp; welcome </title></head><body><p>One</p><p>Two &lt;3</p></body></html>",
+			want: document{title: "Hello & welcome", text: "Hello & welcome One Two <3"},
+		},
+		{
+			name: "quoted and unquoted attributes",
+			page: `<a href="/double">d</a><a href='/single'>s</a><a href=/bare>b</a><A HREF = "/upper" >u</A>`,
+			want: document{text: "dsbu", links: []string{"/double", "/single", "/bare", "/upper"}},
+		},
+		{
+			name: "attribute values are unescaped",
+			page: `<a href="/q?a=1&amp;b=2">q</a>`,
+			want: document{text: "q", links: []string{"/q?a=1&b=2"}},
+		},
+		{
+			name: "other attributes and valueless ones",
+			page: `<a class="x" download href="/file" title='a > b'>f</a>`,
+			want: document{text: "f", links: []string{"/file"}},
+		},
+		{
+			name: "anchors without href",
+			page: `<a name="top">top</a><a href="">empty</a>`,
+			want: document{text: "topempty", links: []string{""}},
+		},
+		{
+			name: "comments hide links",
+			page: `before<!-- <a href="/hidden">x</a> -->after<!DOCTYPE html><?xml version="1.0"?>`,
+			want: document{text: "beforeafter"},
+		},
+		{
+			name: "script and style are raw text",
+			page: `<script>if (a < b) { document.write('<a href="/js">x</a>') }</SCRIPT><style>a > b { }</style><a href="/real">r</a>`,
+			want: document{text: "r", links: []string{"/real"}},
+		},
+		{
+			name: "Latin-1 in a script",
+			page: "<a href=\"/x\">x</a><script>\xe9\xe8\xe0\xf1\xfc\xe9</script>",
+			want: document{text: "x", links: []string{"/x"}},
+		},
+		{
+			name: "base",
+			page: `<head><base href="http://other/dir/"><base href="/ignored"></head><a href="page">p</a>`,
+			want: document{text: "p", base: "http://other/dir/", links: []string{"page"}},
+		},
+		{
+			name: "relative, fragment and off-host hrefs are kept as written",
+			page: `<a href="../up">1</a><a href="#frag">2</a><a href="http://elsewhere/x">3</a><a href="mailto:a@b">4</a>`,
+			want: document{text: "1234", links: []string{"../up", "#frag", "http://elsewhere/x", "mailto:a@b"}},
+		},
+		{
+			name: "malformed markup",
+			page: `1 < 2 and <3 <a href="/x"`,
+			want: document{text: "1 < 2 and <3", links: []string{"/x"}},
+		},
+		{
+			name: "unterminated quote",
+			page: `<a href="/never-closed>text`,
+			want: document{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseHTML([]byte(tt.page)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHTML(%q)\n got %+v\nwant %+v", tt.page, got, tt.want)
+			}
+		})
+	}
+}
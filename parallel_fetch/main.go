@@ -1,8 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"sync"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
 )
 
 type Fetcher interface {
@@ -11,57 +22,479 @@ type Fetcher interface {
 	Fetch(url string) (body string, urls []string, err error)
 }
 
-// Crawl uses fetcher to recursively crawl
-// pages starting with url, to a maximum of depth.
-func Crawl(url string, depth int, fetcher Fetcher, ch chan string) {
-	// depth limit
-	if depth <= 0 {
-		return
+// ContextFetcher is a Fetcher that can abandon a fetch when its context
+// is done. The crawler uses FetchContext when a fetcher has it.
+type ContextFetcher interface {
+	Fetcher
+	FetchContext(ctx context.Context, url string) (body string, urls []string, err error)
+}
+
+// SizedFetcher is a ContextFetcher that also reports how many bytes of
+// the page it read, which the body it returns may not show: the body can
+// be a summary, and truncated says whether it was cut short. The crawler
+// counts these bytes when a fetcher has it.
+type SizedFetcher interface {
+	ContextFetcher
+	FetchSized(ctx context.Context, url string) (body string, urls []string, size int, truncated bool, err error)
+}
+
+// fetchSized fetches url with f through the richest interface it has.
+// Without SizedFetcher the size is the length of the body, which is whole.
+func fetchSized(ctx context.Context, f Fetcher, url string) (string, []string, int, bool, error) {
+	switch f := f.(type) {
+	case SizedFetcher:
+		return f.FetchSized(ctx, url)
+	case ContextFetcher:
+		body, urls, err := f.FetchContext(ctx, url)
+		return body, urls, len(body), false, err
+	}
+	body, urls, err := f.Fetch(url)
+	return body, urls, len(body), false, err
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "coordinator":
+			runCoordinator(os.Args[2:])
+			return
+		case "worker":
+			runWorker(os.Args[2:])
+			return
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		case "search":
+			runSearch(os.Args[2:])
+			return
+		}
+	}
+	runCrawl(os.Args[1:])
+}
+
+// runCrawl crawls in this process, the command run without a subcommand.
+func runCrawl(args []string) {
+	fs := flag.NewFlagSet("parallel_fetch", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
 	}
-	body, urls, err := fetcher.Fetch(url)
+	seed := fs.String("url", "https://golang.org/", "page to start crawling from")
+	depth := fs.Int("depth", 4, "maximum link depth")
+	var ff fetchFlags
+	ff.register(fs)
+	timeout := fs.Duration("timeout", 0, "stop the crawl after this long (0 = no limit)")
+	maxPages := fs.Int("max-pages", 0, "stop after fetching this many pages (0 = no limit)")
+	maxBytes := fs.Int64("max-bytes", 0, "stop after reading this many bytes of pages (0 = no limit)")
+	format := fs.String("format", "text", "output format: text, jsonl, csv or dot")
+	output := fs.String("o", "", "write the crawl to this file instead of stdout")
+	frontierPath := fs.String("frontier", "", "keep the crawl frontier in this file so it can be resumed (default in memory)")
+	resume := fs.Bool("resume", false, "continue the crawl saved in -frontier instead of starting over")
+	fs.Parse(args)
+
+	if _, ok := exporters[*format]; !ok {
+		log.Fatalf("unknown -format %q", *format)
+	}
+	crawler := ff.crawler(*seed)
+	crawler.MaxPages = *maxPages
+	crawler.MaxBytes = *maxBytes
+	frontier, err := openFrontier(*frontierPath, *resume)
 	if err != nil {
-		fmt.Println(err)
-		return
+		log.Fatal(err)
 	}
-	// send result
-	ch <- fmt.Sprintf("found: %s %q\n", url, body)
-	// spawn children: increment WaitGroup before starting each goroutine
-	for _, u := range urls {
-		wg.Add(1)
-		go func(u string) {
-			defer wg.Done()
-			Crawl(u, depth-1, fetcher, ch)
-		}(u)
+	defer frontier.Close()
+	crawler.Frontier = frontier
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	pages, summary := crawler.Crawl(ctx, *seed, *depth)
+	if err := writeOutput(*format, *output, pages); err != nil {
+		log.Fatal(err)
 	}
+	printSummary(os.Stderr, summary)
 }
 
-var wg *sync.WaitGroup
+// runCoordinator serves a crawl's frontier to workers until every URL is
+// done, then writes the crawl like runCrawl.
+func runCoordinator(args []string) {
+	fs := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	listen := fs.String("listen", ":9090", "address to serve workers on")
+	seed := fs.String("url", "https://golang.org/", "page to start crawling from")
+	depth := fs.Int("depth", 4, "maximum link depth")
+	ttl := fs.Duration("lease", 30*time.Second, "how long a worker may hold a URL before it is reassigned")
+	linger := fs.Duration("linger", 5*time.Second, "how long to keep telling workers the crawl is over before exiting")
+	format := fs.String("format", "text", "output format: text, jsonl, csv or dot")
+	output := fs.String("o", "", "write the crawl to this file instead of stdout")
+	frontierPath := fs.String("frontier", "", "keep the crawl frontier in this file so it can be resumed (default in memory)")
+	resume := fs.Bool("resume", false, "continue the crawl saved in -frontier instead of starting over")
+	fs.Parse(args)
 
-func main() {
-	ch := make(chan string)
-	wg = &sync.WaitGroup{}
-	// start initial crawl
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		Crawl("https://golang.org/", 4, fetcher, ch)
-	}()
+	if _, ok := exporters[*format]; !ok {
+		log.Fatalf("unknown -format %q", *format)
+	}
+	frontier, err := openFrontier(*frontierPath, *resume)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer frontier.Close()
+	coord, err := NewCoordinator(frontier, *seed, *depth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	coord.LeaseTTL = *ttl
 
-	// close channel once all crawls complete
+	mux := http.NewServeMux()
+	coord.Register(mux)
+	srv := &http.Server{Addr: *listen, Handler: mux}
 	go func() {
-		wg.Wait()
-		close(ch)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
+	log.Printf("coordinator for %s listening on %s", *seed, *listen)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	select {
+	case <-coord.Finished():
+		// Answer the workers still polling so they exit too.
+		deadline := time.Now().Add(*linger)
+		for !coord.AllTold() && time.Now().Before(deadline) && ctx.Err() == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+	case <-ctx.Done():
+	}
+	srv.Close()
+
+	pages, summary := coord.Result()
+	if err := writeOutput(*format, *output, pages); err != nil {
+		log.Fatal(err)
+	}
+	printSummary(os.Stderr, summary)
+}
+
+// runWorker fetches pages leased from a coordinator until the crawl is over.
+func runWorker(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	coordinator := fs.String("coordinator", "http://localhost:9090", "base URL of the coordinator")
+	id := fs.String("id", "", "worker name (default host-pid)")
+	workers := fs.Int("workers", 4, "pages fetched at the same time")
+	poll := fs.Duration("poll", 500*time.Millisecond, "wait between lease requests when no URL is waiting")
+	var ff fetchFlags
+	ff.register(fs)
+	fs.Parse(args)
+
+	if *id == "" {
+		host, _ := os.Hostname()
+		*id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	// collect results after channel is closed
-	var results []string
-	for s := range ch {
-		results = append(results, s)
+	worker := &Worker{
+		ID:          *id,
+		Coordinator: strings.TrimSuffix(*coordinator, "/"),
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Poll:        *poll,
+	}
+	seed, err := worker.Status(ctx)
+	for err != nil && ctx.Err() == nil {
+		log.Printf("waiting for coordinator: %v", err)
+		worker.sleep(ctx)
+		seed, err = worker.Status(ctx)
 	}
+	worker.Crawler = ff.crawler(seed)
+	n := worker.Run(ctx, *workers)
+	log.Printf("worker %s reported %d pages", *id, n)
+}
 
-	// results now contains all messages sent on ch
-	for _, r := range results {
-		fmt.Print(r)
+// runAnalyze prints statistics of the link graph of an exported crawl.
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: parallel_fetch analyze [flags] crawl.jsonl|crawl.csv")
+		fs.PrintDefaults()
+	}
+	seed := fs.String("seed", "", "URL to measure distances from (default the page crawled at depth 0)")
+	top := fs.Int("top", 10, "entries listed per ranking")
+	format := fs.String("format", "text", "output format: text or json")
+	path := fs.String("path", "", "also print the shortest link path from the seed to this URL")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	in := os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	pages, err := ReadPages(in)
+	if err != nil {
+		log.Fatalf("%s: %v", fs.Arg(0), err)
+	}
+	if len(pages) == 0 {
+		log.Fatalf("%s: no pages", fs.Arg(0))
+	}
+	if *seed == "" {
+		*seed = pages[0].URL
+		for _, p := range pages {
+			if p.Depth == 0 {
+				*seed = p.URL
+				break
+			}
+		}
+	}
+
+	g := NewLinkGraph(pages)
+	a, err := Analyze(g, *seed, *top)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch *format {
+	case "text":
+		err = a.WriteText(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(a)
+	default:
+		log.Fatalf("unknown -format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *path != "" {
+		to, ok := g.Node(*path)
+		if !ok {
+			log.Fatalf("%s is not in the crawl", *path)
+		}
+		from, _ := g.Node(*seed)
+		_, prev := g.ShortestPaths(from)
+		steps := g.Path(prev, from, to)
+		if steps == nil {
+			fmt.Printf("\nno path from %s to %s\n", *seed, *path)
+			return
+		}
+		fmt.Printf("\npath from the seed (%d links):\n", len(steps)-1)
+		for _, u := range steps {
+			fmt.Printf("  %s\n", u)
+		}
+	}
+}
+
+// runSearch indexes the bodies of an exported crawl and answers queries
+// given as arguments, typed on stdin, or over HTTP.
+func runSearch(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: parallel_fetch search [flags] crawl.jsonl [query]")
+		fs.PrintDefaults()
+	}
+	limit := fs.Int("n", 10, "results per query (0 = all)")
+	serve := fs.String("serve", "", "serve GET /search?q= on this address instead of answering on the command line")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	pages, err := ReadPages(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("%s: %v", fs.Arg(0), err)
+	}
+	idx := NewIndex(pages)
+	if n := idx.Truncated(); n > 0 {
+		log.Fatalf("%s: the text of %d pages was cut by -body-limit; crawl again with -body-limit 0 to search them", fs.Arg(0), n)
+	}
+	if idx.Len() == 0 {
+		log.Fatalf("%s: no page bodies to index (export the crawl with -format jsonl)", fs.Arg(0))
+	}
+
+	if *serve != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/search", idx)
+		log.Printf("%d pages indexed; serving http://%s/search?q=", idx.Len(), *serve)
+		log.Fatal(http.ListenAndServe(*serve, mux))
+	}
+	answer := func(q string) {
+		hits, total := idx.Search(q, *limit)
+		fmt.Printf("%d pages match %q\n", total, q)
+		for i, h := range hits {
+			fmt.Printf("%2d. %s  (%.3f)\n    %s\n    %s\n", i+1, h.Title, h.Score, h.URL, h.Snippet)
+		}
+	}
+	if fs.NArg() > 1 {
+		answer(strings.Join(fs.Args()[1:], " "))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d pages indexed; one query per line\n", idx.Len())
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		if q := strings.TrimSpace(sc.Text()); q != "" {
+			answer(q)
+		}
+	}
+}
+
+const usage = `usage:
+  parallel_fetch [flags]                crawl from -url in this process
+  parallel_fetch coordinator [flags]    serve a crawl's frontier to workers
+  parallel_fetch worker [flags]         fetch pages leased from a coordinator
+  parallel_fetch analyze [flags] FILE   print link graph statistics of an exported crawl
+  parallel_fetch search [flags] FILE    search the pages of a crawl exported as JSON Lines
+
+flags without a subcommand:
+`
+
+// fetchFlags are the flags of the commands that fetch pages: which
+// fetcher to use and how politely.
+type fetchFlags struct {
+	source      string
+	hosts       string
+	userAgent   string
+	robots      bool
+	robotsRetry time.Duration
+	concurrency int
+	perHost     int
+	delay       time.Duration
+	bodyLimit   int
+
+	record       string
+	fixtures     string
+	latencyScale float64
+	failRate     float64
+	replaySeed   int64
+}
+
+func (ff *fetchFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&ff.source, "fetcher", "fake", "where pages come from: fake (canned pages), http, or replay (of -fixtures)")
+	fs.StringVar(&ff.hosts, "hosts", "", "comma-separated hosts to follow links to with -fetcher http (default the host of the seed URL)")
+	fs.StringVar(&ff.userAgent, "user-agent", "parallel_fetch/1.0", "User-Agent sent and matched against robots.txt")
+	fs.BoolVar(&ff.robots, "robots", true, "obey robots.txt (http fetcher only)")
+	fs.DurationVar(&ff.robotsRetry, "robots-retry", time.Minute, "how long to skip a host whose robots.txt could not be fetched before trying again")
+	fs.IntVar(&ff.concurrency, "concurrency", 0, "maximum fetches in progress (0 = no limit)")
+	fs.IntVar(&ff.perHost, "per-host", 0, "maximum fetches in progress per host (0 = no limit)")
+	fs.DurationVar(&ff.delay, "delay", 0, "minimum time between requests to one host")
+	fs.IntVar(&ff.bodyLimit, "body-limit", 500, "characters of page text kept with -fetcher http (0 = all; search refuses cut pages)")
+	fs.StringVar(&ff.record, "record", "", "record every response to this fixture file")
+	fs.StringVar(&ff.fixtures, "fixtures", "", "fixture file served by -fetcher replay")
+	fs.Float64Var(&ff.latencyScale, "replay-latency", 0, "with -fetcher replay, sleep the recorded latency times this")
+	fs.Float64Var(&ff.failRate, "replay-fail-rate", 0, "with -fetcher replay, fraction of fetches to fail on purpose")
+	fs.Int64Var(&ff.replaySeed, "replay-seed", 1, "seed choosing which replayed fetches fail")
+}
+
+// crawler returns a crawler using the fetcher chosen by the flags.
+func (ff *fetchFlags) crawler(seed string) *Crawler {
+	var f Fetcher = fetcher
+	var client *http.Client
+	switch ff.source {
+	case "fake":
+	case "http":
+		allowed := strings.Split(ff.hosts, ",")
+		if ff.hosts == "" {
+			u, err := url.Parse(seed)
+			if err != nil {
+				log.Fatalf("invalid seed URL: %v", err)
+			}
+			allowed = []string{u.Host}
+		}
+		hf := NewHTTPFetcher(allowed...)
+		hf.UserAgent = ff.userAgent
+		hf.SummaryLen = ff.bodyLimit
+		f, client = hf, hf.Client
+	case "replay":
+		if ff.fixtures == "" {
+			log.Fatal("-fetcher replay needs -fixtures")
+		}
+		rf, err := OpenReplayFetcher(ff.fixtures)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rf.LatencyScale, rf.FailRate, rf.Seed = ff.latencyScale, ff.failRate, ff.replaySeed
+		f = rf
+	default:
+		log.Fatalf("unknown -fetcher %q", ff.source)
+	}
+	if ff.record != "" {
+		// Each response is flushed as it is recorded, so the file needs no closing.
+		rec, err := NewRecordingFetcher(f, ff.record)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f = rec
+	}
+
+	crawler := NewCrawler(f)
+	crawler.UserAgent = ff.userAgent
+	crawler.Robots = ff.robots && client != nil
+	crawler.Client = client
+	crawler.RobotsRetry = ff.robotsRetry
+	crawler.MaxConcurrency = ff.concurrency
+	crawler.PerHost = ff.perHost
+	crawler.HostDelay = ff.delay
+	return crawler
+}
+
+// openFrontier opens the disk frontier at path, emptied unless resume is
+// set, or returns a memory frontier if path is empty.
+func openFrontier(path string, resume bool) (Frontier, error) {
+	if path == "" {
+		if resume {
+			return nil, fmt.Errorf("-resume needs -frontier")
+		}
+		return NewMemoryFrontier(), nil
+	}
+	if !resume {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return OpenDiskFrontier(path)
+}
+
+// writeOutput exports pages in format to the file path, or to stdout if
+// path is empty.
+func writeOutput(format, path string, pages []Page) error {
+	out := os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return exporters[format](out, pages)
+}
+
+func printSummary(w io.Writer, s Summary) {
+	fmt.Fprintf(w, "%d pages, %d bytes in %s", s.Pages, s.Bytes, s.Duration.Round(time.Millisecond))
+	if s.Stopped != "" {
+		fmt.Fprintf(w, ", stopped: %s", s.Stopped)
+	}
+	fmt.Fprintf(w, "; %d errors, %d skipped\n", len(s.Errors), len(s.Skipped))
+	for _, e := range s.Errors {
+		fmt.Fprintf(w, "  error: %s\n", e.Err)
+	}
+	for _, sk := range s.Skipped {
+		fmt.Fprintf(w, "  skipped: %s (%s)\n", sk.URL, sk.Reason)
 	}
 }
 
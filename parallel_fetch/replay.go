@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+)
+
+// Fixture is one recorded response of a Fetcher.
+type Fixture struct {
+	URL       string        `json:"url"`
+	Body      string        `json:"body,omitempty"`
+	Links     []string      `json:"links,omitempty"`
+	Size      int           `json:"size,omitempty"`      // bytes read; recordings without it count Body
+	Truncated bool          `json:"truncated,omitempty"` // Body is a summary cut short
+	Err       string        `json:"error,omitempty"`     // the status line for a StatusError
+	Status    int           `json:"status,omitempty"`    // code of a StatusError
+	Latency   time.Duration `json:"latency"`
+}
+
+// RecordingFetcher wraps a Fetcher and appends every response it gives
+// to a fixture file, one JSON line each, for a ReplayFetcher to serve.
+type RecordingFetcher struct {
+	Fetcher Fetcher
+
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// NewRecordingFetcher records the responses of fetcher to the file at
+// path, replacing it.
+func NewRecordingFetcher(fetcher Fetcher, path string) (*RecordingFetcher, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingFetcher{Fetcher: fetcher, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (r *RecordingFetcher) Fetch(url string) (string, []string, error) {
+	return r.FetchContext(context.Background(), url)
+}
+
+func (r *RecordingFetcher) FetchContext(ctx context.Context, url string) (string, []string, error) {
+	body, urls, _, _, err := r.FetchSized(ctx, url)
+	return body, urls, err
+}
+
+// FetchSized fetches url and records the response. Fetches abandoned
+// because ctx is done are not recorded: they say nothing about the page.
+func (r *RecordingFetcher) FetchSized(ctx context.Context, url string) (string, []string, int, bool, error) {
+	start := time.Now()
+	body, urls, size, cut, err := fetchSized(ctx, r.Fetcher, url)
+	if err != nil && ctx.Err() != nil {
+		return body, urls, size, cut, err
+	}
+
+	fx := Fixture{URL: url, Body: body, Links: urls, Size: size, Truncated: cut, Latency: time.Since(start)}
+	if err != nil {
+		fx.Err = err.Error()
+		var se *StatusError
+		if errors.As(err, &se) {
+			fx.Status, fx.Err = se.Code, se.Status
+		}
+	}
+	if rerr := r.record(fx); rerr != nil {
+		return "", nil, 0, false, fmt.Errorf("recording %s: %w", url, rerr)
+	}
+	return body, urls, size, cut, err
+}
+
+func (r *RecordingFetcher) record(fx Fixture) error {
+	line, err := json.Marshal(fx)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return r.w.Flush()
+}
+
+// Close closes the fixture file.
+func (r *RecordingFetcher) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// errInjected is the error of fetches failed on purpose by a ReplayFetcher.
+var errInjected = errors.New("injected failure")
+
+// ReplayFetcher serves the responses saved by a RecordingFetcher, so a
+// crawl can be repeated offline. URLs that were not recorded fail.
+type ReplayFetcher struct {
+	// LatencyScale multiplies the recorded latency slept before each
+	// answer: 0 answers at once, 1 as fast as the recording.
+	LatencyScale float64
+	// FailRate is the fraction of fetches failed with an injected error.
+	// Which ones fail depends only on Seed, the URL and how many times it
+	// was fetched before, not on the order of concurrent fetches.
+	FailRate float64
+	Seed     int64
+
+	fixtures map[string]Fixture
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+// OpenReplayFetcher loads the fixture file at path. When a URL was
+// recorded more than once, the last response is served.
+func OpenReplayFetcher(path string) (*ReplayFetcher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fixtures := make(map[string]Fixture)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		var fx Fixture
+		if err := json.Unmarshal(sc.Bytes(), &fx); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		fixtures[fx.URL] = fx
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return &ReplayFetcher{fixtures: fixtures, attempts: make(map[string]int)}, nil
+}
+
+func (r *ReplayFetcher) Fetch(url string) (string, []string, error) {
+	return r.FetchContext(context.Background(), url)
+}
+
+func (r *ReplayFetcher) FetchContext(ctx context.Context, url string) (string, []string, error) {
+	body, urls, _, _, err := r.FetchSized(ctx, url)
+	return body, urls, err
+}
+
+// FetchSized answers as the recording did, after the scaled latency.
+func (r *ReplayFetcher) FetchSized(ctx context.Context, url string) (string, []string, int, bool, error) {
+	fx, ok := r.fixtures[url]
+	if !ok {
+		return "", nil, 0, false, fmt.Errorf("not recorded: %s", url)
+	}
+	r.mu.Lock()
+	attempt := r.attempts[url]
+	r.attempts[url]++
+	r.mu.Unlock()
+
+	if d := time.Duration(float64(fx.Latency) * r.LatencyScale); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return "", nil, 0, false, ctx.Err()
+		}
+	}
+	if r.FailRate > 0 && r.roll(url, attempt) < r.FailRate {
+		return "", nil, 0, false, fmt.Errorf("%s: %w", url, errInjected)
+	}
+	switch {
+	case fx.Status != 0:
+		return "", nil, 0, false, &StatusError{URL: url, Code: fx.Status, Status: fx.Err}
+	case fx.Err != "":
+		return "", nil, 0, false, errors.New(fx.Err)
+	}
+	size := fx.Size
+	if size == 0 {
+		size = len(fx.Body)
+	}
+	return fx.Body, fx.Links, size, fx.Truncated, nil
+}
+
+// roll returns a number in [0, 1) drawn from the seed, url and attempt.
+func (r *ReplayFetcher) roll(url string, attempt int) float64 {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, r.Seed)
+	h.Write([]byte(url))
+	binary.Write(h, binary.LittleEndian, int64(attempt))
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
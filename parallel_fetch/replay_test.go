@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// sized is a fetcher whose pages are cut summaries of larger ones.
+type sized struct{ fakeFetcher }
+
+func (f sized) FetchContext(ctx context.Context, url string) (string, []string, error) {
+	return f.Fetch(url)
+}
+
+func (f sized) FetchSized(ctx context.Context, url string) (string, []string, int, bool, error) {
+	body, urls, err := f.Fetch(url)
+	return body, urls, 1000 * len(body), err == nil, err
+}
+
+func TestReplayKeepsSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures.jsonl")
+	rec, err := NewRecordingFetcher(sized{fetcher}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, _ := NewCrawler(rec).Crawl(context.Background(), "https://golang.org/", 4)
+	rec.Close()
+
+	replay, err := OpenReplayFetcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, _ := NewCrawler(replay).Crawl(context.Background(), "https://golang.org/", 4)
+	if len(replayed) != len(recorded) {
+		t.Fatalf("%d pages replayed, %d recorded", len(replayed), len(recorded))
+	}
+	for i, p := range replayed {
+		if want := recorded[i].Size; p.Size != want || p.Err == "" && p.Size != 1000*len(p.Body) {
+			t.Errorf("%s: size %d, want %d", p.URL, p.Size, want)
+		}
+		if p.Truncated != (p.Err == "") {
+			t.Errorf("%s: truncated %v", p.URL, p.Truncated)
+		}
+	}
+}
+
+func TestReplayWithoutSizeCountsBody(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures.jsonl")
+	if err := os.WriteFile(path, []byte(`{"url":"http://a/","body":"hello","latency":0}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := OpenReplayFetcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, size, _, err := replay.FetchSized(context.Background(), "http://a/"); err != nil || size != 5 {
+		t.Errorf("size %d, err %v; want 5", size, err)
+	}
+}
+
+// replayOf returns a replay fetcher of n recorded pages, failing rate of
+// fetches with seed.
+func replayOf(t *testing.T, n int, rate float64, seed int64) (*ReplayFetcher, []string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fixtures.jsonl")
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	var urls []string
+	for i := 0; i < n; i++ {
+		u := fmt.Sprintf("http://a/%d", i)
+		urls = append(urls, u)
+		enc.Encode(Fixture{URL: u, Body: "page"})
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenReplayFetcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.FailRate, r.Seed = rate, seed
+	return r, urls
+}
+
+// failures fetches each URL attempts times, in an order that changes
+// from call to call and from several goroutines, and returns which
+// attempts failed, by URL.
+func failures(r *ReplayFetcher, urls []string, attempts int) map[string][]bool {
+	var mu sync.Mutex
+	out := make(map[string][]bool)
+	var wg sync.WaitGroup
+	for _, i := range rand.Perm(len(urls)) {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			fails := make([]bool, attempts)
+			for a := range fails {
+				_, _, err := r.Fetch(u)
+				fails[a] = errors.Is(err, errInjected)
+			}
+			mu.Lock()
+			out[u] = fails
+			mu.Unlock()
+		}(urls[i])
+	}
+	wg.Wait()
+	return out
+}
+
+func TestReplayFailRateIsDeterministic(t *testing.T) {
+	r1, urls := replayOf(t, 200, 0.3, 42)
+	r2, _ := replayOf(t, 200, 0.3, 42)
+	first := failures(r1, urls, 3)
+	if again := failures(r2, urls, 3); !reflect.DeepEqual(again, first) {
+		t.Fatal("the same seed failed different fetches")
+	}
+	r3, _ := replayOf(t, 200, 0.3, 43)
+	if other := failures(r3, urls, 3); reflect.DeepEqual(other, first) {
+		t.Fatal("different seeds failed the same fetches")
+	}
+	// Retrying a failed URL draws again, so it can succeed.
+	retried := false
+	for _, fails := range first {
+		if fails[0] && !fails[1] {
+			retried = true
+		}
+	}
+	if !retried {
+		t.Error("no failed fetch succeeded when retried")
+	}
+}
+
+func TestReplayFailRate(t *testing.T) {
+	tests := []struct {
+		rate     float64
+		min, max int // failed fetches of 1000
+	}{
+		{0, 0, 0},
+		{0.1, 60, 140},
+		{0.5, 440, 560},
+		{1, 1000, 1000},
+	}
+	for _, tt := range tests {
+		r, urls := replayOf(t, 1000, tt.rate, 7)
+		n := 0
+		for _, fails := range failures(r, urls, 1) {
+			if fails[0] {
+				n++
+			}
+		}
+		if n < tt.min || n > tt.max {
+			t.Errorf("rate %v failed %d of 1000 fetches, want %d to %d", tt.rate, n, tt.min, tt.max)
+		}
+	}
+}
+
+func TestReplayCrawlIsRepeatable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures.jsonl")
+	rec, err := NewRecordingFetcher(fetcher, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewCrawler(rec).Crawl(context.Background(), "https://golang.org/", 4)
+	rec.Close()
+
+	replay := func() []string {
+		r, err := OpenReplayFetcher(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.FailRate, r.Seed = 0.4, 3
+		pages, _ := NewCrawler(r).Crawl(context.Background(), "https://golang.org/", 4)
+		var out []string
+		for _, p := range pages {
+			out = append(out, p.URL+" "+p.Err)
+		}
+		return out
+	}
+	first := replay()
+	for i := 0; i < 5; i++ {
+		if again := replay(); !reflect.DeepEqual(again, first) {
+			t.Fatalf("replay %d differs:\n%v\nfirst:\n%v", i, again, first)
+		}
+	}
+}
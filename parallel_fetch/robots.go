@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Robots holds the rules of a robots.txt file (RFC 9309).
+type Robots struct {
+	groups []robotsGroup
+	// disallowAll is set when robots.txt could not be fetched because the
+	// server failed; nothing may be crawled until it answers.
+	disallowAll bool
+}
+
+type robotsGroup struct {
+	agents []string // lower-cased
+	rules  []robotsRule
+	delay  time.Duration
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// allowAll is the policy when a host has no robots.txt.
+var allowAll = &Robots{}
+
+// unavailable is the policy while a host's robots.txt cannot be fetched.
+var unavailable = &Robots{disallowAll: true}
+
+// ParseRobots reads a robots.txt file. Unknown lines are ignored, as are
+// rules before the first User-agent line.
+func ParseRobots(r io.Reader) *Robots {
+	robots := &Robots{}
+	var cur *robotsGroup
+	inRules := false // the current group already has rules, so a new agent starts a new group
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if cur == nil || inRules {
+				robots.groups = append(robots.groups, robotsGroup{})
+				cur = &robots.groups[len(robots.groups)-1]
+				inRules = false
+			}
+			cur.agents = append(cur.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			if cur == nil {
+				continue
+			}
+			inRules = true
+			if value != "" {
+				cur.rules = append(cur.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "crawl-delay":
+			if cur == nil {
+				continue
+			}
+			inRules = true
+			if secs, err := strconv.ParseFloat(value, 64); err == nil && secs >= 0 {
+				cur.delay = time.Duration(secs * float64(time.Second))
+			}
+		}
+	}
+	return robots
+}
+
+// match returns the rules and crawl delay that apply to userAgent: those
+// of every group naming its product token, or else of the "*" groups.
+func (r *Robots) match(userAgent string) ([]robotsRule, time.Duration) {
+	token := strings.ToLower(userAgent)
+	if i := strings.IndexAny(token, "/ "); i >= 0 {
+		token = token[:i]
+	}
+	collect := func(name string) ([]robotsRule, time.Duration, bool) {
+		var rules []robotsRule
+		var delay time.Duration
+		found := false
+		for _, g := range r.groups {
+			for _, a := range g.agents {
+				if a == name {
+					rules = append(rules, g.rules...)
+					delay = max(delay, g.delay)
+					found = true
+					break
+				}
+			}
+		}
+		return rules, delay, found
+	}
+	if rules, delay, ok := collect(token); ok {
+		return rules, delay
+	}
+	rules, delay, _ := collect("*")
+	return rules, delay
+}
+
+// Allowed reports whether userAgent may fetch path, which includes the
+// query string. The longest matching rule wins, and Allow wins a tie.
+func (r *Robots) Allowed(userAgent, path string) bool {
+	if path == "/robots.txt" {
+		return true
+	}
+	if r.disallowAll {
+		return false
+	}
+	rules, _ := r.match(userAgent)
+	allowed, longest := true, -1
+	for _, rule := range rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if n := len(rule.pattern); n > longest || n == longest && rule.allow {
+			allowed, longest = rule.allow, n
+		}
+	}
+	return allowed
+}
+
+// CrawlDelay returns the Crawl-delay robots.txt asks of userAgent.
+func (r *Robots) CrawlDelay(userAgent string) time.Duration {
+	_, delay := r.match(userAgent)
+	return delay
+}
+
+// robotsMatch matches path against a rule pattern, where '*' matches any
+// sequence of characters and a trailing '$' anchors the end.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			// The last part has to end the path.
+			return len(path)-len(part) >= pos && strings.HasSuffix(path, part)
+		}
+		j := strings.Index(path[pos:], part)
+		if j < 0 {
+			return false
+		}
+		pos += j + len(part)
+	}
+	return !anchored || pos == len(path)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRobotsMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/", "/anything", true},
+		{"/private", "/private", true},
+		{"/private", "/private/page", true},
+		{"/private", "/privateer", true},
+		{"/private", "/public", false},
+		{"/private/", "/private", false},
+		{"/*.pdf", "/docs/a.pdf", true},
+		{"/*.pdf", "/a.pdf?download=1", true},
+		{"/*.pdf$", "/a.pdf?download=1", false},
+		{"/*.pdf$", "/docs/a.pdf", true},
+		{"/*.pdf$", "/a.pdfx", false},
+		{"/a*b*c", "/axxbyyc", true},
+		{"/a*b*c", "/axxcyyb", false},
+		{"/exact$", "/exact", true},
+		{"/exact$", "/exact/", false},
+		{"*", "/", true},
+		{"/*$", "/", true},
+		{"/a*a$", "/a", false},
+		{"/a*a$", "/aa", true},
+		{"/p?q=", "/p?q=1", true},
+	}
+	for _, tt := range tests {
+		if got := robotsMatch(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("robotsMatch(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+const robotsTxt = `# comments and unknown lines are ignored
+Disallow: /before-any-group
+Sitemap: http://example.com/sitemap.xml
+
+User-agent: *
+Disallow: /private
+Allow: /private/open
+Disallow: /*.pdf$
+Crawl-delay: 2
+
+User-agent: parallel_fetch
+User-agent: OtherBot   # both agents share this group
+Disallow: /
+Allow: /public
+Allow: /page$
+Crawl-delay: 0.5
+
+user-AGENT: parallel_fetch
+disallow: /tmp  # a second group for the same agent is merged
+Crawl-delay: 1
+
+User-agent: EmptyBot
+Disallow:
+
+User-agent: TieBot
+Disallow: /same
+Allow: /same
+`
+
+func TestRobotsAllowed(t *testing.T) {
+	robots := ParseRobots(strings.NewReader(robotsTxt))
+	tests := []struct {
+		agent, path string
+		want        bool
+	}{
+		// The "*" group.
+		{"SomeBot", "/", true},
+		{"SomeBot", "/before-any-group", true},
+		{"SomeBot", "/private/page", false},
+		{"SomeBot", "/private/open/page", true}, // the longer rule wins
+		{"SomeBot", "/doc.pdf", false},
+		{"SomeBot", "/doc.pdf?x=1", true},
+		// Groups naming the agent replace "*", whatever the case and version.
+		{"parallel_fetch/1.0", "/private/open", false},
+		{"Parallel_Fetch", "/public/page", true},
+		{"parallel_fetch", "/page", true},
+		{"parallel_fetch", "/page/2", false},
+		{"parallel_fetch", "/tmp", false},
+		{"otherbot", "/public", true},
+		{"otherbot", "/elsewhere", false},
+		// An empty Disallow allows everything.
+		{"EmptyBot", "/private", true},
+		// Allow wins a tie.
+		{"TieBot", "/same", true},
+		// robots.txt itself is always allowed.
+		{"parallel_fetch", "/robots.txt", true},
+	}
+	for _, tt := range tests {
+		if got := robots.Allowed(tt.agent, tt.path); got != tt.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", tt.agent, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRobotsPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		robots *Robots
+		path   string
+		want   bool
+	}{
+		{"missing file allows all", allowAll, "/private", true},
+		{"unavailable file allows nothing", unavailable, "/", false},
+		{"unavailable file still allows robots.txt", unavailable, "/robots.txt", true},
+		{"empty file allows all", ParseRobots(strings.NewReader("")), "/x", true},
+	}
+	for _, tt := range tests {
+		if got := tt.robots.Allowed("parallel_fetch", tt.path); got != tt.want {
+			t.Errorf("%s: Allowed(%q) = %v, want %v", tt.name, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRobotsCrawlDelay(t *testing.T) {
+	robots := ParseRobots(strings.NewReader(robotsTxt + "\nUser-agent: BadBot\nCrawl-delay: soon\n\nUser-agent: NegBot\nCrawl-delay: -1\n"))
+	tests := []struct {
+		agent string
+		want  time.Duration
+	}{
+		{"SomeBot", 2 * time.Second},
+		{"OtherBot", 500 * time.Millisecond},
+		{"parallel_fetch", time.Second}, // the largest of its groups
+		{"EmptyBot", 0},
+		{"BadBot", 0},
+		{"NegBot", 0},
+	}
+	for _, tt := range tests {
+		if got := robots.CrawlDelay(tt.agent); got != tt.want {
+			t.Errorf("CrawlDelay(%q) = %v, want %v", tt.agent, got, tt.want)
+		}
+	}
+}
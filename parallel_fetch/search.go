@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/liviu274/Distributed-systems/httpjson"
+)
+
+// stopWords are left out of the index: they match nearly every page.
+var stopWords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`a an and are as at be but by for from has have
+		he her his i if in into is it its me my no not of on or our she so than that
+		the their them then there these they this to was we were what when which who
+		will with you your`) {
+		stopWords[w] = true
+	}
+}
+
+// tokenize splits text into lower-case words of letters and digits,
+// without stop words.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := words[:0]
+	for _, w := range words {
+		if !stopWords[w] {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// BM25 parameters: k1 limits how much repeating a term counts, b how
+// much long pages are penalised.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+type posting struct {
+	doc  int
+	freq int
+}
+
+type indexedPage struct {
+	url    string
+	title  string
+	body   string
+	length int // terms
+}
+
+// Index is an inverted index of page bodies, ranked with BM25.
+type Index struct {
+	pages     []indexedPage
+	postings  map[string][]posting
+	total     int // terms in all pages
+	truncated int // pages left out because their bodies were cut short
+}
+
+// NewIndex indexes the pages fetched successfully. The first line of a
+// body is taken as the title, as HTTPFetcher writes it. Truncated bodies
+// are left out: most of their words are missing, so they would rank
+// wrongly.
+func NewIndex(pages []Page) *Index {
+	idx := &Index{postings: make(map[string][]posting)}
+	for _, p := range pages {
+		if p.Err != "" || p.Body == "" {
+			continue
+		}
+		if p.Truncated {
+			idx.truncated++
+			continue
+		}
+		doc := len(idx.pages)
+		title, _, _ := strings.Cut(p.Body, "\n")
+		terms := tokenize(p.Body)
+		idx.pages = append(idx.pages, indexedPage{url: p.URL, title: title, body: p.Body, length: len(terms)})
+		idx.total += len(terms)
+
+		freq := make(map[string]int)
+		for _, t := range terms {
+			freq[t]++
+		}
+		for t, n := range freq {
+			idx.postings[t] = append(idx.postings[t], posting{doc: doc, freq: n})
+		}
+	}
+	return idx
+}
+
+// Len returns the number of pages indexed.
+func (idx *Index) Len() int { return len(idx.pages) }
+
+// Truncated returns the number of pages left out because their bodies
+// were cut short.
+func (idx *Index) Truncated() int { return idx.truncated }
+
+// Hit is a page matching a query.
+type Hit struct {
+	URL     string  `json:"url"`
+	Title   string  `json:"title"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+// Search returns the pages matching any term of query, best first, at
+// most limit of them (0 = all), and how many matched in total.
+func (idx *Index) Search(query string, limit int) ([]Hit, int) {
+	terms := tokenize(query)
+	if len(terms) == 0 || len(idx.pages) == 0 {
+		return nil, 0
+	}
+	n := float64(len(idx.pages))
+	avg := float64(idx.total) / n
+	scores := make(map[int]float64)
+	seen := make(map[string]bool)
+	for _, t := range terms {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		list := idx.postings[t]
+		df := float64(len(list))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for _, p := range list {
+			tf := float64(p.freq)
+			norm := 1 - bm25B + bm25B*float64(idx.pages[p.doc].length)/avg
+			scores[p.doc] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	docs := make([]int, 0, len(scores))
+	for d := range scores {
+		docs = append(docs, d)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if scores[docs[i]] != scores[docs[j]] {
+			return scores[docs[i]] > scores[docs[j]]
+		}
+		return idx.pages[docs[i]].url < idx.pages[docs[j]].url
+	})
+	total := len(docs)
+	if limit > 0 && len(docs) > limit {
+		docs = docs[:limit]
+	}
+	hits := make([]Hit, len(docs))
+	for i, d := range docs {
+		p := idx.pages[d]
+		hits[i] = Hit{URL: p.url, Title: p.title, Score: scores[d], Snippet: snippet(p.body, terms)}
+	}
+	return hits, total
+}
+
+// snippet returns about 160 characters of body around the first query
+// term it contains.
+func snippet(body string, terms []string) string {
+	const width = 160
+	text := []rune(collapse(body))
+	// Lower-case rune by rune, so offsets in lower are offsets in text.
+	runes := make([]rune, len(text))
+	for i, r := range text {
+		runes[i] = unicode.ToLower(r)
+	}
+	lower := string(runes)
+	at := -1
+	for _, t := range terms {
+		if i := strings.Index(lower, t); i >= 0 {
+			if r := utf8.RuneCountInString(lower[:i]); at < 0 || r < at {
+				at = r
+			}
+		}
+	}
+	start := max(0, at-width/3)
+	end := min(len(text), start+width)
+	s := string(text[start:end])
+	if start > 0 {
+		s = "..." + s
+	}
+	if end < len(text) {
+		s += "..."
+	}
+	return s
+}
+
+// ServeHTTP answers GET /search?q=terms&n=10 with the hits as JSON.
+func (idx *Index) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		http.Error(w, "missing q", http.StatusBadRequest)
+		return
+	}
+	limit := 10
+	if s := r.URL.Query().Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	hits, total := idx.Search(q, limit)
+	if hits == nil {
+		hits = []Hit{}
+	}
+	httpjson.Write(w, http.StatusOK, map[string]interface{}{"query": q, "total": total, "hits": hits})
+}
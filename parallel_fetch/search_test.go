@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func hitURLs(hits []Hit) []string {
+	var out []string
+	for _, h := range hits {
+		out = append(out, h.URL)
+	}
+	return out
+}
+
+func TestSearch(t *testing.T) {
+	idx := NewIndex([]Page{
+		{URL: "http://a/go", Body: "Go\nGo is a language. Go has goroutines and channels."},
+		{URL: "http://a/rust", Body: "Rust\nRust is a language with ownership."},
+		{URL: "http://a/chan", Body: "Channels\nChannels connect goroutines."},
+		{URL: "http://a/gone", Err: "http://a/gone: 404 Not Found"},
+	})
+	if idx.Len() != 3 {
+		t.Fatalf("%d pages indexed, want 3", idx.Len())
+	}
+	tests := []struct {
+		query string
+		limit int
+		want  []string
+		total int
+	}{
+		{"language", 0, []string{"http://a/rust", "http://a/go"}, 2}, // the shorter page first
+		{"GO", 0, []string{"http://a/go"}, 1},
+		{"goroutines channels", 1, []string{"http://a/chan"}, 2},
+		{"the and of", 0, nil, 0}, // stop words only
+		{"python", 0, nil, 0},
+	}
+	for _, tt := range tests {
+		hits, total := idx.Search(tt.query, tt.limit)
+		if got := hitURLs(hits); !reflect.DeepEqual(got, tt.want) || total != tt.total {
+			t.Errorf("%q: %v of %d, want %v of %d", tt.query, got, total, tt.want, tt.total)
+		}
+	}
+}
+
+func TestIndexLeavesOutTruncatedBodies(t *testing.T) {
+	idx := NewIndex([]Page{
+		{URL: "http://a/whole", Body: "Whole\nthe whole text"},
+		{URL: "http://a/cut", Body: "Cut\nthe first words...", Truncated: true},
+	})
+	if idx.Len() != 1 || idx.Truncated() != 1 {
+		t.Fatalf("%d pages indexed, %d truncated; want 1 and 1", idx.Len(), idx.Truncated())
+	}
+	if hits, _ := idx.Search("words", 0); len(hits) != 0 {
+		t.Errorf("truncated page found: %v", hitURLs(hits))
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	if got := snippet("Title\nsome   text", []string{"text"}); got != "Title some text" {
+		t.Errorf("short body: %q", got)
+	}
+	long := strings.Repeat("x ", 100) + "Needle" + strings.Repeat(" y", 100)
+	got := snippet(long, []string{"needle"})
+	if !strings.HasPrefix(got, "...") || !strings.HasSuffix(got, "...") || len(got) != 166 {
+		t.Fatalf("long body: %q", got)
+	}
+	// The term comes a third of the way in.
+	if i := strings.Index(got, "Needle"); i != 3+160/3 {
+		t.Errorf("term at %d of %q", i, got)
+	}
+	if got := snippet(long, []string{"missing"}); !strings.HasPrefix(got, "x x") {
+		t.Errorf("no match: %q", got)
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	idx := NewIndex([]Page{{URL: "http://a/", Body: "Home\nwelcome"}})
+	tests := []struct {
+		target string
+		code   int
+		hits   int
+	}{
+		{"/search?q=welcome", http.StatusOK, 1},
+		{"/search?q=nothing", http.StatusOK, 0},
+		{"/search", http.StatusBadRequest, 0},
+		{"/search?q=welcome&n=-1", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		idx.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.target, w.Code, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var resp struct{ Hits []Hit }
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Hits == nil || len(resp.Hits) != tt.hits {
+			t.Errorf("%s: %s (%v)", tt.target, w.Body, err)
+		}
+	}
+}
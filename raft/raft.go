@@ -0,0 +1,812 @@
+// Package raft implements the Raft consensus algorithm: leader election,
+// log replication and log compaction through snapshots. A Node replicates
+// opaque commands and applies committed ones, in order, to a StateMachine.
+// Nodes talk through a Transport; InmemNetwork connects nodes inside one
+// process for tests and HTTPTransport connects separate processes.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is one log entry. An empty Command is a no-op appended by new leaders.
+type Entry struct {
+	Index   uint64 `json:"index"`
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"`
+}
+
+// StateMachine receives committed commands.
+type StateMachine interface {
+	// Apply applies a committed command and returns its result.
+	Apply(index uint64, command []byte) interface{}
+	// Snapshot serialises the current state.
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with a snapshot.
+	Restore(data []byte) error
+}
+
+// Role is the role a node currently plays.
+type Role string
+
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+var (
+	// ErrNotLeader is returned when proposing on a node that is not leader.
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrLostLeadership is returned when a proposal was overwritten by a new leader.
+	ErrLostLeadership = errors.New("raft: leadership lost before the command committed")
+	// ErrSnapshotted is returned when the leader's snapshot replaced a
+	// proposal's log entry before this node applied it, so its result is unknown.
+	ErrSnapshotted = errors.New("raft: command's entry was replaced by a snapshot before it was applied")
+	// ErrStopped is returned after Stop.
+	ErrStopped = errors.New("raft: node stopped")
+)
+
+// Config configures a Node. Zero durations get defaults.
+type Config struct {
+	ID    string
+	Peers []string // IDs of all cluster members, including ID
+
+	Transport    Transport
+	Storage      Storage
+	StateMachine StateMachine
+
+	ElectionTimeout   time.Duration // minimum election timeout, randomised up to twice this (default 300ms)
+	HeartbeatInterval time.Duration // leader heartbeat period (default 50ms)
+	SnapshotThreshold uint64        // applied entries kept before snapshotting (default 1000)
+
+	// OnLeader is called (in its own goroutine) each time this node becomes
+	// leader, once the no-op entry of its term has been applied, so the
+	// state machine holds everything earlier leaders committed.
+	OnLeader func(term uint64)
+	Logger   *log.Logger
+	Rand     *rand.Rand
+}
+
+type applyResult struct {
+	term  uint64
+	value interface{}
+	err   error
+}
+
+// Node is one member of a Raft cluster.
+type Node struct {
+	cfg   Config
+	peers []string // other members
+
+	mu          sync.Mutex
+	role        Role
+	term        uint64
+	votedFor    string
+	leader      string
+	log         []Entry // log[0] is a sentinel at the snapshot index
+	snapshot    []byte
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicating map[string]bool
+	deadline    time.Time // election deadline (follower/candidate)
+	waiters     map[uint64]chan applyResult
+	rnd         *rand.Rand
+
+	smMu    sync.Mutex // serialises access to the state machine
+	applyCh chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New restores a node from its storage as a follower; Start runs it.
+func New(cfg Config) (*Node, error) {
+	if cfg.ID == "" || cfg.Transport == nil || cfg.StateMachine == nil {
+		return nil, errors.New("raft: config needs ID, Transport and StateMachine")
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = NewMemoryStorage()
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = 1000
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	if cfg.Rand == nil {
+		cfg.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	st, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("raft: load state: %w", err)
+	}
+
+	n := &Node{
+		cfg:         cfg,
+		role:        Follower,
+		term:        st.Term,
+		votedFor:    st.VotedFor,
+		log:         append([]Entry{{Index: st.SnapshotIndex, Term: st.SnapshotTerm}}, st.Entries...),
+		snapshot:    st.Snapshot,
+		commitIndex: st.SnapshotIndex,
+		lastApplied: st.SnapshotIndex,
+		waiters:     make(map[uint64]chan applyResult),
+		rnd:         cfg.Rand,
+		applyCh:     make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	for _, p := range cfg.Peers {
+		if p != cfg.ID {
+			n.peers = append(n.peers, p)
+		}
+	}
+	sort.Strings(n.peers)
+	if st.Snapshot != nil {
+		if err := cfg.StateMachine.Restore(st.Snapshot); err != nil {
+			return nil, fmt.Errorf("raft: restore snapshot: %w", err)
+		}
+	}
+	n.resetDeadline()
+	return n, nil
+}
+
+// Start runs the node's timers and applier. Nothing happens before it is
+// called, so callers can finish wiring up anything OnLeader uses.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+	n.wg.Add(2)
+	go n.ticker()
+	go n.applier()
+}
+
+// Stop halts the node. Its storage keeps the persistent state.
+func (n *Node) Stop() {
+	select {
+	case <-n.stop:
+		return
+	default:
+	}
+	close(n.stop)
+	n.wg.Wait()
+
+	n.mu.Lock()
+	for idx, ch := range n.waiters {
+		close(ch)
+		delete(n.waiters, idx)
+	}
+	n.mu.Unlock()
+}
+
+// ID returns the node's ID.
+func (n *Node) ID() string { return n.cfg.ID }
+
+// Status is a snapshot of a node's Raft state.
+type Status struct {
+	ID            string `json:"id"`
+	Role          Role   `json:"role"`
+	Term          uint64 `json:"term"`
+	Leader        string `json:"leader"`
+	CommitIndex   uint64 `json:"commit_index"`
+	LastApplied   uint64 `json:"last_applied"`
+	LastLogIndex  uint64 `json:"last_log_index"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+}
+
+// Status reports the node's current state.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.cfg.ID,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        n.leader,
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastLogIndex:  n.lastIndex(),
+		SnapshotIndex: n.log[0].Index,
+	}
+}
+
+// --- log helpers; callers hold n.mu ---
+
+func (n *Node) lastIndex() uint64 { return n.log[len(n.log)-1].Index }
+func (n *Node) lastTerm() uint64  { return n.log[len(n.log)-1].Term }
+
+// entry returns the entry at index, which must be within the log.
+func (n *Node) entry(index uint64) Entry { return n.log[index-n.log[0].Index] }
+
+// saveState persists the term and vote. Nothing may be promised on the
+// strength of them, such as a vote, unless it succeeds.
+func (n *Node) saveState() error {
+	err := n.cfg.Storage.SetState(n.term, n.votedFor)
+	if err != nil {
+		n.cfg.Logger.Printf("raft %s: persist failed: %v", n.cfg.ID, err)
+	}
+	return err
+}
+
+// saveEntries persists entries appended to the log, replacing any stored
+// entries from the first one's index on. Entries it fails to store must
+// not stay in the log, where they would be counted as stored.
+func (n *Node) saveEntries(entries []Entry) error {
+	err := n.cfg.Storage.Append(entries)
+	if err != nil {
+		n.cfg.Logger.Printf("raft %s: persist failed: %v", n.cfg.ID, err)
+	}
+	return err
+}
+
+// saveSnapshot persists the snapshot and the log after it. A snapshot
+// holds only committed entries, so if this fails the stored log still
+// leads to the same state.
+func (n *Node) saveSnapshot() error {
+	err := n.cfg.Storage.SaveSnapshot(n.log[0].Index, n.log[0].Term, n.snapshot, n.log[1:])
+	if err != nil {
+		n.cfg.Logger.Printf("raft %s: persist failed: %v", n.cfg.ID, err)
+	}
+	return err
+}
+
+func (n *Node) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(n.rnd.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// becomeFollower steps down, moving to term if it is newer. It fails if
+// the new term could not be stored; the node steps down all the same, but
+// must not answer for the new term.
+func (n *Node) becomeFollower(term uint64, leader string) error {
+	var err error
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		err = n.saveState()
+	}
+	if n.role != Follower {
+		n.cfg.Logger.Printf("raft %s: follower in term %d", n.cfg.ID, n.term)
+	}
+	n.role = Follower
+	n.leader = leader
+	return err
+}
+
+func (n *Node) quorum() int { return (len(n.peers)+1)/2 + 1 }
+
+// --- timers ---
+
+func (n *Node) ticker() {
+	defer n.wg.Done()
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	lastBeat := time.Time{}
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-t.C:
+			n.mu.Lock()
+			switch n.role {
+			case Leader:
+				if now.Sub(lastBeat) >= n.cfg.HeartbeatInterval {
+					lastBeat = now
+					n.broadcastAppend()
+				}
+			default:
+				if now.After(n.deadline) {
+					n.startElection()
+				}
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+// --- elections ---
+
+func (n *Node) startElection() {
+	n.resetDeadline()
+	prevTerm, prevVote := n.term, n.votedFor
+	n.term++
+	n.votedFor = n.cfg.ID
+	if n.saveState() != nil {
+		// Try again at the next deadline rather than campaign in a term
+		// this node could forget.
+		n.term, n.votedFor = prevTerm, prevVote
+		return
+	}
+	n.role = Candidate
+	n.leader = ""
+
+	term := n.term
+	args := RequestVoteArgs{Term: term, Candidate: n.cfg.ID, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+	n.cfg.Logger.Printf("raft %s: starting election for term %d", n.cfg.ID, term)
+
+	if len(n.peers) == 0 {
+		n.becomeLeader()
+		return
+	}
+	votes := 1
+	for _, p := range n.peers {
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			defer cancel()
+			reply, err := n.cfg.Transport.RequestVote(ctx, peer, args)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term, "")
+				return
+			}
+			if n.role != Candidate || n.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leader = n.cfg.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.replicating = make(map[string]bool)
+	for _, p := range n.peers {
+		n.nextIndex[p] = n.lastIndex() + 1
+	}
+	// A no-op from the new term lets earlier entries commit. Without it
+	// stored the node cannot lead: step down and let another try.
+	noop := Entry{Index: n.lastIndex() + 1, Term: n.term}
+	if n.saveEntries([]Entry{noop}) != nil {
+		n.becomeFollower(n.term, "")
+		n.resetDeadline()
+		return
+	}
+	n.log = append(n.log, noop)
+	n.cfg.Logger.Printf("raft %s: leader for term %d", n.cfg.ID, n.term)
+	n.advanceCommit()
+	n.broadcastAppend()
+}
+
+// HandleRequestVote answers a vote request.
+func (n *Node) HandleRequestVote(args RequestVoteArgs) RequestVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term > n.term {
+		if n.becomeFollower(args.Term, "") != nil {
+			return RequestVoteReply{Term: n.term}
+		}
+	}
+	reply := RequestVoteReply{Term: n.term}
+	if args.Term < n.term {
+		return reply
+	}
+	upToDate := args.LastLogTerm > n.lastTerm() ||
+		(args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == args.Candidate) && upToDate {
+		votedFor := n.votedFor
+		n.votedFor = args.Candidate
+		if n.saveState() != nil {
+			n.votedFor = votedFor
+			return reply
+		}
+		n.resetDeadline()
+		reply.VoteGranted = true
+	}
+	return reply
+}
+
+// --- replication ---
+
+func (n *Node) broadcastAppend() {
+	for _, p := range n.peers {
+		if !n.replicating[p] {
+			n.replicating[p] = true
+			go n.replicate(p, n.term)
+		}
+	}
+}
+
+// replicate sends one AppendEntries or InstallSnapshot to peer.
+func (n *Node) replicate(peer string, term uint64) {
+	n.mu.Lock()
+	if n.role != Leader || n.term != term {
+		n.replicating[peer] = false
+		n.mu.Unlock()
+		return
+	}
+	next := n.nextIndex[peer]
+	if next <= n.log[0].Index {
+		args := InstallSnapshotArgs{Term: term, Leader: n.cfg.ID, SnapshotIndex: n.log[0].Index, SnapshotTerm: n.log[0].Term, Data: n.snapshot}
+		n.mu.Unlock()
+		n.sendSnapshot(peer, args)
+		return
+	}
+	prev := n.entry(next - 1)
+	args := AppendEntriesArgs{
+		Term:         term,
+		Leader:       n.cfg.ID,
+		PrevLogIndex: prev.Index,
+		PrevLogTerm:  prev.Term,
+		Entries:      append([]Entry(nil), n.log[next-n.log[0].Index:]...),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	reply, err := n.cfg.Transport.AppendEntries(ctx, peer, args)
+	cancel()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.replicating[peer] = false
+	if err != nil {
+		return
+	}
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term, "")
+		n.resetDeadline()
+		return
+	}
+	if n.role != Leader || n.term != term {
+		return
+	}
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommit()
+		if n.nextIndex[peer] <= n.lastIndex() {
+			n.replicating[peer] = true
+			go n.replicate(peer, term)
+		}
+		return
+	}
+	if reply.ConflictIndex >= 1 && reply.ConflictIndex < n.nextIndex[peer] {
+		n.nextIndex[peer] = reply.ConflictIndex
+	} else if n.nextIndex[peer] > 1 {
+		n.nextIndex[peer]--
+	}
+	n.replicating[peer] = true
+	go n.replicate(peer, term)
+}
+
+func (n *Node) sendSnapshot(peer string, args InstallSnapshotArgs) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*n.cfg.ElectionTimeout)
+	reply, err := n.cfg.Transport.InstallSnapshot(ctx, peer, args)
+	cancel()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.replicating[peer] = false
+	if err != nil {
+		return
+	}
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term, "")
+		n.resetDeadline()
+		return
+	}
+	if n.role != Leader || n.term != args.Term {
+		return
+	}
+	if args.SnapshotIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = args.SnapshotIndex
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+}
+
+// advanceCommit commits the highest index from the current term that a
+// quorum has stored.
+func (n *Node) advanceCommit() {
+	for idx := n.lastIndex(); idx > n.commitIndex && idx > n.log[0].Index; idx-- {
+		if n.entry(idx).Term != n.term {
+			break
+		}
+		count := 1
+		for _, p := range n.peers {
+			if n.matchIndex[p] >= idx {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = idx
+			n.signalApply()
+			return
+		}
+	}
+}
+
+// HandleAppendEntries processes replication from the leader.
+func (n *Node) HandleAppendEntries(args AppendEntriesArgs) AppendEntriesReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term < n.term {
+		return AppendEntriesReply{Term: n.term}
+	}
+	err := n.becomeFollower(args.Term, args.Leader)
+	n.resetDeadline()
+	reply := AppendEntriesReply{Term: n.term}
+	if err != nil {
+		return reply
+	}
+
+	// Skip entries already covered by our snapshot.
+	entries := args.Entries
+	prevIndex, prevTerm := args.PrevLogIndex, args.PrevLogTerm
+	if prevIndex < n.log[0].Index {
+		skip := n.log[0].Index - prevIndex
+		if uint64(len(entries)) <= skip {
+			reply.Success = true
+			return reply
+		}
+		entries = entries[skip:]
+		prevIndex, prevTerm = n.log[0].Index, n.log[0].Term
+	}
+
+	if prevIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return reply
+	}
+	if t := n.entry(prevIndex).Term; t != prevTerm {
+		// Point the leader at the first entry of the conflicting term.
+		idx := prevIndex
+		for idx > n.log[0].Index+1 && n.entry(idx-1).Term == t {
+			idx--
+		}
+		reply.ConflictIndex = idx
+		return reply
+	}
+
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.entry(e.Index).Term == e.Term {
+				continue
+			}
+			n.log = n.log[:e.Index-n.log[0].Index]
+		}
+		if n.saveEntries(entries[i:]) != nil {
+			// Have the leader send them again, from here.
+			reply.ConflictIndex = e.Index
+			return reply
+		}
+		n.log = append(n.log, entries[i:]...)
+		break
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		last := prevIndex + uint64(len(entries))
+		if args.LeaderCommit < last {
+			last = args.LeaderCommit
+		}
+		if last > n.commitIndex {
+			n.commitIndex = last
+			n.signalApply()
+		}
+	}
+	reply.Success = true
+	return reply
+}
+
+// HandleInstallSnapshot replaces the follower's state with the leader's snapshot.
+func (n *Node) HandleInstallSnapshot(args InstallSnapshotArgs) InstallSnapshotReply {
+	n.smMu.Lock()
+	defer n.smMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term < n.term {
+		return InstallSnapshotReply{Term: n.term}
+	}
+	err := n.becomeFollower(args.Term, args.Leader)
+	n.resetDeadline()
+	if err != nil {
+		return InstallSnapshotReply{Term: n.term}
+	}
+	if args.SnapshotIndex <= n.log[0].Index || args.SnapshotIndex <= n.lastApplied {
+		return InstallSnapshotReply{Term: n.term}
+	}
+
+	if err := n.cfg.StateMachine.Restore(args.Data); err != nil {
+		n.cfg.Logger.Printf("raft %s: restore snapshot failed: %v", n.cfg.ID, err)
+		return InstallSnapshotReply{Term: n.term}
+	}
+
+	sentinel := Entry{Index: args.SnapshotIndex, Term: args.SnapshotTerm}
+	if args.SnapshotIndex < n.lastIndex() && n.entry(args.SnapshotIndex).Term == args.SnapshotTerm {
+		// Keep the entries that follow the snapshot.
+		n.log = append([]Entry{sentinel}, n.log[args.SnapshotIndex-n.log[0].Index+1:]...)
+	} else {
+		n.log = []Entry{sentinel}
+	}
+	n.snapshot = args.Data
+	if n.commitIndex < args.SnapshotIndex {
+		n.commitIndex = args.SnapshotIndex
+	}
+	n.lastApplied = args.SnapshotIndex
+	n.saveSnapshot()
+
+	// Commands at or below the snapshot were never applied here, so
+	// their results are unknown.
+	for idx, ch := range n.waiters {
+		if idx <= args.SnapshotIndex {
+			ch <- applyResult{err: ErrSnapshotted}
+			delete(n.waiters, idx)
+		}
+	}
+	return InstallSnapshotReply{Term: n.term}
+}
+
+// --- proposals and application ---
+
+// Propose appends command to the leader's log and returns its index and
+// term. It does not wait for the command to commit.
+func (n *Node) Propose(command []byte) (uint64, uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	index, term, err := n.propose(command)
+	return index, term, err
+}
+
+func (n *Node) propose(command []byte) (uint64, uint64, error) {
+	select {
+	case <-n.stop:
+		return 0, 0, ErrStopped
+	default:
+	}
+	if n.role != Leader {
+		return 0, 0, ErrNotLeader
+	}
+	if len(command) == 0 {
+		return 0, 0, errors.New("raft: empty command")
+	}
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Command: command}
+	if err := n.saveEntries([]Entry{e}); err != nil {
+		return 0, 0, fmt.Errorf("raft: storing the command: %w", err)
+	}
+	n.log = append(n.log, e)
+	n.advanceCommit() // single-node clusters commit immediately
+	n.broadcastAppend()
+	return e.Index, e.Term, nil
+}
+
+// Apply proposes command and waits until it is committed and applied,
+// returning the state machine's result.
+func (n *Node) Apply(ctx context.Context, command []byte) (interface{}, error) {
+	n.mu.Lock()
+	index, term, err := n.propose(command)
+	if err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	ch := make(chan applyResult, 1)
+	n.waiters[index] = ch
+	n.mu.Unlock()
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, ErrStopped
+		}
+		if res.err != nil {
+			return nil, res.err
+		}
+		if res.term != term {
+			return nil, ErrLostLeadership
+		}
+		return res.value, nil
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (n *Node) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyCh:
+		}
+		n.applyCommitted()
+	}
+}
+
+// applyCommitted applies every committed entry not yet applied and takes a
+// snapshot when enough entries have accumulated.
+func (n *Node) applyCommitted() {
+	n.smMu.Lock()
+	defer n.smMu.Unlock()
+
+	n.mu.Lock()
+	if n.commitIndex <= n.lastApplied {
+		n.mu.Unlock()
+		return
+	}
+	entries := append([]Entry(nil), n.log[n.lastApplied+1-n.log[0].Index:n.commitIndex+1-n.log[0].Index]...)
+	n.lastApplied = n.commitIndex
+	n.mu.Unlock()
+
+	for _, e := range entries {
+		var value interface{}
+		if len(e.Command) > 0 {
+			value = n.cfg.StateMachine.Apply(e.Index, e.Command)
+		}
+		n.mu.Lock()
+		if ch, ok := n.waiters[e.Index]; ok {
+			ch <- applyResult{term: e.Term, value: value}
+			delete(n.waiters, e.Index)
+		}
+		leading := len(e.Command) == 0 && n.role == Leader && n.term == e.Term
+		n.mu.Unlock()
+		if leading && n.cfg.OnLeader != nil {
+			go n.cfg.OnLeader(e.Term)
+		}
+	}
+
+	n.mu.Lock()
+	due := n.lastApplied-n.log[0].Index >= n.cfg.SnapshotThreshold
+	n.mu.Unlock()
+	if due {
+		n.takeSnapshot()
+	}
+}
+
+// takeSnapshot compacts the log up to lastApplied. Caller holds n.smMu.
+func (n *Node) takeSnapshot() {
+	data, err := n.cfg.StateMachine.Snapshot()
+	if err != nil {
+		n.cfg.Logger.Printf("raft %s: snapshot failed: %v", n.cfg.ID, err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	index := n.lastApplied
+	if index <= n.log[0].Index {
+		return
+	}
+	sentinel := Entry{Index: index, Term: n.entry(index).Term}
+	n.log = append([]Entry{sentinel}, n.log[index-n.log[0].Index+1:]...)
+	n.snapshot = data
+	n.saveSnapshot()
+	n.cfg.Logger.Printf("raft %s: snapshot at index %d", n.cfg.ID, index)
+}
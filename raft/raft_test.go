@@ -0,0 +1,515 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var quiet = log.New(io.Discard, "", 0)
+
+// listSM is a state machine that records the commands applied to it.
+type listSM struct {
+	mu   sync.Mutex
+	cmds []string
+}
+
+func (m *listSM) Apply(index uint64, command []byte) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cmds = append(m.cmds, string(command))
+	return len(m.cmds)
+}
+
+func (m *listSM) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal(m.cmds)
+}
+
+func (m *listSM) Restore(data []byte) error {
+	var cmds []string
+	if err := json.Unmarshal(data, &cmds); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cmds = cmds
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *listSM) list() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.cmds...)
+}
+
+type testCluster struct {
+	nw    *InmemNetwork
+	ids   []string
+	nodes map[string]*Node
+	sms   map[string]*listSM
+
+	mu     sync.Mutex
+	onLead map[string][]string // commands applied when OnLeader ran, per node
+}
+
+// newCluster starts size nodes on an in-memory network with fast timers.
+func newCluster(t *testing.T, size int, snapshotThreshold uint64) *testCluster {
+	t.Helper()
+	c := &testCluster{
+		nw:     NewInmemNetwork(),
+		nodes:  make(map[string]*Node),
+		sms:    make(map[string]*listSM),
+		onLead: make(map[string][]string),
+	}
+	for i := 1; i <= size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range c.ids {
+		id := id
+		sm := &listSM{}
+		n, err := New(Config{
+			ID:                id,
+			Peers:             c.ids,
+			Transport:         c.nw.Transport(id),
+			StateMachine:      sm,
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			SnapshotThreshold: snapshotThreshold,
+			OnLeader: func(uint64) {
+				c.mu.Lock()
+				c.onLead[id] = sm.list()
+				c.mu.Unlock()
+			},
+			Logger: quiet,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.nodes[id], c.sms[id] = n, sm
+		c.nw.Register(n)
+	}
+	for _, n := range c.nodes {
+		n.Start()
+		t.Cleanup(n.Stop)
+	}
+	return c
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// leader waits until exactly one of the nodes not in down leads and every
+// such node agrees, and returns it.
+func (c *testCluster) leader(t *testing.T, down ...string) *Node {
+	t.Helper()
+	var leader *Node
+	waitFor(t, "a leader", func() bool {
+		leader = nil
+		var term uint64
+		for _, id := range c.ids {
+			if contains(down, id) {
+				continue
+			}
+			st := c.nodes[id].Status()
+			if st.Role == Leader {
+				if leader != nil {
+					return false
+				}
+				leader, term = c.nodes[id], st.Term
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, id := range c.ids {
+			if st := c.nodes[id].Status(); !contains(down, id) && (st.Leader != leader.ID() || st.Term != term) {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies commands on n and fails the test on error.
+func apply(t *testing.T, n *Node, cmds ...string) {
+	t.Helper()
+	for _, cmd := range cmds {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := n.Apply(ctx, []byte(cmd))
+		cancel()
+		if err != nil {
+			t.Fatalf("apply %s on %s: %v", cmd, n.ID(), err)
+		}
+	}
+}
+
+// converge waits until every node in ids has applied want.
+func (c *testCluster) converge(t *testing.T, want []string, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		sm := c.sms[id]
+		waitFor(t, id+" to apply "+fmt.Sprint(want), func() bool { return reflect.DeepEqual(sm.list(), want) })
+	}
+}
+
+func cmds(from, to int) []string {
+	var out []string
+	for i := from; i <= to; i++ {
+		out = append(out, fmt.Sprintf("c%d", i))
+	}
+	return out
+}
+
+func TestElection(t *testing.T) {
+	c := newCluster(t, 3, 1000)
+	leader := c.leader(t)
+	term := leader.Status().Term
+
+	// With nothing going wrong the leader keeps its term.
+	time.Sleep(200 * time.Millisecond)
+	if again := c.leader(t); again != leader || again.Status().Term != term {
+		t.Fatalf("leadership changed from %s@%d to %s@%d", leader.ID(), term, again.ID(), again.Status().Term)
+	}
+	waitFor(t, "OnLeader", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		_, ok := c.onLead[leader.ID()]
+		return ok
+	})
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 3, 1000)
+	leader := c.leader(t)
+	apply(t, leader, cmds(1, 20)...)
+	c.converge(t, cmds(1, 20), c.ids...)
+
+	for _, id := range c.ids {
+		if id == leader.ID() {
+			continue
+		}
+		if _, err := c.nodes[id].Apply(context.Background(), []byte("x")); !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("apply on follower %s: %v, want ErrNotLeader", id, err)
+		}
+	}
+}
+
+func TestLeaderCrash(t *testing.T) {
+	c := newCluster(t, 3, 1000)
+	old := c.leader(t)
+	oldTerm := old.Status().Term
+	apply(t, old, cmds(1, 5)...)
+
+	c.nw.Disconnect(old.ID())
+	leader := c.leader(t, old.ID())
+	if leader.Status().Term <= oldTerm {
+		t.Fatalf("new leader in term %d, old term %d", leader.Status().Term, oldTerm)
+	}
+	// OnLeader runs only once everything the old leader committed is applied.
+	waitFor(t, "OnLeader on "+leader.ID(), func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.onLead[leader.ID()] != nil
+	})
+	c.mu.Lock()
+	seen := c.onLead[leader.ID()]
+	c.mu.Unlock()
+	if !reflect.DeepEqual(seen, cmds(1, 5)) {
+		t.Fatalf("OnLeader saw %v, want %v", seen, cmds(1, 5))
+	}
+
+	// Writes to the isolated old leader never commit.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if _, err := old.Apply(ctx, []byte("lost")); err == nil {
+		t.Fatal("isolated leader committed a command")
+	}
+	cancel()
+
+	apply(t, leader, cmds(6, 10)...)
+	c.nw.Connect(old.ID())
+	c.leader(t)
+	c.converge(t, cmds(1, 10), c.ids...)
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	c := newCluster(t, 3, 5)
+	leader := c.leader(t)
+	var lagging string
+	for _, id := range c.ids {
+		if id != leader.ID() {
+			lagging = id
+			break
+		}
+	}
+	apply(t, leader, cmds(1, 3)...)
+	c.converge(t, cmds(1, 3), lagging)
+
+	c.nw.Disconnect(lagging)
+	apply(t, leader, cmds(4, 30)...)
+	// The lagging node holds up to index 4 (the no-op and c1-c3); once the
+	// leader's log starts after that, only a snapshot can catch it up.
+	if leader.Status().SnapshotIndex <= 4 {
+		t.Fatalf("leader did not snapshot past the lagging node: %+v", leader.Status())
+	}
+
+	c.nw.Connect(lagging)
+	c.converge(t, cmds(1, 30), c.ids...)
+	if st := c.nodes[lagging].Status(); st.SnapshotIndex == 0 {
+		t.Fatalf("%s caught up without a snapshot: %+v", lagging, st)
+	}
+}
+
+func TestInstallSnapshotWakesWaiters(t *testing.T) {
+	n, err := New(Config{ID: "a", Peers: []string{"a", "b"}, Transport: NewInmemNetwork().Transport("a"), StateMachine: &listSM{}, Logger: quiet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped, kept := make(chan applyResult, 1), make(chan applyResult, 1)
+	n.waiters[2], n.waiters[9] = skipped, kept
+
+	data, _ := json.Marshal([]string{"x", "y", "z"})
+	n.HandleInstallSnapshot(InstallSnapshotArgs{Term: 1, Leader: "b", SnapshotIndex: 5, SnapshotTerm: 1, Data: data})
+	select {
+	case res := <-skipped:
+		if !errors.Is(res.err, ErrSnapshotted) {
+			t.Fatalf("skipped waiter got %+v", res)
+		}
+	default:
+		t.Fatal("waiter below the snapshot was not woken")
+	}
+	if _, ok := n.waiters[9]; !ok || len(kept) != 0 {
+		t.Fatal("waiter above the snapshot was woken")
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft-n1.log")
+	s := NewFileStorage(path)
+	if _, err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	e := func(index, term uint64) Entry { return Entry{Index: index, Term: term, Command: []byte("x")} }
+	steps := []func() error{
+		func() error { return s.SetState(1, "n1") },
+		func() error { return s.Append([]Entry{e(1, 1), e(2, 1), e(3, 1)}) },
+		func() error { return s.SetState(2, "") },
+		func() error { return s.Append([]Entry{e(3, 2), e(4, 2)}) }, // replaces 3
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+	s.Close()
+
+	// A crash mid-write leaves a torn line.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"op":"append","entries":[{"ind`)
+	f.Close()
+
+	s = NewFileStorage(path)
+	st, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PersistentState{Term: 2, Entries: []Entry{e(1, 1), e(2, 1), e(3, 2), e(4, 2)}}
+	if !reflect.DeepEqual(st, want) {
+		t.Fatalf("loaded %+v, want %+v", st, want)
+	}
+
+	if err := s.Append([]Entry{e(5, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveSnapshot(3, 2, []byte("snap"), []Entry{e(4, 2), e(5, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append([]Entry{e(6, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	st, err = NewFileStorage(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = PersistentState{Term: 2, SnapshotIndex: 3, SnapshotTerm: 2, Snapshot: []byte("snap"), Entries: []Entry{e(4, 2), e(5, 2), e(6, 2)}}
+	if !reflect.DeepEqual(st, want) {
+		t.Fatalf("after snapshot loaded %+v, want %+v", st, want)
+	}
+}
+
+func TestRestartFromFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft-solo.log")
+	start := func(sm *listSM) *Node {
+		n, err := New(Config{
+			ID:                "solo",
+			Peers:             []string{"solo"},
+			Transport:         NewInmemNetwork().Transport("solo"),
+			Storage:           NewFileStorage(path),
+			StateMachine:      sm,
+			ElectionTimeout:   20 * time.Millisecond,
+			SnapshotThreshold: 4,
+			Logger:            quiet,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Start()
+		waitFor(t, "solo to lead", func() bool { return n.Status().Role == Leader })
+		return n
+	}
+
+	first := start(&listSM{})
+	apply(t, first, cmds(1, 10)...)
+	first.Stop()
+
+	sm := &listSM{}
+	second := start(sm)
+	defer second.Stop()
+	waitFor(t, "the log to be replayed", func() bool { return reflect.DeepEqual(sm.list(), cmds(1, 10)) })
+	if st := second.Status(); st.SnapshotIndex == 0 {
+		t.Fatalf("restarted without the snapshot: %+v", st)
+	}
+}
+
+// brokenStorage is memory storage whose writes fail while broken is set.
+type brokenStorage struct {
+	*MemoryStorage
+	mu     sync.Mutex
+	broken bool
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (s *brokenStorage) set(broken bool) {
+	s.mu.Lock()
+	s.broken = broken
+	s.mu.Unlock()
+}
+
+func (s *brokenStorage) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken {
+		return errDiskFull
+	}
+	return nil
+}
+
+func (s *brokenStorage) SetState(term uint64, votedFor string) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.MemoryStorage.SetState(term, votedFor)
+}
+
+func (s *brokenStorage) Append(entries []Entry) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.MemoryStorage.Append(entries)
+}
+
+func TestStorageFailureIsNotAcknowledged(t *testing.T) {
+	storage := &brokenStorage{MemoryStorage: NewMemoryStorage(), broken: true}
+	n, err := New(Config{ID: "a", Peers: []string{"a", "b"}, Transport: NewInmemNetwork().Transport("a"), Storage: storage, StateMachine: &listSM{}, Logger: quiet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vote := RequestVoteArgs{Term: 1, Candidate: "b"}
+	if reply := n.HandleRequestVote(vote); reply.VoteGranted {
+		t.Error("vote granted though the term could not be stored")
+	}
+	storage.set(false)
+	if reply := n.HandleRequestVote(vote); !reply.VoteGranted {
+		t.Fatalf("vote refused once storage works: %+v", reply)
+	}
+	st, _ := storage.Load()
+	if st.Term != 1 || st.VotedFor != "b" {
+		t.Fatalf("stored %+v", st)
+	}
+
+	storage.set(true)
+	args := AppendEntriesArgs{Term: 1, Leader: "b", Entries: []Entry{{Index: 1, Term: 1, Command: []byte("x")}}, LeaderCommit: 1}
+	if reply := n.HandleAppendEntries(args); reply.Success || reply.ConflictIndex != 1 {
+		t.Errorf("append acknowledged though not stored: %+v", reply)
+	}
+	if s := n.Status(); s.LastLogIndex != 0 || s.CommitIndex != 0 {
+		t.Errorf("unstored entry kept: %+v", s)
+	}
+	storage.set(false)
+	if reply := n.HandleAppendEntries(args); !reply.Success {
+		t.Fatalf("append refused once storage works: %+v", reply)
+	}
+	if s := n.Status(); s.LastLogIndex != 1 || s.CommitIndex != 1 {
+		t.Errorf("stored entry missing: %+v", s)
+	}
+}
+
+func TestLeaderStorageFailure(t *testing.T) {
+	storage := &brokenStorage{MemoryStorage: NewMemoryStorage(), broken: true}
+	n, err := New(Config{
+		ID:              "solo",
+		Peers:           []string{"solo"},
+		Transport:       NewInmemNetwork().Transport("solo"),
+		Storage:         storage,
+		StateMachine:    &listSM{},
+		ElectionTimeout: 20 * time.Millisecond,
+		Logger:          quiet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Start()
+	defer n.Stop()
+
+	// It cannot even store the term it would campaign in.
+	time.Sleep(100 * time.Millisecond)
+	if st := n.Status(); st.Role == Leader || st.Term != 0 {
+		t.Fatalf("campaigned without storage: %+v", st)
+	}
+	storage.set(false)
+	waitFor(t, "solo to lead", func() bool { return n.Status().Role == Leader })
+	apply(t, n, "c1")
+
+	storage.set(true)
+	before := n.Status()
+	if _, err := n.Apply(context.Background(), []byte("c2")); !errors.Is(err, errDiskFull) {
+		t.Fatalf("apply without storage: %v", err)
+	}
+	if st := n.Status(); st.LastLogIndex != before.LastLogIndex || st.CommitIndex != before.CommitIndex {
+		t.Fatalf("unstored entry counted: %+v, was %+v", st, before)
+	}
+	storage.set(false)
+	apply(t, n, "c3")
+}
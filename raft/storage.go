@@ -0,0 +1,281 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/liviu274/Distributed-systems/jsonl"
+)
+
+// PersistentState is everything a node must keep across restarts: the
+// current term and vote, the latest snapshot and the log after it.
+type PersistentState struct {
+	Term          uint64  `json:"term"`
+	VotedFor      string  `json:"voted_for"`
+	SnapshotIndex uint64  `json:"snapshot_index"`
+	SnapshotTerm  uint64  `json:"snapshot_term"`
+	Snapshot      []byte  `json:"snapshot,omitempty"`
+	Entries       []Entry `json:"entries"`
+}
+
+// Storage persists a node's state. Each change must be durable when the
+// method returns.
+type Storage interface {
+	// Load returns the state stored so far.
+	Load() (PersistentState, error)
+	// SetState records the current term and vote.
+	SetState(term uint64, votedFor string) error
+	// Append stores entries, first dropping any stored entries at or
+	// after the index of the first one.
+	Append(entries []Entry) error
+	// SaveSnapshot stores a snapshot at index and replaces the stored
+	// entries with entries, the ones that follow it.
+	SaveSnapshot(index, term uint64, data []byte, entries []Entry) error
+}
+
+// truncateAppend drops the entries of log at or after entries[0].Index
+// and appends entries.
+func truncateAppend(log []Entry, entries []Entry) []Entry {
+	if len(entries) == 0 {
+		return log
+	}
+	first := entries[0].Index
+	for len(log) > 0 && log[len(log)-1].Index >= first {
+		log = log[:len(log)-1]
+	}
+	return append(log, entries...)
+}
+
+// MemoryStorage keeps state in memory; it survives node restarts within
+// one process, which is what tests need.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	state PersistentState
+}
+
+// NewMemoryStorage returns empty in-memory storage.
+func NewMemoryStorage() *MemoryStorage { return &MemoryStorage{} }
+
+func (s *MemoryStorage) Load() (PersistentState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.state
+	st.Entries = append([]Entry(nil), st.Entries...)
+	return st, nil
+}
+
+func (s *MemoryStorage) SetState(term uint64, votedFor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Term, s.state.VotedFor = term, votedFor
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Entries = truncateAppend(s.state.Entries, entries)
+	return nil
+}
+
+func (s *MemoryStorage) SaveSnapshot(index, term uint64, data []byte, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.SnapshotIndex, s.state.SnapshotTerm, s.state.Snapshot = index, term, data
+	s.state.Entries = append([]Entry(nil), entries...)
+	return nil
+}
+
+// logRecord is one line of a FileStorage log.
+type logRecord struct {
+	Op       string  `json:"op"` // "state" or "append"
+	Term     uint64  `json:"term,omitempty"`
+	VotedFor string  `json:"voted_for,omitempty"`
+	Entries  []Entry `json:"entries,omitempty"`
+}
+
+// snapshotFile is the content of a FileStorage snapshot file.
+type snapshotFile struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+// FileStorage keeps the log in an append-only file of JSON lines, synced
+// after every record, and the latest snapshot in a file next to it
+// (path with its extension replaced by ".snap"). Saving a snapshot
+// rewrites the log to hold only the entries after it. A torn last line
+// left by a crash mid-write is dropped on Load.
+type FileStorage struct {
+	path     string
+	snapPath string
+
+	mu       sync.Mutex
+	f        *os.File
+	term     uint64
+	votedFor string
+}
+
+// NewFileStorage returns storage logging to path.
+func NewFileStorage(path string) *FileStorage {
+	return &FileStorage{
+		path:     path,
+		snapPath: strings.TrimSuffix(path, filepath.Ext(path)) + ".snap",
+	}
+}
+
+// Load reads the snapshot and replays the log. It also opens the log for
+// the appends that follow.
+func (s *FileStorage) Load() (PersistentState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var st PersistentState
+
+	data, err := os.ReadFile(s.snapPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return st, err
+	}
+	if err == nil {
+		var snap snapshotFile
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return st, err
+		}
+		st.SnapshotIndex, st.SnapshotTerm, st.Snapshot = snap.Index, snap.Term, snap.Data
+	}
+
+	f, err := jsonl.Open(s.path, func(rec logRecord) {
+		switch rec.Op {
+		case "state":
+			st.Term, st.VotedFor = rec.Term, rec.VotedFor
+		case "append":
+			st.Entries = truncateAppend(st.Entries, rec.Entries)
+		}
+	})
+	if err != nil {
+		return st, err
+	}
+
+	// A crash between writing a snapshot and rewriting the log leaves
+	// entries the snapshot already covers.
+	kept := st.Entries[:0]
+	for _, e := range st.Entries {
+		if e.Index > st.SnapshotIndex {
+			kept = append(kept, e)
+		}
+	}
+	st.Entries = kept
+
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, s.term, s.votedFor = f, st.Term, st.VotedFor
+	return st, nil
+}
+
+func (s *FileStorage) SetState(term uint64, votedFor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.term, s.votedFor = term, votedFor
+	return s.append(logRecord{Op: "state", Term: term, VotedFor: votedFor})
+}
+
+func (s *FileStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(logRecord{Op: "append", Entries: entries})
+}
+
+// SaveSnapshot writes the snapshot file first, so a crash before the log
+// is rewritten only leaves entries that Load drops.
+func (s *FileStorage) SaveSnapshot(index, term uint64, data []byte, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap, err := json.Marshal(snapshotFile{Index: index, Term: term, Data: data})
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(s.snapPath, snap); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.Encode(logRecord{Op: "state", Term: s.term, VotedFor: s.votedFor})
+	if len(entries) > 0 {
+		enc.Encode(logRecord{Op: "append", Entries: entries})
+	}
+	if err := writeFileSync(s.path, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f = f
+	return nil
+}
+
+// Close closes the log file.
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// append writes rec as one line and syncs it. Caller holds s.mu.
+func (s *FileStorage) append(rec logRecord) error {
+	if s.f == nil {
+		f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.f = f
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// writeFileSync replaces path with data through a synced temporary file.
+func writeFileSync(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
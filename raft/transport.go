@@ -0,0 +1,259 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestVoteArgs is sent by candidates to gather votes.
+type RequestVoteArgs struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type RequestVoteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+// AppendEntriesArgs replicates log entries and doubles as heartbeat.
+type AppendEntriesArgs struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// AppendEntriesReply carries a conflict hint so the leader can skip back a
+// whole term at a time instead of one entry per round trip.
+type AppendEntriesReply struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflict_index"`
+}
+
+// InstallSnapshotArgs sends the leader's snapshot to a follower that is
+// too far behind to be caught up from the log.
+type InstallSnapshotArgs struct {
+	Term          uint64 `json:"term"`
+	Leader        string `json:"leader"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+	SnapshotTerm  uint64 `json:"snapshot_term"`
+	Data          []byte `json:"data"`
+}
+
+type InstallSnapshotReply struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport delivers RPCs to peers identified by node ID.
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(ctx context.Context, peer string, args AppendEntriesArgs) (AppendEntriesReply, error)
+	InstallSnapshot(ctx context.Context, peer string, args InstallSnapshotArgs) (InstallSnapshotReply, error)
+}
+
+// ErrUnreachable is returned by transports when a peer cannot be reached.
+var ErrUnreachable = errors.New("raft: peer unreachable")
+
+// InmemNetwork connects nodes of one process directly. Nodes can be
+// disconnected and reconnected to simulate crashes and partitions.
+type InmemNetwork struct {
+	mu    sync.RWMutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+// NewInmemNetwork returns an empty network.
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{nodes: make(map[string]*Node), down: make(map[string]bool)}
+}
+
+// Transport returns the transport node id uses to send RPCs.
+func (nw *InmemNetwork) Transport(id string) Transport {
+	return &inmemTransport{nw: nw, from: id}
+}
+
+// Register makes n reachable under its ID.
+func (nw *InmemNetwork) Register(n *Node) {
+	nw.mu.Lock()
+	nw.nodes[n.ID()] = n
+	nw.mu.Unlock()
+}
+
+// Disconnect drops all traffic to and from id.
+func (nw *InmemNetwork) Disconnect(id string) {
+	nw.mu.Lock()
+	nw.down[id] = true
+	nw.mu.Unlock()
+}
+
+// Connect restores traffic to and from id.
+func (nw *InmemNetwork) Connect(id string) {
+	nw.mu.Lock()
+	delete(nw.down, id)
+	nw.mu.Unlock()
+}
+
+func (nw *InmemNetwork) target(from, to string) (*Node, error) {
+	nw.mu.RLock()
+	defer nw.mu.RUnlock()
+	n, ok := nw.nodes[to]
+	if !ok || nw.down[from] || nw.down[to] {
+		return nil, ErrUnreachable
+	}
+	return n, nil
+}
+
+type inmemTransport struct {
+	nw   *InmemNetwork
+	from string
+}
+
+func (t *inmemTransport) RequestVote(ctx context.Context, peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	n, err := t.nw.target(t.from, peer)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return n.HandleRequestVote(args), nil
+}
+
+func (t *inmemTransport) AppendEntries(ctx context.Context, peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	n, err := t.nw.target(t.from, peer)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	return n.HandleAppendEntries(args), nil
+}
+
+func (t *inmemTransport) InstallSnapshot(ctx context.Context, peer string, args InstallSnapshotArgs) (InstallSnapshotReply, error) {
+	n, err := t.nw.target(t.from, peer)
+	if err != nil {
+		return InstallSnapshotReply{}, err
+	}
+	return n.HandleInstallSnapshot(args), nil
+}
+
+// HTTPTransport sends RPCs as JSON POSTs to /raft/{vote,append,snapshot}
+// on each peer's base URL.
+type HTTPTransport struct {
+	Peers  map[string]string // node ID -> base URL
+	Client *http.Client
+	// Sign, if set, authenticates every RPC with its body, such as with
+	// auth.Sign and the cluster key.
+	Sign func(req *http.Request, body []byte)
+}
+
+// NewHTTPTransport returns a transport for the given peer URLs.
+func NewHTTPTransport(peers map[string]string) *HTTPTransport {
+	return &HTTPTransport{Peers: peers, Client: &http.Client{Timeout: time.Second}}
+}
+
+// ParsePeers parses "n1=http://localhost:8080,n2=http://localhost:8081".
+func ParsePeers(s string) (map[string]string, error) {
+	peers := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, url, ok := strings.Cut(part, "=")
+		if !ok || id == "" || url == "" {
+			return nil, fmt.Errorf("invalid peer %q: expected id=url", part)
+		}
+		peers[id] = strings.TrimRight(url, "/")
+	}
+	return peers, nil
+}
+
+func (t *HTTPTransport) call(ctx context.Context, peer, path string, args, reply interface{}) error {
+	base, ok := t.Peers[peer]
+	if !ok {
+		return fmt.Errorf("raft: unknown peer %q", peer)
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.Sign != nil {
+		t.Sign(req, data)
+	}
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: %s%s: %s", base, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	var reply RequestVoteReply
+	err := t.call(ctx, peer, "/raft/vote", args, &reply)
+	return reply, err
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	var reply AppendEntriesReply
+	err := t.call(ctx, peer, "/raft/append", args, &reply)
+	return reply, err
+}
+
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, peer string, args InstallSnapshotArgs) (InstallSnapshotReply, error) {
+	var reply InstallSnapshotReply
+	err := t.call(ctx, peer, "/raft/snapshot", args, &reply)
+	return reply, err
+}
+
+// Register installs the RPC endpoints of n, plus GET /raft/status, on mux.
+// The RPC endpoints are wrapped by wrap, which should only let the other
+// nodes through (see HTTPTransport.Sign).
+func Register(mux *http.ServeMux, n *Node, wrap func(http.HandlerFunc) http.Handler) {
+	mux.Handle("/raft/vote", wrap(rpcHandler(n.HandleRequestVote)))
+	mux.Handle("/raft/append", wrap(rpcHandler(n.HandleAppendEntries)))
+	mux.Handle("/raft/snapshot", wrap(rpcHandler(n.HandleInstallSnapshot)))
+	mux.HandleFunc("/raft/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(n.Status()); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func rpcHandler[A, R any](handle func(A) R) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var args A
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(handle(args)); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Package ratelimit implements token-bucket rate limiting keyed by
+// client name (X-Client-Name) and by remote IP address.
+package ratelimit
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bucket is a single token bucket. Tokens refill continuously at rate
+// tokens per second up to burst.
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	allowed int
+	denied  int
+}
+
+// idleTimeout is how long a full bucket is kept unused before it is
+// dropped. A dropped bucket is recreated full, so only its counters are lost.
+const idleTimeout = 10 * time.Minute
+
+// Limiter holds one token bucket per key, all sharing the same rate and burst.
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewLimiter returns a limiter refilling rate tokens per second with a
+// bucket capacity of burst. A rate <= 0 disables limiting.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Enabled reports whether the limiter actually limits anything.
+func (l *Limiter) Enabled() bool {
+	return l != nil && l.rate > 0
+}
+
+// refill brings b up to date at time now. Caller must hold l.mu.
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.last = now
+	}
+}
+
+// wait returns how long the bucket for key must wait for a token, 0 if it
+// has one. Buckets not yet created are full. Caller must hold l.mu.
+func (l *Limiter) wait(key string, now time.Time) time.Duration {
+	b, ok := l.buckets[key]
+	if !ok {
+		return 0
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// take spends a token of the bucket for key, creating it, after wait
+// said there is one. Caller must hold l.mu.
+func (l *Limiter) take(key string, now time.Time) {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens--
+	b.allowed++
+}
+
+// deny counts a request refused for key. Caller must hold l.mu.
+func (l *Limiter) deny(key string) {
+	if b, ok := l.buckets[key]; ok {
+		b.denied++
+	}
+}
+
+// sweep drops buckets that are full and were unused for idleTimeout, at
+// most once per idleTimeout. Caller must hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		idle := now.Sub(b.last)
+		l.refill(b, now)
+		if idle >= idleTimeout && b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Allow takes one token from the bucket for key. When the bucket is empty
+// it returns false and how long the caller should wait before retrying.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if !l.Enabled() {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	if wait := l.wait(key, now); wait > 0 {
+		l.deny(key)
+		return false, wait
+	}
+	l.take(key, now)
+	return true, 0
+}
+
+// BucketState is a point-in-time view of one bucket, used by the admin endpoint.
+type BucketState struct {
+	Key     string  `json:"key"`
+	Tokens  float64 `json:"tokens"`
+	Burst   float64 `json:"burst"`
+	Rate    float64 `json:"rate"`
+	Allowed int     `json:"allowed"`
+	Denied  int     `json:"denied"`
+}
+
+// Snapshot returns the state of every bucket, sorted by key.
+func (l *Limiter) Snapshot() []BucketState {
+	states := []BucketState{}
+	if !l.Enabled() {
+		return states
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		states = append(states, BucketState{
+			Key:     key,
+			Tokens:  b.tokens,
+			Burst:   l.burst,
+			Rate:    l.rate,
+			Allowed: b.allowed,
+			Denied:  b.denied,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+	return states
+}
+
+// Reset drops all buckets so a new experiment starts from full buckets.
+func (l *Limiter) Reset() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.buckets = make(map[string]*bucket)
+	l.mu.Unlock()
+}
+
+// Config selects the per-client and per-IP rates. A zero rate disables
+// that dimension.
+type Config struct {
+	ClientRate  float64
+	ClientBurst int
+	IPRate      float64
+	IPBurst     int
+}
+
+// Middleware rate limits requests by X-Client-Name and by remote IP.
+type Middleware struct {
+	clients *Limiter
+	ips     *Limiter
+}
+
+// New builds a Middleware from cfg.
+func New(cfg Config) *Middleware {
+	return &Middleware{
+		clients: NewLimiter(cfg.ClientRate, cfg.ClientBurst),
+		ips:     NewLimiter(cfg.IPRate, cfg.IPBurst),
+	}
+}
+
+// ClientName returns the client name a request claims, or "unknown".
+func ClientName(r *http.Request) string {
+	name := r.Header.Get("X-Client-Name")
+	if name == "" {
+		name = "unknown"
+	}
+	return name
+}
+
+// RemoteIP returns the IP part of r.RemoteAddr.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Wrap returns a handler that answers 429 Too Many Requests with a
+// Retry-After header when either the IP or the client bucket is empty.
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scope, wait := m.allow(RemoteIP(r), ClientName(r)); wait > 0 {
+			tooMany(w, scope, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow takes a token from both the ip and the client bucket, or from
+// neither when one of them is empty, so a request refused for one does
+// not use up the other. It returns the scope that refused and how long
+// to wait.
+func (m *Middleware) allow(ip, client string) (string, time.Duration) {
+	limiters := []struct {
+		scope string
+		l     *Limiter
+		key   string
+	}{{"ip", m.ips, ip}, {"client", m.clients, client}}
+
+	// Always lock ips before clients.
+	for _, x := range limiters {
+		if x.l.Enabled() {
+			x.l.mu.Lock()
+			defer x.l.mu.Unlock()
+		}
+	}
+	for _, x := range limiters {
+		if !x.l.Enabled() {
+			continue
+		}
+		now := x.l.now()
+		x.l.sweep(now)
+		if wait := x.l.wait(x.key, now); wait > 0 {
+			x.l.deny(x.key)
+			return x.scope, wait
+		}
+	}
+	for _, x := range limiters {
+		if x.l.Enabled() {
+			x.l.take(x.key, x.l.now())
+		}
+	}
+	return "", 0
+}
+
+func tooMany(w http.ResponseWriter, scope string, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "rate limit exceeded ("+scope+")", http.StatusTooManyRequests)
+}
+
+// AdminHandler reports the state of all buckets on GET and resets them on DELETE.
+func (m *Middleware) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		m.clients.Reset()
+		m.ips.Reset()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"clients": m.clients.Snapshot(), "ips": m.ips.Snapshot()}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for limiters.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newMiddleware(clock *fakeClock, cfg Config) *Middleware {
+	m := New(cfg)
+	m.clients.now = clock.now
+	m.ips.now = clock.now
+	return m
+}
+
+func TestLimiterRefill(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := NewLimiter(2, 2)
+	l.now = clock.now
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d denied within burst", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("Allow = %v, %v; want false, 500ms", ok, wait)
+	}
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("denied after refill")
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("other key denied")
+	}
+}
+
+func TestDeniedRequestKeepsOtherToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    Config
+		first  [2]string // ip, client of a request that uses up one bucket
+		second [2]string // refused request
+		scope  string
+		third  [2]string // must still be allowed
+	}{
+		{
+			name:   "client empty keeps ip token",
+			cfg:    Config{ClientRate: 1, ClientBurst: 1, IPRate: 1, IPBurst: 2},
+			first:  [2]string{"10.0.0.1", "alice"},
+			second: [2]string{"10.0.0.1", "alice"},
+			scope:  "client",
+			third:  [2]string{"10.0.0.1", "bob"},
+		},
+		{
+			name:   "ip empty keeps client token",
+			cfg:    Config{ClientRate: 1, ClientBurst: 2, IPRate: 1, IPBurst: 1},
+			first:  [2]string{"10.0.0.1", "alice"},
+			second: [2]string{"10.0.0.1", "alice"},
+			scope:  "ip",
+			third:  [2]string{"10.0.0.2", "alice"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{t: time.Unix(0, 0)}
+			m := newMiddleware(clock, tt.cfg)
+			if scope, _ := m.allow(tt.first[0], tt.first[1]); scope != "" {
+				t.Fatalf("first request refused by %s", scope)
+			}
+			if scope, _ := m.allow(tt.second[0], tt.second[1]); scope != tt.scope {
+				t.Fatalf("second request refused by %q, want %q", scope, tt.scope)
+			}
+			if scope, _ := m.allow(tt.third[0], tt.third[1]); scope != "" {
+				t.Fatalf("third request refused by %s", scope)
+			}
+		})
+	}
+}
+
+func TestRefusedIPCreatesNoClientBucket(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	m := newMiddleware(clock, Config{ClientRate: 1, ClientBurst: 1, IPRate: 1, IPBurst: 1})
+	m.allow("10.0.0.1", "a")
+	for _, name := range []string{"b", "c", "d"} {
+		m.allow("10.0.0.1", name)
+	}
+	if n := len(m.clients.buckets); n != 1 {
+		t.Fatalf("%d client buckets, want 1", n)
+	}
+}
+
+func TestIdleBucketsEvicted(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0).Add(idleTimeout)}
+	l := NewLimiter(1, 1)
+	l.now = clock.now
+	l.Allow("old")
+	clock.t = clock.t.Add(idleTimeout)
+	l.Allow("new")
+	if _, ok := l.buckets["old"]; ok {
+		t.Fatal("idle bucket kept")
+	}
+	if _, ok := l.buckets["new"]; !ok {
+		t.Fatal("new bucket missing")
+	}
+}
+
+func TestWrapRetryAfter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	m := newMiddleware(clock, Config{ClientRate: 0.5, ClientBurst: 1})
+	h := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := []int{http.StatusOK, http.StatusTooManyRequests}
+	for _, want := range codes {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Client-Name", "alice")
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("code %d, want %d", rec.Code, want)
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "2" {
+			t.Fatalf("Retry-After %q, want 2", rec.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Package sched schedules per-item work from many clients onto a fixed pool
+// of workers. Work is queued per client and dispatched either in arrival
+// order (FIFO) or by deficit round-robin (DRR) within strict priority
+// classes, and the wait time of every item is recorded per client so
+// scheduling policies can be compared.
+package sched
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority is a scheduling class. Lower values are served first.
+type Priority int
+
+const (
+	High Priority = iota
+	Normal
+	Low
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case High:
+		return "high"
+	case Low:
+		return "low"
+	default:
+		return "normal"
+	}
+}
+
+// ParsePriority maps an X-Priority header value to a class. Unknown or
+// empty values are Normal.
+func ParsePriority(s string) Priority {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "high":
+		return High
+	case "low":
+		return Low
+	default:
+		return Normal
+	}
+}
+
+// Policy selects how queued items are dispatched.
+type Policy string
+
+const (
+	FIFO Policy = "fifo" // global arrival order, priorities ignored
+	DRR  Policy = "drr"  // strict priority classes, deficit round-robin per client within a class
+)
+
+// ParsePolicy validates a policy name.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case FIFO, DRR:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown scheduling policy %q", s)
+}
+
+// ParseWeights parses "Alice=2,Dan=1" into a weight map.
+func ParseWeights(s string) (map[string]int, error) {
+	weights := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid weight %q: expected name=weight", part)
+		}
+		w, err := strconv.Atoi(value)
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("invalid weight %q: weight must be a positive integer", part)
+		}
+		weights[name] = w
+	}
+	return weights, nil
+}
+
+type task struct {
+	fn       func()
+	client   string
+	priority Priority
+	enqueued time.Time
+}
+
+// clientQueue holds the pending items of one client in one priority class.
+type clientQueue struct {
+	client  string
+	tasks   []task
+	deficit int
+}
+
+// class is one priority level: the clients with pending work, visited in
+// round-robin order.
+type class struct {
+	queues map[string]*clientQueue
+	active []*clientQueue
+	pos    int
+}
+
+// ClientStats summarises the wait times of one client's items.
+type ClientStats struct {
+	Client     string  `json:"client"`
+	Weight     int     `json:"weight"`
+	Queued     int     `json:"queued"`
+	Dispatched int     `json:"dispatched"`
+	AvgWaitMs  float64 `json:"avg_wait_ms"`
+	MaxWaitMs  float64 `json:"max_wait_ms"`
+	totalWait  time.Duration
+	maxWait    time.Duration
+}
+
+// Scheduler dispatches submitted items onto a fixed worker pool.
+type Scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	policy  Policy
+	weights map[string]int
+	workers int
+	fifo    []task
+	classes [numPriorities]*class
+	pending int
+	stats   map[string]*ClientStats
+}
+
+// New starts a scheduler with the given number of workers. weights gives
+// the DRR quantum of each client in items per round; clients not listed
+// get weight 1.
+func New(workers int, policy Policy, weights map[string]int) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	s := &Scheduler{
+		policy:  policy,
+		weights: weights,
+		workers: workers,
+		stats:   make(map[string]*ClientStats),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i := range s.classes {
+		s.classes[i] = &class{queues: make(map[string]*clientQueue)}
+	}
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+func (s *Scheduler) weight(client string) int {
+	if w, ok := s.weights[client]; ok {
+		return w
+	}
+	return 1
+}
+
+// Submit queues fn on behalf of client. It never blocks; fn runs on one of
+// the scheduler's workers.
+func (s *Scheduler) Submit(client string, priority Priority, fn func()) {
+	if priority < High || priority >= numPriorities {
+		priority = Normal
+	}
+	t := task{fn: fn, client: client, priority: priority, enqueued: time.Now()}
+
+	s.mu.Lock()
+	st := s.clientStats(client)
+	st.Queued++
+	s.pending++
+	if s.policy == FIFO {
+		s.fifo = append(s.fifo, t)
+	} else {
+		c := s.classes[priority]
+		q, ok := c.queues[client]
+		if !ok {
+			q = &clientQueue{client: client}
+			c.queues[client] = q
+		}
+		if len(q.tasks) == 0 {
+			c.active = append(c.active, q)
+		}
+		q.tasks = append(q.tasks, t)
+	}
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *Scheduler) clientStats(client string) *ClientStats {
+	st, ok := s.stats[client]
+	if !ok {
+		st = &ClientStats{Client: client}
+		s.stats[client] = st
+	}
+	return st
+}
+
+// next removes the item to run next. Caller must hold s.mu and ensure
+// s.pending > 0.
+func (s *Scheduler) next() task {
+	if s.policy == FIFO {
+		t := s.fifo[0]
+		s.fifo = s.fifo[1:]
+		return t
+	}
+	for _, c := range s.classes {
+		if len(c.active) > 0 {
+			return s.nextDRR(c)
+		}
+	}
+	panic("sched: next called with no pending work")
+}
+
+// nextDRR serves the client at the round-robin position while it has
+// deficit left, then moves on and grants the next client its quantum.
+func (s *Scheduler) nextDRR(c *class) task {
+	for {
+		q := c.active[c.pos]
+		if q.deficit >= 1 {
+			t := q.tasks[0]
+			q.tasks = q.tasks[1:]
+			q.deficit--
+			if len(q.tasks) == 0 {
+				// An idle client does not keep its unused deficit.
+				q.deficit = 0
+				c.active = append(c.active[:c.pos], c.active[c.pos+1:]...)
+				if len(c.active) > 0 {
+					c.pos %= len(c.active)
+					c.active[c.pos].deficit += s.weight(c.active[c.pos].client)
+				} else {
+					c.pos = 0
+				}
+			}
+			return t
+		}
+		c.pos = (c.pos + 1) % len(c.active)
+		c.active[c.pos].deficit += s.weight(c.active[c.pos].client)
+	}
+}
+
+func (s *Scheduler) worker() {
+	for {
+		s.mu.Lock()
+		for s.pending == 0 {
+			s.cond.Wait()
+		}
+		t := s.next()
+		s.pending--
+		wait := time.Since(t.enqueued)
+		st := s.clientStats(t.client)
+		st.Queued--
+		st.Dispatched++
+		st.totalWait += wait
+		if wait > st.maxWait {
+			st.maxWait = wait
+		}
+		s.mu.Unlock()
+
+		t.fn()
+	}
+}
+
+// Snapshot returns per-client statistics sorted by client name.
+func (s *Scheduler) Snapshot() []ClientStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]ClientStats, 0, len(s.stats))
+	for _, st := range s.stats {
+		cp := *st
+		cp.Weight = s.weight(st.Client)
+		if st.Dispatched > 0 {
+			cp.AvgWaitMs = float64(st.totalWait) / float64(st.Dispatched) / float64(time.Millisecond)
+		}
+		cp.MaxWaitMs = float64(st.maxWait) / float64(time.Millisecond)
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Client < out[j].Client })
+	return out
+}
+
+// Reset clears the collected statistics, keeping queued work.
+func (s *Scheduler) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for client, st := range s.stats {
+		s.stats[client] = &ClientStats{Client: client, Queued: st.Queued}
+	}
+}
+
+// AdminHandler reports per-client wait statistics on GET and clears them on DELETE.
+func (s *Scheduler) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		s.Reset()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"policy": s.policy, "workers": s.workers, "clients": s.Snapshot()}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,165 @@
+package sched
+
+import (
+	"sync"
+	"testing"
+)
+
+// newIdle returns a scheduler without workers, so tests can call next
+// and see the dispatch order.
+func newIdle(policy Policy, weights map[string]int) *Scheduler {
+	s := &Scheduler{policy: policy, weights: weights, workers: 0, stats: make(map[string]*ClientStats)}
+	s.cond = sync.NewCond(&s.mu)
+	for i := range s.classes {
+		s.classes[i] = &class{queues: make(map[string]*clientQueue)}
+	}
+	return s
+}
+
+// drain dispatches everything queued and returns the clients in order.
+func drain(s *Scheduler) []string {
+	var order []string
+	for s.pending > 0 {
+		order = append(order, s.next().client)
+		s.pending--
+	}
+	return order
+}
+
+func count(order []string, client string) int {
+	n := 0
+	for _, c := range order {
+		if c == client {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDRRWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		window  int
+		want    map[string]int // items per client in the first window dispatches
+	}{
+		{"equal", nil, 6, map[string]int{"A": 3, "B": 3}},
+		{"two to one", map[string]int{"A": 2}, 9, map[string]int{"A": 6, "B": 3}},
+		{"three to one", map[string]int{"B": 3}, 8, map[string]int{"A": 2, "B": 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newIdle(DRR, tt.weights)
+			for i := 0; i < 20; i++ {
+				s.Submit("A", Normal, func() {})
+			}
+			for i := 0; i < 20; i++ {
+				s.Submit("B", Normal, func() {})
+			}
+			order := drain(s)
+			if len(order) != 40 {
+				t.Fatalf("dispatched %d items, want 40", len(order))
+			}
+			for client, want := range tt.want {
+				if got := count(order[:tt.window], client); got != want {
+					t.Errorf("%s got %d of the first %d items, want %d (order %v)", client, got, tt.window, want, order[:tt.window])
+				}
+			}
+		})
+	}
+}
+
+func TestDRRPriorityClasses(t *testing.T) {
+	s := newIdle(DRR, nil)
+	s.Submit("low", Low, func() {})
+	s.Submit("normal", Normal, func() {})
+	s.Submit("high", High, func() {})
+	s.Submit("high", High, func() {})
+	got := drain(s)
+	want := []string{"high", "high", "normal", "low"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("order %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDRRLateClientNotStarved(t *testing.T) {
+	s := newIdle(DRR, nil)
+	for i := 0; i < 10; i++ {
+		s.Submit("bulk", Normal, func() {})
+	}
+	first := s.next().client
+	s.pending--
+	s.Submit("late", Normal, func() {})
+	order := append([]string{first}, drain(s)...)
+	for i, c := range order {
+		if c == "late" {
+			if i > 2 {
+				t.Fatalf("late client served at position %d: %v", i, order)
+			}
+			return
+		}
+	}
+	t.Fatal("late client never served")
+}
+
+func TestFIFOIgnoresPriority(t *testing.T) {
+	s := newIdle(FIFO, nil)
+	s.Submit("A", Low, func() {})
+	s.Submit("B", High, func() {})
+	s.Submit("A", Normal, func() {})
+	got := drain(s)
+	want := []string{"A", "B", "A"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("order %v, want %v", got, want)
+		}
+	}
+}
+
+func TestWorkersRunEverything(t *testing.T) {
+	s := New(3, DRR, map[string]int{"A": 2})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ran := map[string]int{}
+	for _, client := range []string{"A", "B", "C"} {
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			client := client
+			s.Submit(client, ParsePriority("normal"), func() {
+				mu.Lock()
+				ran[client]++
+				mu.Unlock()
+				wg.Done()
+			})
+		}
+	}
+	wg.Wait()
+	for _, st := range s.Snapshot() {
+		if st.Dispatched != 50 || st.Queued != 0 || ran[st.Client] != 50 {
+			t.Errorf("%s: dispatched %d queued %d ran %d", st.Client, st.Dispatched, st.Queued, ran[st.Client])
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	if _, err := ParsePolicy("round-robin"); err == nil {
+		t.Error("ParsePolicy accepted an unknown policy")
+	}
+	if p, _ := ParsePolicy("DRR"); p != DRR {
+		t.Errorf("ParsePolicy(DRR) = %q", p)
+	}
+	w, err := ParseWeights("Alice=2, Dan=1")
+	if err != nil || w["Alice"] != 2 || w["Dan"] != 1 {
+		t.Errorf("ParseWeights = %v, %v", w, err)
+	}
+	for _, bad := range []string{"Alice", "Alice=0", "Alice=x"} {
+		if _, err := ParseWeights(bad); err == nil {
+			t.Errorf("ParseWeights(%q) accepted", bad)
+		}
+	}
+	if ParsePriority(" HIGH ") != High || ParsePriority("urgent") != Normal {
+		t.Error("ParsePriority")
+	}
+}
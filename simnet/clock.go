@@ -0,0 +1,209 @@
+package simnet
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a Network.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the wall clock.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time                         { return time.Now() }
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// sleep waits d on clock, or until ctx is done.
+func sleep(ctx context.Context, clock Clock, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type timer struct {
+	at  time.Time
+	seq uint64 // breaks ties in creation order
+	ch  chan time.Time
+}
+
+type timerHeap []timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h timerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timerHeap) Push(x interface{}) { *h = append(*h, x.(timer)) }
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// SimClock is a virtual clock that only moves when told to. Timers fire
+// in deadline order, ties in the order they were created, so a scenario
+// that advances the clock step by step replays identically.
+type SimClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  timerHeap
+	seq     uint64
+	changed chan struct{} // closed and replaced whenever a timer is added
+	hooks   []func()      // run with mu held before a timer fires
+}
+
+// NewSimClock returns a virtual clock reading start.
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start, changed: make(chan struct{})}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *SimClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d <= 0 {
+		ch := make(chan time.Time, 1)
+		ch <- c.now
+		return ch
+	}
+	return c.add(d)
+}
+
+// add starts a timer firing d from now; unlike After it also waits for
+// the next step of the clock when d is not positive. Caller holds c.mu.
+func (c *SimClock) add(d time.Duration) chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.seq++
+	heap.Push(&c.timers, timer{at: c.now.Add(d), seq: c.seq, ch: ch})
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return ch
+}
+
+// reset moves the pending timer of ch to fire d from now, after the
+// timers already due then. Caller holds c.mu.
+func (c *SimClock) reset(ch chan time.Time, d time.Duration) {
+	for i := range c.timers {
+		if c.timers[i].ch == ch {
+			c.seq++
+			c.timers[i].at, c.timers[i].seq = c.now.Add(d), c.seq
+			heap.Fix(&c.timers, i)
+			return
+		}
+	}
+}
+
+// hold starts a timer that fires at the next step of the clock and
+// passes it to register, all under the clock's lock, so no hook runs in
+// between.
+func (c *SimClock) hold(register func(ch chan time.Time)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	register(c.add(0))
+}
+
+// beforeFire registers f to run before any timer fires. f runs with the
+// clock locked and must only use the clock through reset.
+func (c *SimClock) beforeFire(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hooks = append(c.hooks, f)
+}
+
+func (c *SimClock) runHooks() {
+	for _, f := range c.hooks {
+		f()
+	}
+}
+
+// Pending returns the number of timers that have not fired yet.
+func (c *SimClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until at least n timers are pending, i.e. until the
+// goroutines of a scenario have reached the points where they wait on
+// the clock. Stopped timers of abandoned waits still count until they fire.
+func (c *SimClock) BlockUntil(ctx context.Context, n int) error {
+	for {
+		c.mu.Lock()
+		pending, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+		if pending >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due
+// on the way, one at a time in order.
+func (c *SimClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	for c.fireNext(target) {
+	}
+	c.mu.Lock()
+	if target.After(c.now) {
+		c.now = target
+	}
+	c.mu.Unlock()
+}
+
+// AdvanceToNext moves the clock to the earliest pending timer and fires
+// it. It returns false if no timer is pending.
+func (c *SimClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	c.runHooks()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	at := c.timers[0].at
+	c.mu.Unlock()
+	return c.fireNext(at)
+}
+
+// fireNext fires the earliest timer due at or before limit.
+func (c *SimClock) fireNext(limit time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runHooks()
+	if len(c.timers) == 0 || c.timers[0].at.After(limit) {
+		return false
+	}
+	t := heap.Pop(&c.timers).(timer)
+	if t.at.After(c.now) {
+		c.now = t.at
+	}
+	t.ch <- c.now
+	return true
+}
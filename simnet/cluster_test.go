@@ -0,0 +1,108 @@
+package simnet
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/cluster"
+)
+
+// worker answers shards the way an exercise server does, upper-casing
+// every item.
+var worker = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var items []string
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	processed := make([]string, len(items))
+	for i, item := range items {
+		processed[i] = strings.ToUpper(item)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"processed": processed})
+})
+
+// TestCoordinatorOverNetwork runs a cluster coordinator against three
+// workers on the network, with the faults of setup in place, and checks
+// that every shard is processed in order by a worker setup leaves
+// reachable.
+func TestCoordinatorOverNetwork(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(*Network)
+		unreachable string
+		check       func(Stats) bool
+	}{
+		{
+			name:        "drop",
+			setup:       func(nw *Network) { nw.SetLink("coord", "w2", Link{DropRate: 1}) },
+			unreachable: "http://w2:80",
+			check:       func(s Stats) bool { return s.Dropped > 0 && s.Partitioned == 0 },
+		},
+		{
+			name:        "partition",
+			setup:       func(nw *Network) { nw.Partition([]string{"coord", "w1", "w3"}, []string{"w2"}) },
+			unreachable: "http://w2:80",
+			check:       func(s Stats) bool { return s.Partitioned > 0 && s.Dropped == 0 },
+		},
+		{
+			name:  "healthy",
+			setup: func(*Network) {},
+			check: func(s Stats) bool { return s.Delivered == s.Sent },
+		},
+	}
+	items := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i"}
+	want := `["A","B","C","D","E","F","G","H","I"]`
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nw := New(Config{Seed: 1, Latency: time.Millisecond, Timeout: 20 * time.Millisecond})
+			var urls []string
+			for _, addr := range []string{"w1:80", "w2:80", "w3:80"} {
+				ln, err := nw.Listen(addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				srv := &http.Server{Handler: worker}
+				go srv.Serve(ln)
+				defer srv.Close()
+				urls = append(urls, "http://"+addr)
+			}
+			tt.setup(nw)
+
+			coord := cluster.NewCoordinator(urls, 2)
+			coord.Client.Transport = nw.Transport("coord")
+			processed, shards, err := coord.Process(context.Background(), "ex2", items, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := json.Marshal(processed); string(got) != want {
+				t.Errorf("processed %s, want %s", got, want)
+			}
+			var ranges [][2]int
+			retried := 0
+			for _, sh := range shards {
+				ranges = append(ranges, [2]int{sh.Start, sh.End})
+				if sh.Attempts > 1 {
+					retried++
+				}
+				if sh.Worker == tt.unreachable {
+					t.Errorf("shard %s reported done by unreachable %s", sh.Describe(), sh.Worker)
+				}
+			}
+			if wantRanges := [][2]int{{0, 2}, {2, 4}, {4, 6}, {6, 8}, {8, 9}}; !reflect.DeepEqual(ranges, wantRanges) {
+				t.Errorf("shards %v, want %v", ranges, wantRanges)
+			}
+			if tt.unreachable != "" && retried == 0 {
+				t.Errorf("no shard was retried away from %s", tt.unreachable)
+			}
+			if stats := nw.Stats(); !tt.check(stats) {
+				t.Errorf("stats %+v", stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+// Package simnet is an in-process network for running cluster scenarios
+// of the exercise server without real sockets. Servers listen on a
+// Network through net.Listener, clients reach them through the
+// http.RoundTripper of their node, and the network decides the fate of
+// every message: latency, drops, partitions and reordering. All random
+// choices come from the seed, and with a SimClock time only moves when
+// the scenario advances it, so a run can be replayed exactly.
+//
+// A coordinator/worker scenario in a test looks like:
+//
+//	clock := simnet.NewSimClock(time.Unix(0, 0))
+//	nw := simnet.New(simnet.Config{Seed: 1, Clock: clock, Latency: 5 * time.Millisecond, DropRate: 0.1})
+//	for _, w := range []string{"w1:80", "w2:80"} {
+//		ln, _ := nw.Listen(w)
+//		go http.Serve(ln, workerMux)
+//	}
+//	coord := cluster.NewCoordinator([]string{"http://w1:80", "http://w2:80"}, 2)
+//	coord.Client.Transport = nw.Transport("coord")
+//	nw.Partition([]string{"coord", "w1"}, []string{"w2"})
+//	go coord.Process(ctx, "ex2", items, nil)
+//	clock.BlockUntil(ctx, 1) // the shard request is in flight
+//	clock.Advance(5 * time.Millisecond)
+package simnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config sets the default behaviour of every link.
+type Config struct {
+	Seed  int64
+	Clock Clock // defaults to RealClock
+	// Latency is the one-way delay of a message, plus up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// DropRate is the probability that a request, or independently its
+	// response, is lost.
+	DropRate float64
+	// ReorderRate is the probability that a message is held back an
+	// extra ReorderDelay, letting later messages overtake it.
+	ReorderRate  float64
+	ReorderDelay time.Duration
+	// Timeout is how long a sender waits for a lost message before it
+	// gets an error, as a real client would time out. Defaults to 1s.
+	Timeout time.Duration
+}
+
+// Link overrides the Config for messages from one node to another.
+type Link struct {
+	Latency     time.Duration
+	Jitter      time.Duration
+	DropRate    float64
+	ReorderRate float64
+}
+
+// Stats counts what happened to the messages sent so far.
+type Stats struct {
+	Sent        int `json:"sent"`
+	Delivered   int `json:"delivered"`
+	Dropped     int `json:"dropped"`
+	Partitioned int `json:"partitioned"`
+	Reordered   int `json:"reordered"`
+}
+
+// ErrUnreachable is returned for messages lost to a drop or a partition,
+// after the sender's timeout.
+var ErrUnreachable = errors.New("simnet: message lost")
+
+// Network connects the simulated nodes.
+type Network struct {
+	cfg Config
+
+	mu        sync.Mutex
+	listeners map[string]*listener
+	links     map[[2]string]Link
+	groups    map[string]int // node -> partition group; nil when healed
+	counts    map[[2]string]uint64
+	stats     Stats
+	sim       *SimClock  // set when cfg.Clock is one
+	outbox    []*message // sent since the SimClock last moved
+	sent      uint64
+}
+
+// New returns an empty network.
+func New(cfg Config) *Network {
+	if cfg.Clock == nil {
+		cfg.Clock = RealClock{}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	nw := &Network{
+		cfg:       cfg,
+		listeners: make(map[string]*listener),
+		links:     make(map[[2]string]Link),
+		counts:    make(map[[2]string]uint64),
+	}
+	if sim, ok := cfg.Clock.(*SimClock); ok {
+		nw.sim = sim
+		sim.beforeFire(nw.flush)
+	}
+	return nw
+}
+
+// Clock returns the network's clock.
+func (nw *Network) Clock() Clock {
+	return nw.cfg.Clock
+}
+
+// node is the name partitions and links use for an address: its host.
+func node(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// SetLink overrides the behaviour of messages sent from one node to another.
+func (nw *Network) SetLink(from, to string, l Link) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.links[[2]string{from, to}] = l
+}
+
+// Partition splits the network: nodes only reach nodes of their own group.
+// Nodes not named in any group form one more group together.
+func (nw *Network) Partition(groups ...[]string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.groups = make(map[string]int)
+	for i, g := range groups {
+		for _, n := range g {
+			nw.groups[n] = i + 1
+		}
+	}
+}
+
+// Heal removes any partition.
+func (nw *Network) Heal() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.groups = nil
+}
+
+// Stats returns the message counters.
+func (nw *Network) Stats() Stats {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	return nw.stats
+}
+
+func (nw *Network) connected(from, to string) bool {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	return nw.groups == nil || nw.groups[from] == nw.groups[to]
+}
+
+// fate is what the network decided for one request and its response.
+type fate struct {
+	requestDelay  time.Duration
+	responseDelay time.Duration
+	dropRequest   bool
+	dropResponse  bool
+}
+
+// decide draws the fate of the next message on a link. The draws come
+// from a generator seeded by the network seed, the link and its message
+// count, so they do not depend on how goroutines interleave across links;
+// flush keeps the count on one link deterministic too.
+func (nw *Network) decide(from, to string) fate {
+	nw.mu.Lock()
+	key := [2]string{from, to}
+	nw.counts[key]++
+	n := nw.counts[key]
+	l, ok := nw.links[key]
+	nw.mu.Unlock()
+	if !ok {
+		l = Link{Latency: nw.cfg.Latency, Jitter: nw.cfg.Jitter, DropRate: nw.cfg.DropRate, ReorderRate: nw.cfg.ReorderRate}
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%d", nw.cfg.Seed, from, to, n)
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+	delay := func() time.Duration {
+		d := l.Latency
+		if l.Jitter > 0 {
+			d += time.Duration(rng.Int63n(int64(l.Jitter) + 1))
+		}
+		if rng.Float64() < l.ReorderRate {
+			d += nw.cfg.ReorderDelay
+			nw.mu.Lock()
+			nw.stats.Reordered++
+			nw.mu.Unlock()
+		}
+		return d
+	}
+	return fate{
+		requestDelay:  delay(),
+		dropRequest:   rng.Float64() < l.DropRate,
+		responseDelay: delay(),
+		dropResponse:  rng.Float64() < l.DropRate,
+	}
+}
+
+// message is a request on its way through the network.
+type message struct {
+	from, to string
+	key      string // method, URL and body digest
+	seq      uint64 // send order, which only breaks ties between identical messages
+
+	timer  chan time.Time   // the SimClock timer behind arrive
+	arrive <-chan time.Time // fires when the request arrives, or when its sender gives up on it
+
+	fate        fate
+	partitioned bool
+}
+
+// send puts a request on the network. With a SimClock its fate is decided
+// at the next step of the clock, together with everything else sent at
+// the same time; otherwise it is decided at once.
+func (nw *Network) send(from, to, key string) *message {
+	m := &message{from: from, to: to, key: key}
+	if nw.sim == nil {
+		m.arrive = nw.cfg.Clock.After(nw.decideMessage(m))
+		return m
+	}
+	nw.sim.hold(func(ch chan time.Time) {
+		m.timer, m.arrive = ch, ch
+		nw.mu.Lock()
+		nw.sent++
+		m.seq = nw.sent
+		nw.outbox = append(nw.outbox, m)
+		nw.mu.Unlock()
+	})
+	return m
+}
+
+// flush decides the messages sent since the SimClock last moved, in
+// (time, sequence) order: they were all sent at the current time, and are
+// ordered by link, then content, then send order. The per-link counts,
+// and so every draw, are then the same on every run. It runs with the
+// clock locked, before a timer fires.
+func (nw *Network) flush() {
+	nw.mu.Lock()
+	out := nw.outbox
+	nw.outbox = nil
+	nw.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.from != b.from {
+			return a.from < b.from
+		}
+		if a.to != b.to {
+			return a.to < b.to
+		}
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.seq < b.seq
+	})
+	for _, m := range out {
+		nw.sim.reset(m.timer, nw.decideMessage(m))
+	}
+}
+
+// decideMessage draws the fate of m and returns how long its sender
+// waits: the request delay, or the timeout for a lost request.
+func (nw *Network) decideMessage(m *message) time.Duration {
+	m.fate = nw.decide(m.from, m.to)
+	m.partitioned = !nw.connected(m.from, m.to)
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.stats.Sent++
+	switch {
+	case m.partitioned:
+		nw.stats.Partitioned++
+	case m.fate.dropRequest:
+		nw.stats.Dropped++
+	default:
+		return m.fate.requestDelay
+	}
+	return nw.cfg.Timeout
+}
+
+// messageKey identifies the content of req for ordering; it reads the body
+// and puts it back.
+func messageKey(req *http.Request) (string, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	h := fnv.New64a()
+	h.Write(body)
+	return fmt.Sprintf("%s %s %x", req.Method, req.URL, h.Sum64()), nil
+}
+
+// lose waits out the sender's timeout for a message that never arrives.
+func (nw *Network) lose(ctx context.Context, partitioned bool, what string) error {
+	nw.mu.Lock()
+	if partitioned {
+		nw.stats.Partitioned++
+	} else {
+		nw.stats.Dropped++
+	}
+	nw.mu.Unlock()
+	if err := sleep(ctx, nw.cfg.Clock, nw.cfg.Timeout); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrUnreachable, what)
+}
+
+// Transport returns the RoundTripper of node from. Every request goes
+// through the network's faults on the way to its listener and back.
+func (nw *Network) Transport(from string) http.RoundTripper {
+	base := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return nw.Dial(from, addr)
+		},
+		DisableKeepAlives: true,
+	}
+	return &transport{nw: nw, from: from, base: base}
+}
+
+type transport struct {
+	nw   *Network
+	from string
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	to := node(req.URL.Host)
+	what := fmt.Sprintf("%s %s from %s", req.Method, req.URL, t.from)
+	key, err := messageKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	m := t.nw.send(t.from, to, key)
+	select {
+	case <-m.arrive:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if m.partitioned || m.fate.dropRequest {
+		return nil, fmt.Errorf("%w: request %s", ErrUnreachable, what)
+	}
+	f := m.fate
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// The response travels as one message, so read it whole first.
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if !t.nw.connected(to, t.from) {
+		return nil, t.nw.lose(ctx, true, "response to "+what)
+	}
+	if f.dropResponse {
+		return nil, t.nw.lose(ctx, false, "response to "+what)
+	}
+	if err := sleep(ctx, t.nw.cfg.Clock, f.responseDelay); err != nil {
+		return nil, err
+	}
+	t.nw.mu.Lock()
+	t.nw.stats.Delivered++
+	t.nw.mu.Unlock()
+	return resp, nil
+}
+
+// Addr is a network address on a Network.
+type Addr string
+
+func (a Addr) Network() string { return "sim" }
+func (a Addr) String() string  { return string(a) }
+
+// Listen returns a listener for addr (host:port), which clients reach with
+// URLs such as http://host:port.
+func (nw *Network) Listen(addr string) (net.Listener, error) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	if _, ok := nw.listeners[addr]; ok {
+		return nil, fmt.Errorf("simnet: %s already in use", addr)
+	}
+	l := &listener{nw: nw, addr: Addr(addr), conns: make(chan net.Conn), done: make(chan struct{})}
+	nw.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects node from to the listener at addr.
+func (nw *Network) Dial(from, addr string) (net.Conn, error) {
+	nw.mu.Lock()
+	l, ok := nw.listeners[addr]
+	nw.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("simnet: dial %s: connection refused", addr)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &conn{Conn: server, local: l.addr, remote: Addr(from)}:
+		return &conn{Conn: client, local: Addr(from), remote: l.addr}, nil
+	case <-l.done:
+		return nil, fmt.Errorf("simnet: dial %s: connection refused", addr)
+	}
+}
+
+type listener struct {
+	nw    *Network
+	addr  Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.nw.mu.Lock()
+		delete(l.nw.listeners, string(l.addr))
+		l.nw.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr { return l.addr }
+
+// conn reports simulated addresses instead of the pipe's.
+type conn struct {
+	net.Conn
+	local, remote Addr
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
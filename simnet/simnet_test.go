@@ -0,0 +1,189 @@
+package simnet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// request is one message a scenario sends.
+type request struct {
+	from, to string // node name, listener address
+	body     string
+}
+
+// outcome is what a scenario observed for one request.
+type outcome struct {
+	Reply string        // response body, or "lost"
+	At    time.Duration // virtual time at which the sender got it
+}
+
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	fmt.Fprintf(w, "%s got %s", r.Host, body)
+})
+
+// run sends reqs all at once on a fresh network and steps its virtual
+// clock until every sender has its answer. The clock only moves when each
+// request in flight is waiting on it, so the run does not depend on how
+// goroutines are scheduled.
+func run(t *testing.T, cfg Config, setup func(*Network), reqs []request) ([]outcome, Stats) {
+	t.Helper()
+	start := time.Unix(0, 0)
+	clock := NewSimClock(start)
+	cfg.Clock = clock
+	nw := New(cfg)
+	for _, addr := range []string{"w1:80", "w2:80"} {
+		ln, err := nw.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: echo}
+		go srv.Serve(ln)
+		defer srv.Close()
+	}
+	if setup != nil {
+		setup(nw)
+	}
+
+	out := make([]outcome, len(reqs))
+	var inflight atomic.Int64
+	inflight.Store(int64(len(reqs)))
+	for i, r := range reqs {
+		go func(i int, r request) {
+			defer inflight.Add(-1)
+			// Send in an order that changes from run to run.
+			time.Sleep(time.Duration(rand.Intn(300)) * time.Microsecond)
+			client := &http.Client{Transport: nw.Transport(r.from)}
+			resp, err := client.Post("http://"+r.to+"/", "text/plain", strings.NewReader(r.body))
+			out[i].At = clock.Now().Sub(start)
+			if err != nil {
+				if !errors.Is(err, ErrUnreachable) {
+					t.Errorf("request %d: %v", i, err)
+				}
+				out[i].Reply = "lost"
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			out[i].Reply = string(body)
+		}(i, r)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		n := inflight.Load()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("scenario stuck with %d requests in flight", n)
+		}
+		if clock.Pending() >= int(n) {
+			clock.AdvanceToNext()
+		} else {
+			time.Sleep(50 * time.Microsecond)
+		}
+	}
+	return out, nw.Stats()
+}
+
+// replay runs a scenario several times and fails unless every run gives
+// the same outcomes and counters.
+func replay(t *testing.T, cfg Config, setup func(*Network), reqs []request) ([]outcome, Stats) {
+	t.Helper()
+	first, stats := run(t, cfg, setup, reqs)
+	for i := 1; i < 5; i++ {
+		again, againStats := run(t, cfg, setup, reqs)
+		if !reflect.DeepEqual(again, first) || againStats != stats {
+			t.Fatalf("run %d differs:\n%v %+v\nfirst:\n%v %+v", i, again, againStats, first, stats)
+		}
+	}
+	return first, stats
+}
+
+// burst returns n requests from c, alternating between the two workers,
+// several on each link at the same instant.
+func burst(n int) []request {
+	reqs := make([]request, n)
+	for i := range reqs {
+		reqs[i] = request{from: "c", to: fmt.Sprintf("w%d:80", i%2+1), body: fmt.Sprint(i)}
+	}
+	return reqs
+}
+
+func TestDelay(t *testing.T) {
+	cfg := Config{Seed: 7, Latency: 5 * time.Millisecond, Jitter: 4 * time.Millisecond, ReorderRate: 0.3, ReorderDelay: 20 * time.Millisecond}
+	out, stats := replay(t, cfg, nil, burst(12))
+	for i, o := range out {
+		if want := fmt.Sprintf("w%d:80 got %d", i%2+1, i); o.Reply != want {
+			t.Errorf("request %d: reply %q, want %q", i, o.Reply, want)
+		}
+		// Two one-way trips of 5-9ms, each possibly held back 20ms.
+		if o.At < 10*time.Millisecond || o.At > 58*time.Millisecond {
+			t.Errorf("request %d answered at %v", i, o.At)
+		}
+	}
+	if stats.Sent != 12 || stats.Delivered != 12 || stats.Reordered == 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	cfg := Config{Seed: 3, Latency: time.Millisecond, DropRate: 0.3, Timeout: 100 * time.Millisecond}
+	out, stats := replay(t, cfg, nil, burst(30))
+	lost := 0
+	for i, o := range out {
+		switch {
+		case o.Reply == "lost":
+			lost++
+			if o.At < cfg.Timeout {
+				t.Errorf("request %d reported lost at %v, before the timeout", i, o.At)
+			}
+		case o.At != 2*time.Millisecond:
+			t.Errorf("request %d answered at %v, want 2ms", i, o.At)
+		}
+	}
+	if lost == 0 || lost == len(out) {
+		t.Fatalf("%d of %d requests lost", lost, len(out))
+	}
+	if stats.Sent != 30 || stats.Dropped != lost || stats.Delivered != 30-lost {
+		t.Errorf("stats %+v with %d lost", stats, lost)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	cfg := Config{Seed: 1, Latency: 2 * time.Millisecond, Timeout: 50 * time.Millisecond}
+	split := func(nw *Network) { nw.Partition([]string{"c", "w1"}, []string{"w2"}) }
+	out, stats := replay(t, cfg, split, burst(8))
+	for i, o := range out {
+		want := outcome{Reply: fmt.Sprintf("w1:80 got %d", i), At: 4 * time.Millisecond}
+		if i%2 == 1 {
+			want = outcome{Reply: "lost", At: cfg.Timeout}
+		}
+		if o != want {
+			t.Errorf("request %d: %+v, want %+v", i, o, want)
+		}
+	}
+	if stats.Partitioned != 4 || stats.Delivered != 4 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestSeedChangesFates(t *testing.T) {
+	cfg := Config{Latency: time.Millisecond, DropRate: 0.5, Timeout: 10 * time.Millisecond}
+	cfg.Seed = 1
+	a, _ := run(t, cfg, nil, burst(20))
+	cfg.Seed = 2
+	b, _ := run(t, cfg, nil, burst(20))
+	if reflect.DeepEqual(a, b) {
+		t.Fatal("different seeds dropped the same requests")
+	}
+}
@@ -0,0 +1,69 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIssueAndLoad(t *testing.T) {
+	ca, err := NewAuthority("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	caCert, caKey := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	if err := WriteFiles(ca.Cert, ca.Key, caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAuthority(caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, _, err := loaded.Issue("Alice", nil, true, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := CertPool(caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Fatalf("client certificate does not verify: %v", err)
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	cert := &x509.Certificate{}
+	cert.Subject.CommonName = "Alice"
+	tests := []struct {
+		name string
+		tls  *tls.ConnectionState
+		want string
+	}{
+		{"plain HTTP keeps header", nil, "Mallory"},
+		{"unverified TLS keeps header", &tls.ConnectionState{}, "Mallory"},
+		{"certificate wins", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, "Alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := PeerIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("X-Client-Name")
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/ex2", nil)
+			req.Header.Set("X-Client-Name", "Mallory")
+			req.TLS = tt.tls
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Fatalf("X-Client-Name %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+// Package twopc runs a batch on several exercise servers atomically with
+// two-phase commit. The coordinator asks every participant to prepare,
+// which processes the batch and logs its result; only if all vote yes is
+// the transaction committed and the results made visible, otherwise it is
+// aborted everywhere. Participants and the coordinator keep write-ahead
+// logs on disk, so a restarted coordinator finishes the transactions it
+// had decided and aborts those it had not, while participants left in
+// doubt ask it for the outcome until they get one.
+package twopc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/httpjson"
+)
+
+// Coordinator log states besides Committed and Aborted.
+const (
+	begun = "begin"
+	ended = "end" // every participant acknowledged the decision
+)
+
+// Pending is the decision reported for a transaction still collecting votes.
+const Pending = "pending"
+
+// Outcome is the result of a transaction.
+type Outcome struct {
+	Tx       string                     `json:"tx"`
+	Decision string                     `json:"decision"`
+	Votes    map[string]Vote            `json:"votes"`
+	Results  map[string]json.RawMessage `json:"results,omitempty"` // by participant, only when committed
+}
+
+type coordTx struct {
+	rec      Record // the begin record
+	decision string
+	done     bool
+}
+
+// Coordinator drives transactions across participants.
+type Coordinator struct {
+	// Self is the base URL participants use to ask for decisions.
+	Self string
+	// PrepareTimeout bounds the wait for each vote; no vote counts as no.
+	PrepareTimeout time.Duration
+	// RetryInterval is how often unacknowledged decisions are resent.
+	RetryInterval time.Duration
+	Client        *http.Client
+	// Sign, if set, authenticates every request to a participant with its
+	// body, such as with auth.Sign and the cluster key.
+	Sign func(req *http.Request, body []byte)
+	// Participants are the base URLs clients may name in a SubmitRequest,
+	// the servers of the cluster; SubmitHandler refuses any other, so
+	// signed prepares only go to cluster members.
+	Participants []string
+	// CrashAfter makes the process exit right after a phase, to demonstrate
+	// recovery: "prepare" (votes collected, no decision logged) or
+	// "decision" (decision logged, not yet sent).
+	CrashAfter string
+
+	wal *WAL
+
+	mu  sync.Mutex
+	txs map[string]*coordTx
+}
+
+// NewCoordinator opens the coordinator log in dir. Transactions that were
+// begun but never decided before a crash are aborted.
+func NewCoordinator(dir, self string) (*Coordinator, error) {
+	wal, records, err := OpenWAL(filepath.Join(dir, "coordinator.wal"))
+	if err != nil {
+		return nil, err
+	}
+	c := &Coordinator{
+		Self:           self,
+		PrepareTimeout: 5 * time.Second,
+		RetryInterval:  2 * time.Second,
+		Client:         &http.Client{Timeout: 3 * time.Second},
+		wal:            wal,
+		txs:            make(map[string]*coordTx),
+	}
+	for _, rec := range records {
+		switch rec.State {
+		case begun:
+			c.txs[rec.Tx] = &coordTx{rec: rec}
+		case Committed, Aborted:
+			if tx, ok := c.txs[rec.Tx]; ok {
+				tx.decision = rec.State
+			}
+		case ended:
+			if tx, ok := c.txs[rec.Tx]; ok {
+				tx.done = true
+			}
+		}
+	}
+	for id, tx := range c.txs {
+		if tx.decision == "" {
+			// Presumed abort: nobody can have been told to commit.
+			if err := wal.Append(Record{Tx: id, State: Aborted}); err != nil {
+				return nil, err
+			}
+			tx.decision = Aborted
+			log.Printf("2pc: aborting transaction %s left undecided by a crash", id)
+		} else if !tx.done {
+			log.Printf("2pc: resending %s decision of transaction %s", tx.decision, id)
+		}
+	}
+	return c, nil
+}
+
+func newTxID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Submit runs body as a transaction of exercise on every participant.
+func (c *Coordinator) Submit(ctx context.Context, exercise string, body json.RawMessage, header map[string]string, participants []string) (Outcome, error) {
+	if len(participants) == 0 {
+		return Outcome{}, fmt.Errorf("no participants")
+	}
+	id := newTxID()
+	begin := Record{Tx: id, State: begun, Exercise: exercise, Participants: participants}
+	if err := c.wal.Append(begin); err != nil {
+		return Outcome{}, err
+	}
+	c.mu.Lock()
+	c.txs[id] = &coordTx{rec: begin}
+	c.mu.Unlock()
+
+	// Phase 1: collect votes.
+	out := Outcome{Tx: id, Votes: make(map[string]Vote), Results: make(map[string]json.RawMessage)}
+	prepare := PrepareRequest{Tx: id, Coordinator: c.Self, Exercise: exercise, Body: body, Header: header}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, p := range participants {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, c.PrepareTimeout)
+			defer cancel()
+			var vote Vote
+			if err := c.post(pctx, p+"/2pc/prepare", prepare, &vote); err != nil {
+				vote = Vote{Tx: id, Reason: err.Error()}
+			}
+			mu.Lock()
+			out.Votes[p] = vote
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	c.crashPoint("prepare")
+
+	decision := Committed
+	for _, v := range out.Votes {
+		if !v.Yes {
+			decision = Aborted
+		}
+	}
+	if err := c.wal.Append(Record{Tx: id, State: decision}); err != nil {
+		// The decision may not be durable, so a restart could presume
+		// abort: abort now too. A failed write may still have left the
+		// record behind, so log the abort after it where possible.
+		log.Printf("2pc: logging the %s decision of %s failed, aborting: %v", decision, id, err)
+		if decision == Committed {
+			if err := c.wal.Append(Record{Tx: id, State: Aborted}); err != nil {
+				log.Printf("2pc: %v", err)
+			}
+		}
+		c.mu.Lock()
+		c.txs[id].decision = Aborted
+		c.mu.Unlock()
+		out.Decision = Aborted
+		return out, err
+	}
+	c.mu.Lock()
+	c.txs[id].decision = decision
+	c.mu.Unlock()
+	out.Decision = decision
+	c.crashPoint("decision")
+
+	// Phase 2: the decision is durable, so it stands even if delivering
+	// it fails now; Run keeps resending it.
+	acks := c.deliver(ctx, id, decision, participants)
+	if decision == Committed {
+		for p, ack := range acks {
+			out.Results[p] = ack.Result
+		}
+	}
+	return out, nil
+}
+
+// deliver sends decision to the participants and logs the end of the
+// transaction once all have acknowledged it.
+func (c *Coordinator) deliver(ctx context.Context, id, decision string, participants []string) map[string]Ack {
+	path := "/2pc/commit"
+	if decision == Aborted {
+		path = "/2pc/abort"
+	}
+	acks := make(map[string]Ack)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, p := range participants {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			var ack Ack
+			if err := c.post(ctx, p+path, DecisionRequest{Tx: id}, &ack); err != nil {
+				log.Printf("2pc: %s of %s not acknowledged by %s: %v", decision, id, p, err)
+				return
+			}
+			mu.Lock()
+			acks[p] = ack
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+
+	if len(acks) == len(participants) {
+		if err := c.wal.Append(Record{Tx: id, State: ended}); err != nil {
+			log.Printf("2pc: %v", err)
+			return acks
+		}
+		c.mu.Lock()
+		c.txs[id].done = true
+		c.mu.Unlock()
+	}
+	return acks
+}
+
+// Run resends decisions not yet acknowledged by every participant, every
+// RetryInterval until ctx is done.
+func (c *Coordinator) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.RetryInterval)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		var open []coordTx
+		for _, tx := range c.txs {
+			if tx.decision != "" && !tx.done {
+				open = append(open, *tx)
+			}
+		}
+		c.mu.Unlock()
+		for _, tx := range open {
+			c.deliver(ctx, tx.rec.Tx, tx.decision, tx.rec.Participants)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Decision returns the outcome of tx: Committed, Aborted or Pending.
+// Transactions the coordinator has no record of were never decided to
+// commit, so they are reported aborted.
+func (c *Coordinator) Decision(tx string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.txs[tx]
+	if !ok {
+		return Aborted
+	}
+	if t.decision == "" {
+		return Pending
+	}
+	return t.decision
+}
+
+func (c *Coordinator) crashPoint(phase string) {
+	if c.CrashAfter == phase {
+		log.Printf("2pc: crashing after %s as requested", phase)
+		os.Exit(3)
+	}
+}
+
+func (c *Coordinator) post(ctx context.Context, url string, in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Sign != nil {
+		c.Sign(req, data)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// SubmitRequest is the body of POST /2pc/submit.
+type SubmitRequest struct {
+	Exercise     string          `json:"exercise"`
+	Participants []string        `json:"participants"`
+	Items        json.RawMessage `json:"items"`
+}
+
+// SubmitHandler runs a transaction for the client: the same batch on
+// every participant. The response holds the results only if all committed.
+func (c *Coordinator) SubmitHandler(w http.ResponseWriter, r *http.Request) {
+	var req SubmitRequest
+	if !httpjson.DecodePost(w, r, &req) {
+		return
+	}
+	for _, p := range req.Participants {
+		if !c.member(p) {
+			http.Error(w, fmt.Sprintf("2pc: %s is not a participant of this cluster", p), http.StatusForbidden)
+			return
+		}
+	}
+	header := map[string]string{}
+	for _, h := range []string{"X-Client-Name", "X-Request-Type", "X-Priority"} {
+		if v := r.Header.Get(h); v != "" {
+			header[h] = v
+		}
+	}
+	out, err := c.Submit(r.Context(), req.Exercise, req.Items, header, req.Participants)
+	if err != nil {
+		http.Error(w, "2pc: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	code := http.StatusOK
+	if out.Decision != Committed {
+		code = http.StatusConflict
+	}
+	httpjson.Write(w, code, out)
+}
+
+// member reports whether url is one of c.Participants.
+func (c *Coordinator) member(url string) bool {
+	for _, p := range c.Participants {
+		if strings.TrimSuffix(p, "/") == strings.TrimSuffix(url, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Register adds the coordinator endpoints to mux: POST /2pc/submit is
+// wrapped by wrap (the server's client middleware), GET /2pc/decision?tx=
+// answers participants in doubt.
+func (c *Coordinator) Register(mux *http.ServeMux, wrap func(http.HandlerFunc) http.Handler) {
+	mux.Handle("/2pc/submit", wrap(c.SubmitHandler))
+	mux.HandleFunc("/2pc/decision", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tx := r.URL.Query().Get("tx")
+		httpjson.Write(w, http.StatusOK, map[string]string{"tx": tx, "decision": c.Decision(tx)})
+	})
+}
@@ -0,0 +1,323 @@
+package twopc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/httpbuf"
+	"github.com/liviu274/Distributed-systems/httpjson"
+)
+
+// Participant states.
+const (
+	Prepared  = "prepared"
+	Committed = "committed"
+	Aborted   = "aborted"
+)
+
+// PrepareRequest asks a participant to run a batch and vote.
+type PrepareRequest struct {
+	Tx          string            `json:"tx"`
+	Coordinator string            `json:"coordinator"` // base URL to ask for the decision
+	Exercise    string            `json:"exercise"`
+	Body        json.RawMessage   `json:"body"`
+	Header      map[string]string `json:"header,omitempty"`
+}
+
+// Vote is a participant's answer to a prepare.
+type Vote struct {
+	Tx     string `json:"tx"`
+	Yes    bool   `json:"yes"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// DecisionRequest carries the coordinator's decision for a transaction.
+type DecisionRequest struct {
+	Tx string `json:"tx"`
+}
+
+// Ack answers a decision; after a commit it carries the result that has
+// just become visible.
+type Ack struct {
+	Tx     string          `json:"tx"`
+	State  string          `json:"state"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// Participant runs batches of a transaction on one exercise server. A
+// batch is processed during prepare and its result kept in the write-ahead
+// log, but it is only visible once the coordinator decides to commit.
+type Participant struct {
+	// ResolveInterval is how often in-doubt transactions ask their
+	// coordinator for the decision.
+	ResolveInterval time.Duration
+	Client          *http.Client
+
+	wal      *WAL
+	handlers map[string]http.Handler
+
+	mu  sync.Mutex
+	txs map[string]*Record
+}
+
+// NewParticipant opens the participant log in dir and restores the state
+// of every transaction in it. handlers maps exercise names to the
+// handlers that process their batches.
+func NewParticipant(dir string, handlers map[string]http.Handler) (*Participant, error) {
+	wal, records, err := OpenWAL(filepath.Join(dir, "participant.wal"))
+	if err != nil {
+		return nil, err
+	}
+	p := &Participant{
+		ResolveInterval: 2 * time.Second,
+		Client:          &http.Client{Timeout: 3 * time.Second},
+		wal:             wal,
+		handlers:        handlers,
+		txs:             make(map[string]*Record),
+	}
+	for _, rec := range records {
+		rec := rec
+		if prev, ok := p.txs[rec.Tx]; ok && rec.State != Prepared {
+			// Decisions only change the state; the batch and result stay.
+			prev.State = rec.State
+			continue
+		}
+		p.txs[rec.Tx] = &rec
+	}
+	for _, rec := range p.txs {
+		if rec.State == Prepared {
+			log.Printf("2pc: transaction %s is in doubt, waiting for %s", rec.Tx, rec.Coordinator)
+		}
+	}
+	return p, nil
+}
+
+// Prepare processes the batch and votes. Voting yes is a promise to
+// commit if told to, so the result is logged before the vote is sent.
+func (p *Participant) Prepare(req PrepareRequest) Vote {
+	if vote, ok := p.known(req.Tx); ok {
+		// A retried prepare, or one arriving after the coordinator gave up.
+		return vote
+	}
+
+	rec := Record{Tx: req.Tx, Coordinator: req.Coordinator, Exercise: req.Exercise, Body: req.Body, Header: req.Header}
+	h, ok := p.handlers[req.Exercise]
+	if !ok {
+		rec.State, rec.Reason = Aborted, fmt.Sprintf("unknown exercise %q", req.Exercise)
+	} else {
+		hreq, err := http.NewRequest(http.MethodPost, "/"+req.Exercise, bytes.NewReader(req.Body))
+		if err != nil {
+			return Vote{Tx: req.Tx, Yes: false, Reason: err.Error()}
+		}
+		for k, v := range req.Header {
+			hreq.Header.Set(k, v)
+		}
+		out := httpbuf.Serve(h, hreq)
+		if out.Code == http.StatusOK {
+			rec.State, rec.Result = Prepared, json.RawMessage(out.Body.Bytes())
+		} else {
+			rec.State, rec.Reason = Aborted, fmt.Sprintf("exercise answered %d: %s", out.Code, bytes.TrimSpace(out.Body.Bytes()))
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.txs[req.Tx]; ok {
+		// An abort (or a duplicate prepare) won the race while processing.
+		vote, _ := p.voteLocked(req.Tx)
+		return vote
+	}
+	if err := p.wal.Append(rec); err != nil {
+		return Vote{Tx: req.Tx, Yes: false, Reason: "write-ahead log: " + err.Error()}
+	}
+	p.txs[req.Tx] = &rec
+	return Vote{Tx: req.Tx, Yes: rec.State == Prepared, Reason: rec.Reason}
+}
+
+// known returns the vote already given for tx, if any.
+func (p *Participant) known(tx string) (Vote, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.voteLocked(tx)
+}
+
+// voteLocked is known for callers holding p.mu.
+func (p *Participant) voteLocked(tx string) (Vote, bool) {
+	rec, ok := p.txs[tx]
+	if !ok {
+		return Vote{}, false
+	}
+	return Vote{Tx: tx, Yes: rec.State != Aborted, Reason: rec.Reason}, true
+}
+
+// Decide applies the coordinator's decision, state being Committed or Aborted.
+func (p *Participant) Decide(tx, state string) (Ack, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rec, ok := p.txs[tx]
+	if !ok {
+		if state == Committed {
+			return Ack{}, fmt.Errorf("commit of unknown transaction %s", tx)
+		}
+		// Abort before the prepare arrived: remember it so a late prepare votes no.
+		rec = &Record{Tx: tx, State: Aborted, Reason: "aborted before prepare"}
+		if err := p.wal.Append(*rec); err != nil {
+			return Ack{}, err
+		}
+		p.txs[tx] = rec
+		return Ack{Tx: tx, State: Aborted}, nil
+	}
+	if rec.State == state {
+		return Ack{Tx: tx, State: state, Result: p.visible(rec)}, nil
+	}
+	if rec.State != Prepared {
+		return Ack{}, fmt.Errorf("transaction %s is already %s", tx, rec.State)
+	}
+	if err := p.wal.Append(Record{Tx: tx, State: state}); err != nil {
+		return Ack{}, err
+	}
+	rec.State = state
+	log.Printf("2pc: transaction %s %s", tx, state)
+	return Ack{Tx: tx, State: state, Result: p.visible(rec)}, nil
+}
+
+// visible returns the result of rec if it may be seen. Caller holds p.mu.
+func (p *Participant) visible(rec *Record) json.RawMessage {
+	if rec.State == Committed {
+		return rec.Result
+	}
+	return nil
+}
+
+// Run asks the coordinators of in-doubt transactions for their decision
+// every ResolveInterval until ctx is done. A participant that voted yes
+// cannot decide on its own, so it waits as long as its coordinator is down.
+func (p *Participant) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.ResolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		p.mu.Lock()
+		var doubt []Record
+		for _, rec := range p.txs {
+			if rec.State == Prepared && rec.Coordinator != "" {
+				doubt = append(doubt, *rec)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, rec := range doubt {
+			decision, err := p.askDecision(ctx, rec)
+			if err != nil {
+				log.Printf("2pc: transaction %s still in doubt: %v", rec.Tx, err)
+				continue
+			}
+			if decision == Committed || decision == Aborted {
+				if _, err := p.Decide(rec.Tx, decision); err != nil {
+					log.Printf("2pc: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (p *Participant) askDecision(ctx context.Context, rec Record) (string, error) {
+	u := rec.Coordinator + "/2pc/decision?tx=" + url.QueryEscape(rec.Tx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Decision string `json:"decision"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Decision, nil
+}
+
+// Register adds the participant endpoints to mux:
+//
+//	POST /2pc/prepare  PrepareRequest  -> Vote
+//	POST /2pc/commit   DecisionRequest -> Ack
+//	POST /2pc/abort    DecisionRequest -> Ack
+//	GET  /2pc/tx?id=   state of one transaction, with its result once committed
+//	GET  /2pc/tx       every transaction this participant knows
+//
+// The prepare, commit and abort endpoints are wrapped by wrap, which should
+// only let coordinators through (see Coordinator.Sign).
+func (p *Participant) Register(mux *http.ServeMux, wrap func(http.HandlerFunc) http.Handler) {
+	mux.Handle("/2pc/prepare", wrap(func(w http.ResponseWriter, r *http.Request) {
+		var req PrepareRequest
+		if !httpjson.DecodePost(w, r, &req) {
+			return
+		}
+		httpjson.Write(w, http.StatusOK, p.Prepare(req))
+	}))
+	decide := func(state string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var req DecisionRequest
+			if !httpjson.DecodePost(w, r, &req) {
+				return
+			}
+			ack, err := p.Decide(req.Tx, state)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, ack)
+		}
+	}
+	mux.Handle("/2pc/commit", wrap(decide(Committed)))
+	mux.Handle("/2pc/abort", wrap(decide(Aborted)))
+	mux.HandleFunc("/2pc/tx", p.txHandler)
+}
+
+func (p *Participant) txHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	view := func(rec *Record) map[string]interface{} {
+		return map[string]interface{}{"tx": rec.Tx, "state": rec.State, "exercise": rec.Exercise, "reason": rec.Reason, "result": p.visible(rec)}
+	}
+	if id := r.URL.Query().Get("id"); id != "" {
+		rec, ok := p.txs[id]
+		if !ok {
+			http.Error(w, "unknown transaction", http.StatusNotFound)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, view(rec))
+		return
+	}
+	ids := make([]string, 0, len(p.txs))
+	for id := range p.txs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	all := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		all = append(all, view(p.txs[id]))
+	}
+	httpjson.Write(w, http.StatusOK, map[string]interface{}{"transactions": all})
+}
@@ -0,0 +1,322 @@
+package twopc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() { log.SetOutput(io.Discard) }
+
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Write(body)
+})
+
+// participant starts a participant server in a temporary directory. Its
+// prepare, commit and abort endpoints run through wrap.
+func participant(t *testing.T, wrap func(http.HandlerFunc) http.Handler) (*Participant, string) {
+	t.Helper()
+	p, err := NewParticipant(t.TempDir(), map[string]http.Handler{"ex2": echo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	p.Register(mux, wrap)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return p, srv.URL
+}
+
+func open(h http.HandlerFunc) http.Handler { return h }
+
+func state(t *testing.T, p *Participant, tx string) string {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rec, ok := p.txs[tx]
+	if !ok {
+		return ""
+	}
+	return rec.State
+}
+
+func TestSubmit(t *testing.T) {
+	rejectUnsigned := func(h http.HandlerFunc) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Signed") != "yes" {
+				http.Error(w, "unsigned", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		})
+	}
+	sign := func(req *http.Request, body []byte) { req.Header.Set("X-Signed", "yes") }
+	tests := []struct {
+		name     string
+		wrap     func(http.HandlerFunc) http.Handler
+		sign     func(*http.Request, []byte)
+		exercise string
+		want     string
+	}{
+		{"commit", open, nil, "ex2", Committed},
+		{"unknown exercise votes no", open, nil, "ex99", Aborted},
+		{"signed", rejectUnsigned, sign, "ex2", Committed},
+		{"unsigned is refused", rejectUnsigned, nil, "ex2", Aborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p1, u1 := participant(t, tt.wrap)
+			p2, u2 := participant(t, tt.wrap)
+			c, err := NewCoordinator(t.TempDir(), "http://coordinator")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Sign = tt.sign
+			out, err := c.Submit(context.Background(), tt.exercise, json.RawMessage(`["a"]`), nil, []string{u1, u2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Decision != tt.want {
+				t.Fatalf("decision %s, want %s (votes %+v)", out.Decision, tt.want, out.Votes)
+			}
+			// A participant that never prepared has no record of an abort.
+			for _, p := range []*Participant{p1, p2} {
+				if got := state(t, p, out.Tx); got != tt.want && got != "" {
+					t.Errorf("participant state %s, want %s", got, tt.want)
+				}
+			}
+			if tt.want == Committed && string(out.Results[u1]) != `["a"]` {
+				t.Errorf("result %s", out.Results[u1])
+			}
+		})
+	}
+}
+
+func TestDecisionLogFailureAborts(t *testing.T) {
+	c, err := NewCoordinator(t.TempDir(), "http://coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Break the coordinator log once the transaction has begun.
+	breakLog := func(h http.HandlerFunc) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/2pc/prepare" {
+				c.wal.Close()
+			}
+			h(w, r)
+		})
+	}
+	p, u := participant(t, breakLog)
+	out, err := c.Submit(context.Background(), "ex2", json.RawMessage(`["a"]`), nil, []string{u})
+	if err == nil {
+		t.Fatal("Submit succeeded without logging its decision")
+	}
+	if out.Decision != Aborted || c.Decision(out.Tx) != Aborted {
+		t.Fatalf("decision %q, coordinator answers %q; want aborted", out.Decision, c.Decision(out.Tx))
+	}
+	// Run resends the abort to the participant that voted yes.
+	c.RetryInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	waitFor(t, "the participant to abort", func() bool { return state(t, p, out.Tx) == Aborted })
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSubmitHandlerOnlyNamesMembers(t *testing.T) {
+	_, u := participant(t, open)
+	c, err := NewCoordinator(t.TempDir(), "http://coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Participants = []string{u + "/"}
+	tests := []struct {
+		name         string
+		participants []string
+		want         int
+	}{
+		{"member", []string{u}, http.StatusOK},
+		{"outsider", []string{u, "http://elsewhere"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(SubmitRequest{Exercise: "ex2", Participants: tt.participants, Items: json.RawMessage(`["a"]`)})
+			rec := httptest.NewRecorder()
+			c.SubmitHandler(rec, httptest.NewRequest(http.MethodPost, "/2pc/submit", bytes.NewReader(body)))
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+// restart closes the coordinator log and opens the coordinator again
+// from the same directory, as after a crash.
+func restart(t *testing.T, c *Coordinator, dir string) *Coordinator {
+	t.Helper()
+	c.wal.Close()
+	c, err := NewCoordinator(dir, "http://coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RetryInterval = 10 * time.Millisecond
+	t.Cleanup(func() { c.wal.Close() })
+	return c
+}
+
+func TestCoordinatorRecovery(t *testing.T) {
+	tests := []struct {
+		name   string
+		logged []string // states logged before the crash
+		want   string
+	}{
+		{"undecided is presumed aborted", []string{begun}, Aborted},
+		{"logged commit is resent", []string{begun, Committed}, Committed},
+		{"logged abort is resent", []string{begun, Aborted}, Aborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, u := participant(t, open)
+			if vote := p.Prepare(PrepareRequest{Tx: "t1", Exercise: "ex2", Body: json.RawMessage(`["a"]`)}); !vote.Yes {
+				t.Fatalf("vote %+v", vote)
+			}
+			dir := t.TempDir()
+			c, err := NewCoordinator(dir, "http://coordinator")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.logged {
+				if err := c.wal.Append(Record{Tx: "t1", State: s, Exercise: "ex2", Participants: []string{u}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c = restart(t, c, dir)
+			if got := c.Decision("t1"); got != tt.want {
+				t.Fatalf("decision after restart %s, want %s", got, tt.want)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			go c.Run(ctx)
+			waitFor(t, "the participant to learn the decision", func() bool { return state(t, p, "t1") == tt.want })
+			waitFor(t, "the transaction to end", func() bool {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				return c.txs["t1"].done
+			})
+			cancel()
+
+			// The decision and the end were logged: a second restart
+			// neither changes the decision nor resends it.
+			c = restart(t, c, dir)
+			if got := c.Decision("t1"); got != tt.want || !c.txs["t1"].done {
+				t.Errorf("after a second restart: decision %s, done %v", got, c.txs["t1"].done)
+			}
+		})
+	}
+}
+
+func TestParticipantRecovery(t *testing.T) {
+	// The coordinator has decided t1, whose participant restarts in doubt.
+	coordDir := t.TempDir()
+	c, err := NewCoordinator(coordDir, "http://coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.wal.Append(Record{Tx: "t1", State: begun, Exercise: "ex2"})
+	c.wal.Append(Record{Tx: "t1", State: Committed})
+	c = restart(t, c, coordDir)
+	mux := http.NewServeMux()
+	c.Register(mux, open)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	handlers := map[string]http.Handler{"ex2": echo}
+	p, err := NewParticipant(dir, handlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vote := p.Prepare(PrepareRequest{Tx: "t1", Coordinator: srv.URL, Exercise: "ex2", Body: json.RawMessage(`["a"]`)}); !vote.Yes {
+		t.Fatalf("vote %+v", vote)
+	}
+	p.wal.Close()
+
+	p, err = NewParticipant(dir, handlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.wal.Close()
+	if got := state(t, p, "t1"); got != Prepared {
+		t.Fatalf("state after restart %q, want prepared", got)
+	}
+	// A retried prepare gets the vote already logged, not a second run.
+	if vote := p.Prepare(PrepareRequest{Tx: "t1", Exercise: "ex99"}); !vote.Yes {
+		t.Errorf("retried prepare after restart voted %+v", vote)
+	}
+
+	p.ResolveInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+	waitFor(t, "the participant to resolve t1", func() bool { return state(t, p, "t1") == Committed })
+	ack, err := p.Decide("t1", Committed)
+	if err != nil || string(ack.Result) != `["a"]` {
+		t.Errorf("result after recovery %s, %v", ack.Result, err)
+	}
+}
+
+func TestOpenWALDropsTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, _, err := OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(Record{Tx: "t1", State: begun})
+	w.Append(Record{Tx: "t1", State: Committed})
+	w.Close()
+	// A crash in the middle of the next write.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"tx":"t2","sta`)
+	f.Close()
+
+	w, records, err := OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].State != Committed {
+		t.Fatalf("records %+v, want the two complete ones", records)
+	}
+	if err := w.Append(Record{Tx: "t2", State: begun}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	_, records, err = OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[2].Tx != "t2" {
+		t.Errorf("records after appending %+v", records)
+	}
+}
@@ -0,0 +1,66 @@
+package twopc
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/liviu274/Distributed-systems/jsonl"
+)
+
+// Record is one entry of a write-ahead log. Participants and the
+// coordinator use different State values; only the fields relevant to a
+// state are set.
+type Record struct {
+	Tx           string            `json:"tx"`
+	State        string            `json:"state"`
+	Exercise     string            `json:"exercise,omitempty"`
+	Body         json.RawMessage   `json:"body,omitempty"`
+	Header       map[string]string `json:"header,omitempty"`
+	Result       json.RawMessage   `json:"result,omitempty"`
+	Reason       string            `json:"reason,omitempty"`
+	Coordinator  string            `json:"coordinator,omitempty"`
+	Participants []string          `json:"participants,omitempty"`
+	Time         time.Time         `json:"time"`
+}
+
+// WAL is an append-only log of records, one JSON line each, synced to
+// disk before Append returns.
+type WAL struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenWAL opens the log at path and returns the records already in it.
+// A torn last line left by a crash mid-write is cut off, see jsonl.Open.
+func OpenWAL(path string) (*WAL, []Record, error) {
+	var records []Record
+	f, err := jsonl.Open(path, func(rec Record) { records = append(records, rec) })
+	if err != nil {
+		return nil, nil, err
+	}
+	return &WAL{f: f}, records, nil
+}
+
+// Append writes rec and syncs the log.
+func (w *WAL) Append(rec Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// Close closes the log file.
+func (w *WAL) Close() error {
+	return w.f.Close()
+}
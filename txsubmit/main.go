@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/liviu274/Distributed-systems/auth"
+	"github.com/liviu274/Distributed-systems/twopc"
+)
+
+// txsubmit sends one exercise batch as a two-phase commit transaction:
+// the same items run on every participant, and the results come back only
+// if all of them commit. Run it from "client-server app" so the default
+// input files resolve, with servers started with -2pc-dir and the
+// coordinator with the participants in -2pc-participants:
+//
+//	go run ../txsubmit -exercise ex2 -participants http://localhost:8081,http://localhost:8082
+//
+// Against servers started with -auth-keys, sign the request with -key.
+func main() {
+	coordinator := flag.String("coordinator", "http://localhost:8080", "server that coordinates the transaction")
+	exercise := flag.String("exercise", "ex2", "exercise to run: ex2, ex5, ex7, ex9 or ex14")
+	participants := flag.String("participants", "", "comma-separated participant server URLs")
+	input := flag.String("input", "", "input file, one item per line (default data/<exercise>-input.txt)")
+	maxElements := flag.Int("max", 0, "maximum number of elements to send (0 = send all)")
+	clientName := flag.String("name", "Alice", "client name to send in header")
+	keyID := flag.String("key", "", "API key ID used to sign the request (empty = unsigned)")
+	keysFile := flag.String("keys", "data/clients.json", "key registry file holding the secret for -key")
+	flag.Parse()
+
+	if *participants == "" {
+		log.Fatal("-participants is required")
+	}
+	if *input == "" {
+		*input = "data/" + *exercise + "-input.txt"
+	}
+	content, err := os.ReadFile(*input)
+	if err != nil {
+		log.Fatalf("failed to read %s: %v", *input, err)
+	}
+	arr := []string{}
+	for _, l := range bytes.Split(content, []byte{'\n'}) {
+		if v := bytes.TrimSpace(l); len(v) > 0 {
+			arr = append(arr, string(v))
+		}
+	}
+	if *maxElements > 0 && len(arr) > *maxElements {
+		arr = arr[:*maxElements]
+	}
+	items, err := json.Marshal(arr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := json.Marshal(twopc.SubmitRequest{
+		Exercise:     *exercise,
+		Participants: strings.Split(*participants, ","),
+		Items:        items,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, *coordinator+"/2pc/submit", bytes.NewReader(data))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Client-Name", *clientName)
+	req.Header.Set("X-Request-Type", "POST")
+	if *keyID != "" {
+		reg, err := auth.LoadRegistry(*keysFile)
+		if err != nil {
+			log.Fatalf("failed to load keys: %v", err)
+		}
+		k, ok := reg.Lookup(*keyID)
+		if !ok {
+			log.Fatalf("key %s not found in %s", *keyID, *keysFile)
+		}
+		auth.Sign(req, k, data)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Printf("status: %s\n", resp.Status)
+
+	var out twopc.Outcome
+	if err := json.Unmarshal(body, &out); err != nil {
+		fmt.Printf("body: %s\n", body)
+		os.Exit(1)
+	}
+	fmt.Printf("transaction %s: %s\n", out.Tx, out.Decision)
+	for p, v := range out.Votes {
+		vote := "yes"
+		if !v.Yes {
+			vote = "no (" + v.Reason + ")"
+		}
+		fmt.Printf("  %s voted %s\n", p, vote)
+	}
+	for p, r := range out.Results {
+		fmt.Printf("  %s result: %s\n", p, bytes.TrimSpace(r))
+	}
+}